@@ -0,0 +1,349 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	k8score "k8s.io/api/core/v1"
+	k8snetworking "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"strings"
+)
+
+const (
+	// namespaces are selected by this label, as kubernetes does not label them with their name
+	NamespaceLabel = "name"
+	// the namespace of istio, which runs the ingress controller and the control plane the sidecars talk to
+	istioNamespace = "istio-system"
+	istioRbacPath  = "/apis/rbac.istio.io/v1alpha1"
+	clusterDomain  = "cluster.local"
+)
+
+// Creates a Kubernetes NetworkPolicy object restricting the traffic to and from the pods of the application to
+// the applications in its access policy. A direction without rules is not restricted, and nil is returned when
+// neither direction has rules. Unless the ingress is disabled, the ingress controller can always reach the pods,
+// and with outbound rules the pods can always look up names and, with an istio sidecar, reach istio.
+func createNetworkPolicyDef(manifest NaisManifest, application, namespace string, istioEnabled bool) *k8snetworking.NetworkPolicy {
+	policy := manifest.AccessPolicy
+	if len(policy.Inbound) == 0 && len(policy.Outbound) == 0 {
+		return nil
+	}
+
+	spec := k8snetworking.NetworkPolicySpec{
+		PodSelector: k8smeta.LabelSelector{MatchLabels: map[string]string{"app": application}},
+	}
+
+	if len(policy.Inbound) > 0 {
+		from := createNetworkPolicyPeers(policy.Inbound, namespace)
+		if !manifest.Ingress.Disabled {
+			from = append(from, createNamespacePeer(istioNamespace))
+		}
+		spec.PolicyTypes = append(spec.PolicyTypes, k8snetworking.PolicyTypeIngress)
+		spec.Ingress = []k8snetworking.NetworkPolicyIngressRule{{From: from}}
+	}
+
+	if len(policy.Outbound) > 0 {
+		to := createNetworkPolicyPeers(policy.Outbound, namespace)
+		if istioEnabled && manifest.Istio.Enabled {
+			to = append(to, createNamespacePeer(istioNamespace))
+		}
+		udp, tcp, dns := k8score.ProtocolUDP, k8score.ProtocolTCP, intstr.FromInt(53)
+		spec.PolicyTypes = append(spec.PolicyTypes, k8snetworking.PolicyTypeEgress)
+		spec.Egress = []k8snetworking.NetworkPolicyEgressRule{
+			{To: to},
+			{Ports: []k8snetworking.NetworkPolicyPort{{Protocol: &udp, Port: &dns}, {Protocol: &tcp, Port: &dns}}},
+		}
+	}
+
+	return &k8snetworking.NetworkPolicy{
+		TypeMeta: k8smeta.TypeMeta{
+			Kind:       "NetworkPolicy",
+			APIVersion: "networking.k8s.io/v1",
+		},
+		ObjectMeta: createObjectMeta(application, namespace),
+		Spec:       spec,
+	}
+}
+
+// Applications in the namespace of the application are selected by their app label. A network policy cannot
+// select the pods of another namespace by their labels, so a rule for another namespace admits all of it.
+func createNetworkPolicyPeers(rules []AccessRule, namespace string) []k8snetworking.NetworkPolicyPeer {
+	var peers []k8snetworking.NetworkPolicyPeer
+	for _, rule := range rules {
+		if rule.Namespace != "" && rule.Namespace != namespace {
+			peers = append(peers, createNamespacePeer(rule.Namespace))
+			continue
+		}
+
+		selector := &k8smeta.LabelSelector{}
+		if rule.Application != "" {
+			selector.MatchLabels = map[string]string{"app": rule.Application}
+		}
+		peers = append(peers, k8snetworking.NetworkPolicyPeer{PodSelector: selector})
+	}
+	return peers
+}
+
+func createNamespacePeer(namespace string) k8snetworking.NetworkPolicyPeer {
+	return k8snetworking.NetworkPolicyPeer{
+		NamespaceSelector: &k8smeta.LabelSelector{MatchLabels: map[string]string{NamespaceLabel: namespace}},
+	}
+}
+
+// Creates or updates the network policy of the application, and on clusters running istio its authorization
+// rules. Returns nil if the application has no access policy.
+func createOrUpdateAccessPolicy(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, istioEnabled bool, k8sClient kubernetes.Interface) (*k8snetworking.NetworkPolicy, error) {
+	if err := createOrUpdateIstioRules(deploymentRequest, manifest, istioEnabled, k8sClient); err != nil {
+		return nil, fmt.Errorf("failed while creating or updating istio rules: %s", err)
+	}
+
+	policyDef := createNetworkPolicyDef(manifest, deploymentRequest.Application, deploymentRequest.Namespace, istioEnabled)
+	if policyDef == nil {
+		return nil, nil
+	}
+
+	existingPolicy, err := getExistingNetworkPolicy(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing networkpolicy: %s", err)
+	}
+
+	policies := k8sClient.NetworkingV1().NetworkPolicies(deploymentRequest.Namespace)
+	if existingPolicy != nil {
+		existingPolicy.Spec = policyDef.Spec
+		return policies.Update(existingPolicy)
+	}
+	return policies.Create(policyDef)
+}
+
+func getExistingNetworkPolicy(application string, namespace string, k8sClient kubernetes.Interface) (*k8snetworking.NetworkPolicy, error) {
+	policy, err := k8sClient.NetworkingV1().NetworkPolicies(namespace).Get(application, k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return policy, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Deletes the networkpolicy of the application if naisd created it, returning whether it was deleted
+func deleteNetworkPolicy(application, namespace string, k8sClient kubernetes.Interface) (bool, error) {
+	policy, err := getExistingNetworkPolicy(application, namespace, k8sClient)
+	if err != nil || policy == nil || !createdByNaisd(policy.ObjectMeta, application) {
+		return false, err
+	}
+
+	err = k8sClient.NetworkingV1().NetworkPolicies(namespace).Delete(application, &k8smeta.DeleteOptions{})
+	return deleted(err)
+}
+
+// Istio authorizes callers by the service account of their pods, so applications with istio authorization rules
+// run with a service account of their own. Outbound rules have no istio counterpart, as istio authorizes calls
+// where they are received.
+func istioRulesEnabled(manifest NaisManifest, istioEnabled bool) bool {
+	return istioEnabled && manifest.Istio.Enabled && len(manifest.AccessPolicy.Inbound) > 0
+}
+
+// An object of the istio rbac API, which client-go has no types for
+type istioObject struct {
+	k8smeta.TypeMeta   `json:",inline"`
+	k8smeta.ObjectMeta `json:"metadata"`
+	Spec               interface{} `json:"spec"`
+}
+
+type serviceRoleSpec struct {
+	Rules []serviceRoleRule `json:"rules"`
+}
+
+type serviceRoleRule struct {
+	Services []string `json:"services"`
+	Methods  []string `json:"methods"`
+}
+
+type serviceRoleBindingSpec struct {
+	Subjects []serviceRoleBindingSubject `json:"subjects"`
+	RoleRef  serviceRoleRef              `json:"roleRef"`
+}
+
+type serviceRoleBindingSubject struct {
+	User       string            `json:"user,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type serviceRoleRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+func createIstioObject(kind, application, namespace string, spec interface{}) *istioObject {
+	return &istioObject{
+		TypeMeta: k8smeta.TypeMeta{
+			Kind:       kind,
+			APIVersion: "rbac.istio.io/v1alpha1",
+		},
+		ObjectMeta: createObjectMeta(application, namespace),
+		Spec:       spec,
+	}
+}
+
+// Creates an istio ServiceRole allowing any call to the services of the application
+func createServiceRoleDef(manifest NaisManifest, application, namespace string) *istioObject {
+	names := []string{application}
+	if manifest.Strategy.BlueGreen.Enabled {
+		names = append(names, colourName(application, ColourBlue), colourName(application, ColourGreen))
+	}
+	if manifest.Kind == KindStatefulSet {
+		names = append(names, headlessServiceName(application))
+	}
+
+	var services []string
+	for _, name := range names {
+		services = append(services, fmt.Sprintf("%s.%s.svc.%s", name, namespace, clusterDomain))
+	}
+
+	return createIstioObject("ServiceRole", application, namespace, serviceRoleSpec{
+		Rules: []serviceRoleRule{{Services: services, Methods: []string{"*"}}},
+	})
+}
+
+// Creates an istio ServiceRoleBinding granting the ServiceRole of the application to the service accounts of the
+// applications in its inbound rules. A rule without an application grants it to its whole namespace, as does
+// the ingress unless it is disabled.
+func createServiceRoleBindingDef(manifest NaisManifest, application, namespace string) *istioObject {
+	var subjects []serviceRoleBindingSubject
+	for _, rule := range manifest.AccessPolicy.Inbound {
+		ruleNamespace := rule.Namespace
+		if ruleNamespace == "" {
+			ruleNamespace = namespace
+		}
+
+		if rule.Application == "" {
+			subjects = append(subjects, serviceRoleBindingSubject{Properties: map[string]string{"source.namespace": ruleNamespace}})
+		} else {
+			subjects = append(subjects, serviceRoleBindingSubject{User: fmt.Sprintf("%s/ns/%s/sa/%s", clusterDomain, ruleNamespace, rule.Application)})
+		}
+	}
+	if !manifest.Ingress.Disabled {
+		subjects = append(subjects, serviceRoleBindingSubject{Properties: map[string]string{"source.namespace": istioNamespace}})
+	}
+
+	return createIstioObject("ServiceRoleBinding", application, namespace, serviceRoleBindingSpec{
+		Subjects: subjects,
+		RoleRef:  serviceRoleRef{Kind: "ServiceRole", Name: application},
+	})
+}
+
+func createServiceAccountDef(application, namespace string) *k8score.ServiceAccount {
+	return &k8score.ServiceAccount{
+		TypeMeta: k8smeta.TypeMeta{
+			Kind:       "ServiceAccount",
+			APIVersion: "v1",
+		},
+		ObjectMeta: createObjectMeta(application, namespace),
+	}
+}
+
+// Creates the service account of the application unless it exists. The service account is kept when the
+// authorization rules are removed, as pods of earlier versions may still run with it.
+func createServiceAccount(application, namespace string, k8sClient kubernetes.Interface) error {
+	_, err := k8sClient.CoreV1().ServiceAccounts(namespace).Get(application, k8smeta.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("unable to get existing service account: %s", err)
+	}
+
+	_, err = k8sClient.CoreV1().ServiceAccounts(namespace).Create(createServiceAccountDef(application, namespace))
+	return err
+}
+
+// Creates or updates the istio authorization rules of the application, or deletes them if it no longer has any.
+// Does nothing on clusters without istio.
+func createOrUpdateIstioRules(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, istioEnabled bool, k8sClient kubernetes.Interface) error {
+	if !istioEnabled {
+		return nil
+	}
+
+	application, namespace := deploymentRequest.Application, deploymentRequest.Namespace
+	restClient := k8sClient.Discovery().RESTClient()
+
+	if !istioRulesEnabled(manifest, istioEnabled) {
+		deleted, err := deleteIstioRules(application, namespace, restClient)
+		for _, resource := range deleted {
+			glog.Infof("deleted %s of %s in %s", resource.Kind, application, namespace)
+		}
+		return err
+	}
+
+	if err := createServiceAccount(application, namespace, k8sClient); err != nil {
+		return err
+	}
+	if err := applyIstioObject(restClient, "serviceroles", createServiceRoleDef(manifest, application, namespace)); err != nil {
+		return fmt.Errorf("unable to apply servicerole: %s", err)
+	}
+	if err := applyIstioObject(restClient, "servicerolebindings", createServiceRoleBindingDef(manifest, application, namespace)); err != nil {
+		return fmt.Errorf("unable to apply servicerolebinding: %s", err)
+	}
+	return nil
+}
+
+// Creates the object, or replaces the one with its name
+func applyIstioObject(restClient rest.Interface, resource string, object *istioObject) error {
+	existingObject, err := getExistingIstioObject(restClient, resource, object.Name, object.Namespace)
+	if err != nil {
+		return err
+	}
+	if existingObject != nil {
+		object.ResourceVersion = existingObject.ResourceVersion
+	}
+
+	body, err := json.Marshal(object)
+	if err != nil {
+		return fmt.Errorf("unable to marshal %s: %s", resource, err)
+	}
+
+	if object.ResourceVersion != "" {
+		return restClient.Put().AbsPath(istioRbacPath, "namespaces", object.Namespace, resource, object.Name).Body(body).Do().Error()
+	}
+	return restClient.Post().AbsPath(istioRbacPath, "namespaces", object.Namespace, resource).Body(body).Do().Error()
+}
+
+func getExistingIstioObject(restClient rest.Interface, resource, name, namespace string) (*istioObject, error) {
+	existing, err := restClient.Get().AbsPath(istioRbacPath, "namespaces", namespace, resource, name).Do().Raw()
+
+	switch {
+	case err == nil:
+		var existingObject istioObject
+		if err := json.Unmarshal(existing, &existingObject); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal existing %s: %s", resource, err)
+		}
+		return &existingObject, nil
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Deletes the istio authorization rules of the application, returning the ones that were deleted
+func deleteIstioRules(application, namespace string, restClient rest.Interface) ([]DeletedResource, error) {
+	var deletedRules []DeletedResource
+	for _, kind := range []string{"ServiceRoleBinding", "ServiceRole"} {
+		resource := strings.ToLower(kind) + "s"
+		ok, err := deleted(restClient.Delete().AbsPath(istioRbacPath, "namespaces", namespace, resource, application).Do().Error())
+		if err != nil {
+			return deletedRules, fmt.Errorf("unable to delete %s: %s", strings.ToLower(kind), err)
+		}
+		if ok {
+			deletedRules = append(deletedRules, DeletedResource{Kind: kind, Name: application})
+		}
+	}
+	return deletedRules, nil
+}
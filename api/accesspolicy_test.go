@@ -0,0 +1,138 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	k8score "k8s.io/api/core/v1"
+	k8snetworking "k8s.io/api/networking/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestCreateNetworkPolicyDef(t *testing.T) {
+	appPeer := func(application string) k8snetworking.NetworkPolicyPeer {
+		return k8snetworking.NetworkPolicyPeer{PodSelector: &k8smeta.LabelSelector{MatchLabels: map[string]string{"app": application}}}
+	}
+	namespacePeer := func(namespace string) k8snetworking.NetworkPolicyPeer {
+		return k8snetworking.NetworkPolicyPeer{NamespaceSelector: &k8smeta.LabelSelector{MatchLabels: map[string]string{NamespaceLabel: namespace}}}
+	}
+
+	t.Run("applications without an access policy get no network policy", func(t *testing.T) {
+		assert.Nil(t, createNetworkPolicyDef(newDefaultManifest(), appName, namespace, false))
+	})
+
+	t.Run("inbound rules admit the listed applications and the ingress controller", func(t *testing.T) {
+		manifest := newDefaultManifest()
+		manifest.AccessPolicy.Inbound = []AccessRule{{Application: "frontend"}, {Application: "batch", Namespace: "other"}, {Namespace: namespace}}
+
+		policy := createNetworkPolicyDef(manifest, appName, namespace, false)
+		assert.Equal(t, map[string]string{"app": appName}, policy.Spec.PodSelector.MatchLabels)
+		assert.Equal(t, []k8snetworking.PolicyType{k8snetworking.PolicyTypeIngress}, policy.Spec.PolicyTypes)
+		assert.Empty(t, policy.Spec.Egress)
+		assert.Equal(t, []k8snetworking.NetworkPolicyPeer{
+			appPeer("frontend"),
+			namespacePeer("other"),
+			{PodSelector: &k8smeta.LabelSelector{}},
+			namespacePeer(istioNamespace),
+		}, policy.Spec.Ingress[0].From)
+
+		manifest.Ingress.Disabled = true
+		policy = createNetworkPolicyDef(manifest, appName, namespace, false)
+		assert.Len(t, policy.Spec.Ingress[0].From, 3)
+	})
+
+	t.Run("outbound rules let the pods reach the listed applications and look up names", func(t *testing.T) {
+		manifest := newDefaultManifest()
+		manifest.AccessPolicy.Outbound = []AccessRule{{Application: "backend"}}
+		manifest.Istio.Enabled = true
+
+		policy := createNetworkPolicyDef(manifest, appName, namespace, false)
+		assert.Equal(t, []k8snetworking.PolicyType{k8snetworking.PolicyTypeEgress}, policy.Spec.PolicyTypes)
+		assert.Empty(t, policy.Spec.Ingress)
+		assert.Equal(t, []k8snetworking.NetworkPolicyPeer{appPeer("backend")}, policy.Spec.Egress[0].To)
+
+		udp, tcp, dns := k8score.ProtocolUDP, k8score.ProtocolTCP, intstr.FromInt(53)
+		assert.Empty(t, policy.Spec.Egress[1].To)
+		assert.Equal(t, []k8snetworking.NetworkPolicyPort{{Protocol: &udp, Port: &dns}, {Protocol: &tcp, Port: &dns}}, policy.Spec.Egress[1].Ports)
+
+		policy = createNetworkPolicyDef(manifest, appName, namespace, true)
+		assert.Equal(t, []k8snetworking.NetworkPolicyPeer{appPeer("backend"), namespacePeer(istioNamespace)}, policy.Spec.Egress[0].To)
+	})
+}
+
+func TestCreateIstioRuleDefs(t *testing.T) {
+	manifest := newDefaultManifest()
+	manifest.Istio.Enabled = true
+	manifest.AccessPolicy.Inbound = []AccessRule{{Application: "frontend"}, {Application: "batch", Namespace: "other"}, {Namespace: "monitoring"}}
+
+	t.Run("the service role covers the services of the application", func(t *testing.T) {
+		role := createServiceRoleDef(manifest, appName, namespace)
+		assert.Equal(t, "ServiceRole", role.Kind)
+		assert.Equal(t, serviceRoleSpec{Rules: []serviceRoleRule{{
+			Services: []string{appName + "." + namespace + ".svc.cluster.local"},
+			Methods:  []string{"*"},
+		}}}, role.Spec)
+
+		blueGreen := manifest
+		blueGreen.Strategy.BlueGreen.Enabled = true
+		assert.Len(t, createServiceRoleDef(blueGreen, appName, namespace).Spec.(serviceRoleSpec).Rules[0].Services, 3)
+	})
+
+	t.Run("the binding grants the role to the inbound applications and the ingress", func(t *testing.T) {
+		binding := createServiceRoleBindingDef(manifest, appName, namespace)
+		assert.Equal(t, serviceRoleBindingSpec{
+			Subjects: []serviceRoleBindingSubject{
+				{User: "cluster.local/ns/" + namespace + "/sa/frontend"},
+				{User: "cluster.local/ns/other/sa/batch"},
+				{Properties: map[string]string{"source.namespace": "monitoring"}},
+				{Properties: map[string]string{"source.namespace": istioNamespace}},
+			},
+			RoleRef: serviceRoleRef{Kind: "ServiceRole", Name: appName},
+		}, binding.Spec)
+	})
+
+	t.Run("pods run with a service account of their own when the rules are enabled", func(t *testing.T) {
+		deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace}
+
+		deployment, err := createDeploymentDef([]NaisResource{}, manifest, deploymentRequest, nil, true)
+		assert.NoError(t, err)
+		assert.Equal(t, appName, deployment.Spec.Template.Spec.ServiceAccountName)
+
+		deployment, err = createDeploymentDef([]NaisResource{}, manifest, deploymentRequest, nil, false)
+		assert.NoError(t, err)
+		assert.Empty(t, deployment.Spec.Template.Spec.ServiceAccountName)
+	})
+}
+
+func TestCreateOrUpdateAccessPolicy(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+	manifest := newDefaultManifest()
+	manifest.AccessPolicy.Inbound = []AccessRule{{Application: "frontend"}}
+
+	t.Run("the network policy is created and updated", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		result, err := createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.NotNil(t, result.NetworkPolicy)
+		assert.Contains(t, string(createResponse(result, nil)), "- created networkpolicy\n")
+
+		updated := manifest
+		updated.AccessPolicy.Inbound = []AccessRule{{Application: "frontend"}, {Application: "admin"}}
+		_, err = createOrUpdateK8sResources(deploymentRequest, updated, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		policy, _ := getExistingNetworkPolicy(appName, namespace, clientset)
+		assert.Len(t, policy.Spec.Ingress[0].From, 3)
+	})
+
+	t.Run("the network policy is deleted with the access policy", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+
+		result, err := createOrUpdateK8sResources(deploymentRequest, newDefaultManifest(), []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, result.NetworkPolicy)
+		assert.Contains(t, result.Deleted, DeletedResource{Kind: "NetworkPolicy", Name: appName})
+	})
+}
@@ -14,7 +14,9 @@ import (
 	"io/ioutil"
 	"k8s.io/client-go/kubernetes"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Api struct {
@@ -24,6 +26,9 @@ type Api struct {
 	ClusterName            string
 	IstioEnabled           bool
 	DeploymentStatusViewer DeploymentStatusViewer
+	JobStore               JobStore
+	DeployLocker           DeployLocker
+	DeployHistory          DeployHistory
 }
 
 type NaisDeploymentRequest struct {
@@ -39,6 +44,7 @@ type NaisDeploymentRequest struct {
 	FasitPassword    string `json:"fasitPassword"`
 	OnBehalfOf       string `json:"onbehalfof,omitempty"`
 	Namespace        string `json:"namespace"`
+	DryRun           bool   `json:"dryRun,omitempty"`
 }
 
 type AppError interface {
@@ -91,13 +97,20 @@ func (api Api) Handler() http.Handler {
 
 	mux.Handle(pat.Get("/isalive"), appHandler(api.isAlive))
 	mux.Handle(pat.Post("/deploy"), appHandler(api.deploy))
+	mux.Handle(pat.Post("/deploy/diff"), appHandler(api.diff))
+	mux.Handle(pat.Get("/deploy/jobs/:id"), appHandler(api.deployJob))
 	mux.Handle(pat.Get("/metrics"), promhttp.Handler())
 	mux.Handle(pat.Get("/version"), appHandler(api.version))
 	mux.Handle(pat.Get("/deploystatus/:namespace/:deployName"), appHandler(api.deploymentStatusHandler))
+	mux.Handle(pat.Get("/revisions/:namespace/:application"), appHandler(api.revisions))
+	mux.Handle(pat.Get("/deployments/:namespace/:application"), appHandler(api.history))
+	mux.Handle(pat.Post("/rollback"), appHandler(api.rollback))
+	mux.Handle(pat.Post("/switchback/:namespace/:application"), appHandler(api.switchBackHandler))
+	mux.Handle(pat.Delete("/app/:namespace/:application"), appHandler(api.undeploy))
 	return mux
 }
 
-func NewApi(clientset kubernetes.Interface, fasitUrl, clusterDomain, clusterName string, istioEnabled bool, d DeploymentStatusViewer) Api {
+func NewApi(clientset kubernetes.Interface, fasitUrl, clusterDomain, clusterName string, istioEnabled bool, d DeploymentStatusViewer, jobStore JobStore, deployLocker DeployLocker, deployHistory DeployHistory) Api {
 	return Api{
 		Clientset:              clientset,
 		FasitUrl:               fasitUrl,
@@ -105,6 +118,9 @@ func NewApi(clientset kubernetes.Interface, fasitUrl, clusterDomain, clusterName
 		ClusterName:            clusterName,
 		IstioEnabled:           istioEnabled,
 		DeploymentStatusViewer: d,
+		JobStore:               jobStore,
+		DeployLocker:           deployLocker,
+		DeployHistory:          deployHistory,
 	}
 }
 
@@ -120,53 +136,273 @@ func (api Api) deploy(w http.ResponseWriter, r *http.Request) *appError {
 	//TODO remove this once grace period ends
 	deploymentRequest, warnings := ensurePropertyCompatability(deploymentRequest)
 
+	if dryRun, err := strconv.ParseBool(r.URL.Query().Get("dryRun")); err == nil && dryRun {
+		deploymentRequest.DryRun = true
+	}
+
+	if deploymentRequest.DryRun {
+		fasit := FasitClient{api.FasitUrl, deploymentRequest.FasitUsername, deploymentRequest.FasitPassword}
+		manifest, err := GenerateManifest(deploymentRequest, fasit.GetFasitEnvironmentClass)
+		if err != nil {
+			return &appError{err, "unable to generate manifest/nais.yaml", http.StatusInternalServerError}
+		}
+
+		return api.dryRun(w, deploymentRequest, manifest)
+	}
+
+	job, err := newDeployJob(deploymentRequest, warnings)
+	if err != nil {
+		return &appError{err, "unable to create deploy job", http.StatusInternalServerError}
+	}
+
+	release, appErr := api.lock(deploymentRequest, job.Id)
+	if appErr != nil {
+		return appErr
+	}
+
+	if err := api.JobStore.Save(job); err != nil {
+		release()
+		return &appError{err, "unable to queue deploy job", http.StatusInternalServerError}
+	}
+
+	glog.Infof("Queued deployment job %s. Deploying %s:%s to %s\n", job.Id, deploymentRequest.Application, deploymentRequest.Version, deploymentRequest.FasitEnvironment)
+
+	go func() {
+		defer release()
+		api.runDeployJob(newJobTracker(job, api.JobStore), deploymentRequest)
+	}()
+
+	w.Header().Set("Location", "/deploy/jobs/"+job.Id)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		glog.Errorf("unable to encode deploy job %s: %s", job.Id, err)
+	}
+
+	return nil
+}
+
+func (api Api) runDeployJob(tracker *jobTracker, deploymentRequest NaisDeploymentRequest) {
+	started := time.Now()
+	tracker.start()
+
+	var deploymentResult DeploymentResult
+	var appErr *appError
+
+	tracker.begin(StepGenerateManifest)
 	fasit := FasitClient{api.FasitUrl, deploymentRequest.FasitUsername, deploymentRequest.FasitPassword}
+	manifest, err := GenerateManifest(deploymentRequest, fasit.GetFasitEnvironmentClass)
+	if err != nil {
+		appErr = &appError{err, "unable to generate manifest/nais.yaml", http.StatusInternalServerError}
+	} else {
+		deploymentResult, appErr = api.deployManifest(deploymentRequest, manifest, tracker)
+	}
+
+	api.recordDeploy(newDeployRecord(DeployKindDeploy, deploymentRequest, manifest, started, appErr))
+	tracker.finish(deploymentResult, appErr)
+
+	if appErr != nil {
+		glog.Errorf("deployment job %s failed: %s", tracker.job.Id, appErr)
+	} else {
+		glog.Infof("deployment job %s of %s:%s succeeded", tracker.job.Id, deploymentRequest.Application, deploymentRequest.Version)
+	}
 
-	glog.Infof("Starting deployment. Deploying %s:%s to %s\n", deploymentRequest.Application, deploymentRequest.Version, deploymentRequest.FasitEnvironment)
+	if err := api.JobStore.DeleteFinishedBefore(time.Now().Add(-jobRetention)); err != nil {
+		glog.Errorf("unable to clean up old deploy jobs: %s", err)
+	}
+	// a job holds the deploy lock while it runs, so one whose lock has expired is never finished
+	if err := api.JobStore.ExpireUnfinishedBefore(time.Now().Add(-deployLockTimeout), api.holdsDeployLock); err != nil {
+		glog.Errorf("unable to expire unfinished deploy jobs: %s", err)
+	}
+}
 
-	manifest, err := GenerateManifest(deploymentRequest)
+// Whether the job holds the deploy lock of its application, which its replica renews while it runs
+func (api Api) holdsDeployLock(job DeployJob) bool {
+	lock, err := api.DeployLocker.Get(job.Namespace, job.Application)
 	if err != nil {
-		return &appError{err, "unable to generate manifest/nais.yaml", http.StatusInternalServerError}
+		glog.Errorf("unable to get deploy lock of job %s: %s", job.Id, err)
+		return true
 	}
+	return lock != nil && heldByJob(*lock, job.Id)
+}
 
-	var fasitEnvironmentClass string
+// Takes the deploy lock of the application, giving 409 Conflict if another deploy holds it
+func (api Api) lock(deploymentRequest NaisDeploymentRequest, jobId string) (func(), *appError) {
+	release, err := api.DeployLocker.Lock(deploymentRequest.Namespace, deploymentRequest.Application, deployLockHolder(deploymentRequest, jobId))
+	if err != nil {
+		if _, ok := err.(deployLockedError); ok {
+			return nil, &appError{err, "deploy blocked", http.StatusConflict}
+		}
+		return nil, &appError{err, "unable to take deploy lock", http.StatusInternalServerError}
+	}
 
-	if hasResources(manifest) {
-		if deploymentRequest.FasitEnvironment == "" {
-			return &appError{err, "no fasit environment provided, but contains resources to be consumed or exposed", http.StatusInternalServerError}
+	return release, nil
+}
+
+func (api Api) deployJob(w http.ResponseWriter, r *http.Request) *appError {
+	requests.With(prometheus.Labels{"path": "deployJob"}).Inc()
+
+	id := pat.Param(r, "id")
+	job, err := api.JobStore.Get(id)
+	if err != nil {
+		return &appError{err, "unable to get deploy job", http.StatusInternalServerError}
+	}
+	if job == nil {
+		return &appError{nil, fmt.Sprintf("deploy job %s not found", id), http.StatusNotFound}
+	}
+
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		return &appError{err, "unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	return nil
+}
+
+// Performs every step of a deploy after the manifest is resolved: fetching resources from Fasit, creating or
+// updating the k8s-resources, registering the application instance in Fasit and notifying Sensu.
+// The progress is recorded by the tracker, which may be nil.
+func (api Api) deployManifest(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, tracker *jobTracker) (DeploymentResult, *appError) {
+	fasit := FasitClient{api.FasitUrl, deploymentRequest.FasitUsername, deploymentRequest.FasitPassword}
+
+	tracker.begin(StepFetchFasitResources)
+	naisResources, fasitEnvironmentClass, appErr := fetchResources(fasit, deploymentRequest, manifest)
+	if appErr != nil {
+		return DeploymentResult{}, appErr
+	}
+
+	if manifest.Migration.Enabled {
+		tracker.begin(StepMigration)
+		if err := api.runMigration(deploymentRequest, manifest, naisResources); err != nil {
+			return DeploymentResult{}, &appError{err, "migration failed, deploy aborted", http.StatusInternalServerError}
 		}
-		if err := validateFasitRequirements(fasit, deploymentRequest.Application, deploymentRequest.FasitEnvironment); err != nil {
-			return &appError{err, "validating requirements for deployment failed", http.StatusInternalServerError}
+	}
+
+	if manifest.Strategy.Canary.Enabled() {
+		tracker.begin(StepCanary)
+		if err := api.runCanary(deploymentRequest, manifest, naisResources); err != nil {
+			return DeploymentResult{}, &appError{err, "canary failed, deploy aborted", http.StatusInternalServerError}
 		}
-		fasitEnvironmentClass, err = fasit.GetFasitEnvironmentClass(deploymentRequest.FasitEnvironment)
 	}
 
-	glog.Infof("Starting deployment. Deploying %s:%s to %s\n", deploymentRequest.Application, deploymentRequest.Version, deploymentRequest.FasitEnvironment)
+	tracker.begin(StepK8sResources)
+	var snapshot rollbackSnapshot
+	var err error
+	if manifest.Rollback == RollbackAuto {
+		if snapshot, err = takeRollbackSnapshot(deploymentRequest.Application, deploymentRequest.Namespace, api.Clientset); err != nil {
+			return DeploymentResult{}, &appError{err, "unable to snapshot k8s-resources for automatic rollback", http.StatusInternalServerError}
+		}
+	}
 
-	naisResources, err := FetchFasitResources(fasit, deploymentRequest.Application, deploymentRequest.FasitEnvironment, deploymentRequest.Zone, manifest.FasitResources.Used)
+	var deploymentResult DeploymentResult
+	if manifest.Strategy.BlueGreen.Enabled {
+		deploymentResult, err = api.deployBlueGreen(deploymentRequest, manifest, naisResources, tracker)
+	} else {
+		deploymentResult, err = createOrUpdateK8sResources(deploymentRequest, manifest, naisResources, api.ClusterSubdomain, api.IstioEnabled, api.Clientset)
+	}
 	if err != nil {
-		return &appError{err, "unable to fetch fasit resources", http.StatusBadRequest}
+		return deploymentResult, &appError{err, "failed while creating or updating k8s-resources", http.StatusInternalServerError}
 	}
 
-	deploymentResult, err := createOrUpdateK8sResources(deploymentRequest, manifest, naisResources, api.ClusterSubdomain, api.IstioEnabled, api.Clientset)
-	if err != nil {
-		return &appError{err, "failed while creating or updating k8s-resources", http.StatusInternalServerError}
+	if manifest.Rollback == RollbackAuto {
+		go api.watchDeploymentAndRollback(deploymentRequest, snapshot)
 	}
 
 	deploys.With(prometheus.Labels{"nais_app": deploymentRequest.Application}).Inc()
 
 	if hasResources(manifest) {
+		tracker.begin(StepUpdateFasit)
 		if err := updateFasit(fasit, deploymentRequest, naisResources, manifest, createIngressHostname(deploymentRequest.Application, deploymentRequest.Namespace, api.ClusterSubdomain), fasitEnvironmentClass, deploymentRequest.FasitEnvironment, api.ClusterSubdomain); err != nil {
-			return &appError{err, "failed while updating Fasit", http.StatusInternalServerError}
+			return deploymentResult, &appError{err, "failed while updating Fasit", http.StatusInternalServerError}
 		}
 	}
 
+	tracker.begin(StepNotifySensu)
 	NotifySensuAboutDeploy(&deploymentRequest, &api.ClusterName)
 
+	return deploymentResult, nil
+}
+
+func (api Api) dryRun(w http.ResponseWriter, deploymentRequest NaisDeploymentRequest, manifest NaisManifest) *appError {
+	fasit := FasitClient{api.FasitUrl, deploymentRequest.FasitUsername, deploymentRequest.FasitPassword}
+
+	naisResources, _, appErr := fetchResources(fasit, deploymentRequest, manifest)
+	if appErr != nil {
+		return appErr
+	}
+
+	deploymentResult, err := createK8sResourceDefs(deploymentRequest, manifest, naisResources, api.ClusterSubdomain, api.IstioEnabled)
+	if err != nil {
+		return &appError{err, "failed while creating k8s-resource definitions", http.StatusInternalServerError}
+	}
+
+	response, err := createDryRunResponse(deploymentResult)
+	if err != nil {
+		return &appError{err, "unable to marshal k8s-resource definitions", http.StatusInternalServerError}
+	}
+
+	w.Header().Set("Content-Type", "application/x-yaml")
 	w.WriteHeader(200)
-	w.Write(createResponse(deploymentResult, warnings))
+	w.Write(response)
+	return nil
+}
+
+// Validates the Fasit requirements of the manifest and fetches the resources it uses.
+// Returns the resources and the environment class of the Fasit environment.
+func fetchResources(fasit FasitClientAdapter, deploymentRequest NaisDeploymentRequest, manifest NaisManifest) ([]NaisResource, string, *appError) {
+	var fasitEnvironmentClass string
+	var err error
+
+	if hasResources(manifest) {
+		if deploymentRequest.FasitEnvironment == "" {
+			return nil, "", &appError{err, "no fasit environment provided, but contains resources to be consumed or exposed", http.StatusInternalServerError}
+		}
+		if err := validateFasitRequirements(fasit, deploymentRequest.Application, deploymentRequest.FasitEnvironment); err != nil {
+			return nil, "", &appError{err, "validating requirements for deployment failed", http.StatusInternalServerError}
+		}
+		fasitEnvironmentClass, err = fasit.GetFasitEnvironmentClass(deploymentRequest.FasitEnvironment)
+	}
+
+	naisResources, err := FetchFasitResources(fasit, deploymentRequest.Application, deploymentRequest.FasitEnvironment, deploymentRequest.Zone, manifest.FasitResources.Used)
+	if err != nil {
+		return nil, "", &appError{err, "unable to fetch fasit resources", http.StatusBadRequest}
+	}
+
+	return naisResources, fasitEnvironmentClass, nil
+}
+
+func (api Api) diff(w http.ResponseWriter, r *http.Request) *appError {
+	requests.With(prometheus.Labels{"path": "diff"}).Inc()
+
+	deploymentRequest, err := unmarshalDeploymentRequest(r.Body)
+	if err != nil {
+		return &appError{err, "unable to unmarshal deployment request", http.StatusBadRequest}
+	}
+
+	deploymentRequest, _ = ensurePropertyCompatability(deploymentRequest)
+
+	fasit := FasitClient{api.FasitUrl, deploymentRequest.FasitUsername, deploymentRequest.FasitPassword}
+
+	manifest, err := GenerateManifest(deploymentRequest, fasit.GetFasitEnvironmentClass)
+	if err != nil {
+		return &appError{err, "unable to generate manifest/nais.yaml", http.StatusInternalServerError}
+	}
+
+	naisResources, _, appErr := fetchResources(fasit, deploymentRequest, manifest)
+	if appErr != nil {
+		return appErr
+	}
+
+	diffs, err := diffK8sResources(deploymentRequest, manifest, naisResources, api.ClusterSubdomain, api.IstioEnabled, api.Clientset)
+	if err != nil {
+		return &appError{err, "failed while comparing k8s-resources", http.StatusInternalServerError}
+	}
+
+	if err := json.NewEncoder(w).Encode(diffs); err != nil {
+		return &appError{err, "unable to encode JSON", http.StatusInternalServerError}
+	}
+
 	return nil
 }
+
 func (api Api) deploymentStatusHandler(w http.ResponseWriter, r *http.Request) *appError {
 	namespace := pat.Param(r, "namespace")
 	deployName := pat.Param(r, "deployName")
@@ -195,6 +431,232 @@ func (api Api) deploymentStatusHandler(w http.ResponseWriter, r *http.Request) *
 	return nil
 }
 
+func (api Api) revisions(w http.ResponseWriter, r *http.Request) *appError {
+	requests.With(prometheus.Labels{"path": "revisions"}).Inc()
+
+	limit := 10
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			return &appError{err, "limit must be a number", http.StatusBadRequest}
+		}
+	}
+
+	revisions, err := listRevisions(pat.Param(r, "application"), pat.Param(r, "namespace"), limit, api.Clientset)
+	if err != nil {
+		if _, ok := err.(revisionNotFoundError); ok {
+			return &appError{err, "unable to list revisions", http.StatusNotFound}
+		}
+		return &appError{err, "unable to list revisions", http.StatusInternalServerError}
+	}
+
+	if err := json.NewEncoder(w).Encode(revisions); err != nil {
+		return &appError{err, "unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	return nil
+}
+
+func (api Api) history(w http.ResponseWriter, r *http.Request) *appError {
+	requests.With(prometheus.Labels{"path": "history"}).Inc()
+
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			return &appError{err, "limit must be a number", http.StatusBadRequest}
+		}
+	}
+
+	records, err := api.DeployHistory.List(pat.Param(r, "namespace"), pat.Param(r, "application"))
+	if err != nil {
+		return &appError{err, "unable to list deploy history", http.StatusInternalServerError}
+	}
+
+	if at := r.URL.Query().Get("at"); at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return &appError{err, "at must be a RFC 3339 timestamp", http.StatusBadRequest}
+		}
+		records = recordsBefore(records, t)
+	}
+
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		return &appError{err, "unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	return nil
+}
+
+func (api Api) rollback(w http.ResponseWriter, r *http.Request) *appError {
+	requests.With(prometheus.Labels{"path": "rollback"}).Inc()
+
+	var rollbackRequest RollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&rollbackRequest); err != nil {
+		return &appError{err, "unable to unmarshal rollback request", http.StatusBadRequest}
+	}
+
+	fasit := FasitClient{api.FasitUrl, rollbackRequest.FasitUsername, rollbackRequest.FasitPassword}
+	deploymentRequest, manifest, err := deploymentFromRevision(rollbackRequest, fasit.GetFasitEnvironmentClass, api.Clientset)
+	if err != nil {
+		if _, ok := err.(revisionNotFoundError); ok {
+			return &appError{err, "unable to roll back", http.StatusNotFound}
+		}
+		return &appError{err, "unable to recreate deployment of revision", http.StatusInternalServerError}
+	}
+
+	release, appErr := api.lock(deploymentRequest, "")
+	if appErr != nil {
+		return appErr
+	}
+	defer release()
+
+	glog.Infof("Rolling back %s to revision %d (version %s)\n", deploymentRequest.Application, rollbackRequest.Revision, deploymentRequest.Version)
+
+	// the revision has already been running, so a rollback goes straight to it without a canary,
+	// and the schema has already been migrated past it
+	manifest.Strategy.Canary = CanaryStrategy{}
+	manifest.Migration = Migration{}
+
+	started := time.Now()
+	deploymentResult, appErr := api.deployManifest(deploymentRequest, manifest, nil)
+	api.recordDeploy(newDeployRecord(DeployKindRollback, deploymentRequest, manifest, started, appErr))
+	if appErr != nil {
+		return appErr
+	}
+
+	w.WriteHeader(200)
+	w.Write(createResponse(deploymentResult, nil))
+	return nil
+}
+
+func (api Api) switchBackHandler(w http.ResponseWriter, r *http.Request) *appError {
+	requests.With(prometheus.Labels{"path": "switchback"}).Inc()
+
+	application, namespace := pat.Param(r, "application"), pat.Param(r, "namespace")
+
+	release, appErr := api.lock(NaisDeploymentRequest{Application: application, Namespace: namespace}, "")
+	if appErr != nil {
+		return appErr
+	}
+	defer release()
+
+	glog.Infof("Switching %s in %s back to the previous version\n", application, namespace)
+
+	started := time.Now()
+	deploymentRequest, manifest, appErr := api.switchBack(application, namespace)
+	api.recordDeploy(newDeployRecord(DeployKindSwitchBack, deploymentRequest, manifest, started, appErr))
+	if appErr != nil {
+		return appErr
+	}
+
+	w.WriteHeader(200)
+	w.Write([]byte(fmt.Sprintf("switched %s in %s back to version %s\n", application, namespace, deploymentRequest.Version)))
+	return nil
+}
+
+func (api Api) undeploy(w http.ResponseWriter, r *http.Request) *appError {
+	requests.With(prometheus.Labels{"path": "undeploy"}).Inc()
+
+	var undeployRequest UndeployRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return &appError{err, "unable to read undeploy request", http.StatusBadRequest}
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &undeployRequest); err != nil {
+			return &appError{err, "unable to unmarshal undeploy request", http.StatusBadRequest}
+		}
+	}
+
+	deploymentRequest := NaisDeploymentRequest{
+		Application:      pat.Param(r, "application"),
+		Namespace:        pat.Param(r, "namespace"),
+		FasitEnvironment: undeployRequest.FasitEnvironment,
+		FasitUsername:    undeployRequest.FasitUsername,
+		FasitPassword:    undeployRequest.FasitPassword,
+		OnBehalfOf:       undeployRequest.OnBehalfOf,
+	}
+
+	deployName, err := activeDeploymentName(deploymentRequest.Application, deploymentRequest.Namespace, api.Clientset)
+	if err != nil {
+		return &appError{err, "unable to get existing service", http.StatusInternalServerError}
+	}
+	deployment, err := getExistingDeployment(deployName, deploymentRequest.Namespace, api.Clientset)
+	if err != nil {
+		return &appError{err, "unable to get existing deployment", http.StatusInternalServerError}
+	}
+	if deployment != nil {
+		recorded := recordedDeploymentRequest(deploymentRequest.Application, deploymentRequest.Namespace, deployment.Annotations, deployment.Spec.Template.Spec.Containers)
+		deploymentRequest.Version = recorded.Version
+		if deploymentRequest.FasitEnvironment == "" {
+			deploymentRequest.FasitEnvironment = recorded.FasitEnvironment
+		}
+	}
+
+	if undeployRequest.UnregisterFasit && deploymentRequest.FasitEnvironment == "" {
+		return &appError{nil, "no fasit environment provided, and none is recorded on the deployment", http.StatusBadRequest}
+	}
+
+	release, appErr := api.lock(deploymentRequest, "")
+	if appErr != nil {
+		return appErr
+	}
+	defer release()
+
+	glog.Infof("Undeploying %s from %s\n", deploymentRequest.Application, deploymentRequest.Namespace)
+
+	started := time.Now()
+	undeployResult, appErr := api.undeployApplication(deploymentRequest, undeployRequest.UnregisterFasit)
+	api.recordDeploy(newDeployRecord(DeployKindUndeploy, deploymentRequest, NaisManifest{}, started, appErr))
+	if appErr != nil {
+		return appErr
+	}
+
+	if len(undeployResult.Deleted) == 0 && undeployResult.FasitApplicationInstance == 0 {
+		return &appError{nil, fmt.Sprintf("found nothing to undeploy for %s in %s", deploymentRequest.Application, deploymentRequest.Namespace), http.StatusNotFound}
+	}
+
+	if err := json.NewEncoder(w).Encode(undeployResult); err != nil {
+		return &appError{err, "unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	return nil
+}
+
+// Deletes the k8s-resources of the application, and optionally its application instance and exposed resources in Fasit
+func (api Api) undeployApplication(deploymentRequest NaisDeploymentRequest, unregisterFasit bool) (UndeployResult, *appError) {
+	var undeployResult UndeployResult
+	var err error
+
+	undeployResult.Deleted, err = deleteK8sResources(deploymentRequest.Application, deploymentRequest.Namespace, api.Clientset)
+	if err != nil {
+		return undeployResult, &appError{err, "failed while deleting k8s-resources", http.StatusInternalServerError}
+	}
+
+	if api.IstioEnabled {
+		deletedRules, err := deleteIstioRules(deploymentRequest.Application, deploymentRequest.Namespace, api.Clientset.Discovery().RESTClient())
+		undeployResult.Deleted = append(undeployResult.Deleted, deletedRules...)
+		if err != nil {
+			return undeployResult, &appError{err, "failed while deleting istio rules", http.StatusInternalServerError}
+		}
+	}
+
+	if unregisterFasit {
+		fasit := FasitClient{api.FasitUrl, deploymentRequest.FasitUsername, deploymentRequest.FasitPassword}
+		undeployResult.FasitApplicationInstance, undeployResult.FasitExposedResources, err = unregisterFromFasit(fasit, deploymentRequest.Application, deploymentRequest.FasitEnvironment, deploymentRequest.OnBehalfOf)
+		if err != nil {
+			return undeployResult, &appError{err, "k8s-resources were deleted, but unregistering from Fasit failed", http.StatusInternalServerError}
+		}
+	}
+
+	return undeployResult, nil
+}
+
 func (api Api) isAlive(w http.ResponseWriter, _ *http.Request) *appError {
 	requests.With(prometheus.Labels{"path": "isAlive"}).Inc()
 	fmt.Fprint(w, "")
@@ -261,6 +723,9 @@ func createResponse(deploymentResult DeploymentResult, warnings []string) []byte
 	if deploymentResult.Secret != nil {
 		response += "- created secret\n"
 	}
+	if deploymentResult.ConfigMap != nil {
+		response += "- created configmap\n"
+	}
 	if deploymentResult.Service != nil {
 		response += "- created service\n"
 	}
@@ -270,6 +735,21 @@ func createResponse(deploymentResult DeploymentResult, warnings []string) []byte
 	if deploymentResult.Autoscaler != nil {
 		response += "- created autoscaler\n"
 	}
+	if deploymentResult.PodDisruptionBudget != nil {
+		response += "- created poddisruptionbudget\n"
+	}
+	if deploymentResult.NetworkPolicy != nil {
+		response += "- created networkpolicy\n"
+	}
+	if deploymentResult.StatefulSet != nil {
+		response += "- created statefulset\n"
+	}
+	if deploymentResult.CronJob != nil {
+		response += "- created cronjob\n"
+	}
+	for _, deleted := range deploymentResult.Deleted {
+		response += fmt.Sprintf("- deleted %s\n", strings.ToLower(deleted.Kind))
+	}
 
 	if len(warnings) > 0 {
 		response += "\nWarnings:\n"
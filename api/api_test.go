@@ -14,6 +14,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 type FakeDeployStatusViewer struct {
@@ -102,7 +103,8 @@ func TestDeployStatusHandler(t *testing.T) {
 }
 
 func TestNoManifestGivesError(t *testing.T) {
-	api := Api{}
+	clientset := fake.NewSimpleClientset()
+	api := Api{JobStore: NewConfigMapJobStore(clientset, "naisd"), DeployLocker: NewConfigMapDeployLocker(clientset, "naisd"), DeployHistory: NewConfigMapDeployHistory(clientset, "naisd")}
 
 	manifestUrl := "http://repo.com/app"
 	depReq := NaisDeploymentRequest{
@@ -135,11 +137,16 @@ func TestNoManifestGivesError(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	assert.Equal(t, 500, rr.Code)
-	assert.Contains(t, string(rr.Body.Bytes()), manifestUrl)
+	assert.Equal(t, 202, rr.Code)
+
+	job := waitForJob(t, api.JobStore, jobFromResponse(t, rr).Id)
+	assert.Equal(t, JobFailed, job.Status)
+	assert.Contains(t, job.Error, manifestUrl)
+	assert.Equal(t, StepGenerateManifest, job.Steps[0].Name)
+	assert.Equal(t, JobFailed, job.Steps[0].Status)
 }
 
-//TODO remove once grace period ends
+// TODO remove once grace period ends
 func TestWarningsWhenUsingOldPropertyNames(t *testing.T) {
 	appName := "appname"
 	namespace := "namespace"
@@ -149,7 +156,7 @@ func TestWarningsWhenUsingOldPropertyNames(t *testing.T) {
 
 	clientset := fake.NewSimpleClientset()
 
-	api := Api{clientset, "https://fasit.local", "nais.example.tk", "test-cluster", false, nil}
+	api := Api{clientset, "https://fasit.local", "nais.example.tk", "test-cluster", false, nil, NewConfigMapJobStore(clientset, "naisd"), NewConfigMapDeployLocker(clientset, "naisd"), NewConfigMapDeployHistory(clientset, "naisd")}
 
 	depReq := NaisDeploymentRequest{
 		Application: appName,
@@ -196,9 +203,17 @@ func TestWarningsWhenUsingOldPropertyNames(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, 202, rr.Code)
+
+	job := waitForJob(t, api.JobStore, jobFromResponse(t, rr).Id)
+	assert.Equal(t, JobSucceeded, job.Status)
 	assert.True(t, gock.IsDone())
-	assert.Equal(t, "result: \n- created deployment\n- created secret\n- created service\n- created ingress\n- created autoscaler\n\nWarnings:\n- Deployment request property 'environment' is deprecated. Use 'fasitEnvironment' instead\n- Deployment request property 'username' is deprecated. Use 'fasitUsername' instead\n- Deployment request property 'password' is deprecated. Use 'fasitPassword' instead\n", string(rr.Body.Bytes()))
+	assert.NotNil(t, job.Result.Deployment)
+	assert.Equal(t, []string{
+		"Deployment request property 'environment' is deprecated. Use 'fasitEnvironment' instead",
+		"Deployment request property 'username' is deprecated. Use 'fasitUsername' instead",
+		"Deployment request property 'password' is deprecated. Use 'fasitPassword' instead",
+	}, job.Warnings)
 }
 func TestValidDeploymentRequestAndManifestCreateResources(t *testing.T) {
 	appName := "appname"
@@ -212,7 +227,7 @@ func TestValidDeploymentRequestAndManifestCreateResources(t *testing.T) {
 
 	clientset := fake.NewSimpleClientset()
 
-	api := Api{clientset, "https://fasit.local", "nais.example.tk", "test-cluster", false, nil}
+	api := Api{clientset, "https://fasit.local", "nais.example.tk", "test-cluster", false, nil, NewConfigMapJobStore(clientset, "naisd"), NewConfigMapDeployLocker(clientset, "naisd"), NewConfigMapDeployHistory(clientset, "naisd")}
 
 	depReq := NaisDeploymentRequest{
 		Application:      appName,
@@ -285,9 +300,33 @@ func TestValidDeploymentRequestAndManifestCreateResources(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, 202, rr.Code)
+	assert.Equal(t, "/deploy/jobs/"+jobFromResponse(t, rr).Id, rr.Header().Get("Location"))
+
+	job := waitForJob(t, api.JobStore, jobFromResponse(t, rr).Id)
+	assert.Equal(t, JobSucceeded, job.Status)
 	assert.True(t, gock.IsDone())
-	assert.Equal(t, "result: \n- created deployment\n- created secret\n- created service\n- created ingress\n- created autoscaler\n", string(rr.Body.Bytes()))
+
+	var steps []string
+	for _, step := range job.Steps {
+		assert.Equal(t, JobSucceeded, step.Status, step.Name)
+		steps = append(steps, step.Name)
+	}
+	assert.Equal(t, []string{StepGenerateManifest, StepFetchFasitResources, StepK8sResources, StepUpdateFasit, StepNotifySensu}, steps)
+
+	assert.NotNil(t, job.Result.Deployment)
+	assert.NotNil(t, job.Result.Secret)
+	assert.NotNil(t, job.Result.Service)
+	assert.NotNil(t, job.Result.Ingress)
+	assert.NotNil(t, job.Result.Autoscaler)
+	assert.Empty(t, job.Result.Secret.Data, "secret values are not kept in the job")
+
+	records, err := api.DeployHistory.List(namespace, appName)
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, JobSucceeded, records[0].Outcome)
+	assert.Equal(t, version, records[0].Version)
+	assert.Equal(t, []HistoryResource{{resourceAlias, resourceType}}, records[0].UsedResources)
 }
 
 func TestMissingResources(t *testing.T) {
@@ -327,15 +366,209 @@ func TestMissingResources(t *testing.T) {
 	req, _ := http.NewRequest("POST", "/deploy", strings.NewReader(CreateDefaultDeploymentRequest()))
 
 	rr := httptest.NewRecorder()
-	api := Api{fake.NewSimpleClientset(), "https://fasit.local", "nais.example.tk", "clustername", false, nil}
+	clientset := fake.NewSimpleClientset()
+	api := Api{clientset, "https://fasit.local", "nais.example.tk", "clustername", false, nil, NewConfigMapJobStore(clientset, "naisd"), NewConfigMapDeployLocker(clientset, "naisd"), NewConfigMapDeployHistory(clientset, "naisd")}
 	handler := http.Handler(appHandler(api.deploy))
 
 	handler.ServeHTTP(rr, req)
 
-	assert.Equal(t, 400, rr.Code)
+	assert.Equal(t, 202, rr.Code)
+
+	job := waitForJob(t, api.JobStore, jobFromResponse(t, rr).Id)
 	assert.True(t, gock.IsDone())
 
-	assert.Contains(t, string(rr.Body.Bytes()), fmt.Sprintf("unable to get resource %s (%s)", resourceAlias, resourceType))
+	assert.Equal(t, JobFailed, job.Status)
+	failedStep := job.Steps[len(job.Steps)-1]
+	assert.Equal(t, StepFetchFasitResources, failedStep.Name)
+	assert.Equal(t, JobFailed, failedStep.Status)
+	assert.Contains(t, failedStep.Error, fmt.Sprintf("unable to get resource %s (%s)", resourceAlias, resourceType))
+}
+
+func TestDeployOfLockedApplicationGivesConflict(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	api := Api{clientset, "https://fasit.local", "nais.example.tk", "test-cluster", false, nil, NewConfigMapJobStore(clientset, "naisd"), NewConfigMapDeployLocker(clientset, "naisd"), NewConfigMapDeployHistory(clientset, "naisd")}
+
+	_, err := api.DeployLocker.Lock("namespace", "appname", "someone else")
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("POST", "/deploy", strings.NewReader(CreateDefaultDeploymentRequest()))
+	rr := httptest.NewRecorder()
+	handler := http.Handler(appHandler(api.deploy))
+
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, string(rr.Body.Bytes()), "appname in namespace namespace is being deployed by someone else since")
+}
+
+func TestHistoryHandler(t *testing.T) {
+	history := NewConfigMapDeployHistory(fake.NewSimpleClientset(), "naisd")
+	api := Api{DeployHistory: history}
+
+	mux := goji.NewMux()
+	mux.Handle(pat.Get("/deployments/:namespace/:application"), appHandler(api.history))
+
+	started, _ := time.Parse(time.RFC3339, "2018-01-02T14:00:00Z")
+	history.Record(DeployRecord{Id: "1", Application: "appname", Namespace: "namespace", Version: "1", Started: started})
+	history.Record(DeployRecord{Id: "2", Application: "appname", Namespace: "namespace", Version: "2", Started: started.Add(time.Hour)})
+
+	t.Run("Records are returned newest first", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/deployments/namespace/appname", nil)
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		var records []DeployRecord
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &records))
+		assert.Len(t, records, 2)
+		assert.Equal(t, "2", records[0].Version)
+	})
+
+	t.Run("Records are filtered by time", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/deployments/namespace/appname?at=2018-01-02T14:05:00Z", nil)
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		var records []DeployRecord
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &records))
+		assert.Len(t, records, 1)
+		assert.Equal(t, "1", records[0].Version)
+	})
+
+	t.Run("Invalid time gives 400", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/deployments/namespace/appname?at=yesterday", nil)
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
+
+func TestUndeployHandler(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	api := Api{clientset, "https://fasit.local", "nais.example.tk", "test-cluster", false, nil, nil, NewConfigMapDeployLocker(clientset, "naisd"), NewConfigMapDeployHistory(clientset, "naisd")}
+
+	mux := goji.NewMux()
+	mux.Handle(pat.Delete("/app/:namespace/:application"), appHandler(api.undeploy))
+
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, FasitEnvironment: environment}
+	_, err := createOrUpdateK8sResources(deploymentRequest, newDefaultManifest(), []NaisResource{}, "nais.example.tk", false, clientset)
+	assert.NoError(t, err)
+
+	t.Run("Every k8s-resource of the application is deleted and the application is unregistered from Fasit", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("https://fasit.local").
+			Get(fmt.Sprintf("/api/v2/applicationinstances/environment/%s/application/%s", environment, appName)).
+			Reply(200).
+			JSON(map[string]interface{}{"id": 4242, "exposedresources": []map[string]int{{"id": 1337}}})
+		gock.New("https://fasit.local").
+			Delete("/api/v2/resources/1337").
+			Reply(204)
+		gock.New("https://fasit.local").
+			Delete("/api/v2/applicationinstances/4242").
+			Reply(204)
+
+		req, _ := http.NewRequest("DELETE", "/app/"+namespace+"/"+appName, strings.NewReader(`{"fasitUsername": "user", "fasitPassword": "password", "unregisterFasit": true}`))
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		var undeployResult UndeployResult
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &undeployResult))
+		assert.Equal(t, []DeletedResource{
+			{"Ingress", appName},
+			{"HorizontalPodAutoscaler", appName},
+			{"Deployment", appName},
+			{"Service", appName},
+		}, undeployResult.Deleted)
+		assert.Equal(t, 4242, undeployResult.FasitApplicationInstance)
+		assert.Equal(t, []int{1337}, undeployResult.FasitExposedResources)
+		assert.True(t, gock.IsDone())
+
+		deployment, _ := getExistingDeployment(appName, namespace, clientset)
+		assert.Nil(t, deployment)
+
+		records, _ := api.DeployHistory.List(namespace, appName)
+		assert.Equal(t, DeployKindUndeploy, records[0].Kind)
+		assert.Equal(t, version, records[0].Version)
+	})
+
+	t.Run("Undeploying an application that does not exist gives 404", func(t *testing.T) {
+		req, _ := http.NewRequest("DELETE", "/app/"+namespace+"/"+appName, nil)
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("Unregistering from Fasit requires a Fasit environment", func(t *testing.T) {
+		req, _ := http.NewRequest("DELETE", "/app/"+namespace+"/"+appName, strings.NewReader(`{"unregisterFasit": true}`))
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
+
+func TestDeployJobHandler(t *testing.T) {
+	jobStore := NewConfigMapJobStore(fake.NewSimpleClientset(), "naisd")
+	api := Api{JobStore: jobStore}
+
+	mux := goji.NewMux()
+	mux.Handle(pat.Get("/deploy/jobs/:id"), appHandler(api.deployJob))
+
+	t.Run("Unknown job gives 404", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/deploy/jobs/unknown", nil)
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("Existing job is returned", func(t *testing.T) {
+		job, err := newDeployJob(NaisDeploymentRequest{Application: "appname", Namespace: "namespace", Version: "123"}, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, jobStore.Save(job))
+
+		req, _ := http.NewRequest("GET", "/deploy/jobs/"+job.Id, nil)
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		returned := jobFromResponse(t, rr)
+		assert.Equal(t, job.Id, returned.Id)
+		assert.Equal(t, JobQueued, returned.Status)
+		assert.Equal(t, "appname", returned.Application)
+	})
+}
+
+func jobFromResponse(t *testing.T, rr *httptest.ResponseRecorder) DeployJob {
+	var job DeployJob
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &job))
+	return job
+}
+
+func waitForJob(t *testing.T, jobStore JobStore, id string) DeployJob {
+	for i := 0; i < 200; i++ {
+		job, err := jobStore.Get(id)
+		assert.NoError(t, err)
+		if job != nil && job.Done() {
+			return *job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("job %s did not finish", id)
+	return DeployJob{}
 }
 
 func CreateDefaultDeploymentRequest() string {
@@ -376,3 +609,55 @@ func TestValidateDeploymentRequest(t *testing.T) {
 		assert.Contains(t, err, errors.New("password is required and is empty"))
 	})
 }
+
+func TestDryRunDoesNotTouchClusterOrFasit(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	api := Api{clientset, "https://fasit.local", "nais.example.tk", "test-cluster", false, nil, NewConfigMapJobStore(clientset, "naisd"), NewConfigMapDeployLocker(clientset, "naisd"), NewConfigMapDeployHistory(clientset, "naisd")}
+
+	manifest := NaisManifest{
+		Image: "name/Container",
+		Port:  321,
+	}
+	data, _ := yaml.Marshal(manifest)
+
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", NavTruststoreFasitAlias).
+		Reply(200).File("testdata/fasitTruststoreResponse.json")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/resources/3024713/file/keystore").
+		Reply(200).
+		BodyString("supersecret")
+
+	gock.New("http://repo.com").
+		Get("/app").
+		Reply(200).
+		BodyString(string(data))
+
+	req, _ := http.NewRequest("POST", "/deploy?dryRun=true", strings.NewReader(CreateDefaultDeploymentRequest()))
+
+	rr := httptest.NewRecorder()
+	handler := http.Handler(appHandler(api.deploy))
+
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, 200, rr.Code)
+	assert.True(t, gock.IsDone())
+
+	body := string(rr.Body.Bytes())
+	assert.Contains(t, body, "kind: Deployment")
+	assert.Contains(t, body, "kind: Service")
+	assert.Contains(t, body, "kind: Secret")
+	assert.Contains(t, body, "kind: Ingress")
+	assert.Contains(t, body, "kind: HorizontalPodAutoscaler")
+	assert.Contains(t, body, RedactedValue)
+	assert.NotContains(t, body, "supersecret")
+
+	deployment, err := getExistingDeployment("appname", "namespace", clientset)
+	assert.NoError(t, err)
+	assert.Nil(t, deployment, "dry run should not create a deployment")
+}
@@ -0,0 +1,493 @@
+package api
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	k8score "k8s.io/api/core/v1"
+	k8sextensions "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"net/http"
+	"time"
+)
+
+const (
+	ColourLabel          = "naisd.io/colour"
+	ColourBlue           = "blue"
+	ColourGreen          = "green"
+	KeepUntilAnnotation  = "naisd.io/keep-until"
+	DeployKindSwitchBack = "switchback"
+	defaultKeepPrevious  = time.Hour
+)
+
+var blueGreenPollInterval = 5 * time.Second
+
+var switches = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "bluegreen_switches", Help: "blue/green traffic switches done by NaisD"}, []string{"nais_app", "kind"},
+)
+
+func init() {
+	prometheus.MustRegister(switches)
+}
+
+func (b BlueGreenStrategy) keepPrevious() time.Duration {
+	if duration, err := time.ParseDuration(b.KeepPrevious); err == nil && duration > 0 {
+		return duration
+	}
+	return defaultKeepPrevious
+}
+
+func colourName(application, colour string) string {
+	return application + "-" + colour
+}
+
+func otherColour(colour string) string {
+	if colour == ColourBlue {
+		return ColourGreen
+	}
+	return ColourBlue
+}
+
+// The colour the service of the application sends traffic to, empty if the application is not deployed blue/green
+func activeColour(application, namespace string, k8sClient kubernetes.Interface) (string, error) {
+	service, err := getExistingService(application, namespace, k8sClient)
+	if err != nil || service == nil || service.Labels[ColourLabel] != "" {
+		return "", err
+	}
+	return service.Spec.Selector[ColourLabel], nil
+}
+
+// The name of the deployment serving the application, which is the deployment of the active colour for
+// applications deployed blue/green
+func activeDeploymentName(application, namespace string, k8sClient kubernetes.Interface) (string, error) {
+	colour, err := activeColour(application, namespace, k8sClient)
+	if err != nil || colour == "" {
+		return application, err
+	}
+	return colourName(application, colour), nil
+}
+
+// Deploys the new version to the colour not receiving traffic, in a deployment and service of its own. When
+// the new colour has rolled out, the service, ingress and autoscaler of the application are switched to it at
+// once. The previous colour is kept running for keepPrevious, so traffic can be switched back to it. If the new
+// colour does not roll out, traffic stays on the previous colour.
+func (api Api) deployBlueGreen(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, resources []NaisResource, tracker *jobTracker) (DeploymentResult, error) {
+	var deploymentResult DeploymentResult
+	application, namespace := deploymentRequest.Application, deploymentRequest.Namespace
+
+	active, err := activeColour(application, namespace, api.Clientset)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("unable to get active colour: %s", err)
+	}
+	next := otherColour(active)
+
+	// before the first blue/green deploy, traffic goes to the deployment named after the application
+	previousName := application
+	if active != "" {
+		previousName = colourName(application, active)
+	}
+	previous, err := getExistingDeployment(previousName, namespace, api.Clientset)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("unable to get existing deployment: %s", err)
+	}
+
+	secret, err := createOrUpdateSecret(deploymentRequest, resources, api.Clientset)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating secret: %s", err)
+	}
+	deploymentResult.Secret = secret
+
+	// both colours mount the configmap, so the previous one sees the new files once its pods restart
+	deploymentResult.ConfigMap, err = createOrUpdateConfigMap(deploymentRequest, manifest, api.Clientset)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating configmap: %s", err)
+	}
+
+	// the policy selects the pods of both colours by the app label, and brings the service account they run
+	// with, so it is applied before the deployment of the next colour
+	deploymentResult.NetworkPolicy, err = createOrUpdateAccessPolicy(deploymentRequest, manifest, api.IstioEnabled, api.Clientset)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating access policy: %s", err)
+	}
+
+	deployment, err := createOrUpdateColourDeployment(deploymentRequest, manifest, resources, next, colourReplicas(manifest, previous), api.IstioEnabled, api.Clientset)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating deployment: %s", err)
+	}
+	deploymentResult.Deployment = deployment
+
+	if _, err := createColourService(application, namespace, next, manifest, api.Clientset); err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating service: %s", err)
+	}
+
+	if status, reason := api.waitForColour(namespace, deployment); status != Success {
+		return deploymentResult, fmt.Errorf("%s did not roll out, traffic stays on the previous version: %s", deployment.Name, reason)
+	}
+
+	tracker.begin(StepSwitchTraffic)
+
+	service, err := selectColour(application, namespace, next, manifest, api.Clientset)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while switching service: %s", err)
+	}
+	deploymentResult.Service = service
+
+	if !manifest.Ingress.Disabled {
+		existingIngress, err := getExistingIngress(application, namespace, api.Clientset)
+		if err != nil {
+			return deploymentResult, fmt.Errorf("unable to get existing ingress: %s", err)
+		}
+		ingress := existingIngress
+		if ingress == nil {
+			ingress = createIngressDef(application, namespace)
+		}
+		addIngressRules(ingress, deploymentRequest, manifest, api.ClusterSubdomain, resources)
+		setIngressBackend(ingress, colourName(application, next))
+
+		if existingIngress != nil {
+			deploymentResult.Ingress, err = api.Clientset.ExtensionsV1beta1().Ingresses(namespace).Update(ingress)
+		} else {
+			deploymentResult.Ingress, err = api.Clientset.ExtensionsV1beta1().Ingresses(namespace).Create(ingress)
+		}
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while switching ingress: %s", err)
+		}
+	}
+
+	existingAutoscaler, err := getExistingAutoscaler(application, namespace, api.Clientset)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("unable to get existing autoscaler: %s", err)
+	}
+	autoscaler := createOrUpdateAutoscalerDef(manifest.Replicas, existingAutoscaler, application, namespace)
+	autoscaler.Spec.ScaleTargetRef.Name = deployment.Name
+	if existingAutoscaler != nil {
+		deploymentResult.Autoscaler, err = api.Clientset.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace).Update(autoscaler)
+	} else {
+		deploymentResult.Autoscaler, err = api.Clientset.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace).Create(autoscaler)
+	}
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while switching autoscaler: %s", err)
+	}
+
+	// the budget selects the pods of both colours by the app label
+	deploymentResult.PodDisruptionBudget, err = createOrUpdatePodDisruptionBudget(deploymentRequest, manifest, api.Clientset)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating poddisruptionbudget: %s", err)
+	}
+
+	switches.With(prometheus.Labels{"nais_app": application, "kind": DeployKindDeploy}).Inc()
+
+	if previous != nil {
+		keepPreviousColour(previous, manifest.Strategy.BlueGreen.keepPrevious(), api.Clientset)
+	}
+
+	deleted, err := deleteRemovedResources(deploymentRequest, manifest, resources, api.Clientset)
+	deploymentResult.Deleted = deleted
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while deleting removed resources: %s", err)
+	}
+
+	return deploymentResult, nil
+}
+
+// Switches traffic back to the colour that served the application before the last deploy, as long as it is kept.
+// The colour switched away from is kept in its place. Returns the recorded deploy of the colour switched to.
+func (api Api) switchBack(application, namespace string) (NaisDeploymentRequest, NaisManifest, *appError) {
+	deploymentRequest := NaisDeploymentRequest{Application: application, Namespace: namespace}
+
+	active, err := activeColour(application, namespace, api.Clientset)
+	if err != nil {
+		return deploymentRequest, NaisManifest{}, &appError{err, "unable to get active colour", http.StatusInternalServerError}
+	}
+	if active == "" {
+		return deploymentRequest, NaisManifest{}, &appError{nil, fmt.Sprintf("%s in %s is not deployed blue/green", application, namespace), http.StatusNotFound}
+	}
+	previousColour := otherColour(active)
+
+	previous, err := getExistingDeployment(colourName(application, previousColour), namespace, api.Clientset)
+	if err != nil {
+		return deploymentRequest, NaisManifest{}, &appError{err, "unable to get existing deployment", http.StatusInternalServerError}
+	}
+	// a colour kept past its time is about to be removed, and is not switched back to
+	if previous == nil || previous.Annotations[KeepUntilAnnotation] == "" || keepExpired(previous.ObjectMeta) {
+		return deploymentRequest, NaisManifest{}, &appError{nil, fmt.Sprintf("no previous version of %s in %s is kept", application, namespace), http.StatusNotFound}
+	}
+
+	deploymentRequest = recordedDeploymentRequest(application, namespace, previous.Annotations, previous.Spec.Template.Spec.Containers)
+	manifest, err := recordedManifest(previous.Annotations)
+	if err != nil {
+		return deploymentRequest, NaisManifest{}, &appError{err, "unable to read recorded manifest", http.StatusInternalServerError}
+	}
+	if manifest == nil {
+		manifest = &NaisManifest{}
+	}
+
+	if status, view, err := api.DeploymentStatusViewer.DeploymentStatusView(namespace, previous.Name); err != nil || status != Success {
+		return deploymentRequest, *manifest, &appError{err, fmt.Sprintf("%s is not rolled out: %s", previous.Name, view.Reason), http.StatusConflict}
+	}
+
+	current, err := getExistingDeployment(colourName(application, active), namespace, api.Clientset)
+	if err != nil {
+		return deploymentRequest, *manifest, &appError{err, "unable to get existing deployment", http.StatusInternalServerError}
+	}
+
+	if err := switchTraffic(application, namespace, previousColour, *manifest, api.Clientset); err != nil {
+		return deploymentRequest, *manifest, &appError{err, "failed while switching traffic", http.StatusInternalServerError}
+	}
+	switches.With(prometheus.Labels{"nais_app": application, "kind": DeployKindSwitchBack}).Inc()
+
+	delete(previous.Annotations, KeepUntilAnnotation)
+	if _, err := api.Clientset.ExtensionsV1beta1().Deployments(namespace).Update(previous); err != nil {
+		glog.Errorf("unable to stop keeping %s in %s: %s", previous.Name, namespace, err)
+	}
+	if current != nil {
+		keepPreviousColour(current, manifest.Strategy.BlueGreen.keepPrevious(), api.Clientset)
+	}
+
+	return deploymentRequest, *manifest, nil
+}
+
+// Points the service, ingress and autoscaler of the application at the colour, exposing the ports of its manifest
+func switchTraffic(application, namespace, colour string, manifest NaisManifest, k8sClient kubernetes.Interface) error {
+	if _, err := selectColour(application, namespace, colour, manifest, k8sClient); err != nil {
+		return fmt.Errorf("unable to switch service: %s", err)
+	}
+
+	ingress, err := getExistingIngress(application, namespace, k8sClient)
+	if err != nil {
+		return fmt.Errorf("unable to get existing ingress: %s", err)
+	}
+	if ingress != nil {
+		setIngressBackend(ingress, colourName(application, colour))
+		if _, err := k8sClient.ExtensionsV1beta1().Ingresses(namespace).Update(ingress); err != nil {
+			return fmt.Errorf("unable to switch ingress: %s", err)
+		}
+	}
+
+	autoscaler, err := getExistingAutoscaler(application, namespace, k8sClient)
+	if err != nil {
+		return fmt.Errorf("unable to get existing autoscaler: %s", err)
+	}
+	if autoscaler != nil {
+		autoscaler.Spec.ScaleTargetRef.Name = colourName(application, colour)
+		if _, err := k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace).Update(autoscaler); err != nil {
+			return fmt.Errorf("unable to switch autoscaler: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Waits for the deployment of a colour to roll out, giving up a while after its progress deadline
+func (api Api) waitForColour(namespace string, deployment *k8sextensions.Deployment) (DeployStatus, string) {
+	progressDeadline := time.Duration(300) * time.Second
+	if deployment.Spec.ProgressDeadlineSeconds != nil {
+		progressDeadline = time.Duration(*deployment.Spec.ProgressDeadlineSeconds) * time.Second
+	}
+	deadline := time.Now().Add(progressDeadline + rollbackDeadlineMargin)
+
+	for {
+		status, view, err := api.DeploymentStatusViewer.DeploymentStatusView(namespace, deployment.Name)
+		if err != nil {
+			return Failed, err.Error()
+		}
+		if status != InProgress {
+			return status, view.Reason
+		}
+		if time.Now().After(deadline) {
+			return InProgress, fmt.Sprintf("gave up waiting for rollout: %s", view.Reason)
+		}
+
+		time.Sleep(blueGreenPollInterval)
+	}
+}
+
+// The deployment of a colour is named after it, and its pods carry the app label along with the colour
+func createOrUpdateColourDeployment(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource, colour string, replicas int32, istioEnabled bool, k8sClient kubernetes.Interface) (*k8sextensions.Deployment, error) {
+	name := colourName(deploymentRequest.Application, colour)
+
+	existingDeployment, err := getExistingDeployment(name, deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing deployment: %s", err)
+	}
+
+	deployment, err := createDeploymentDef(naisResources, manifest, deploymentRequest, existingDeployment, istioEnabled)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create deployment: %s", err)
+	}
+
+	deployment.Name = name
+	delete(deployment.Annotations, KeepUntilAnnotation)
+	deployment.Spec.Replicas = int32p(replicas)
+	setColour(deployment, deploymentRequest.Application, colour)
+
+	if existingDeployment != nil {
+		return k8sClient.ExtensionsV1beta1().Deployments(deploymentRequest.Namespace).Update(deployment)
+	}
+	return k8sClient.ExtensionsV1beta1().Deployments(deploymentRequest.Namespace).Create(deployment)
+}
+
+// The next colour starts with as many replicas as the previous one runs, so it can take all of its traffic
+func colourReplicas(manifest NaisManifest, previous *k8sextensions.Deployment) int32 {
+	replicas := int32(manifest.Replicas.Min)
+	if previous != nil && previous.Spec.Replicas != nil && *previous.Spec.Replicas > replicas {
+		replicas = *previous.Spec.Replicas
+	}
+	return replicas
+}
+
+func setColour(deployment *k8sextensions.Deployment, application, colour string) {
+	deployment.Labels[ColourLabel] = colour
+	deployment.Spec.Template.Labels[ColourLabel] = colour
+	deployment.Spec.Selector = &k8smeta.LabelSelector{
+		MatchLabels: map[string]string{"app": application, ColourLabel: colour},
+	}
+}
+
+// The service of a colour reaches its pods directly, also while the colour is not receiving traffic
+func createColourService(application, namespace, colour string, manifest NaisManifest, k8sClient kubernetes.Interface) (*k8score.Service, error) {
+	name := colourName(application, colour)
+
+	existingService, err := getExistingService(name, namespace, k8sClient)
+	if err != nil {
+		return nil, err
+	}
+
+	service := createServiceDef(application, namespace, manifest)
+	if existingService != nil {
+		if _, err := updateServicePorts(existingService, service, k8sClient); err != nil {
+			return nil, err
+		}
+		return existingService, nil
+	}
+
+	service.Name = name
+	service.Labels[ColourLabel] = colour
+	service.Spec.Selector[ColourLabel] = colour
+	return createServiceResource(service, namespace, k8sClient)
+}
+
+// Sends the traffic of the service of the application to the colour, creating the service if needed
+func selectColour(application, namespace, colour string, manifest NaisManifest, k8sClient kubernetes.Interface) (*k8score.Service, error) {
+	service, err := getExistingService(application, namespace, k8sClient)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceDef := createServiceDef(application, namespace, manifest)
+	if service == nil {
+		serviceDef.Spec.Selector[ColourLabel] = colour
+		return createServiceResource(serviceDef, namespace, k8sClient)
+	}
+
+	service.Spec.Selector = map[string]string{"app": application, ColourLabel: colour}
+	service.Spec.Ports = serviceDef.Spec.Ports
+	return k8sClient.CoreV1().Services(namespace).Update(service)
+}
+
+func setIngressBackend(ingress *k8sextensions.Ingress, serviceName string) {
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for i := range rule.HTTP.Paths {
+			rule.HTTP.Paths[i].Backend.ServiceName = serviceName
+		}
+	}
+}
+
+// Marks the deployment as kept until the given time from now, and removes it then. Should naisd be restarted in the
+// meantime, the deployment is removed by the PreviousColourSweeper instead.
+func keepPreviousColour(deployment *k8sextensions.Deployment, keep time.Duration, k8sClient kubernetes.Interface) {
+	keepUntil := time.Now().Add(keep).UTC().Format(time.RFC3339)
+
+	if deployment.Annotations == nil {
+		deployment.Annotations = map[string]string{}
+	}
+	deployment.Annotations[KeepUntilAnnotation] = keepUntil
+	if _, err := k8sClient.ExtensionsV1beta1().Deployments(deployment.Namespace).Update(deployment); err != nil {
+		glog.Errorf("unable to keep %s in %s: %s", deployment.Name, deployment.Namespace, err)
+		return
+	}
+
+	go func() {
+		time.Sleep(keep)
+		removePreviousColour(deployment.Name, deployment.Namespace, keepUntil, k8sClient)
+	}()
+}
+
+// Deletes a deployment that is no longer kept, along with the service of its colour. A deployment that was
+// switched back to or redeployed in the meantime no longer has the same keep-until annotation and is left alone.
+func removePreviousColour(deployName, namespace, keepUntil string, k8sClient kubernetes.Interface) {
+	deployment, err := getExistingDeployment(deployName, namespace, k8sClient)
+	if err != nil {
+		glog.Errorf("unable to get %s in %s: %s", deployName, namespace, err)
+		return
+	}
+	if deployment == nil || deployment.Annotations[KeepUntilAnnotation] != keepUntil {
+		return
+	}
+
+	glog.Infof("removing previous version %s in %s", deployName, namespace)
+
+	propagation := k8smeta.DeletePropagationBackground
+	deleteOptions := &k8smeta.DeleteOptions{PropagationPolicy: &propagation}
+	if err := k8sClient.ExtensionsV1beta1().Deployments(namespace).Delete(deployName, deleteOptions); err != nil && !errors.IsNotFound(err) {
+		glog.Errorf("unable to delete %s in %s: %s", deployName, namespace, err)
+		return
+	}
+
+	// the deployment made before the first blue/green deploy shares its name with the service of the application
+	if colour := deployment.Labels[ColourLabel]; colour != "" {
+		if err := k8sClient.CoreV1().Services(namespace).Delete(deployName, deleteOptions); err != nil && !errors.IsNotFound(err) {
+			glog.Errorf("unable to delete service %s in %s: %s", deployName, namespace, err)
+		}
+	}
+}
+
+// Whether the time a deployment was kept until has passed. An unparseable time counts as passed.
+func keepExpired(objectMeta k8smeta.ObjectMeta) bool {
+	keepUntil, err := time.Parse(time.RFC3339, objectMeta.Annotations[KeepUntilAnnotation])
+	return err != nil || !time.Now().Before(keepUntil)
+}
+
+// Periodically removes the previous colours kept past their keep-until annotation, which are left behind when
+// the naisd replica that kept them stops before removing them
+type PreviousColourSweeper struct {
+	Clientset kubernetes.Interface
+	Interval  time.Duration
+}
+
+func (s PreviousColourSweeper) Run(stop <-chan struct{}) {
+	glog.Infof("starting previous colour sweeper, sweeping every %s", s.Interval)
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		removeExpiredColours(s.Clientset)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func removeExpiredColours(k8sClient kubernetes.Interface) {
+	deployments, err := k8sClient.ExtensionsV1beta1().Deployments("").List(k8smeta.ListOptions{LabelSelector: "app"})
+	if err != nil {
+		glog.Errorf("unable to list deployments: %s", err)
+		return
+	}
+
+	for _, deployment := range deployments.Items {
+		keepUntil := deployment.Annotations[KeepUntilAnnotation]
+		if keepUntil != "" && keepExpired(deployment.ObjectMeta) {
+			removePreviousColour(deployment.Name, deployment.Namespace, keepUntil, k8sClient)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newBlueGreenApi(clientset kubernetes.Interface, status DeployStatus) Api {
+	return Api{Clientset: clientset, ClusterSubdomain: "nais.example.yo", DeploymentStatusViewer: FakeDeployStatusViewer{deployStatusToReturn: status}}
+}
+
+func assertServing(t *testing.T, clientset kubernetes.Interface, colour string) {
+	service, _ := getExistingService(appName, namespace, clientset)
+	assert.Equal(t, map[string]string{"app": appName, ColourLabel: colour}, service.Spec.Selector)
+
+	ingress, _ := getExistingIngress(appName, namespace, clientset)
+	assert.Equal(t, appName+"-"+colour, ingress.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName)
+
+	autoscaler, _ := getExistingAutoscaler(appName, namespace, clientset)
+	assert.Equal(t, appName+"-"+colour, autoscaler.Spec.ScaleTargetRef.Name)
+}
+
+func TestDeployBlueGreen(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+	manifest := newDefaultManifest()
+	manifest.Strategy.BlueGreen = BlueGreenStrategy{Enabled: true}
+
+	t.Run("the first deploy goes to blue", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+
+		result, err := newBlueGreenApi(clientset, Success).deployBlueGreen(deploymentRequest, manifest, []NaisResource{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, appName+"-blue", result.Deployment.Name)
+		assert.Equal(t, map[string]string{"app": appName, ColourLabel: ColourBlue}, result.Deployment.Spec.Template.Labels)
+
+		colourService, _ := getExistingService(appName+"-blue", namespace, clientset)
+		assert.Equal(t, map[string]string{"app": appName, ColourLabel: ColourBlue}, colourService.Spec.Selector)
+		assertServing(t, clientset, ColourBlue)
+	})
+
+	t.Run("the next deploy switches to green and keeps blue", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		api := newBlueGreenApi(clientset, Success)
+		_, err := api.deployBlueGreen(deploymentRequest, manifest, []NaisResource{}, nil)
+		assert.NoError(t, err)
+
+		newVersion := deploymentRequest
+		newVersion.Version = "2.0"
+		result, err := api.deployBlueGreen(newVersion, manifest, []NaisResource{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, image+":2.0", result.Deployment.Spec.Template.Spec.Containers[0].Image)
+		assertServing(t, clientset, ColourGreen)
+
+		blue, _ := getExistingDeployment(appName+"-blue", namespace, clientset)
+		assert.NotEmpty(t, blue.Annotations[KeepUntilAnnotation])
+		assert.Equal(t, image+":"+version, blue.Spec.Template.Spec.Containers[0].Image)
+	})
+
+	t.Run("traffic stays on the previous colour when the new one does not roll out", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		_, err := newBlueGreenApi(clientset, Success).deployBlueGreen(deploymentRequest, manifest, []NaisResource{}, nil)
+		assert.NoError(t, err)
+
+		_, err = newBlueGreenApi(clientset, Failed).deployBlueGreen(deploymentRequest, manifest, []NaisResource{}, nil)
+		assert.Error(t, err)
+		assertServing(t, clientset, ColourBlue)
+	})
+}
+
+func TestSwitchBack(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+	manifest := newDefaultManifest()
+	manifest.Strategy.BlueGreen = BlueGreenStrategy{Enabled: true}
+
+	t.Run("traffic is switched back to the kept colour", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		api := newBlueGreenApi(clientset, Success)
+		api.deployBlueGreen(deploymentRequest, manifest, []NaisResource{}, nil)
+		newVersion := deploymentRequest
+		newVersion.Version = "2.0"
+		api.deployBlueGreen(newVersion, manifest, []NaisResource{}, nil)
+
+		switchedTo, _, appErr := api.switchBack(appName, namespace)
+		assert.Nil(t, appErr)
+		assert.Equal(t, version, switchedTo.Version)
+		assertServing(t, clientset, ColourBlue)
+
+		blue, _ := getExistingDeployment(appName+"-blue", namespace, clientset)
+		assert.Empty(t, blue.Annotations[KeepUntilAnnotation])
+		green, _ := getExistingDeployment(appName+"-green", namespace, clientset)
+		assert.NotEmpty(t, green.Annotations[KeepUntilAnnotation])
+	})
+
+	t.Run("a colour kept past its time is not switched back to", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		api := newBlueGreenApi(clientset, Success)
+		api.deployBlueGreen(deploymentRequest, manifest, []NaisResource{}, nil)
+		newVersion := deploymentRequest
+		newVersion.Version = "2.0"
+		api.deployBlueGreen(newVersion, manifest, []NaisResource{}, nil)
+
+		blue, _ := getExistingDeployment(appName+"-blue", namespace, clientset)
+		blue.Annotations[KeepUntilAnnotation] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+		clientset.ExtensionsV1beta1().Deployments(namespace).Update(blue)
+
+		_, _, appErr := api.switchBack(appName, namespace)
+		assert.Equal(t, http.StatusNotFound, appErr.StatusCode)
+		assertServing(t, clientset, ColourGreen)
+	})
+
+	t.Run("there is nothing to switch back to after the first deploy", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		api := newBlueGreenApi(clientset, Success)
+		api.deployBlueGreen(deploymentRequest, manifest, []NaisResource{}, nil)
+
+		_, _, appErr := api.switchBack(appName, namespace)
+		assert.Equal(t, http.StatusNotFound, appErr.StatusCode)
+	})
+
+	t.Run("applications not deployed blue/green cannot be switched back", func(t *testing.T) {
+		_, _, appErr := newBlueGreenApi(newDeployedClientset(t, []NaisResource{}), Success).switchBack(appName, namespace)
+		assert.Equal(t, http.StatusNotFound, appErr.StatusCode)
+	})
+}
+
+func TestRemoveExpiredColours(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+	manifest := newDefaultManifest()
+	manifest.Strategy.BlueGreen = BlueGreenStrategy{Enabled: true}
+
+	clientset := fake.NewSimpleClientset()
+	api := newBlueGreenApi(clientset, Success)
+	api.deployBlueGreen(deploymentRequest, manifest, []NaisResource{}, nil)
+	api.deployBlueGreen(deploymentRequest, manifest, []NaisResource{}, nil)
+
+	removeExpiredColours(clientset)
+	blue, _ := getExistingDeployment(appName+"-blue", namespace, clientset)
+	assert.NotNil(t, blue, "a colour is kept until its time has passed")
+
+	// as left behind by a naisd replica that stopped while keeping it
+	blue.Annotations[KeepUntilAnnotation] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	clientset.ExtensionsV1beta1().Deployments(namespace).Update(blue)
+
+	removeExpiredColours(clientset)
+	blue, _ = getExistingDeployment(appName+"-blue", namespace, clientset)
+	assert.Nil(t, blue)
+	blueService, _ := getExistingService(appName+"-blue", namespace, clientset)
+	assert.Nil(t, blueService)
+	assertServing(t, clientset, ColourGreen)
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	k8score "k8s.io/api/core/v1"
+	k8sextensions "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"math"
+	"time"
+)
+
+const (
+	TrackLabel            = "naisd.io/track"
+	TrackCanary           = "canary"
+	canarySuffix          = "-canary"
+	defaultCanaryDuration = 5 * time.Minute
+	// a canary holds the deploy lock, which is renewed while the deploy runs
+	maxCanaryDuration = 20 * time.Minute
+)
+
+var canaryPollInterval = 5 * time.Second
+
+var canaries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "canaries", Help: "canary deploys done by NaisD"}, []string{"nais_app", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(canaries)
+}
+
+func (c CanaryStrategy) duration() time.Duration {
+	if duration, err := time.ParseDuration(c.Duration); err == nil && duration > 0 {
+		return duration
+	}
+	return defaultCanaryDuration
+}
+
+// The number of canary pods, a weight is rounded up so the canary always gets at least one pod
+func (c CanaryStrategy) replicas(currentReplicas int32) int32 {
+	if c.Replicas > 0 {
+		return int32(c.Replicas)
+	}
+	return int32(math.Max(1, math.Ceil(float64(currentReplicas)*float64(c.Weight)/100)))
+}
+
+func canaryName(application string) string {
+	return application + canarySuffix
+}
+
+// Runs the new version in a deployment of its own next to the current one. The canary pods carry the app label,
+// so the service sends them their share of the traffic. If the canary does not roll out, or fails while it is
+// held, the deploy is aborted and the secret and configmap put back the way they were. The canary is removed in either case, the
+// normal rolling update promotes the version. A first deploy has nothing to compare with and skips the canary.
+func (api Api) runCanary(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource) error {
+	application, namespace := deploymentRequest.Application, deploymentRequest.Namespace
+
+	currentDeployment, err := getExistingDeployment(application, namespace, api.Clientset)
+	if err != nil {
+		return fmt.Errorf("unable to get existing deployment: %s", err)
+	}
+	if currentDeployment == nil {
+		glog.Infof("%s in %s is not deployed yet, skipping canary", application, namespace)
+		return nil
+	}
+
+	previousSecret, err := getExistingSecret(application, namespace, api.Clientset)
+	if err != nil {
+		return fmt.Errorf("unable to get existing secret: %s", err)
+	}
+	if _, err := createOrUpdateSecret(deploymentRequest, naisResources, api.Clientset); err != nil {
+		return fmt.Errorf("failed while creating or updating secret: %s", err)
+	}
+
+	previousConfigMap, err := getExistingConfigMap(application, namespace, api.Clientset)
+	if err != nil {
+		return fmt.Errorf("unable to get existing configmap: %s", err)
+	}
+	if _, err := createOrUpdateConfigMap(deploymentRequest, manifest, api.Clientset); err != nil {
+		return fmt.Errorf("failed while creating or updating configmap: %s", err)
+	}
+
+	currentReplicas := int32(1)
+	if currentDeployment.Spec.Replicas != nil {
+		currentReplicas = *currentDeployment.Spec.Replicas
+	}
+
+	if err := createOrUpdateCanary(deploymentRequest, manifest, naisResources, manifest.Strategy.Canary.replicas(currentReplicas), api.IstioEnabled, api.Clientset); err != nil {
+		return fmt.Errorf("unable to create canary: %s", err)
+	}
+	defer func() {
+		if err := deleteCanary(application, namespace, api.Clientset); err != nil {
+			glog.Errorf("unable to delete canary of %s in %s: %s", application, namespace, err)
+		}
+	}()
+
+	duration := manifest.Strategy.Canary.duration()
+	glog.Infof("holding canary of %s version %s in %s for %s", application, deploymentRequest.Version, namespace, duration)
+
+	if status, reason := api.holdCanary(namespace, canaryName(application), duration); status != Success {
+		canaries.With(prometheus.Labels{"nais_app": application, "result": "aborted"}).Inc()
+		recordDeployEvent(currentDeployment, k8score.EventTypeWarning, "CanaryAborted", fmt.Sprintf("canary of version %s aborted: %s", deploymentRequest.Version, reason), api.Clientset)
+
+		if err := restoreSecret(application, namespace, previousSecret, api.Clientset); err != nil {
+			glog.Errorf("unable to restore secret of %s in %s: %s", application, namespace, err)
+		}
+		if err := restoreConfigMap(application, namespace, previousConfigMap, api.Clientset); err != nil {
+			glog.Errorf("unable to restore configmap of %s in %s: %s", application, namespace, err)
+		}
+		return fmt.Errorf("canary of version %s aborted: %s", deploymentRequest.Version, reason)
+	}
+
+	canaries.With(prometheus.Labels{"nais_app": application, "result": "promoted"}).Inc()
+	recordDeployEvent(currentDeployment, k8score.EventTypeNormal, "CanaryPromoted", fmt.Sprintf("canary of version %s stayed healthy for %s", deploymentRequest.Version, duration), api.Clientset)
+	return nil
+}
+
+// Checks the status of the canary until the duration has passed. The canary passes if it never failed and
+// has rolled out by the end, otherwise the reason it did not pass is returned.
+func (api Api) holdCanary(namespace, deployName string, duration time.Duration) (DeployStatus, string) {
+	deadline := time.Now().Add(duration)
+
+	for {
+		status, view, err := api.DeploymentStatusViewer.DeploymentStatusView(namespace, deployName)
+		if err != nil {
+			return Failed, err.Error()
+		}
+		if status == Failed {
+			return Failed, view.Reason
+		}
+
+		if !time.Now().Before(deadline) {
+			if status != Success {
+				return status, fmt.Sprintf("not rolled out within %s: %s", duration, view.Reason)
+			}
+			return Success, ""
+		}
+
+		time.Sleep(canaryPollInterval)
+	}
+}
+
+// The canary is a deployment like the one it is compared with, without the annotations naisd records
+// on deployments, so revisions, drift and rollbacks leave it alone
+func createCanaryDef(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource, replicas int32, istioEnabled bool) (*k8sextensions.Deployment, error) {
+	deployment, err := createDeploymentDef(naisResources, manifest, deploymentRequest, nil, istioEnabled)
+	if err != nil {
+		return nil, err
+	}
+
+	deployment.Name = canaryName(deploymentRequest.Application)
+	deployment.Annotations = nil
+	deployment.Labels[TrackLabel] = TrackCanary
+	deployment.Spec.Replicas = int32p(replicas)
+	deployment.Spec.Template.Labels[TrackLabel] = TrackCanary
+	deployment.Spec.Selector = &k8smeta.LabelSelector{
+		MatchLabels: map[string]string{"app": deploymentRequest.Application, TrackLabel: TrackCanary},
+	}
+
+	return deployment, nil
+}
+
+// A canary left behind by an earlier deploy is replaced
+func createOrUpdateCanary(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource, replicas int32, istioEnabled bool, k8sClient kubernetes.Interface) error {
+	canaryDef, err := createCanaryDef(deploymentRequest, manifest, naisResources, replicas, istioEnabled)
+	if err != nil {
+		return err
+	}
+
+	// the canary of the first deploy with istio authorization rules runs with the service account they bring
+	if istioRulesEnabled(manifest, istioEnabled) {
+		if err := createServiceAccount(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient); err != nil {
+			return err
+		}
+	}
+
+	existingCanary, err := getExistingDeployment(canaryDef.Name, deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return fmt.Errorf("unable to get existing canary: %s", err)
+	}
+	if existingCanary != nil {
+		canaryDef.ResourceVersion = existingCanary.ResourceVersion
+		_, err = k8sClient.ExtensionsV1beta1().Deployments(deploymentRequest.Namespace).Update(canaryDef)
+		return err
+	}
+
+	_, err = k8sClient.ExtensionsV1beta1().Deployments(deploymentRequest.Namespace).Create(canaryDef)
+	return err
+}
+
+func deleteCanary(application, namespace string, k8sClient kubernetes.Interface) error {
+	propagation := k8smeta.DeletePropagationBackground
+	err := k8sClient.ExtensionsV1beta1().Deployments(namespace).Delete(canaryName(application), &k8smeta.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
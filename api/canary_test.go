@@ -0,0 +1,111 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	k8sextensions "k8s.io/api/extensions/v1beta1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+	"time"
+)
+
+func TestCanaryReplicas(t *testing.T) {
+	assert.Equal(t, int32(2), CanaryStrategy{Replicas: 2}.replicas(10))
+	assert.Equal(t, int32(3), CanaryStrategy{Weight: 25}.replicas(10))
+	assert.Equal(t, int32(1), CanaryStrategy{Weight: 10}.replicas(2))
+}
+
+func TestRunCanary(t *testing.T) {
+	canaryPollInterval = time.Millisecond
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: "2.0", Namespace: namespace, Zone: ZONE_FSS}
+	manifest := newDefaultManifest()
+	manifest.Strategy.Canary = CanaryStrategy{Weight: 50, Duration: "10ms"}
+	secretResource := NaisResource{name: "db", resourceType: "credential", properties: map[string]string{}, secret: map[string]string{"password": "secret"}}
+
+	createdCanary := func(clientset *fake.Clientset) *k8sextensions.Deployment {
+		for _, action := range clientset.Actions() {
+			if create, ok := action.(k8stesting.CreateAction); ok {
+				if deployment, ok := create.GetObject().(*k8sextensions.Deployment); ok && deployment.Name == appName+canarySuffix {
+					return deployment
+				}
+			}
+		}
+		return nil
+	}
+
+	t.Run("a first deploy skips the canary", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		api := Api{Clientset: clientset, DeploymentStatusViewer: FakeDeployStatusViewer{deployStatusToReturn: Success}}
+
+		assert.NoError(t, api.runCanary(deploymentRequest, manifest, []NaisResource{}))
+		assert.Nil(t, createdCanary(clientset))
+	})
+
+	t.Run("a healthy canary is promoted and removed", func(t *testing.T) {
+		clientset := newDeployedClientset(t, []NaisResource{}).(*fake.Clientset)
+		api := Api{Clientset: clientset, DeploymentStatusViewer: FakeDeployStatusViewer{deployStatusToReturn: Success}}
+
+		assert.NoError(t, api.runCanary(deploymentRequest, manifest, []NaisResource{}))
+
+		canary := createdCanary(clientset)
+		assert.NotNil(t, canary)
+		assert.Equal(t, int32(1), *canary.Spec.Replicas)
+		assert.Equal(t, image+":2.0", canary.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, map[string]string{"app": appName, TrackLabel: TrackCanary}, canary.Spec.Template.Labels)
+		assert.Empty(t, canary.Annotations)
+
+		remaining, _ := getExistingDeployment(appName+canarySuffix, namespace, clientset)
+		assert.Nil(t, remaining)
+	})
+
+	t.Run("a failing canary aborts the deploy and restores the secret", func(t *testing.T) {
+		clientset := newDeployedClientset(t, []NaisResource{}).(*fake.Clientset)
+		api := Api{Clientset: clientset, DeploymentStatusViewer: FakeDeployStatusViewer{
+			deployStatusToReturn: Failed,
+			viewToReturn:         DeploymentStatusView{Reason: "containers are crashing"},
+		}}
+
+		err := api.runCanary(deploymentRequest, manifest, []NaisResource{secretResource})
+		assert.EqualError(t, err, "canary of version 2.0 aborted: containers are crashing")
+
+		remaining, _ := getExistingDeployment(appName+canarySuffix, namespace, clientset)
+		assert.Nil(t, remaining)
+		secret, _ := getExistingSecret(appName, namespace, clientset)
+		assert.Nil(t, secret)
+
+		deployment, _ := getExistingDeployment(appName, namespace, clientset)
+		assert.Equal(t, image+":"+version, deployment.Spec.Template.Spec.Containers[0].Image)
+	})
+
+	t.Run("a canary that has not rolled out in time aborts the deploy", func(t *testing.T) {
+		clientset := newDeployedClientset(t, []NaisResource{}).(*fake.Clientset)
+		api := Api{Clientset: clientset, DeploymentStatusViewer: FakeDeployStatusViewer{
+			deployStatusToReturn: InProgress,
+			viewToReturn:         DeploymentStatusView{Reason: "Waiting for rollout to finish"},
+		}}
+
+		err := api.runCanary(deploymentRequest, manifest, []NaisResource{})
+		assert.EqualError(t, err, "canary of version 2.0 aborted: not rolled out within 10ms: Waiting for rollout to finish")
+	})
+}
+
+func TestCanaryServiceAccount(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: "2.0", Namespace: namespace, Zone: ZONE_FSS}
+	manifest := newDefaultManifest()
+	manifest.Istio.Enabled = true
+	manifest.AccessPolicy.Inbound = []AccessRule{{Application: "caller"}}
+	clientset := fake.NewSimpleClientset()
+
+	assert.NoError(t, createOrUpdateCanary(deploymentRequest, manifest, []NaisResource{}, 1, true, clientset))
+
+	var created []string
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "create" {
+			created = append(created, action.GetResource().Resource)
+		}
+	}
+	assert.Equal(t, []string{"serviceaccounts", "deployments"}, created, "the service account exists before the pods of the canary")
+
+	canary, _ := getExistingDeployment(canaryName(appName), namespace, clientset)
+	assert.Equal(t, appName, canary.Spec.Template.Spec.ServiceAccountName)
+}
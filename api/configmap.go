@@ -0,0 +1,121 @@
+package api
+
+import (
+	"crypto/sha256"
+	"fmt"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+)
+
+const (
+	ConfigMapChecksumAnnotation = "naisd.io/configmap-checksum"
+	// the files are also recorded in the manifest annotation of the deployment, and the annotations of an object
+	// may hold at most 256KiB together
+	maxConfigMapSize = 128 * 1024
+)
+
+// Creates a Kubernetes ConfigMap object holding the files of the manifest. Returns nil if there are no files.
+func createConfigMapDef(manifest NaisManifest, application, namespace string) *k8score.ConfigMap {
+	if len(manifest.ConfigMap.Files) == 0 {
+		return nil
+	}
+
+	data := map[string]string{}
+	for name, content := range manifest.ConfigMap.Files {
+		data[name] = content
+	}
+
+	return &k8score.ConfigMap{
+		TypeMeta: k8smeta.TypeMeta{
+			Kind:       "ConfigMap",
+			APIVersion: "v1",
+		},
+		ObjectMeta: createObjectMeta(application, namespace),
+		Data:       data,
+	}
+}
+
+// Returns nil if the manifest has no files
+func createOrUpdateConfigMap(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, k8sClient kubernetes.Interface) (*k8score.ConfigMap, error) {
+	configMapDef := createConfigMapDef(manifest, deploymentRequest.Application, deploymentRequest.Namespace)
+	if configMapDef == nil {
+		return nil, nil
+	}
+
+	existingConfigMap, err := getExistingConfigMap(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing configmap: %s", err)
+	}
+
+	configMaps := k8sClient.CoreV1().ConfigMaps(deploymentRequest.Namespace)
+	if existingConfigMap != nil {
+		existingConfigMap.Data = configMapDef.Data
+		return configMaps.Update(existingConfigMap)
+	}
+	return configMaps.Create(configMapDef)
+}
+
+func getExistingConfigMap(application string, namespace string, k8sClient kubernetes.Interface) (*k8score.ConfigMap, error) {
+	configMap, err := k8sClient.CoreV1().ConfigMaps(namespace).Get(application, k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return configMap, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Deletes the configmap of the application if naisd created it, returning whether it was deleted
+func deleteConfigMap(application, namespace string, k8sClient kubernetes.Interface) (bool, error) {
+	configMap, err := getExistingConfigMap(application, namespace, k8sClient)
+	if err != nil || configMap == nil || !createdByNaisd(configMap.ObjectMeta, application) {
+		return false, err
+	}
+
+	err = k8sClient.CoreV1().ConfigMaps(namespace).Delete(application, &k8smeta.DeleteOptions{})
+	return deleted(err)
+}
+
+func configMapVolumeName(application string) string {
+	return validLabelName(application + "-files")
+}
+
+func createConfigMapVolume(application string) k8score.Volume {
+	return k8score.Volume{
+		Name: configMapVolumeName(application),
+		VolumeSource: k8score.VolumeSource{
+			ConfigMap: &k8score.ConfigMapVolumeSource{
+				LocalObjectReference: k8score.LocalObjectReference{Name: application},
+			},
+		},
+	}
+}
+
+func createConfigMapVolumeMount(application string, manifest NaisManifest) k8score.VolumeMount {
+	return k8score.VolumeMount{
+		Name:      configMapVolumeName(application),
+		MountPath: manifest.ConfigMap.MountPath,
+		ReadOnly:  true,
+	}
+}
+
+// A checksum of the files, set as an annotation on the pod template so that changing a file rolls out new pods
+func configMapChecksum(files map[string]string) string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%d:%s%d:%s", len(name), name, len(files[name]), files[name])
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
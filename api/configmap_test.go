@@ -0,0 +1,118 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func TestManifestEnv(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace}
+	naisResources := []NaisResource{{name: "r1", resourceType: "credential", properties: map[string]string{"key1": "value1"}}}
+
+	t.Run("the env of the manifest is added after the variables from fasit", func(t *testing.T) {
+		manifest := newDefaultManifest()
+		manifest.Env = map[string]string{"LOG_LEVEL": "debug", "FEATURE_X": "on"}
+		manifest.Sidecars = []Container{{Name: "shipper", Image: "docker.hub/shipper:1.0", FasitEnv: true}}
+
+		podSpec, err := createPodSpec(deploymentRequest, manifest, naisResources)
+		assert.NoError(t, err)
+		env := podSpec.Containers[0].Env
+		assert.Equal(t, []k8score.EnvVar{{Name: "FEATURE_X", Value: "on"}, {Name: "LOG_LEVEL", Value: "debug"}}, env[len(env)-2:])
+		assert.Equal(t, env[:len(env)-2], podSpec.Containers[1].Env, "sidecars only get the variables from fasit")
+	})
+
+	t.Run("a variable that is also set by fasit should error", func(t *testing.T) {
+		manifest := newDefaultManifest()
+		manifest.Env = map[string]string{"R1_KEY1": "value"}
+
+		_, err := createPodSpec(deploymentRequest, manifest, naisResources)
+		assert.EqualError(t, err, "found duplicate environment variable R1_KEY1 when adding R1_KEY1 for env (manifest)"+
+			" Change the Fasit alias or use propertyMap to create unique variable names")
+
+		_, err = createMigrationJobDef(deploymentRequest, manifest, naisResources)
+		assert.Error(t, err)
+	})
+}
+
+func TestCreateOrUpdateConfigMap(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+	manifest := newDefaultManifest()
+	manifest.ConfigMap = ConfigMapConfig{MountPath: "/etc/app", Files: map[string]string{"logback.xml": "<configuration/>"}}
+
+	t.Run("the files are mounted in the app container", func(t *testing.T) {
+		result, err := createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, fake.NewSimpleClientset())
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"logback.xml": "<configuration/>"}, result.ConfigMap.Data)
+		assert.Contains(t, string(createResponse(result, nil)), "- created configmap\n")
+
+		podSpec := result.Deployment.Spec.Template.Spec
+		assert.Contains(t, podSpec.Volumes, createConfigMapVolume(appName))
+		assert.Contains(t, podSpec.Containers[0].VolumeMounts, k8score.VolumeMount{Name: appName + "-files", MountPath: "/etc/app", ReadOnly: true})
+	})
+
+	t.Run("changed files are updated and roll out new pods", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		first, err := createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		changed := manifest
+		changed.ConfigMap.Files = map[string]string{"logback.xml": "<configuration debug=\"true\"/>"}
+		second, err := createOrUpdateK8sResources(deploymentRequest, changed, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		configMap, _ := getExistingConfigMap(appName, namespace, clientset)
+		assert.Equal(t, changed.ConfigMap.Files, configMap.Data)
+		assert.NotEqual(t, first.Deployment.Spec.Template.Annotations[ConfigMapChecksumAnnotation], second.Deployment.Spec.Template.Annotations[ConfigMapChecksumAnnotation])
+	})
+
+	t.Run("the configmap is deleted when the files are removed", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+
+		result, err := createOrUpdateK8sResources(deploymentRequest, newDefaultManifest(), []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, result.ConfigMap)
+		assert.Contains(t, result.Deleted, DeletedResource{Kind: "ConfigMap", Name: appName})
+		assert.Empty(t, result.Deployment.Spec.Template.Annotations[ConfigMapChecksumAnnotation])
+	})
+}
+
+func TestConfigMapChecksum(t *testing.T) {
+	assert.Equal(t, configMapChecksum(map[string]string{"a": "1", "b": "2"}), configMapChecksum(map[string]string{"b": "2", "a": "1"}))
+	assert.NotEqual(t, configMapChecksum(map[string]string{"a": "12"}), configMapChecksum(map[string]string{"a1": "2"}))
+}
+
+func TestUndeployKeepsStateConfigMaps(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace}
+	manifest := newDefaultManifest()
+	manifest.ConfigMap = ConfigMapConfig{MountPath: "/etc/app", Files: map[string]string{"logback.xml": "<configuration/>"}}
+
+	_, err := createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+	assert.NoError(t, err)
+
+	// naisd keeps its state in the namespace of the application
+	history := NewConfigMapDeployHistory(clientset, namespace)
+	assert.NoError(t, history.Record(newDeployRecord(DeployKindDeploy, deploymentRequest, manifest, time.Now(), nil)))
+	job, _ := newDeployJob(deploymentRequest, nil)
+	jobStore := NewConfigMapJobStore(clientset, namespace)
+	assert.NoError(t, jobStore.Save(job))
+	_, err = NewConfigMapDeployLocker(clientset, namespace).Lock(namespace, appName, "test")
+	assert.NoError(t, err)
+
+	deleted, err := deleteK8sResources(appName, namespace, clientset)
+	assert.NoError(t, err)
+	assert.Contains(t, deleted, DeletedResource{Kind: "ConfigMap", Name: appName})
+
+	configMap, _ := getExistingConfigMap(appName, namespace, clientset)
+	assert.Nil(t, configMap)
+	records, _ := history.List(namespace, appName)
+	assert.Len(t, records, 1)
+	savedJob, _ := jobStore.Get(job.Id)
+	assert.NotNil(t, savedJob)
+	_, err = NewConfigMapDeployLocker(clientset, namespace).Lock(namespace, appName, "other")
+	assert.Error(t, err, "the lock is still held")
+}
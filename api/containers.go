@@ -0,0 +1,94 @@
+package api
+
+import (
+	k8score "k8s.io/api/core/v1"
+	k8sresource "k8s.io/apimachinery/pkg/api/resource"
+	"sort"
+)
+
+// Creates the sidecars or init containers of the manifest. The app's environment variables from Fasit are passed
+// on to the containers that ask for them, and each container's own variables are checked against them.
+func createContainers(containers []Container, deploymentRequest NaisDeploymentRequest, naisResources []NaisResource, fasitEnvVars []k8score.EnvVar) ([]k8score.Container, error) {
+	var k8sContainers []k8score.Container
+	for _, container := range containers {
+		k8sContainer, err := createContainer(container, deploymentRequest, naisResources, fasitEnvVars)
+		if err != nil {
+			return nil, err
+		}
+		k8sContainers = append(k8sContainers, k8sContainer)
+	}
+	return k8sContainers, nil
+}
+
+func createContainer(container Container, deploymentRequest NaisDeploymentRequest, naisResources []NaisResource, fasitEnvVars []k8score.EnvVar) (k8score.Container, error) {
+	var envVars []k8score.EnvVar
+	if container.FasitEnv {
+		envVars = append(envVars, fasitEnvVars...)
+	}
+
+	// sorted, so the pod spec is the same from one deploy to the next
+	var names []string
+	for name := range container.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		envVar := k8score.EnvVar{Name: name, Value: container.Env[name]}
+		if err := checkForDuplicates(envVars, envVar, name, NaisResource{name: container.Name, resourceType: "container"}); err != nil {
+			return k8score.Container{}, err
+		}
+		envVars = append(envVars, envVar)
+	}
+
+	k8sContainer := k8score.Container{
+		Name:            container.Name,
+		Image:           container.Image,
+		Command:         container.Command,
+		Args:            container.Args,
+		Resources:       createContainerResources(container.Resources),
+		Env:             envVars,
+		ImagePullPolicy: k8score.PullIfNotPresent,
+	}
+
+	for _, mount := range container.VolumeMounts {
+		k8sContainer.VolumeMounts = append(k8sContainer.VolumeMounts, k8score.VolumeMount{Name: mount.Name, MountPath: mount.MountPath})
+	}
+	if container.FasitEnv && hasCertificate(naisResources) {
+		k8sContainer.VolumeMounts = append(k8sContainer.VolumeMounts, createCertificateVolumeMount(deploymentRequest, naisResources))
+	}
+
+	return k8sContainer, nil
+}
+
+// Unlike the app container, sidecars and init containers only get the resources they ask for
+func createContainerResources(resources ResourceRequirements) k8score.ResourceRequirements {
+	requirements := k8score.ResourceRequirements{}
+	add := func(list k8score.ResourceList, name k8score.ResourceName, quantity string) k8score.ResourceList {
+		if quantity == "" {
+			return list
+		}
+		if list == nil {
+			list = k8score.ResourceList{}
+		}
+		list[name] = k8sresource.MustParse(quantity)
+		return list
+	}
+
+	requirements.Requests = add(requirements.Requests, k8score.ResourceCPU, resources.Requests.Cpu)
+	requirements.Requests = add(requirements.Requests, k8score.ResourceMemory, resources.Requests.Memory)
+	requirements.Limits = add(requirements.Limits, k8score.ResourceCPU, resources.Limits.Cpu)
+	requirements.Limits = add(requirements.Limits, k8score.ResourceMemory, resources.Limits.Memory)
+	return requirements
+}
+
+func createSharedVolumes(sharedVolumes []SharedVolume) []k8score.Volume {
+	var volumes []k8score.Volume
+	for _, volume := range sharedVolumes {
+		volumes = append(volumes, k8score.Volume{
+			Name:         volume.Name,
+			VolumeSource: k8score.VolumeSource{EmptyDir: &k8score.EmptyDirVolumeSource{}},
+		})
+	}
+	return volumes
+}
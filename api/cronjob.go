@@ -0,0 +1,193 @@
+package api
+
+import (
+	"fmt"
+	k8sbatch "k8s.io/api/batch/v1"
+	k8sbatchv1beta1 "k8s.io/api/batch/v1beta1"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	KindDeployment = "deployment"
+	KindCronJob    = "cronjob"
+)
+
+// Creates a Kubernetes CronJob object running the pod of the application on the schedule of the manifest.
+// A run has no port to probe and is not replaced when it exits, and a run still going when the next one is due
+// makes it skip. The annotations recording the deploy are the same as on a deployment.
+func createCronJobDef(naisResources []NaisResource, manifest NaisManifest, deploymentRequest NaisDeploymentRequest, existingCronJob *k8sbatchv1beta1.CronJob) (*k8sbatchv1beta1.CronJob, error) {
+	podSpec, err := createPodSpec(deploymentRequest, manifest, naisResources)
+	if err != nil {
+		return nil, err
+	}
+
+	container := &podSpec.Containers[0]
+	container.Ports = nil
+	container.LivenessProbe = nil
+	container.ReadinessProbe = nil
+	container.Lifecycle = nil
+	podSpec.RestartPolicy = k8score.RestartPolicyOnFailure
+
+	annotations, err := createDeploymentAnnotations(deploymentRequest, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{"app": deploymentRequest.Application}
+	spec := k8sbatchv1beta1.CronJobSpec{
+		Schedule:          manifest.Schedule,
+		ConcurrencyPolicy: k8sbatchv1beta1.ForbidConcurrent,
+		JobTemplate: k8sbatchv1beta1.JobTemplateSpec{
+			ObjectMeta: k8smeta.ObjectMeta{Labels: labels},
+			Spec: k8sbatch.JobSpec{
+				Template: k8score.PodTemplateSpec{
+					ObjectMeta: k8smeta.ObjectMeta{Labels: labels},
+					Spec:       podSpec,
+				},
+			},
+		},
+	}
+
+	cronJob := existingCronJob
+	if cronJob == nil {
+		cronJob = &k8sbatchv1beta1.CronJob{
+			TypeMeta: k8smeta.TypeMeta{
+				Kind:       "CronJob",
+				APIVersion: "batch/v1beta1",
+			},
+			ObjectMeta: createObjectMeta(deploymentRequest.Application, deploymentRequest.Namespace),
+		}
+	}
+	if cronJob.Annotations == nil {
+		cronJob.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		cronJob.Annotations[k] = v
+	}
+	cronJob.Spec = spec
+
+	return cronJob, nil
+}
+
+func createOrUpdateCronJob(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource, k8sClient kubernetes.Interface) (*k8sbatchv1beta1.CronJob, error) {
+	existingCronJob, err := getExistingCronJob(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing cronjob: %s", err)
+	}
+
+	cronJobDef, err := createCronJobDef(naisResources, manifest, deploymentRequest, existingCronJob)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cronjob: %s", err)
+	}
+
+	if existingCronJob != nil {
+		return k8sClient.BatchV1beta1().CronJobs(deploymentRequest.Namespace).Update(cronJobDef)
+	}
+	return k8sClient.BatchV1beta1().CronJobs(deploymentRequest.Namespace).Create(cronJobDef)
+}
+
+// Creates or updates the CronJob and the Secret of a scheduled application. An application that used to be
+// a deployment has its Deployment, Service, Ingress and HorizontalPodAutoscaler deleted.
+func createOrUpdateCronJobResources(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, resources []NaisResource, k8sClient kubernetes.Interface) (DeploymentResult, error) {
+	var deploymentResult DeploymentResult
+
+	secret, err := createOrUpdateSecret(deploymentRequest, resources, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating secret: %s", err)
+	}
+	deploymentResult.Secret = secret
+
+	// the pods of a cronjob receive no calls, so they get no istio authorization rules
+	networkPolicy, err := createOrUpdateAccessPolicy(deploymentRequest, manifest, false, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating access policy: %s", err)
+	}
+	deploymentResult.NetworkPolicy = networkPolicy
+
+	configMap, err := createOrUpdateConfigMap(deploymentRequest, manifest, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating configmap: %s", err)
+	}
+	deploymentResult.ConfigMap = configMap
+
+	cronJob, err := createOrUpdateCronJob(deploymentRequest, manifest, resources, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating cronjob: %s", err)
+	}
+	deploymentResult.CronJob = cronJob
+
+	deleted, err := deleteRemovedResources(deploymentRequest, manifest, resources, k8sClient)
+	deploymentResult.Deleted = deleted
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while deleting removed resources: %s", err)
+	}
+
+	return deploymentResult, nil
+}
+
+func getExistingCronJob(application string, namespace string, k8sClient kubernetes.Interface) (*k8sbatchv1beta1.CronJob, error) {
+	cronJob, err := k8sClient.BatchV1beta1().CronJobs(namespace).Get(application, k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return cronJob, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+}
+
+// The status of a scheduled application is the status of its last run, found among the jobs the CronJob owns.
+// An application that has not run yet is reported as deployed.
+func cronJobStatusAndView(cronJob k8sbatchv1beta1.CronJob, k8sClient kubernetes.Interface) (DeployStatus, DeploymentStatusView, error) {
+	containers, images := findContainerImages(cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers)
+	view := DeploymentStatusView{Name: cronJob.Name, Containers: containers, Images: images}
+
+	jobs, err := k8sClient.BatchV1().Jobs(cronJob.Namespace).List(k8smeta.ListOptions{LabelSelector: "app=" + cronJob.Name})
+	if err != nil {
+		return Failed, DeploymentStatusView{}, fmt.Errorf("unable to list jobs of cronjob %s: %s", cronJob.Name, err)
+	}
+
+	var lastRun *k8sbatch.Job
+	for i, job := range jobs.Items {
+		if !ownedBy(job.ObjectMeta, "CronJob", cronJob.Name) {
+			continue
+		}
+		if lastRun == nil || lastRun.CreationTimestamp.Before(&job.CreationTimestamp) {
+			lastRun = &jobs.Items[i]
+		}
+	}
+
+	status := Success
+	switch {
+	case lastRun == nil:
+		view.Reason = fmt.Sprintf("cronjob %s has not run yet, it runs on the schedule %s", cronJob.Name, cronJob.Spec.Schedule)
+	case lastRun.Status.Succeeded > 0:
+		view.Reason = fmt.Sprintf("last run %s succeeded", lastRun.Name)
+	case lastRun.Status.Failed > 0 || jobFailed(lastRun):
+		status = Failed
+		view.Reason = fmt.Sprintf("last run %s failed", lastRun.Name)
+	default:
+		status = InProgress
+		view.Reason = fmt.Sprintf("last run %s is running", lastRun.Name)
+	}
+	if lastRun != nil {
+		view.Current = lastRun.Status.Active
+	}
+	view.Status = status.String()
+
+	return status, view, nil
+}
+
+func ownedBy(objectMeta k8smeta.ObjectMeta, kind, name string) bool {
+	for _, owner := range objectMeta.OwnerReferences {
+		if owner.Kind == kind && owner.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	k8sbatch "k8s.io/api/batch/v1"
+	k8score "k8s.io/api/core/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func newCronJobManifest() NaisManifest {
+	manifest := newDefaultManifest()
+	manifest.Kind = KindCronJob
+	manifest.Schedule = "0 3 * * *"
+	return manifest
+}
+
+func TestCreateOrUpdateCronJobResources(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+	secretResource := NaisResource{name: "db", resourceType: "credential", properties: map[string]string{}, secret: map[string]string{"password": "secret"}}
+
+	t.Run("a scheduled application gets a cronjob running its pod", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+
+		result, err := createOrUpdateK8sResources(deploymentRequest, newCronJobManifest(), []NaisResource{secretResource}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, result.Deployment)
+		assert.Nil(t, result.Service)
+		assert.NotNil(t, result.Secret)
+
+		cronJob, _ := getExistingCronJob(appName, namespace, clientset)
+		assert.Equal(t, "0 3 * * *", cronJob.Spec.Schedule)
+		assert.Equal(t, version, cronJob.Annotations[VersionAnnotation])
+
+		podSpec := cronJob.Spec.JobTemplate.Spec.Template.Spec
+		assert.Equal(t, k8score.RestartPolicyOnFailure, podSpec.RestartPolicy)
+		assert.Equal(t, image+":"+version, podSpec.Containers[0].Image)
+		assert.Nil(t, podSpec.Containers[0].LivenessProbe)
+		assert.Nil(t, podSpec.Containers[0].ReadinessProbe)
+		assert.Contains(t, podSpec.Containers[0].Env, k8score.EnvVar{Name: "DB_PASSWORD", ValueFrom: &k8score.EnvVarSource{
+			SecretKeyRef: &k8score.SecretKeySelector{LocalObjectReference: k8score.LocalObjectReference{Name: appName}, Key: "db_password"},
+		}})
+	})
+
+	t.Run("a deployment that becomes scheduled has its deployment resources deleted", func(t *testing.T) {
+		clientset := newDeployedClientset(t, []NaisResource{})
+
+		result, err := createOrUpdateK8sResources(deploymentRequest, newCronJobManifest(), []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, []DeletedResource{
+			{Kind: "Ingress", Name: appName},
+			{Kind: "HorizontalPodAutoscaler", Name: appName},
+			{Kind: "Deployment", Name: appName},
+			{Kind: "Service", Name: appName},
+		}, result.Deleted)
+	})
+
+	t.Run("a scheduled application that becomes a deployment has its cronjob deleted", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		createOrUpdateK8sResources(deploymentRequest, newCronJobManifest(), []NaisResource{}, "nais.example.yo", false, clientset)
+
+		result, err := createOrUpdateK8sResources(deploymentRequest, newDefaultManifest(), []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, []DeletedResource{{Kind: "CronJob", Name: appName}}, result.Deleted)
+	})
+}
+
+func TestCronJobStatusAndView(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+	cronJob, err := createCronJobDef([]NaisResource{}, newCronJobManifest(), deploymentRequest, nil)
+	assert.NoError(t, err)
+
+	run := func(name string, created time.Time, status k8sbatch.JobStatus) *k8sbatch.Job {
+		return &k8sbatch.Job{
+			ObjectMeta: k8smeta.ObjectMeta{
+				Name:              name,
+				Namespace:         namespace,
+				Labels:            map[string]string{"app": appName},
+				CreationTimestamp: k8smeta.NewTime(created),
+				OwnerReferences:   []k8smeta.OwnerReference{{Kind: "CronJob", Name: appName}},
+			},
+			Status: status,
+		}
+	}
+	now := time.Now()
+
+	t.Run("a cronjob that has not run yet is deployed", func(t *testing.T) {
+		status, view, err := NewDeploymentStatusViewer(fake.NewSimpleClientset(cronJob)).DeploymentStatusView(namespace, appName)
+		assert.NoError(t, err)
+		assert.Equal(t, Success, status)
+		assert.Equal(t, "cronjob appname has not run yet, it runs on the schedule 0 3 * * *", view.Reason)
+	})
+
+	t.Run("the status is that of the last run", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(
+			cronJob,
+			run("appname-1", now.Add(-2*time.Hour), k8sbatch.JobStatus{Succeeded: 1}),
+			run("appname-2", now.Add(-time.Hour), k8sbatch.JobStatus{Failed: 1}),
+		)
+
+		status, view, err := NewDeploymentStatusViewer(clientset).DeploymentStatusView(namespace, appName)
+		assert.NoError(t, err)
+		assert.Equal(t, Failed, status)
+		assert.Equal(t, "last run appname-2 failed", view.Reason)
+		assert.Equal(t, []string{image + ":" + version}, view.Images)
+	})
+
+	t.Run("jobs not run by the cronjob are left out", func(t *testing.T) {
+		migration := run(appName+migrationSuffix, now, k8sbatch.JobStatus{Failed: 1})
+		migration.OwnerReferences = nil
+		clientset := fake.NewSimpleClientset(cronJob, run("appname-1", now.Add(-time.Hour), k8sbatch.JobStatus{Active: 1}), migration)
+
+		status, view, err := NewDeploymentStatusViewer(clientset).DeploymentStatusView(namespace, appName)
+		assert.NoError(t, err)
+		assert.Equal(t, InProgress, status)
+		assert.Equal(t, int32(1), view.Current)
+	})
+}
@@ -1,8 +1,11 @@
 package api
 
 const (
-	DefaultPortName         = "http"
-	NavTruststoreFasitAlias = "nav_truststore"
+	DefaultPortName                 = "http"
+	NavTruststoreFasitAlias         = "nav_truststore"
+	DeploymentStrategyRollingUpdate = "RollingUpdate"
+	DeploymentStrategyRecreate      = "Recreate"
+	DefaultConfigMapMountPath       = "/var/run/configmaps/naisd.io/"
 )
 
 func DefaultResourceRequests() []ResourceRequest {
@@ -19,8 +22,8 @@ func GetDefaultManifest(application string) NaisManifest {
 
 	defaultManifest := NaisManifest{
 		Replicas: Replicas{
-			Min: 2,
-			Max: 4,
+			Min:                    2,
+			Max:                    4,
 			CpuThresholdPercentage: 50,
 		},
 		Port: 8080,
@@ -60,6 +63,16 @@ func GetDefaultManifest(application string) NaisManifest {
 			},
 		},
 		LeaderElection: false,
+		ConfigMap: ConfigMapConfig{
+			MountPath: DefaultConfigMapMountPath,
+		},
+		Deployment: DeploymentConfig{
+			Strategy:                DeploymentStrategyRollingUpdate,
+			MaxSurge:                "1",
+			MaxUnavailable:          "0",
+			ProgressDeadlineSeconds: 300,
+			RevisionHistoryLimit:    10,
+		},
 	}
 	defaultManifest.Image = "docker.adeo.no:5000/" + application
 
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+	"time"
+)
+
+const (
+	LockHolderAnnotation   = "naisd.io/lock-holder"
+	LockAcquiredAnnotation = "naisd.io/lock-acquired"
+	LockExpiresAnnotation  = "naisd.io/lock-expires"
+	lockTokenAnnotation    = "naisd.io/lock-token"
+	lockConfigMapPrefix    = "naisd-lock."
+	lockLabel              = "naisd.io/deploy-lock"
+)
+
+var (
+	// A lock not renewed for this long is considered abandoned, e.g. by a naisd replica that died during a deploy
+	deployLockTimeout = 30 * time.Minute
+	// The holder renews the lock while it runs, so that migrations, canaries and rollouts can together take longer
+	deployLockRenewInterval = deployLockTimeout / 3
+)
+
+type DeployLock struct {
+	Holder   string
+	Acquired time.Time
+	Expires  time.Time
+}
+
+type deployLockedError struct {
+	namespace   string
+	application string
+	lock        DeployLock
+}
+
+func (e deployLockedError) Error() string {
+	return fmt.Sprintf("%s in namespace %s is being deployed by %s since %s", e.application, e.namespace, e.lock.Holder, e.lock.Acquired.Format(time.RFC3339))
+}
+
+// Serializes deploys of the same application and namespace across naisd replicas
+type DeployLocker interface {
+	// Takes the lock of the application, returning a function that releases it. The lock is renewed until
+	// it is released. Returns a deployLockedError if someone else holds the lock.
+	Lock(namespace, application, holder string) (func(), error)
+	// Returns the lock of the application, or nil if it is free or has expired
+	Get(namespace, application string) (*DeployLock, error)
+}
+
+// Holds each lock as a config map in the namespace naisd runs in. Creating the config map is atomic,
+// so only one replica can take a free lock. An expired lock is taken over by deleting its config map,
+// on the condition that it has the uid seen as expired, and creating a new one. Each holder writes a
+// token of its own, and only deletes the config map on release if it still holds the token.
+type configMapDeployLocker struct {
+	k8sClient kubernetes.Interface
+	namespace string
+}
+
+func NewConfigMapDeployLocker(k8sClient kubernetes.Interface, namespace string) DeployLocker {
+	return configMapDeployLocker{k8sClient: k8sClient, namespace: namespace}
+}
+
+func (l configMapDeployLocker) Lock(namespace, application, holder string) (func(), error) {
+	configMapClient := l.k8sClient.CoreV1().ConfigMaps(l.namespace)
+	name := lockConfigMapPrefix + namespace + "." + application
+
+	token, err := newId()
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate deploy lock token: %s", err)
+	}
+
+	_, err = configMapClient.Create(&k8score.ConfigMap{
+		ObjectMeta: k8smeta.ObjectMeta{
+			Name:        name,
+			Namespace:   l.namespace,
+			Labels:      map[string]string{lockLabel: "true", stateApplicationLabel: application},
+			Annotations: lockAnnotations(holder, token, time.Now()),
+		},
+	})
+
+	if errors.IsAlreadyExists(err) {
+		existing, err := configMapClient.Get(name, k8smeta.GetOptions{})
+		if errors.IsNotFound(err) {
+			return l.Lock(namespace, application, holder)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to get deploy lock: %s", err)
+		}
+
+		lock := deployLockFromAnnotations(existing.Annotations)
+		if time.Now().Before(lock.Expires) {
+			return nil, deployLockedError{namespace: namespace, application: application, lock: lock}
+		}
+
+		glog.Infof("taking over expired deploy lock of %s in %s held by %s since %s", application, namespace, lock.Holder, lock.Acquired)
+
+		// a conflict means another replica took the lock over first
+		uid := existing.UID
+		err = configMapClient.Delete(name, &k8smeta.DeleteOptions{Preconditions: &k8smeta.Preconditions{UID: &uid}})
+		if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			return nil, fmt.Errorf("unable to delete expired deploy lock: %s", err)
+		}
+		return l.Lock(namespace, application, holder)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to take deploy lock: %s", err)
+	}
+
+	done := make(chan struct{})
+	go l.renew(name, token, done)
+
+	return func() {
+		close(done)
+		l.release(name, token)
+	}, nil
+}
+
+func (l configMapDeployLocker) Get(namespace, application string) (*DeployLock, error) {
+	configMap, err := l.k8sClient.CoreV1().ConfigMaps(l.namespace).Get(lockConfigMapPrefix+namespace+"."+application, k8smeta.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+
+	lock := deployLockFromAnnotations(configMap.Annotations)
+	if !time.Now().Before(lock.Expires) {
+		return nil, nil
+	}
+	return &lock, nil
+}
+
+// Moves the expiry of the lock forward until done is closed, or the lock is found to be taken over
+func (l configMapDeployLocker) renew(name, token string, done chan struct{}) {
+	ticker := time.NewTicker(deployLockRenewInterval)
+	defer ticker.Stop()
+
+	configMapClient := l.k8sClient.CoreV1().ConfigMaps(l.namespace)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		configMap, err := configMapClient.Get(name, k8smeta.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			glog.Errorf("unable to renew deploy lock %s: %s", name, err)
+			continue
+		}
+		if errors.IsNotFound(err) || configMap.Annotations[lockTokenAnnotation] != token {
+			glog.Errorf("deploy lock %s was lost while it was held", name)
+			return
+		}
+
+		configMap.Annotations[LockExpiresAnnotation] = time.Now().Add(deployLockTimeout).Format(time.RFC3339)
+		if _, err := configMapClient.Update(configMap); err != nil {
+			glog.Errorf("unable to renew deploy lock %s: %s", name, err)
+		}
+	}
+}
+
+// Deletes the lock if it is still held by the token, and not taken over by another holder after expiring
+func (l configMapDeployLocker) release(name, token string) {
+	configMapClient := l.k8sClient.CoreV1().ConfigMaps(l.namespace)
+
+	configMap, err := configMapClient.Get(name, k8smeta.GetOptions{})
+	if errors.IsNotFound(err) {
+		return
+	}
+	if err != nil {
+		glog.Errorf("unable to release deploy lock %s: %s", name, err)
+		return
+	}
+
+	if configMap.Annotations[lockTokenAnnotation] != token {
+		glog.Infof("not releasing deploy lock %s, which was taken over by %s", name, configMap.Annotations[LockHolderAnnotation])
+		return
+	}
+
+	uid := configMap.UID
+	err = configMapClient.Delete(name, &k8smeta.DeleteOptions{Preconditions: &k8smeta.Preconditions{UID: &uid}})
+	if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+		glog.Errorf("unable to release deploy lock %s: %s", name, err)
+	}
+}
+
+func lockAnnotations(holder, token string, acquired time.Time) map[string]string {
+	return map[string]string{
+		LockHolderAnnotation:   holder,
+		LockAcquiredAnnotation: acquired.Format(time.RFC3339),
+		LockExpiresAnnotation:  acquired.Add(deployLockTimeout).Format(time.RFC3339),
+		lockTokenAnnotation:    token,
+	}
+}
+
+// Unparseable times are treated as zero, making the lock expired
+func deployLockFromAnnotations(annotations map[string]string) DeployLock {
+	acquired, _ := time.Parse(time.RFC3339, annotations[LockAcquiredAnnotation])
+	expires, _ := time.Parse(time.RFC3339, annotations[LockExpiresAnnotation])
+
+	return DeployLock{
+		Holder:   annotations[LockHolderAnnotation],
+		Acquired: acquired,
+		Expires:  expires,
+	}
+}
+
+// Describes who is deploying, for the holder of the deploy lock
+func deployLockHolder(deploymentRequest NaisDeploymentRequest, jobId string) string {
+	user := deploymentRequest.FasitUsername
+	if deploymentRequest.OnBehalfOf != "" {
+		user = deploymentRequest.OnBehalfOf
+	}
+
+	if jobId == "" {
+		return user
+	}
+	return fmt.Sprintf("%s (job %s)", user, jobId)
+}
+
+// Whether the lock was taken for the deploy job with the id, see deployLockHolder
+func heldByJob(lock DeployLock, jobId string) bool {
+	return strings.HasSuffix(lock.Holder, fmt.Sprintf("(job %s)", jobId))
+}
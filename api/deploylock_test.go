@@ -0,0 +1,107 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func TestConfigMapDeployLocker(t *testing.T) {
+	t.Run("A held lock blocks other deploys of the same application", func(t *testing.T) {
+		locker := NewConfigMapDeployLocker(fake.NewSimpleClientset(), "naisd")
+
+		release, err := locker.Lock(namespace, appName, "first")
+		assert.NoError(t, err)
+
+		_, err = locker.Lock(namespace, appName, "second")
+		assert.IsType(t, deployLockedError{}, err)
+		assert.Contains(t, err.Error(), "is being deployed by first since")
+
+		_, err = locker.Lock("othernamespace", appName, "second")
+		assert.NoError(t, err, "locks are per namespace")
+
+		release()
+
+		_, err = locker.Lock(namespace, appName, "second")
+		assert.NoError(t, err, "a released lock can be taken")
+	})
+
+	t.Run("An expired lock is taken over", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		locker := NewConfigMapDeployLocker(clientset, "naisd")
+
+		_, err := locker.Lock(namespace, appName, "abandoned")
+		assert.NoError(t, err)
+
+		configMap, _ := clientset.CoreV1().ConfigMaps("naisd").Get(lockConfigMapPrefix+namespace+"."+appName, k8smeta.GetOptions{})
+		configMap.Annotations = lockAnnotations("abandoned", "", time.Now().Add(-2*deployLockTimeout))
+		clientset.CoreV1().ConfigMaps("naisd").Update(configMap)
+
+		_, err = locker.Lock(namespace, appName, "second")
+		assert.NoError(t, err)
+
+		configMap, _ = clientset.CoreV1().ConfigMaps("naisd").Get(lockConfigMapPrefix+namespace+"."+appName, k8smeta.GetOptions{})
+		assert.Equal(t, "second", configMap.Annotations[LockHolderAnnotation])
+	})
+
+	t.Run("A lock taken over after expiring is not released by the previous holder", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		locker := NewConfigMapDeployLocker(clientset, "naisd")
+		name := lockConfigMapPrefix + namespace + "." + appName
+
+		releaseFirst, err := locker.Lock(namespace, appName, "first")
+		assert.NoError(t, err)
+
+		configMap, _ := clientset.CoreV1().ConfigMaps("naisd").Get(name, k8smeta.GetOptions{})
+		configMap.Annotations[LockExpiresAnnotation] = time.Now().Add(-time.Minute).Format(time.RFC3339)
+		clientset.CoreV1().ConfigMaps("naisd").Update(configMap)
+
+		_, err = locker.Lock(namespace, appName, "second")
+		assert.NoError(t, err)
+
+		releaseFirst()
+
+		configMap, err = clientset.CoreV1().ConfigMaps("naisd").Get(name, k8smeta.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "second", configMap.Annotations[LockHolderAnnotation])
+
+		_, err = locker.Lock(namespace, appName, "third")
+		assert.IsType(t, deployLockedError{}, err)
+	})
+
+	t.Run("A held lock is renewed until it is released", func(t *testing.T) {
+		defer func(interval time.Duration) { deployLockRenewInterval = interval }(deployLockRenewInterval)
+		deployLockRenewInterval = 10 * time.Millisecond
+
+		clientset := fake.NewSimpleClientset()
+		locker := NewConfigMapDeployLocker(clientset, "naisd")
+		name := lockConfigMapPrefix + namespace + "." + appName
+
+		release, err := locker.Lock(namespace, appName, "first")
+		assert.NoError(t, err)
+
+		configMap, _ := clientset.CoreV1().ConfigMaps("naisd").Get(name, k8smeta.GetOptions{})
+		configMap.Annotations[LockExpiresAnnotation] = time.Now().Add(-time.Minute).Format(time.RFC3339)
+		clientset.CoreV1().ConfigMaps("naisd").Update(configMap)
+		time.Sleep(50 * time.Millisecond)
+
+		lock, err := locker.Get(namespace, appName)
+		assert.NoError(t, err)
+		assert.NotNil(t, lock, "the expiry was moved forward")
+
+		release()
+
+		lock, err = locker.Get(namespace, appName)
+		assert.NoError(t, err)
+		assert.Nil(t, lock)
+	})
+}
+
+func TestDeployLockHolder(t *testing.T) {
+	assert.Equal(t, "user (job 42)", deployLockHolder(NaisDeploymentRequest{FasitUsername: "user"}, "42"))
+	assert.Equal(t, "someone", deployLockHolder(NaisDeploymentRequest{FasitUsername: "user", OnBehalfOf: "someone"}, ""))
+	assert.True(t, heldByJob(DeployLock{Holder: "user (job 42)"}, "42"))
+	assert.False(t, heldByJob(DeployLock{Holder: "user (job 142)"}, "42"))
+}
@@ -3,10 +3,10 @@ package api
 import (
 	"fmt"
 	"github.com/golang/glog"
-	"k8s.io/client-go/kubernetes"
 	k8score "k8s.io/api/core/v1"
-	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8sextensions "k8s.io/api/extensions/v1beta1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
 type DeployStatus int
@@ -25,7 +25,7 @@ func (d DeployStatus) String() string {
 }
 
 const (
-	Success    DeployStatus = iota
+	Success DeployStatus = iota
 	InProgress
 	Failed
 )
@@ -45,8 +45,22 @@ func NewDeploymentStatusViewer(clientset kubernetes.Interface) DeploymentStatusV
 }
 
 func (d deploymentStatusViewerImpl) DeploymentStatusView(namespace string, deployName string) (DeployStatus, DeploymentStatusView, error) {
+	// an application deployed blue/green is served by the deployment of its active colour
+	if activeName, err := activeDeploymentName(deployName, namespace, d.client); err == nil {
+		deployName = activeName
+	}
+
 	dep, err := d.client.ExtensionsV1beta1().Deployments(namespace).Get(deployName, k8smeta.GetOptions{})
 	if err != nil {
+		// a stateful application has a statefulset instead of a deployment, and a scheduled one a cronjob
+		if statefulSet, statefulSetErr := getExistingStatefulSet(deployName, namespace, d.client); statefulSetErr == nil && statefulSet != nil {
+			status, view := statefulSetStatusAndView(*statefulSet)
+			return status, view, nil
+		}
+		if cronJob, cronJobErr := getExistingCronJob(deployName, namespace, d.client); cronJobErr == nil && cronJob != nil {
+			return cronJobStatusAndView(*cronJob, d.client)
+		}
+
 		errMess := fmt.Sprintf("did not find deployment: %s in namespace: %s", deployName, namespace)
 		glog.Error(errMess)
 		return Failed, DeploymentStatusView{}, fmt.Errorf("did not find deployment: %s in namespace: %s", deployName, namespace)
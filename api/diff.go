@@ -0,0 +1,606 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	DiffActionCreate    = "create"
+	DiffActionUpdate    = "update"
+	DiffActionDelete    = "delete"
+	DiffActionUnchanged = "unchanged"
+)
+
+type ResourceDiff struct {
+	Kind    string      `json:"kind"`
+	Name    string      `json:"name"`
+	Action  string      `json:"action"`
+	Changes []FieldDiff `json:"changes,omitempty"`
+}
+
+type FieldDiff struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// Compares the objects currently in the cluster with the objects the next deploy would produce.
+// Only fields naisd sets are compared, so values defaulted by the api server are not reported. The workload
+// depends on the kind of the manifest, and objects of the other kinds a previous deploy created are reported
+// as deleted.
+func diffK8sResources(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, resources []NaisResource, clusterSubdomain string, istioEnabled bool, k8sClient kubernetes.Interface) ([]ResourceDiff, error) {
+	application, namespace := deploymentRequest.Application, deploymentRequest.Namespace
+	var diffs []ResourceDiff
+
+	// applications deployed blue/green are compared with the colour receiving traffic
+	deploymentName, err := activeDeploymentName(application, namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get active deployment: %s", err)
+	}
+
+	switch manifest.Kind {
+	case KindCronJob:
+		cronJobDiff, err := diffCronJob(deploymentRequest, manifest, resources, k8sClient)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, cronJobDiff)
+	case KindStatefulSet:
+		statefulSetDiff, err := diffStatefulSet(deploymentRequest, manifest, resources, istioEnabled, k8sClient)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, statefulSetDiff)
+
+		for _, serviceDef := range []*k8score.Service{createServiceDef(application, namespace, manifest), createHeadlessServiceDef(application, namespace, manifest)} {
+			serviceDiff, err := diffService(serviceDef, k8sClient)
+			if err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, serviceDiff)
+		}
+	default:
+		deploymentDiff, err := diffDeployment(deploymentRequest, deploymentName, manifest, resources, istioEnabled, k8sClient)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, deploymentDiff)
+
+		serviceDiff, err := diffService(createServiceDef(application, namespace, manifest), k8sClient)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, serviceDiff)
+	}
+
+	existingSecret, err := getExistingSecret(application, namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing secret: %s", err)
+	}
+	if existingSecret == nil {
+		if secretDef := createSecretDef(resources, nil, application, namespace); secretDef != nil {
+			diffs = append(diffs, ResourceDiff{Kind: "Secret", Name: application, Action: DiffActionCreate})
+		}
+	} else if len(createSecretData(resources)) == 0 && createdByNaisd(existingSecret.ObjectMeta, application) {
+		diffs = append(diffs, ResourceDiff{Kind: "Secret", Name: application, Action: DiffActionDelete})
+	} else {
+		secretDef := createSecretDef(resources, existingSecret.DeepCopy(), application, namespace)
+		diffs = append(diffs, newResourceDiff("Secret", application, diffSecretData(existingSecret.Data, secretDef.Data)))
+	}
+
+	existingConfigMap, err := getExistingConfigMap(application, namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing configmap: %s", err)
+	}
+	configMapDef := createConfigMapDef(manifest, application, namespace)
+	switch {
+	case configMapDef == nil:
+		if existingConfigMap != nil && createdByNaisd(existingConfigMap.ObjectMeta, application) {
+			diffs = append(diffs, ResourceDiff{Kind: "ConfigMap", Name: application, Action: DiffActionDelete})
+		}
+	case existingConfigMap == nil:
+		diffs = append(diffs, ResourceDiff{Kind: "ConfigMap", Name: application, Action: DiffActionCreate})
+	default:
+		diffs = append(diffs, newResourceDiff("ConfigMap", application, diffConfigMapData(existingConfigMap.Data, configMapDef.Data)))
+	}
+
+	existingIngress, err := getExistingIngress(application, namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing ingress: %s", err)
+	}
+	switch {
+	case manifest.Ingress.Disabled || manifest.Kind == KindCronJob:
+		if existingIngress != nil && createdByNaisd(existingIngress.ObjectMeta, application) {
+			diffs = append(diffs, ResourceDiff{Kind: "Ingress", Name: application, Action: DiffActionDelete})
+		}
+	case existingIngress == nil:
+		diffs = append(diffs, ResourceDiff{Kind: "Ingress", Name: application, Action: DiffActionCreate})
+	default:
+		ingressDef := existingIngress.DeepCopy()
+		addIngressRules(ingressDef, deploymentRequest, manifest, clusterSubdomain, resources)
+		if deploymentName != application {
+			setIngressBackend(ingressDef, deploymentName)
+		}
+		changes, err := diffSpecs(existingIngress.Spec, ingressDef.Spec)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, newResourceDiff("Ingress", application, changes))
+	}
+
+	if manifest.Kind != KindCronJob && manifest.Kind != KindStatefulSet {
+		existingAutoscaler, err := getExistingAutoscaler(application, namespace, k8sClient)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get existing autoscaler: %s", err)
+		}
+		if existingAutoscaler == nil {
+			diffs = append(diffs, ResourceDiff{Kind: "HorizontalPodAutoscaler", Name: application, Action: DiffActionCreate})
+		} else {
+			autoscalerDef := createOrUpdateAutoscalerDef(manifest.Replicas, existingAutoscaler.DeepCopy(), application, namespace)
+			autoscalerDef.Spec.ScaleTargetRef.Name = deploymentName
+			changes, err := diffSpecs(existingAutoscaler.Spec, autoscalerDef.Spec)
+			if err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, newResourceDiff("HorizontalPodAutoscaler", application, changes))
+		}
+	}
+
+	existingBudget, err := getExistingPodDisruptionBudget(application, namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing poddisruptionbudget: %s", err)
+	}
+	budgetDef := createPodDisruptionBudgetDef(manifest, application, namespace)
+	switch {
+	case budgetDef == nil:
+		if existingBudget != nil && createdByNaisd(existingBudget.ObjectMeta, application) {
+			diffs = append(diffs, ResourceDiff{Kind: "PodDisruptionBudget", Name: application, Action: DiffActionDelete})
+		}
+	case existingBudget == nil:
+		diffs = append(diffs, ResourceDiff{Kind: "PodDisruptionBudget", Name: application, Action: DiffActionCreate})
+	default:
+		changes, err := diffSpecs(existingBudget.Spec, budgetDef.Spec)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, newResourceDiff("PodDisruptionBudget", application, changes))
+	}
+
+	accessPolicyDiffs, err := diffAccessPolicy(deploymentRequest, manifest, istioEnabled, k8sClient)
+	if err != nil {
+		return nil, err
+	}
+	diffs = append(diffs, accessPolicyDiffs...)
+
+	for _, remove := range removedWorkloadResources(manifest, application) {
+		removed, err := diffRemoved(remove.kind, remove.name, application, namespace, k8sClient)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, removed...)
+	}
+
+	return diffs, nil
+}
+
+// The deployment of a colour is compared as deployBlueGreen would create the next one
+func diffDeployment(deploymentRequest NaisDeploymentRequest, name string, manifest NaisManifest, resources []NaisResource, istioEnabled bool, k8sClient kubernetes.Interface) (ResourceDiff, error) {
+	existingDeployment, err := getExistingDeployment(name, deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return ResourceDiff{}, fmt.Errorf("unable to get existing deployment: %s", err)
+	}
+	if existingDeployment == nil {
+		return ResourceDiff{Kind: "Deployment", Name: name, Action: DiffActionCreate}, nil
+	}
+
+	deploymentDef, err := createDeploymentDef(resources, manifest, deploymentRequest, existingDeployment.DeepCopy(), istioEnabled)
+	if err != nil {
+		return ResourceDiff{}, fmt.Errorf("unable to create deployment: %s", err)
+	}
+	if colour := existingDeployment.Labels[ColourLabel]; colour != "" {
+		deploymentDef.Spec.Replicas = int32p(colourReplicas(manifest, existingDeployment))
+		setColour(deploymentDef, deploymentRequest.Application, colour)
+	}
+	changes, err := diffSpecs(existingDeployment.Spec, deploymentDef.Spec)
+	if err != nil {
+		return ResourceDiff{}, err
+	}
+	return newResourceDiff("Deployment", name, changes), nil
+}
+
+func diffStatefulSet(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, resources []NaisResource, istioEnabled bool, k8sClient kubernetes.Interface) (ResourceDiff, error) {
+	application := deploymentRequest.Application
+	existingStatefulSet, err := getExistingStatefulSet(application, deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return ResourceDiff{}, fmt.Errorf("unable to get existing statefulset: %s", err)
+	}
+	if existingStatefulSet == nil {
+		return ResourceDiff{Kind: "StatefulSet", Name: application, Action: DiffActionCreate}, nil
+	}
+
+	statefulSetDef, err := createStatefulSetDef(resources, manifest, deploymentRequest, existingStatefulSet.DeepCopy(), istioEnabled)
+	if err != nil {
+		return ResourceDiff{}, fmt.Errorf("unable to create statefulset: %s", err)
+	}
+	changes, err := diffSpecs(existingStatefulSet.Spec, statefulSetDef.Spec)
+	if err != nil {
+		return ResourceDiff{}, err
+	}
+	return newResourceDiff("StatefulSet", application, changes), nil
+}
+
+// Deploys only update the ports of an existing service, see createService
+func diffService(serviceDef *k8score.Service, k8sClient kubernetes.Interface) (ResourceDiff, error) {
+	existingService, err := getExistingService(serviceDef.Name, serviceDef.Namespace, k8sClient)
+	if err != nil {
+		return ResourceDiff{}, fmt.Errorf("unable to get existing service: %s", err)
+	}
+	if existingService == nil {
+		return ResourceDiff{Kind: "Service", Name: serviceDef.Name, Action: DiffActionCreate}, nil
+	}
+
+	existingPorts, err := toGenericValue(existingService.Spec.Ports)
+	if err != nil {
+		return ResourceDiff{}, err
+	}
+	desiredPorts, err := toGenericValue(serviceDef.Spec.Ports)
+	if err != nil {
+		return ResourceDiff{}, err
+	}
+	return newResourceDiff("Service", serviceDef.Name, diffValues("spec.ports", existingPorts, desiredPorts)), nil
+}
+
+func diffCronJob(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, resources []NaisResource, k8sClient kubernetes.Interface) (ResourceDiff, error) {
+	application := deploymentRequest.Application
+	existingCronJob, err := getExistingCronJob(application, deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return ResourceDiff{}, fmt.Errorf("unable to get existing cronjob: %s", err)
+	}
+	if existingCronJob == nil {
+		return ResourceDiff{Kind: "CronJob", Name: application, Action: DiffActionCreate}, nil
+	}
+
+	cronJobDef, err := createCronJobDef(resources, manifest, deploymentRequest, existingCronJob.DeepCopy())
+	if err != nil {
+		return ResourceDiff{}, fmt.Errorf("unable to create cronjob: %s", err)
+	}
+	changes, err := diffSpecs(existingCronJob.Spec, cronJobDef.Spec)
+	if err != nil {
+		return ResourceDiff{}, err
+	}
+	return newResourceDiff("CronJob", application, changes), nil
+}
+
+// Compares the network policy, and on clusters running istio the service account and authorization rules, with
+// the ones createOrUpdateAccessPolicy would apply. Like a deploy, the service account is never reported as deleted.
+func diffAccessPolicy(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, istioEnabled bool, k8sClient kubernetes.Interface) ([]ResourceDiff, error) {
+	application, namespace := deploymentRequest.Application, deploymentRequest.Namespace
+	var diffs []ResourceDiff
+
+	// the pods of a cronjob receive no calls, so they get no istio authorization rules
+	if manifest.Kind == KindCronJob {
+		istioEnabled = false
+	}
+
+	existingPolicy, err := getExistingNetworkPolicy(application, namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing networkpolicy: %s", err)
+	}
+	policyDef := createNetworkPolicyDef(manifest, application, namespace, istioEnabled)
+	switch {
+	case policyDef == nil:
+		if existingPolicy != nil && createdByNaisd(existingPolicy.ObjectMeta, application) {
+			diffs = append(diffs, ResourceDiff{Kind: "NetworkPolicy", Name: application, Action: DiffActionDelete})
+		}
+	case existingPolicy == nil:
+		diffs = append(diffs, ResourceDiff{Kind: "NetworkPolicy", Name: application, Action: DiffActionCreate})
+	default:
+		changes, err := diffSpecs(existingPolicy.Spec, policyDef.Spec)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, newResourceDiff("NetworkPolicy", application, changes))
+	}
+
+	if !istioEnabled {
+		return diffs, nil
+	}
+
+	if istioRulesEnabled(manifest, istioEnabled) {
+		_, err := k8sClient.CoreV1().ServiceAccounts(namespace).Get(application, k8smeta.GetOptions{})
+		switch {
+		case err == nil:
+			diffs = append(diffs, ResourceDiff{Kind: "ServiceAccount", Name: application, Action: DiffActionUnchanged})
+		case errors.IsNotFound(err):
+			diffs = append(diffs, ResourceDiff{Kind: "ServiceAccount", Name: application, Action: DiffActionCreate})
+		default:
+			return nil, fmt.Errorf("unable to get existing service account: %s", err)
+		}
+	}
+
+	rules := []*istioObject{createServiceRoleDef(manifest, application, namespace), createServiceRoleBindingDef(manifest, application, namespace)}
+	for _, ruleDef := range rules {
+		ruleDiff, err := diffIstioRule(ruleDef, istioRulesEnabled(manifest, istioEnabled), k8sClient.Discovery().RESTClient())
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, ruleDiff...)
+	}
+
+	return diffs, nil
+}
+
+// Rules that are no longer enabled are reported as deleted, see deleteIstioRules
+func diffIstioRule(ruleDef *istioObject, enabled bool, restClient rest.Interface) ([]ResourceDiff, error) {
+	resource := strings.ToLower(ruleDef.Kind) + "s"
+	existingRule, err := getExistingIstioObject(restClient, resource, ruleDef.Name, ruleDef.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing %s: %s", strings.ToLower(ruleDef.Kind), err)
+	}
+
+	switch {
+	case !enabled:
+		if existingRule != nil {
+			return []ResourceDiff{{Kind: ruleDef.Kind, Name: ruleDef.Name, Action: DiffActionDelete}}, nil
+		}
+		return nil, nil
+	case existingRule == nil:
+		return []ResourceDiff{{Kind: ruleDef.Kind, Name: ruleDef.Name, Action: DiffActionCreate}}, nil
+	default:
+		changes, err := diffSpecs(existingRule.Spec, ruleDef.Spec)
+		if err != nil {
+			return nil, err
+		}
+		return []ResourceDiff{newResourceDiff(ruleDef.Kind, ruleDef.Name, changes)}, nil
+	}
+}
+
+// Reports the object as deleted if naisd created it, as the garbage collection of the deploy will delete it
+func diffRemoved(kind, name, application, namespace string, k8sClient kubernetes.Interface) ([]ResourceDiff, error) {
+	objectMeta, err := getExistingObjectMeta(kind, name, namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing %s: %s", strings.ToLower(kind), err)
+	}
+	if objectMeta == nil || !createdByNaisd(*objectMeta, application) {
+		return nil, nil
+	}
+	return []ResourceDiff{{Kind: kind, Name: name, Action: DiffActionDelete}}, nil
+}
+
+// Returns nil if there is no object of the kind with the name
+func getExistingObjectMeta(kind, name, namespace string, k8sClient kubernetes.Interface) (*k8smeta.ObjectMeta, error) {
+	switch kind {
+	case "Deployment":
+		deployment, err := getExistingDeployment(name, namespace, k8sClient)
+		if err != nil || deployment == nil {
+			return nil, err
+		}
+		return &deployment.ObjectMeta, nil
+	case "StatefulSet":
+		statefulSet, err := getExistingStatefulSet(name, namespace, k8sClient)
+		if err != nil || statefulSet == nil {
+			return nil, err
+		}
+		return &statefulSet.ObjectMeta, nil
+	case "CronJob":
+		cronJob, err := getExistingCronJob(name, namespace, k8sClient)
+		if err != nil || cronJob == nil {
+			return nil, err
+		}
+		return &cronJob.ObjectMeta, nil
+	case "Service":
+		service, err := getExistingService(name, namespace, k8sClient)
+		if err != nil || service == nil {
+			return nil, err
+		}
+		return &service.ObjectMeta, nil
+	case "HorizontalPodAutoscaler":
+		autoscaler, err := getExistingAutoscaler(name, namespace, k8sClient)
+		if err != nil || autoscaler == nil {
+			return nil, err
+		}
+		return &autoscaler.ObjectMeta, nil
+	default:
+		return nil, fmt.Errorf("unknown kind %s", kind)
+	}
+}
+
+func newResourceDiff(kind, name string, changes []FieldDiff) ResourceDiff {
+	action := DiffActionUpdate
+	if len(changes) == 0 {
+		action = DiffActionUnchanged
+	}
+	return ResourceDiff{Kind: kind, Name: name, Action: action, Changes: changes}
+}
+
+// Secret values are never exposed, a changed key is reported with redacted old and new values
+func diffSecretData(existing, desired map[string][]byte) []FieldDiff {
+	var changes []FieldDiff
+
+	for _, key := range sortedKeys(desired) {
+		existingValue, found := existing[key]
+		switch {
+		case !found:
+			changes = append(changes, FieldDiff{Path: "data." + key, Old: nil, New: RedactedValue})
+		case string(existingValue) != string(desired[key]):
+			changes = append(changes, FieldDiff{Path: "data." + key, Old: RedactedValue, New: RedactedValue})
+		}
+	}
+
+	for _, key := range sortedKeys(existing) {
+		if _, found := desired[key]; !found {
+			changes = append(changes, FieldDiff{Path: "data." + key, Old: RedactedValue, New: nil})
+		}
+	}
+
+	return changes
+}
+
+// Like diffSecretData, but the content of the files is shown
+func diffConfigMapData(existing, desired map[string]string) []FieldDiff {
+	var changes []FieldDiff
+
+	for _, name := range sortedKeys(desired) {
+		existingContent, found := existing[name]
+		switch {
+		case !found:
+			changes = append(changes, FieldDiff{Path: "data." + name, Old: nil, New: desired[name]})
+		case existingContent != desired[name]:
+			changes = append(changes, FieldDiff{Path: "data." + name, Old: existingContent, New: desired[name]})
+		}
+	}
+
+	for _, name := range sortedKeys(existing) {
+		if _, found := desired[name]; !found {
+			changes = append(changes, FieldDiff{Path: "data." + name, Old: existing[name], New: nil})
+		}
+	}
+
+	return changes
+}
+
+func diffSpecs(existing, desired interface{}) ([]FieldDiff, error) {
+	existingValue, err := toGenericValue(existing)
+	if err != nil {
+		return nil, err
+	}
+	desiredValue, err := toGenericValue(desired)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffValues("spec", existingValue, desiredValue), nil
+}
+
+func toGenericValue(object interface{}) (interface{}, error) {
+	b, err := json.Marshal(object)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal %T: %s", object, err)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal %T: %s", object, err)
+	}
+	return value, nil
+}
+
+// Walks the desired value and reports every field that differs from the existing value.
+// Lists where every element has a name are matched by name instead of by index.
+func diffValues(path string, existing, desired interface{}) []FieldDiff {
+	if isEmpty(desired) && isEmpty(existing) {
+		return nil
+	}
+
+	if existing == nil && desired != nil {
+		return []FieldDiff{{Path: path, Old: nil, New: desired}}
+	}
+
+	switch desiredValue := desired.(type) {
+	case map[string]interface{}:
+		existingMap, ok := existing.(map[string]interface{})
+		if !ok {
+			return []FieldDiff{{Path: path, Old: existing, New: desired}}
+		}
+
+		var diffs []FieldDiff
+		for _, key := range sortedKeys(desiredValue) {
+			diffs = append(diffs, diffValues(path+"."+key, existingMap[key], desiredValue[key])...)
+		}
+		return diffs
+	case []interface{}:
+		existingList, ok := existing.([]interface{})
+		if !ok {
+			return []FieldDiff{{Path: path, Old: existing, New: desired}}
+		}
+		return diffLists(path, existingList, desiredValue)
+	default:
+		if desired == nil || reflect.DeepEqual(existing, desired) {
+			return nil
+		}
+		return []FieldDiff{{Path: path, Old: existing, New: desired}}
+	}
+}
+
+func diffLists(path string, existing, desired []interface{}) []FieldDiff {
+	var diffs []FieldDiff
+
+	existingByName, existingNamed := namedElements(existing)
+	desiredByName, desiredNamed := namedElements(desired)
+
+	if existingNamed && desiredNamed {
+		for _, element := range desired {
+			name := element.(map[string]interface{})["name"].(string)
+			diffs = append(diffs, diffValues(fmt.Sprintf("%s[%s]", path, name), existingByName[name], element)...)
+		}
+		for _, element := range existing {
+			name := element.(map[string]interface{})["name"].(string)
+			if _, found := desiredByName[name]; !found {
+				diffs = append(diffs, FieldDiff{Path: fmt.Sprintf("%s[%s]", path, name), Old: element, New: nil})
+			}
+		}
+		return diffs
+	}
+
+	for i, element := range desired {
+		var existingElement interface{}
+		if i < len(existing) {
+			existingElement = existing[i]
+		}
+		diffs = append(diffs, diffValues(fmt.Sprintf("%s[%d]", path, i), existingElement, element)...)
+	}
+	for i := len(desired); i < len(existing); i++ {
+		diffs = append(diffs, FieldDiff{Path: fmt.Sprintf("%s[%d]", path, i), Old: existing[i], New: nil})
+	}
+
+	return diffs
+}
+
+func namedElements(list []interface{}) (map[string]interface{}, bool) {
+	byName := make(map[string]interface{})
+
+	for _, element := range list {
+		object, ok := element.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, ok := object["name"].(string)
+		if !ok {
+			return nil, false
+		}
+		byName[name] = element
+	}
+
+	return byName, true
+}
+
+func isEmpty(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	default:
+		return false
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestDiffValues(t *testing.T) {
+	t.Run("fields only present in the existing value are ignored", func(t *testing.T) {
+		existing := map[string]interface{}{"a": "1", "defaulted": "x"}
+		desired := map[string]interface{}{"a": "1"}
+
+		assert.Empty(t, diffValues("spec", existing, desired))
+	})
+
+	t.Run("changed and added fields are reported", func(t *testing.T) {
+		existing := map[string]interface{}{"a": "1"}
+		desired := map[string]interface{}{"a": "2", "b": "3"}
+
+		diffs := diffValues("spec", existing, desired)
+
+		assert.Equal(t, []FieldDiff{{"spec.a", "1", "2"}, {"spec.b", nil, "3"}}, diffs)
+	})
+
+	t.Run("named list elements are matched by name", func(t *testing.T) {
+		existing := []interface{}{
+			map[string]interface{}{"name": "A", "value": "1"},
+			map[string]interface{}{"name": "B", "value": "2"},
+		}
+		desired := []interface{}{
+			map[string]interface{}{"name": "B", "value": "3"},
+			map[string]interface{}{"name": "C", "value": "4"},
+		}
+
+		diffs := diffValues("env", existing, desired)
+
+		assert.Len(t, diffs, 3)
+		assert.Equal(t, FieldDiff{"env[B].value", "2", "3"}, diffs[0])
+		assert.Equal(t, "env[C]", diffs[1].Path)
+		assert.Nil(t, diffs[1].Old)
+		assert.Equal(t, "env[A]", diffs[2].Path)
+		assert.Nil(t, diffs[2].New)
+	})
+
+	t.Run("empty values are considered equal to missing values", func(t *testing.T) {
+		existing := map[string]interface{}{}
+		desired := map[string]interface{}{"lifecycle": map[string]interface{}{}}
+
+		assert.Empty(t, diffValues("spec", existing, desired))
+	})
+}
+
+func TestDiffSecretData(t *testing.T) {
+	existing := map[string][]byte{"same": []byte("1"), "changed": []byte("2"), "removed": []byte("3")}
+	desired := map[string][]byte{"same": []byte("1"), "changed": []byte("4"), "added": []byte("5")}
+
+	diffs := diffSecretData(existing, desired)
+
+	assert.Equal(t, []FieldDiff{
+		{"data.added", nil, RedactedValue},
+		{"data.changed", RedactedValue, RedactedValue},
+		{"data.removed", RedactedValue, nil},
+	}, diffs)
+}
+
+func TestDiffK8sResources(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{
+		Application: appName,
+		Version:     version,
+		Namespace:   namespace,
+	}
+	manifest := newDefaultManifest()
+
+	t.Run("everything is created in an empty cluster", func(t *testing.T) {
+		diffs, err := diffK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, fake.NewSimpleClientset())
+		assert.NoError(t, err)
+
+		for _, diff := range diffs {
+			assert.Equal(t, DiffActionCreate, diff.Action, diff.Kind)
+		}
+		assert.Len(t, diffs, 4, "no secret is created without secret resources")
+	})
+
+	t.Run("redeploying the same version gives no changes", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		_, err := createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		diffs, err := diffK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		for _, diff := range diffs {
+			assert.Equal(t, DiffActionUnchanged, diff.Action, diff.Kind)
+		}
+	})
+
+	t.Run("a new version is reported as a changed image", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		_, err := createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		newRequest := deploymentRequest
+		newRequest.Version = "14"
+		diffs, err := diffK8sResources(newRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "Deployment", diffs[0].Kind)
+		assert.Equal(t, DiffActionUpdate, diffs[0].Action)
+		assert.Contains(t, diffs[0].Changes, FieldDiff{"spec.template.spec.containers[appname].image", image + ":" + version, image + ":14"})
+		assert.Contains(t, diffs[0].Changes, FieldDiff{"spec.template.spec.containers[appname].env[APP_VERSION].value", version, "14"})
+	})
+
+	t.Run("a disabled ingress is reported as deleted", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		_, err := createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		disabledIngress := manifest
+		disabledIngress.Ingress.Disabled = true
+		diffs, err := diffK8sResources(deploymentRequest, disabledIngress, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		assert.Contains(t, diffs, ResourceDiff{Kind: "Ingress", Name: appName, Action: DiffActionDelete})
+	})
+
+	t.Run("the poddisruptionbudget is created, updated and deleted with the minimum replicas", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		replicated := manifest
+		replicated.Replicas.Min = 3
+
+		diffs, err := diffK8sResources(deploymentRequest, replicated, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Contains(t, diffs, ResourceDiff{Kind: "PodDisruptionBudget", Name: appName, Action: DiffActionCreate})
+
+		_, err = createOrUpdateK8sResources(deploymentRequest, replicated, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		replicated.Replicas.Min = 4
+		diffs, err = diffK8sResources(deploymentRequest, replicated, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Contains(t, diffs, ResourceDiff{Kind: "PodDisruptionBudget", Name: appName, Action: DiffActionUpdate, Changes: []FieldDiff{{"spec.minAvailable", float64(2), float64(3)}}})
+
+		replicated.PodDisruptionBudget.Disabled = true
+		diffs, err = diffK8sResources(deploymentRequest, replicated, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Contains(t, diffs, ResourceDiff{Kind: "PodDisruptionBudget", Name: appName, Action: DiffActionDelete})
+	})
+
+	t.Run("the networkpolicy is created, updated and deleted with the access policy", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		restricted := manifest
+		restricted.AccessPolicy.Inbound = []AccessRule{{Application: "caller"}}
+
+		diffs, err := diffK8sResources(deploymentRequest, restricted, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Contains(t, diffs, ResourceDiff{Kind: "NetworkPolicy", Name: appName, Action: DiffActionCreate})
+
+		_, err = createOrUpdateK8sResources(deploymentRequest, restricted, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		diffs, err = diffK8sResources(deploymentRequest, restricted, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Contains(t, diffs, ResourceDiff{Kind: "NetworkPolicy", Name: appName, Action: DiffActionUnchanged})
+
+		restricted.AccessPolicy.Inbound = []AccessRule{{Application: "other-caller"}}
+		diffs, err = diffK8sResources(deploymentRequest, restricted, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Contains(t, diffs, ResourceDiff{Kind: "NetworkPolicy", Name: appName, Action: DiffActionUpdate, Changes: []FieldDiff{{"spec.ingress[0].from[0].podSelector.matchLabels.app", "caller", "other-caller"}}})
+
+		diffs, err = diffK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Contains(t, diffs, ResourceDiff{Kind: "NetworkPolicy", Name: appName, Action: DiffActionDelete})
+	})
+
+	t.Run("a scheduled application diffs its cronjob and deletes the deployment", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		_, err := createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		scheduled := manifest
+		scheduled.Kind = KindCronJob
+		scheduled.Schedule = "0 3 * * *"
+		diffs, err := diffK8sResources(deploymentRequest, scheduled, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		assert.Equal(t, ResourceDiff{Kind: "CronJob", Name: appName, Action: DiffActionCreate}, diffs[0])
+		for _, kind := range []string{"Deployment", "Service", "Ingress", "HorizontalPodAutoscaler"} {
+			assert.Contains(t, diffs, ResourceDiff{Kind: kind, Name: appName, Action: DiffActionDelete})
+		}
+
+		_, err = createOrUpdateK8sResources(deploymentRequest, scheduled, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		diffs, err = diffK8sResources(deploymentRequest, scheduled, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		for _, diff := range diffs {
+			assert.Equal(t, DiffActionUnchanged, diff.Action, diff.Kind)
+		}
+	})
+
+	t.Run("a stateful application diffs its statefulset and services and deletes the deployment", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		_, err := createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		stateful := manifest
+		stateful.Kind = KindStatefulSet
+		diffs, err := diffK8sResources(deploymentRequest, stateful, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		assert.Equal(t, ResourceDiff{Kind: "StatefulSet", Name: appName, Action: DiffActionCreate}, diffs[0])
+		assert.Equal(t, ResourceDiff{Kind: "Service", Name: appName, Action: DiffActionUnchanged}, diffs[1])
+		assert.Equal(t, ResourceDiff{Kind: "Service", Name: headlessServiceName(appName), Action: DiffActionCreate}, diffs[2])
+		assert.Contains(t, diffs, ResourceDiff{Kind: "Deployment", Name: appName, Action: DiffActionDelete})
+		assert.Contains(t, diffs, ResourceDiff{Kind: "HorizontalPodAutoscaler", Name: appName, Action: DiffActionDelete})
+
+		_, err = createOrUpdateK8sResources(deploymentRequest, stateful, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		diffs, err = diffK8sResources(deploymentRequest, stateful, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		for _, diff := range diffs {
+			assert.Equal(t, DiffActionUnchanged, diff.Action, diff.Kind)
+		}
+	})
+
+	t.Run("a blue/green application is compared with the colour receiving traffic", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		blueGreen := manifest
+		blueGreen.Strategy.BlueGreen = BlueGreenStrategy{Enabled: true}
+		_, err := newBlueGreenApi(clientset, Success).deployBlueGreen(deploymentRequest, blueGreen, []NaisResource{}, nil)
+		assert.NoError(t, err)
+
+		diffs, err := diffK8sResources(deploymentRequest, blueGreen, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, appName+"-blue", diffs[0].Name)
+		for _, diff := range diffs {
+			assert.Equal(t, DiffActionUnchanged, diff.Action, diff.Kind)
+		}
+
+		newRequest := deploymentRequest
+		newRequest.Version = "14"
+		diffs, err = diffK8sResources(newRequest, blueGreen, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, DiffActionUpdate, diffs[0].Action)
+		assert.Contains(t, diffs[0].Changes, FieldDiff{"spec.template.spec.containers[appname].image", image + ":" + version, image + ":14"})
+	})
+}
@@ -0,0 +1,392 @@
+package api
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	k8score "k8s.io/api/core/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+const (
+	DriftModeOff     = "off"
+	DriftModeReport  = "report"
+	DriftModeEnforce = "enforce"
+	driftLockHolder  = "drift reconciler"
+)
+
+var (
+	drift = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "drift", Help: "fields of k8s-resources that differ from the last deploy, 1 if the resource is missing or should be deleted"}, []string{"nais_app", "namespace", "kind"},
+	)
+	driftCorrections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "drift_corrections", Help: "k8s-resources restored to the last deploy by the drift reconciler"}, []string{"nais_app", "namespace", "kind"},
+	)
+)
+
+// The kinds the drift gauge is set for, by the application, so the gauges of an undeployed application are deleted
+var driftGaugeKinds = map[driftApplication]map[string]bool{}
+
+type driftApplication struct {
+	name      string
+	namespace string
+}
+
+func init() {
+	prometheus.MustRegister(drift)
+	prometheus.MustRegister(driftCorrections)
+}
+
+// Periodically compares the k8s-resources of every application with the objects its last deploy produced.
+// The deploy is recreated from the annotations naisd records on the deployment, statefulset or cronjob of the
+// application. In report mode drift is only logged and exposed as metrics, in enforce mode the drifted resources
+// are also restored.
+type DriftReconciler struct {
+	Api           Api
+	Mode          string
+	FasitUsername string
+	FasitPassword string
+	Interval      time.Duration
+}
+
+func ValidDriftMode(mode string) bool {
+	return mode == DriftModeOff || mode == DriftModeReport || mode == DriftModeEnforce
+}
+
+func (r DriftReconciler) Run(stop <-chan struct{}) {
+	glog.Infof("starting drift reconciler in %s mode, reconciling every %s", r.Mode, r.Interval)
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.reconcileAll()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// The object an application runs as, which naisd records the last deploy on
+type driftWorkload struct {
+	objectMeta k8smeta.ObjectMeta
+	containers []k8score.Container
+}
+
+func (r DriftReconciler) reconcileAll() {
+	workloads, err := r.listWorkloads()
+	if err != nil {
+		glog.Errorf("unable to list workloads: %s", err)
+		return
+	}
+
+	deployed := make(map[driftApplication]bool)
+	for _, workload := range workloads {
+		deployed[driftApplication{workload.objectMeta.Name, workload.objectMeta.Namespace}] = true
+
+		if err := r.reconcile(workload); err != nil {
+			glog.Errorf("unable to reconcile drift of %s in %s: %s", workload.objectMeta.Name, workload.objectMeta.Namespace, err)
+		}
+	}
+
+	for application := range driftGaugeKinds {
+		if !deployed[application] {
+			setDriftGaugeKinds(application, nil)
+		}
+	}
+}
+
+// Deletes the drift gauges of the application for kinds no longer compared, and remembers the kinds that are
+func setDriftGaugeKinds(application driftApplication, kinds map[string]bool) {
+	for kind := range driftGaugeKinds[application] {
+		if !kinds[kind] {
+			drift.DeleteLabelValues(application.name, application.namespace, kind)
+		}
+	}
+
+	if len(kinds) == 0 {
+		delete(driftGaugeKinds, application)
+		return
+	}
+	driftGaugeKinds[application] = kinds
+}
+
+// Lists the deployments, statefulsets and cronjobs with a recorded deploy. Objects not made by naisd, or made before
+// the manifest was recorded, have no known desired state. The colours of blue/green deploys are switched between by
+// naisd, and are skipped as the last deploy is compared with the deployment named after the application.
+func (r DriftReconciler) listWorkloads() ([]driftWorkload, error) {
+	options := k8smeta.ListOptions{LabelSelector: "app"}
+	var workloads []driftWorkload
+
+	deployments, err := r.Api.Clientset.ExtensionsV1beta1().Deployments("").List(options)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list deployments: %s", err)
+	}
+	for _, deployment := range deployments.Items {
+		if _, ok := deployment.Annotations[ManifestAnnotation]; !ok {
+			continue
+		}
+		if deployment.Labels[ColourLabel] != "" || deployment.Annotations[KeepUntilAnnotation] != "" {
+			glog.V(2).Infof("skipping drift of blue/green deployment %s in %s", deployment.Name, deployment.Namespace)
+			continue
+		}
+		workloads = append(workloads, driftWorkload{deployment.ObjectMeta, deployment.Spec.Template.Spec.Containers})
+	}
+
+	statefulSets, err := r.Api.Clientset.AppsV1().StatefulSets("").List(options)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list statefulsets: %s", err)
+	}
+	for _, statefulSet := range statefulSets.Items {
+		if _, ok := statefulSet.Annotations[ManifestAnnotation]; ok {
+			workloads = append(workloads, driftWorkload{statefulSet.ObjectMeta, statefulSet.Spec.Template.Spec.Containers})
+		}
+	}
+
+	cronJobs, err := r.Api.Clientset.BatchV1beta1().CronJobs("").List(options)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list cronjobs: %s", err)
+	}
+	for _, cronJob := range cronJobs.Items {
+		if _, ok := cronJob.Annotations[ManifestAnnotation]; ok {
+			workloads = append(workloads, driftWorkload{cronJob.ObjectMeta, cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers})
+		}
+	}
+
+	return workloads, nil
+}
+
+func (r DriftReconciler) reconcile(workload driftWorkload) error {
+	deploymentRequest, manifest, naisResources, err := r.lastDeploy(workload)
+	if err != nil {
+		return err
+	}
+
+	diffs, err := diffDrift(deploymentRequest, manifest, naisResources, r.Api.ClusterSubdomain, r.Api.IstioEnabled, r.Api.Clientset)
+	if err != nil {
+		return err
+	}
+
+	var drifted []ResourceDiff
+	kinds := make(map[string]bool)
+	for _, diff := range diffs {
+		fields := len(diff.Changes)
+		if diff.Action == DiffActionCreate || diff.Action == DiffActionDelete {
+			fields = 1
+		}
+		drift.With(driftLabels(deploymentRequest, diff.Kind)).Set(float64(fields))
+		kinds[diff.Kind] = true
+
+		if diff.Action != DiffActionUnchanged {
+			glog.Infof("%s %s in %s has drifted from the last deploy: %s", diff.Kind, diff.Name, deploymentRequest.Namespace, describeDrift(diff))
+			drifted = append(drifted, diff)
+		}
+	}
+	setDriftGaugeKinds(driftApplication{deploymentRequest.Application, deploymentRequest.Namespace}, kinds)
+
+	if len(drifted) == 0 || r.Mode != DriftModeEnforce {
+		return nil
+	}
+
+	release, err := r.Api.DeployLocker.Lock(deploymentRequest.Namespace, deploymentRequest.Application, driftLockHolder)
+	if err != nil {
+		if _, ok := err.(deployLockedError); ok {
+			glog.Infof("not correcting drift of %s in %s: %s", deploymentRequest.Application, deploymentRequest.Namespace, err)
+			return nil
+		}
+		return err
+	}
+	defer release()
+
+	for _, diff := range drifted {
+		if err := correctDrift(diff, deploymentRequest, manifest, naisResources, r.Api.ClusterSubdomain, r.Api.IstioEnabled, r.Api.Clientset); err != nil {
+			return fmt.Errorf("unable to correct drift of %s: %s", diff.Kind, err)
+		}
+
+		glog.Infof("restored %s %s in %s to the last deploy", diff.Kind, diff.Name, deploymentRequest.Namespace)
+		driftCorrections.With(driftLabels(deploymentRequest, diff.Kind)).Inc()
+		drift.With(driftLabels(deploymentRequest, diff.Kind)).Set(0)
+	}
+
+	return nil
+}
+
+// Recreates the deploy that produced the workload, fetching its Fasit resources again
+func (r DriftReconciler) lastDeploy(workload driftWorkload) (NaisDeploymentRequest, NaisManifest, []NaisResource, error) {
+	objectMeta := workload.objectMeta
+	deploymentRequest := recordedDeploymentRequest(objectMeta.Name, objectMeta.Namespace, objectMeta.Annotations, workload.containers)
+	deploymentRequest.FasitUsername = r.FasitUsername
+	deploymentRequest.FasitPassword = r.FasitPassword
+
+	manifest, err := recordedManifest(objectMeta.Annotations)
+	if err != nil {
+		return NaisDeploymentRequest{}, NaisManifest{}, nil, err
+	}
+
+	fasit := FasitClient{r.Api.FasitUrl, deploymentRequest.FasitUsername, deploymentRequest.FasitPassword}
+	naisResources, err := FetchFasitResources(fasit, deploymentRequest.Application, deploymentRequest.FasitEnvironment, deploymentRequest.Zone, manifest.FasitResources.Used)
+	if err != nil {
+		return NaisDeploymentRequest{}, NaisManifest{}, nil, fmt.Errorf("unable to fetch fasit resources: %s", err)
+	}
+
+	return deploymentRequest, *manifest, naisResources, nil
+}
+
+// Compares the k8s-resources with the objects of the deploy, like diffK8sResources. The replicas of the
+// deployment are left to the autoscaler and not compared, while the whole spec of the services is compared
+// even though deploys only update their ports.
+func diffDrift(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, resources []NaisResource, clusterSubdomain string, istioEnabled bool, k8sClient kubernetes.Interface) ([]ResourceDiff, error) {
+	diffs, err := diffK8sResources(deploymentRequest, manifest, resources, clusterSubdomain, istioEnabled, k8sClient)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, diff := range diffs {
+		switch {
+		case diff.Kind == "Deployment" && diff.Action == DiffActionUpdate:
+			var changes []FieldDiff
+			for _, change := range diff.Changes {
+				if change.Path != "spec.replicas" {
+					changes = append(changes, change)
+				}
+			}
+			diffs[i] = newResourceDiff(diff.Kind, diff.Name, changes)
+		case diff.Kind == "Service" && (diff.Action == DiffActionUnchanged || diff.Action == DiffActionUpdate):
+			existingService, err := getExistingService(diff.Name, deploymentRequest.Namespace, k8sClient)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get existing service: %s", err)
+			}
+			changes, err := diffSpecs(existingService.Spec, createServiceDefByName(diff.Name, deploymentRequest, manifest).Spec)
+			if err != nil {
+				return nil, err
+			}
+			diffs[i] = newResourceDiff(diff.Kind, diff.Name, changes)
+		}
+	}
+
+	return diffs, nil
+}
+
+// Creates, updates or deletes one kind of k8s-resource the way a deploy would, except that the deployment keeps its replicas
+func correctDrift(diff ResourceDiff, deploymentRequest NaisDeploymentRequest, manifest NaisManifest, resources []NaisResource, clusterSubdomain string, istioEnabled bool, k8sClient kubernetes.Interface) error {
+	var err error
+
+	// istio rules that are no longer enabled are deleted by createOrUpdateIstioRules, not the garbage collection
+	istioRule := diff.Kind == "ServiceRole" || diff.Kind == "ServiceRoleBinding"
+
+	switch {
+	case diff.Action == DiffActionDelete && !istioRule:
+		_, err = deleteRemovedResources(deploymentRequest, manifest, resources, k8sClient)
+		return err
+	case istioRule || diff.Kind == "NetworkPolicy" || diff.Kind == "ServiceAccount":
+		// the pods of a cronjob receive no calls, so they get no istio authorization rules
+		_, err = createOrUpdateAccessPolicy(deploymentRequest, manifest, istioEnabled && manifest.Kind != KindCronJob, k8sClient)
+		return err
+	}
+
+	switch diff.Kind {
+	case "Deployment":
+		err = restoreDeployment(deploymentRequest, manifest, resources, istioEnabled, k8sClient)
+	case "StatefulSet":
+		_, err = createOrUpdateStatefulSet(deploymentRequest, manifest, resources, istioEnabled, k8sClient)
+	case "Service":
+		err = restoreService(createServiceDefByName(diff.Name, deploymentRequest, manifest), k8sClient)
+	case "CronJob":
+		_, err = createOrUpdateCronJob(deploymentRequest, manifest, resources, k8sClient)
+	case "Secret":
+		_, err = createOrUpdateSecret(deploymentRequest, resources, k8sClient)
+	case "ConfigMap":
+		_, err = createOrUpdateConfigMap(deploymentRequest, manifest, k8sClient)
+	case "Ingress":
+		_, err = createOrUpdateIngress(deploymentRequest, manifest, clusterSubdomain, resources, k8sClient)
+	case "HorizontalPodAutoscaler":
+		_, err = createOrUpdateAutoscaler(deploymentRequest, manifest, k8sClient)
+	case "PodDisruptionBudget":
+		_, err = createOrUpdatePodDisruptionBudget(deploymentRequest, manifest, k8sClient)
+	default:
+		err = fmt.Errorf("unknown kind %s", diff.Kind)
+	}
+
+	return err
+}
+
+func restoreDeployment(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, resources []NaisResource, istioEnabled bool, k8sClient kubernetes.Interface) error {
+	existingDeployment, err := getExistingDeployment(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return fmt.Errorf("unable to get existing deployment: %s", err)
+	}
+
+	var replicas *int32
+	if existingDeployment != nil {
+		replicas = existingDeployment.Spec.Replicas
+	}
+
+	deploymentDef, err := createDeploymentDef(resources, manifest, deploymentRequest, existingDeployment, istioEnabled)
+	if err != nil {
+		return fmt.Errorf("unable to create deployment: %s", err)
+	}
+	if existingDeployment == nil {
+		_, err = k8sClient.ExtensionsV1beta1().Deployments(deploymentRequest.Namespace).Create(deploymentDef)
+		return err
+	}
+
+	if replicas != nil {
+		deploymentDef.Spec.Replicas = replicas
+	}
+	_, err = k8sClient.ExtensionsV1beta1().Deployments(deploymentRequest.Namespace).Update(deploymentDef)
+	return err
+}
+
+// The service of the application, or the headless service of a stateful application
+func createServiceDefByName(name string, deploymentRequest NaisDeploymentRequest, manifest NaisManifest) *k8score.Service {
+	if name == headlessServiceName(deploymentRequest.Application) {
+		return createHeadlessServiceDef(deploymentRequest.Application, deploymentRequest.Namespace, manifest)
+	}
+	return createServiceDef(deploymentRequest.Application, deploymentRequest.Namespace, manifest)
+}
+
+// Restores the fields naisd sets on the service, keeping the cluster ip and other values set by the api server
+func restoreService(serviceDef *k8score.Service, k8sClient kubernetes.Interface) error {
+	existingService, err := getExistingService(serviceDef.Name, serviceDef.Namespace, k8sClient)
+	if err != nil {
+		return fmt.Errorf("unable to get existing service: %s", err)
+	}
+
+	if existingService == nil {
+		_, err = createServiceResource(serviceDef, serviceDef.Namespace, k8sClient)
+		return err
+	}
+
+	existingService.Spec.Type = serviceDef.Spec.Type
+	existingService.Spec.Selector = serviceDef.Spec.Selector
+	existingService.Spec.Ports = serviceDef.Spec.Ports
+	_, err = k8sClient.CoreV1().Services(serviceDef.Namespace).Update(existingService)
+	return err
+}
+
+func driftLabels(deploymentRequest NaisDeploymentRequest, kind string) prometheus.Labels {
+	return prometheus.Labels{"nais_app": deploymentRequest.Application, "namespace": deploymentRequest.Namespace, "kind": kind}
+}
+
+func describeDrift(diff ResourceDiff) string {
+	switch diff.Action {
+	case DiffActionCreate:
+		return "resource is missing"
+	case DiffActionDelete:
+		return "resource is no longer part of the deploy"
+	}
+
+	description := ""
+	for i, change := range diff.Changes {
+		if i > 0 {
+			description += ", "
+		}
+		description += change.Path
+	}
+	return description
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/h2non/gock.v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func newDeployedClientset(t *testing.T, resources []NaisResource) kubernetes.Interface {
+	clientset := fake.NewSimpleClientset()
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+
+	_, err := createOrUpdateK8sResources(deploymentRequest, newDefaultManifest(), resources, "nais.example.yo", false, clientset)
+	assert.NoError(t, err)
+
+	return clientset
+}
+
+// Mocks the default resources every deploy fetches from Fasit, and returns them
+func mockDefaultFasitResources(t *testing.T) []NaisResource {
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", NavTruststoreFasitAlias).
+		Persist().
+		Reply(200).File("testdata/fasitTruststoreResponse.json")
+	gock.New("https://fasit.local").
+		Get("/api/v2/resources/3024713/file/keystore").
+		Persist().
+		Reply(200).
+		BodyString("")
+
+	resources, err := FetchFasitResources(FasitClient{"https://fasit.local", "", ""}, appName, "", ZONE_FSS, nil)
+	assert.NoError(t, err)
+
+	return resources
+}
+
+func newDriftReconciler(mode string, clientset kubernetes.Interface) DriftReconciler {
+	return DriftReconciler{
+		Api:  Api{clientset, "https://fasit.local", "nais.example.yo", "test-cluster", false, nil, nil, NewConfigMapDeployLocker(clientset, "naisd"), nil},
+		Mode: mode,
+	}
+}
+
+func TestDiffDrift(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+	manifest := newDefaultManifest()
+
+	t.Run("replicas set by the autoscaler are not drift", func(t *testing.T) {
+		clientset := newDeployedClientset(t, []NaisResource{})
+		deployment, _ := getExistingDeployment(appName, namespace, clientset)
+		deployment.Spec.Replicas = int32p(4)
+		clientset.ExtensionsV1beta1().Deployments(namespace).Update(deployment)
+
+		diffs, err := diffDrift(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		for _, diff := range diffs {
+			assert.Equal(t, DiffActionUnchanged, diff.Action, diff.Kind)
+		}
+	})
+
+	t.Run("changes to the service are drift", func(t *testing.T) {
+		clientset := newDeployedClientset(t, []NaisResource{})
+		service, _ := getExistingService(appName, namespace, clientset)
+		service.Spec.Selector = map[string]string{"app": "other"}
+		clientset.CoreV1().Services(namespace).Update(service)
+
+		diffs, err := diffDrift(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "Service", diffs[1].Kind)
+		assert.Equal(t, []FieldDiff{{"spec.selector.app", "other", appName}}, diffs[1].Changes)
+	})
+}
+
+func TestDriftReconciler(t *testing.T) {
+	defer gock.Off()
+	resources := mockDefaultFasitResources(t)
+
+	editImage := func(clientset kubernetes.Interface) {
+		deployment, _ := getExistingDeployment(appName, namespace, clientset)
+		deployment.Spec.Template.Spec.Containers[0].Image = "docker.hub/edited"
+		deployment.Spec.Replicas = int32p(3)
+		clientset.ExtensionsV1beta1().Deployments(namespace).Update(deployment)
+	}
+
+	t.Run("drift is only reported in report mode", func(t *testing.T) {
+		clientset := newDeployedClientset(t, resources)
+		editImage(clientset)
+
+		newDriftReconciler(DriftModeReport, clientset).reconcileAll()
+
+		deployment, _ := getExistingDeployment(appName, namespace, clientset)
+		assert.Equal(t, "docker.hub/edited", deployment.Spec.Template.Spec.Containers[0].Image)
+	})
+
+	t.Run("drifted resources are restored in enforce mode, keeping the replicas", func(t *testing.T) {
+		clientset := newDeployedClientset(t, resources)
+		editImage(clientset)
+		clientset.ExtensionsV1beta1().Ingresses(namespace).Delete(appName, &k8smeta.DeleteOptions{})
+
+		newDriftReconciler(DriftModeEnforce, clientset).reconcileAll()
+
+		deployment, _ := getExistingDeployment(appName, namespace, clientset)
+		assert.Equal(t, image+":"+version, deployment.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, int32(3), *deployment.Spec.Replicas)
+
+		ingress, _ := getExistingIngress(appName, namespace, clientset)
+		assert.NotNil(t, ingress)
+	})
+
+	t.Run("drifted statefulsets are restored in enforce mode", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+		manifest := newDefaultManifest()
+		manifest.Kind = KindStatefulSet
+		_, err := createOrUpdateK8sResources(deploymentRequest, manifest, resources, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		statefulSet, _ := getExistingStatefulSet(appName, namespace, clientset)
+		statefulSet.Spec.Template.Spec.Containers[0].Image = "docker.hub/edited"
+		clientset.AppsV1().StatefulSets(namespace).Update(statefulSet)
+
+		newDriftReconciler(DriftModeEnforce, clientset).reconcileAll()
+
+		statefulSet, _ = getExistingStatefulSet(appName, namespace, clientset)
+		assert.Equal(t, image+":"+version, statefulSet.Spec.Template.Spec.Containers[0].Image)
+	})
+
+	t.Run("drift is not corrected while the application is being deployed", func(t *testing.T) {
+		clientset := newDeployedClientset(t, resources)
+		editImage(clientset)
+		reconciler := newDriftReconciler(DriftModeEnforce, clientset)
+
+		release, err := reconciler.Api.DeployLocker.Lock(namespace, appName, "someone")
+		assert.NoError(t, err)
+		defer release()
+
+		reconciler.reconcileAll()
+
+		deployment, _ := getExistingDeployment(appName, namespace, clientset)
+		assert.Equal(t, "docker.hub/edited", deployment.Spec.Template.Spec.Containers[0].Image)
+	})
+
+	t.Run("the drift gauges of an undeployed application are deleted", func(t *testing.T) {
+		clientset := newDeployedClientset(t, resources)
+		reconciler := newDriftReconciler(DriftModeReport, clientset)
+		application := driftApplication{appName, namespace}
+
+		reconciler.reconcileAll()
+		assert.True(t, driftGaugeKinds[application]["Deployment"])
+		assert.True(t, driftGaugeKinds[application]["Service"])
+
+		clientset.ExtensionsV1beta1().Deployments(namespace).Delete(appName, &k8smeta.DeleteOptions{})
+		reconciler.reconcileAll()
+		assert.NotContains(t, driftGaugeKinds, application)
+	})
+}
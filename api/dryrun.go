@@ -0,0 +1,71 @@
+package api
+
+import (
+	"fmt"
+	k8syaml "github.com/ghodss/yaml"
+	k8score "k8s.io/api/core/v1"
+)
+
+const RedactedValue = "<redacted>"
+
+// Renders the objects of a deployment result as a multi-document YAML stream.
+// Secret values are never included in the output.
+func createDryRunResponse(deploymentResult DeploymentResult) ([]byte, error) {
+	var objects []interface{}
+
+	if deploymentResult.Deployment != nil {
+		objects = append(objects, deploymentResult.Deployment)
+	}
+	if deploymentResult.StatefulSet != nil {
+		objects = append(objects, deploymentResult.StatefulSet)
+	}
+	if deploymentResult.Service != nil {
+		objects = append(objects, deploymentResult.Service)
+	}
+	if deploymentResult.NetworkPolicy != nil {
+		objects = append(objects, deploymentResult.NetworkPolicy)
+	}
+	if deploymentResult.Secret != nil {
+		objects = append(objects, redactSecret(deploymentResult.Secret))
+	}
+	if deploymentResult.ConfigMap != nil {
+		objects = append(objects, deploymentResult.ConfigMap)
+	}
+	if deploymentResult.Ingress != nil {
+		objects = append(objects, deploymentResult.Ingress)
+	}
+	if deploymentResult.Autoscaler != nil {
+		objects = append(objects, deploymentResult.Autoscaler)
+	}
+	if deploymentResult.PodDisruptionBudget != nil {
+		objects = append(objects, deploymentResult.PodDisruptionBudget)
+	}
+	if deploymentResult.CronJob != nil {
+		objects = append(objects, deploymentResult.CronJob)
+	}
+
+	var response []byte
+	for _, object := range objects {
+		b, err := k8syaml.Marshal(object)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal %T to yaml: %s", object, err)
+		}
+		response = append(response, []byte("---\n")...)
+		response = append(response, b...)
+	}
+
+	return response, nil
+}
+
+// Returns a copy of the secret where every value is replaced, keeping only the keys
+func redactSecret(secret *k8score.Secret) *k8score.Secret {
+	redacted := secret.DeepCopy()
+	redacted.Data = nil
+	redacted.StringData = map[string]string{}
+
+	for key := range secret.Data {
+		redacted.StringData[key] = RedactedValue
+	}
+
+	return redacted
+}
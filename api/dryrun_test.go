@@ -0,0 +1,58 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestCreateDryRunResponse(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{
+		Application: appName,
+		Version:     version,
+		Namespace:   namespace,
+	}
+
+	naisResources := []NaisResource{
+		{
+			id:           1,
+			name:         "resourceName",
+			resourceType: "resourceType",
+			secret:       map[string]string{"password": "hunter2"},
+		},
+	}
+
+	deploymentResult, err := createK8sResourceDefs(deploymentRequest, newDefaultManifest(), naisResources, "nais.example.yo", false)
+	assert.NoError(t, err)
+
+	t.Run("all objects are rendered in order", func(t *testing.T) {
+		response, err := createDryRunResponse(deploymentResult)
+		assert.NoError(t, err)
+
+		documents := strings.Split(string(response), "---\n")[1:]
+		assert.Len(t, documents, 5)
+		assert.Contains(t, documents[0], "kind: Deployment")
+		assert.Contains(t, documents[1], "kind: Service")
+		assert.Contains(t, documents[2], "kind: Secret")
+		assert.Contains(t, documents[3], "kind: Ingress")
+		assert.Contains(t, documents[4], "kind: HorizontalPodAutoscaler")
+		assert.Contains(t, documents[0], image+":"+version)
+	})
+
+	t.Run("secret values are redacted", func(t *testing.T) {
+		response, err := createDryRunResponse(deploymentResult)
+		assert.NoError(t, err)
+
+		assert.NotContains(t, string(response), "hunter2")
+		assert.Contains(t, string(response), "resourcename_password")
+		assert.Contains(t, string(response), RedactedValue)
+	})
+
+	t.Run("redacting a secret leaves the original untouched", func(t *testing.T) {
+		redacted := redactSecret(deploymentResult.Secret)
+
+		assert.Nil(t, redacted.Data)
+		assert.Equal(t, RedactedValue, redacted.StringData["resourcename_password"])
+		assert.Equal(t, []byte("hunter2"), deploymentResult.Secret.Data["resourcename_password"])
+	})
+}
@@ -67,6 +67,11 @@ type Resource struct {
 	Id int `json:"id"`
 }
 
+type ApplicationInstance struct {
+	Id               int        `json:"id"`
+	ExposedResources []Resource `json:"exposedresources"`
+}
+
 type FasitClient struct {
 	FasitUrl string
 	Username string
@@ -193,6 +198,56 @@ func (fasit FasitClient) createApplicationInstance(deploymentRequest NaisDeploym
 	return nil
 }
 
+// Returns the application instance of the application in the environment, or nil if none is registered
+func (fasit FasitClient) getApplicationInstance(application, fasitEnvironment string) (*ApplicationInstance, error) {
+	req, err := fasit.buildRequest("GET", fmt.Sprintf("/api/v2/applicationinstances/environment/%s/application/%s", fasitEnvironment, application), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, appErr := fasit.doRequest(req)
+	if appErr != nil {
+		if appErr.Code() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, appErr
+	}
+
+	var applicationInstance ApplicationInstance
+	if err := json.Unmarshal(body, &applicationInstance); err != nil {
+		errorCounter.WithLabelValues("unmarshal_body").Inc()
+		return nil, fmt.Errorf("unable to unmarshal application instance: %s", err)
+	}
+
+	return &applicationInstance, nil
+}
+
+func (fasit FasitClient) deleteApplicationInstance(id int, onBehalfOf string) error {
+	return fasit.delete(fmt.Sprintf("/api/v2/applicationinstances/%d", id), onBehalfOf)
+}
+
+func (fasit FasitClient) deleteResource(id int, onBehalfOf string) error {
+	return fasit.delete(fmt.Sprintf("/api/v2/resources/%d", id), onBehalfOf)
+}
+
+// Deletes the item at the path, treating an item that is already gone as deleted
+func (fasit FasitClient) delete(path, onBehalfOf string) error {
+	req, err := fasit.buildRequest("DELETE", path, nil)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(fasit.Username, fasit.Password)
+	if onBehalfOf != "" {
+		req.Header.Set("x-onbehalfof", onBehalfOf)
+	}
+
+	if _, appErr := fasit.doRequest(req); appErr != nil && appErr.Code() != http.StatusNotFound {
+		return appErr
+	}
+	return nil
+}
+
 func (fasit FasitClient) getLoadBalancerConfig(application string, environment string) (*NaisResource, error) {
 	req, err := fasit.buildRequest("GET", "/api/v2/resources", map[string]string{
 		"environment": environment,
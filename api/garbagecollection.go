@@ -0,0 +1,202 @@
+package api
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+)
+
+// A k8s-resource deleted by a deploy because the manifest no longer produces it
+type DeletedResource struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// A k8s-resource of an application that is deleted when its kind no longer produces it
+type removal struct {
+	kind       string
+	name       string
+	deleteFunc func(application, namespace string, k8sClient kubernetes.Interface) (bool, error)
+}
+
+// The workload and the resources around it that the kind of the manifest does not produce
+func removedWorkloadResources(manifest NaisManifest, application string) []removal {
+	autoscaler := removal{"HorizontalPodAutoscaler", application, deleteAutoscaler}
+	deployment := removal{"Deployment", application, deleteDeployment}
+	statefulSet := removal{"StatefulSet", application, deleteStatefulSet}
+	service := removal{"Service", application, deleteService}
+	headlessService := removal{"Service", headlessServiceName(application), deleteHeadlessService}
+	cronJob := removal{"CronJob", application, deleteCronJob}
+
+	switch manifest.Kind {
+	case KindCronJob:
+		return []removal{autoscaler, deployment, statefulSet, service, headlessService}
+	case KindStatefulSet:
+		return []removal{autoscaler, deployment, cronJob}
+	default:
+		return []removal{statefulSet, headlessService, cronJob}
+	}
+}
+
+// Deletes the k8s-resources a previous deploy created that the manifest no longer produces: the ingress when
+// it is disabled, and the secret when no resources have secret values. The workload and the resources around
+// it depend on the kind: a scheduled application has only a cronjob, and a stateful one has no autoscaler.
+func deleteRemovedResources(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource, k8sClient kubernetes.Interface) ([]DeletedResource, error) {
+	var deleted []DeletedResource
+
+	if manifest.Ingress.Disabled || manifest.Kind == KindCronJob {
+		ok, err := deleteIngress(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient)
+		if err != nil {
+			return deleted, fmt.Errorf("unable to delete ingress: %s", err)
+		}
+		if ok {
+			deleted = append(deleted, DeletedResource{Kind: "Ingress", Name: deploymentRequest.Application})
+		}
+	}
+
+	if len(createSecretData(naisResources)) == 0 {
+		ok, err := deleteSecret(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient)
+		if err != nil {
+			return deleted, fmt.Errorf("unable to delete secret: %s", err)
+		}
+		if ok {
+			deleted = append(deleted, DeletedResource{Kind: "Secret", Name: deploymentRequest.Application})
+		}
+	}
+
+	application := deploymentRequest.Application
+	removals := removedWorkloadResources(manifest, application)
+	if createPodDisruptionBudgetDef(manifest, application, deploymentRequest.Namespace) == nil {
+		removals = append(removals, removal{"PodDisruptionBudget", application, deletePodDisruptionBudget})
+	}
+	if createConfigMapDef(manifest, application, deploymentRequest.Namespace) == nil {
+		removals = append(removals, removal{"ConfigMap", application, deleteConfigMap})
+	}
+	if len(manifest.AccessPolicy.Inbound) == 0 && len(manifest.AccessPolicy.Outbound) == 0 {
+		removals = append(removals, removal{"NetworkPolicy", application, deleteNetworkPolicy})
+	}
+
+	for _, remove := range removals {
+		ok, err := remove.deleteFunc(application, deploymentRequest.Namespace, k8sClient)
+		if err != nil {
+			return deleted, fmt.Errorf("unable to delete %s: %s", strings.ToLower(remove.kind), err)
+		}
+		if ok {
+			deleted = append(deleted, DeletedResource{Kind: remove.kind, Name: remove.name})
+		}
+	}
+
+	return deleted, nil
+}
+
+// Deletes the autoscaler of the application if naisd created it, returning whether it was deleted
+func deleteAutoscaler(application, namespace string, k8sClient kubernetes.Interface) (bool, error) {
+	autoscaler, err := getExistingAutoscaler(application, namespace, k8sClient)
+	if err != nil || autoscaler == nil || !createdByNaisd(autoscaler.ObjectMeta, application) {
+		return false, err
+	}
+
+	err = k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace).Delete(application, &k8smeta.DeleteOptions{})
+	return deleted(err)
+}
+
+// Deletes the deployment of the application and its pods if naisd created it, returning whether it was deleted
+func deleteDeployment(application, namespace string, k8sClient kubernetes.Interface) (bool, error) {
+	deployment, err := getExistingDeployment(application, namespace, k8sClient)
+	if err != nil || deployment == nil || !createdByNaisd(deployment.ObjectMeta, application) {
+		return false, err
+	}
+
+	propagation := k8smeta.DeletePropagationBackground
+	err = k8sClient.ExtensionsV1beta1().Deployments(namespace).Delete(application, &k8smeta.DeleteOptions{PropagationPolicy: &propagation})
+	return deleted(err)
+}
+
+// Deletes the service of the application if naisd created it, returning whether it was deleted
+func deleteService(application, namespace string, k8sClient kubernetes.Interface) (bool, error) {
+	service, err := getExistingService(application, namespace, k8sClient)
+	if err != nil || service == nil || !createdByNaisd(service.ObjectMeta, application) {
+		return false, err
+	}
+
+	err = k8sClient.CoreV1().Services(namespace).Delete(application, &k8smeta.DeleteOptions{})
+	return deleted(err)
+}
+
+// Deletes the statefulset of the application and its pods if naisd created it, returning whether it was deleted.
+// The volumes claimed for the pods are kept.
+func deleteStatefulSet(application, namespace string, k8sClient kubernetes.Interface) (bool, error) {
+	statefulSet, err := getExistingStatefulSet(application, namespace, k8sClient)
+	if err != nil || statefulSet == nil || !createdByNaisd(statefulSet.ObjectMeta, application) {
+		return false, err
+	}
+
+	propagation := k8smeta.DeletePropagationBackground
+	err = k8sClient.AppsV1().StatefulSets(namespace).Delete(application, &k8smeta.DeleteOptions{PropagationPolicy: &propagation})
+	return deleted(err)
+}
+
+// Deletes the headless service of a stateful application if naisd created it, returning whether it was deleted
+func deleteHeadlessService(application, namespace string, k8sClient kubernetes.Interface) (bool, error) {
+	name := headlessServiceName(application)
+	service, err := getExistingService(name, namespace, k8sClient)
+	if err != nil || service == nil || !createdByNaisd(service.ObjectMeta, application) {
+		return false, err
+	}
+
+	err = k8sClient.CoreV1().Services(namespace).Delete(name, &k8smeta.DeleteOptions{})
+	return deleted(err)
+}
+
+// Deletes the cronjob of the application and its jobs if naisd created it, returning whether it was deleted
+func deleteCronJob(application, namespace string, k8sClient kubernetes.Interface) (bool, error) {
+	cronJob, err := getExistingCronJob(application, namespace, k8sClient)
+	if err != nil || cronJob == nil || !createdByNaisd(cronJob.ObjectMeta, application) {
+		return false, err
+	}
+
+	propagation := k8smeta.DeletePropagationBackground
+	err = k8sClient.BatchV1beta1().CronJobs(namespace).Delete(application, &k8smeta.DeleteOptions{PropagationPolicy: &propagation})
+	return deleted(err)
+}
+
+// Deletes the ingress of the application if naisd created it, returning whether it was deleted
+func deleteIngress(application, namespace string, k8sClient kubernetes.Interface) (bool, error) {
+	ingress, err := getExistingIngress(application, namespace, k8sClient)
+	if err != nil || ingress == nil || !createdByNaisd(ingress.ObjectMeta, application) {
+		return false, err
+	}
+
+	err = k8sClient.ExtensionsV1beta1().Ingresses(namespace).Delete(application, &k8smeta.DeleteOptions{})
+	return deleted(err)
+}
+
+// Deletes the secret of the application if naisd created it, returning whether it was deleted
+func deleteSecret(application, namespace string, k8sClient kubernetes.Interface) (bool, error) {
+	secret, err := getExistingSecret(application, namespace, k8sClient)
+	if err != nil || secret == nil || !createdByNaisd(secret.ObjectMeta, application) {
+		return false, err
+	}
+
+	err = k8sClient.CoreV1().Secrets(namespace).Delete(application, &k8smeta.DeleteOptions{})
+	return deleted(err)
+}
+
+// Objects naisd creates carry the app label set by createObjectMeta, objects created by others are left alone
+func createdByNaisd(objectMeta k8smeta.ObjectMeta, application string) bool {
+	return objectMeta.Labels["app"] == application
+}
+
+// An object deleted by someone else in the meantime is not reported as deleted
+func deleted(err error) (bool, error) {
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.IsNotFound(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
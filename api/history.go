@@ -0,0 +1,239 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"time"
+)
+
+const (
+	DeployKindDeploy     = "deploy"
+	DeployKindRollback   = "rollback"
+	recordLabel          = "naisd.io/deploy-record"
+	recordNamespaceLabel = "naisd.io/namespace"
+	// labels the config maps naisd keeps its state in with their application. The app label is left to the
+	// k8s-resources of the application, which undeploy deletes by it.
+	stateApplicationLabel = "naisd.io/application"
+	recordConfigMapPrefix = "naisd-deploy."
+	recordDataKey         = "record"
+)
+
+// The number of records kept per application and namespace
+var historyLimit = 100
+
+type HistoryResource struct {
+	Alias        string `json:"alias"`
+	ResourceType string `json:"resourceType"`
+}
+
+type DeployRecord struct {
+	Id               string            `json:"id"`
+	Kind             string            `json:"kind"`
+	Application      string            `json:"application"`
+	Namespace        string            `json:"namespace"`
+	Version          string            `json:"version"`
+	FasitEnvironment string            `json:"fasitEnvironment,omitempty"`
+	FasitUsername    string            `json:"fasitUsername,omitempty"`
+	OnBehalfOf       string            `json:"onbehalfof,omitempty"`
+	ManifestUrl      string            `json:"manifestUrl,omitempty"`
+	ManifestHash     string            `json:"manifestHash,omitempty"`
+	UsedResources    []HistoryResource `json:"usedResources,omitempty"`
+	ExposedResources []HistoryResource `json:"exposedResources,omitempty"`
+	Outcome          JobStatus         `json:"outcome"`
+	Error            string            `json:"error,omitempty"`
+	Started          time.Time         `json:"started"`
+	Finished         time.Time         `json:"finished"`
+	DurationSeconds  float64           `json:"durationSeconds"`
+}
+
+// Keeps a record of every deploy where every naisd replica can find them
+type DeployHistory interface {
+	Record(record DeployRecord) error
+	// Returns the records of the application, newest first
+	List(namespace, application string) ([]DeployRecord, error)
+}
+
+// Stores each record as JSON in a config map in the namespace naisd runs in
+type configMapDeployHistory struct {
+	k8sClient kubernetes.Interface
+	namespace string
+}
+
+func NewConfigMapDeployHistory(k8sClient kubernetes.Interface, namespace string) DeployHistory {
+	return configMapDeployHistory{k8sClient: k8sClient, namespace: namespace}
+}
+
+func (h configMapDeployHistory) Record(record DeployRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to marshal deploy record: %s", err)
+	}
+
+	configMapClient := h.k8sClient.CoreV1().ConfigMaps(h.namespace)
+	_, err = configMapClient.Create(&k8score.ConfigMap{
+		ObjectMeta: k8smeta.ObjectMeta{
+			Name:      fmt.Sprintf("%s%s.%s.%s", recordConfigMapPrefix, record.Namespace, record.Application, record.Id),
+			Namespace: h.namespace,
+			Labels:    recordLabels(record.Namespace, record.Application),
+		},
+		Data: map[string]string{recordDataKey: string(b)},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to save deploy record: %s", err)
+	}
+
+	return h.prune(record.Namespace, record.Application)
+}
+
+func (h configMapDeployHistory) List(namespace, application string) ([]DeployRecord, error) {
+	records, _, err := h.list(namespace, application)
+	return records, err
+}
+
+// Deletes the oldest records of the application when there are more than historyLimit
+func (h configMapDeployHistory) prune(namespace, application string) error {
+	records, names, err := h.list(namespace, application)
+	if err != nil {
+		return err
+	}
+
+	for i := historyLimit; i < len(records); i++ {
+		if err := h.k8sClient.CoreV1().ConfigMaps(h.namespace).Delete(names[i], &k8smeta.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("unable to delete deploy record %s: %s", records[i].Id, err)
+		}
+	}
+
+	return nil
+}
+
+// Returns the records of the application and the names of their config maps, newest first
+func (h configMapDeployHistory) list(namespace, application string) ([]DeployRecord, []string, error) {
+	selector := fmt.Sprintf("%s=true,%s=%s", recordLabel, recordNamespaceLabel, namespace)
+	configMaps, err := h.k8sClient.CoreV1().ConfigMaps(h.namespace).List(k8smeta.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to list deploy records: %s", err)
+	}
+
+	// records made before stateApplicationLabel was introduced carry the app label instead
+	var items []k8score.ConfigMap
+	for _, configMap := range configMaps.Items {
+		labelled, ok := configMap.Labels[stateApplicationLabel]
+		if !ok {
+			labelled = configMap.Labels["app"]
+		}
+		if labelled == application {
+			items = append(items, configMap)
+		}
+	}
+
+	records := make([]DeployRecord, len(items))
+	for i, configMap := range items {
+		if err := json.Unmarshal([]byte(configMap.Data[recordDataKey]), &records[i]); err != nil {
+			return nil, nil, fmt.Errorf("unable to unmarshal deploy record %s: %s", configMap.Name, err)
+		}
+	}
+
+	sort.Sort(byStartedDescending{records, items})
+
+	names := make([]string, len(items))
+	for i, configMap := range items {
+		names[i] = configMap.Name
+	}
+
+	return records, names, nil
+}
+
+type byStartedDescending struct {
+	records    []DeployRecord
+	configMaps []k8score.ConfigMap
+}
+
+func (s byStartedDescending) Len() int { return len(s.records) }
+func (s byStartedDescending) Less(i, j int) bool {
+	return s.records[i].Started.After(s.records[j].Started)
+}
+func (s byStartedDescending) Swap(i, j int) {
+	s.records[i], s.records[j] = s.records[j], s.records[i]
+	s.configMaps[i], s.configMaps[j] = s.configMaps[j], s.configMaps[i]
+}
+
+func recordLabels(namespace, application string) map[string]string {
+	return map[string]string{recordLabel: "true", recordNamespaceLabel: namespace, stateApplicationLabel: application}
+}
+
+// Creates the record of a deploy that started at the given time and has just finished. The manifest is
+// empty if the deploy failed before it was generated.
+func newDeployRecord(kind string, deploymentRequest NaisDeploymentRequest, manifest NaisManifest, started time.Time, appErr *appError) DeployRecord {
+	finished := time.Now()
+	record := DeployRecord{
+		Kind:             kind,
+		Application:      deploymentRequest.Application,
+		Namespace:        deploymentRequest.Namespace,
+		Version:          deploymentRequest.Version,
+		FasitEnvironment: deploymentRequest.FasitEnvironment,
+		FasitUsername:    deploymentRequest.FasitUsername,
+		OnBehalfOf:       deploymentRequest.OnBehalfOf,
+		ManifestUrl:      deploymentRequest.ManifestUrl,
+		Outcome:          JobSucceeded,
+		Started:          started,
+		Finished:         finished,
+		DurationSeconds:  finished.Sub(started).Seconds(),
+	}
+
+	if appErr != nil {
+		record.Outcome = JobFailed
+		record.Error = appErr.Error()
+	}
+
+	if manifest.Image != "" {
+		record.ManifestHash = manifestHash(manifest)
+	}
+
+	for _, resource := range manifest.FasitResources.Used {
+		record.UsedResources = append(record.UsedResources, HistoryResource{resource.Alias, resource.ResourceType})
+	}
+	for _, resource := range manifest.FasitResources.Exposed {
+		record.ExposedResources = append(record.ExposedResources, HistoryResource{resource.Alias, resource.ResourceType})
+	}
+
+	return record
+}
+
+func manifestHash(manifest NaisManifest) string {
+	b, err := yaml.Marshal(manifest)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
+
+func (api Api) recordDeploy(record DeployRecord) {
+	id, err := newId()
+	if err != nil {
+		glog.Errorf("unable to generate id of deploy record: %s", err)
+		return
+	}
+	record.Id = id
+
+	if err := api.DeployHistory.Record(record); err != nil {
+		glog.Errorf("unable to record deploy of %s in %s: %s", record.Application, record.Namespace, err)
+	}
+}
+
+// Returns the records started before the given time, which starts with the deploys that were running then
+func recordsBefore(records []DeployRecord, t time.Time) []DeployRecord {
+	for i, record := range records {
+		if record.Started.Before(t) {
+			return records[i:]
+		}
+	}
+	return []DeployRecord{}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConfigMapDeployHistory(t *testing.T) {
+	t.Run("Records are listed newest first, per application and namespace", func(t *testing.T) {
+		history := NewConfigMapDeployHistory(fake.NewSimpleClientset(), "naisd")
+		now := time.Now()
+
+		assert.NoError(t, history.Record(DeployRecord{Id: "1", Application: appName, Namespace: namespace, Version: "1", Started: now.Add(-2 * time.Hour)}))
+		assert.NoError(t, history.Record(DeployRecord{Id: "2", Application: appName, Namespace: namespace, Version: "2", Started: now}))
+		assert.NoError(t, history.Record(DeployRecord{Id: "3", Application: appName, Namespace: "other", Version: "3", Started: now}))
+		assert.NoError(t, history.Record(DeployRecord{Id: "4", Application: "otherapp", Namespace: namespace, Version: "4", Started: now}))
+
+		records, err := history.List(namespace, appName)
+		assert.NoError(t, err)
+		assert.Len(t, records, 2)
+		assert.Equal(t, "2", records[0].Version)
+		assert.Equal(t, "1", records[1].Version)
+	})
+
+	t.Run("Only the newest records are kept", func(t *testing.T) {
+		defer func(limit int) { historyLimit = limit }(historyLimit)
+		historyLimit = 2
+
+		history := NewConfigMapDeployHistory(fake.NewSimpleClientset(), "naisd")
+		now := time.Now()
+
+		for i, id := range []string{"a", "b", "c"} {
+			assert.NoError(t, history.Record(DeployRecord{Id: id, Application: appName, Namespace: namespace, Started: now.Add(time.Duration(i) * time.Minute)}))
+		}
+
+		records, err := history.List(namespace, appName)
+		assert.NoError(t, err)
+		assert.Len(t, records, 2)
+		assert.Equal(t, "c", records[0].Id)
+		assert.Equal(t, "b", records[1].Id)
+	})
+}
+
+func TestNewDeployRecord(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{
+		Application:      appName,
+		Namespace:        namespace,
+		Version:          version,
+		FasitEnvironment: environment,
+		FasitUsername:    "user",
+		OnBehalfOf:       "someone",
+		ManifestUrl:      "http://repo.com/app",
+	}
+
+	t.Run("A successful deploy records the manifest and its resources", func(t *testing.T) {
+		manifest := NaisManifest{
+			Image: image,
+			FasitResources: FasitResources{
+				Used:    []UsedResource{{Alias: "db", ResourceType: "datasource"}},
+				Exposed: []ExposedResource{{Alias: "api", ResourceType: "restservice"}},
+			},
+		}
+
+		record := newDeployRecord(DeployKindDeploy, deploymentRequest, manifest, time.Now().Add(-time.Minute), nil)
+
+		assert.Equal(t, JobSucceeded, record.Outcome)
+		assert.Equal(t, "someone", record.OnBehalfOf)
+		assert.Equal(t, "user", record.FasitUsername)
+		assert.Equal(t, "http://repo.com/app", record.ManifestUrl)
+		assert.Equal(t, manifestHash(manifest), record.ManifestHash)
+		assert.Contains(t, record.ManifestHash, "sha256:")
+		assert.Equal(t, []HistoryResource{{"db", "datasource"}}, record.UsedResources)
+		assert.Equal(t, []HistoryResource{{"api", "restservice"}}, record.ExposedResources)
+		assert.True(t, record.DurationSeconds >= 60)
+	})
+
+	t.Run("A deploy that failed before the manifest was generated has no manifest hash", func(t *testing.T) {
+		appErr := &appError{errors.New("not found"), "unable to generate manifest/nais.yaml", http.StatusInternalServerError}
+
+		record := newDeployRecord(DeployKindDeploy, deploymentRequest, NaisManifest{}, time.Now(), appErr)
+
+		assert.Equal(t, JobFailed, record.Outcome)
+		assert.Equal(t, appErr.Error(), record.Error)
+		assert.Empty(t, record.ManifestHash)
+	})
+}
+
+func TestRecordsBefore(t *testing.T) {
+	now := time.Now()
+	records := []DeployRecord{{Id: "new", Started: now}, {Id: "old", Started: now.Add(-time.Hour)}}
+
+	assert.Equal(t, "old", recordsBefore(records, now.Add(-time.Minute))[0].Id)
+	assert.Len(t, recordsBefore(records, now.Add(time.Minute)), 2)
+	assert.Empty(t, recordsBefore(records, now.Add(-2*time.Hour)))
+}
@@ -0,0 +1,304 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+const (
+	StepGenerateManifest    = "generate manifest"
+	StepFetchFasitResources = "fetch fasit resources"
+	StepMigration           = "migration"
+	StepCanary              = "canary"
+	StepK8sResources        = "create or update k8s-resources"
+	StepSwitchTraffic       = "switch traffic"
+	StepUpdateFasit         = "update fasit"
+	StepNotifySensu         = "notify sensu"
+)
+
+const (
+	jobConfigMapPrefix = "naisd-job-"
+	jobLabel           = "naisd.io/deploy-job"
+	jobDataKey         = "job"
+	jobRetention       = 24 * time.Hour
+)
+
+type JobStep struct {
+	Name     string     `json:"name"`
+	Status   JobStatus  `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+type DeployJob struct {
+	Id          string            `json:"id"`
+	Application string            `json:"application"`
+	Namespace   string            `json:"namespace"`
+	Version     string            `json:"version"`
+	Status      JobStatus         `json:"status"`
+	Steps       []JobStep         `json:"steps"`
+	Warnings    []string          `json:"warnings,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Result      *DeploymentResult `json:"result,omitempty"`
+	Created     time.Time         `json:"created"`
+	Finished    *time.Time        `json:"finished,omitempty"`
+}
+
+func (job DeployJob) Done() bool {
+	return job.Status == JobSucceeded || job.Status == JobFailed
+}
+
+// Keeps deploy jobs where every naisd replica can find them
+type JobStore interface {
+	Save(job DeployJob) error
+	// Returns nil if no job with the id exists
+	Get(id string) (*DeployJob, error)
+	DeleteFinishedBefore(t time.Time) error
+	// Fails the jobs created before the time that have not finished and are no longer running, as the replica
+	// running them has gone away
+	ExpireUnfinishedBefore(t time.Time, running func(job DeployJob) bool) error
+}
+
+// Stores each job as JSON in a config map in the namespace naisd runs in
+type configMapJobStore struct {
+	k8sClient kubernetes.Interface
+	namespace string
+}
+
+func NewConfigMapJobStore(k8sClient kubernetes.Interface, namespace string) JobStore {
+	return configMapJobStore{k8sClient: k8sClient, namespace: namespace}
+}
+
+func (s configMapJobStore) Save(job DeployJob) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("unable to marshal job %s: %s", job.Id, err)
+	}
+
+	configMap := &k8score.ConfigMap{
+		ObjectMeta: k8smeta.ObjectMeta{
+			Name:      jobConfigMapPrefix + job.Id,
+			Namespace: s.namespace,
+			Labels:    map[string]string{jobLabel: "true", stateApplicationLabel: job.Application},
+		},
+		Data: map[string]string{jobDataKey: string(b)},
+	}
+
+	configMapClient := s.k8sClient.CoreV1().ConfigMaps(s.namespace)
+	_, err = configMapClient.Update(configMap)
+	if errors.IsNotFound(err) {
+		_, err = configMapClient.Create(configMap)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to save job %s: %s", job.Id, err)
+	}
+	return nil
+}
+
+func (s configMapJobStore) Get(id string) (*DeployJob, error) {
+	configMap, err := s.k8sClient.CoreV1().ConfigMaps(s.namespace).Get(jobConfigMapPrefix+id, k8smeta.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+
+	return unmarshalJob(configMap)
+}
+
+func (s configMapJobStore) DeleteFinishedBefore(t time.Time) error {
+	configMapClient := s.k8sClient.CoreV1().ConfigMaps(s.namespace)
+	configMaps, err := configMapClient.List(k8smeta.ListOptions{LabelSelector: jobLabel + "=true"})
+	if err != nil {
+		return fmt.Errorf("unable to list jobs: %s", err)
+	}
+
+	for _, configMap := range configMaps.Items {
+		job, err := unmarshalJob(&configMap)
+		if err != nil {
+			glog.Errorf("%s", err)
+			continue
+		}
+
+		if job.Finished != nil && job.Finished.Before(t) {
+			if err := configMapClient.Delete(configMap.Name, &k8smeta.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+				return fmt.Errorf("unable to delete job %s: %s", job.Id, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s configMapJobStore) ExpireUnfinishedBefore(t time.Time, running func(job DeployJob) bool) error {
+	configMaps, err := s.k8sClient.CoreV1().ConfigMaps(s.namespace).List(k8smeta.ListOptions{LabelSelector: jobLabel + "=true"})
+	if err != nil {
+		return fmt.Errorf("unable to list jobs: %s", err)
+	}
+
+	for _, configMap := range configMaps.Items {
+		job, err := unmarshalJob(&configMap)
+		if err != nil {
+			glog.Errorf("%s", err)
+			continue
+		}
+
+		if job.Done() || !job.Created.Before(t) || running(*job) {
+			continue
+		}
+
+		tracker := newJobTracker(*job, s)
+		tracker.finish(DeploymentResult{}, &appError{fmt.Errorf("the naisd replica running it stopped before it finished"), "deploy job expired", http.StatusInternalServerError})
+		glog.Infof("expired deploy job %s of %s, which was %s since %s without holding the deploy lock", job.Id, job.Application, job.Status, job.Created.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func unmarshalJob(configMap *k8score.ConfigMap) (*DeployJob, error) {
+	var job DeployJob
+	if err := json.Unmarshal([]byte(configMap.Data[jobDataKey]), &job); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal job in config map %s: %s", configMap.Name, err)
+	}
+	return &job, nil
+}
+
+func newDeployJob(deploymentRequest NaisDeploymentRequest, warnings []string) (DeployJob, error) {
+	id, err := newId()
+	if err != nil {
+		return DeployJob{}, fmt.Errorf("unable to generate job id: %s", err)
+	}
+
+	return DeployJob{
+		Id:          id,
+		Application: deploymentRequest.Application,
+		Namespace:   deploymentRequest.Namespace,
+		Version:     deploymentRequest.Version,
+		Status:      JobQueued,
+		Steps:       []JobStep{},
+		Warnings:    warnings,
+		Created:     time.Now(),
+	}, nil
+}
+
+// Returns a random id, usable in names of k8s-resources
+func newId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Records the progress of a deploy job in the job store. Every method is a no-op on a nil tracker,
+// so the deploy steps can be run without a job.
+type jobTracker struct {
+	job   DeployJob
+	store JobStore
+}
+
+func newJobTracker(job DeployJob, store JobStore) *jobTracker {
+	return &jobTracker{job: job, store: store}
+}
+
+func (t *jobTracker) start() {
+	if t == nil {
+		return
+	}
+
+	t.job.Status = JobRunning
+	t.save()
+}
+
+// Completes the running step, if any, and starts the next one
+func (t *jobTracker) begin(step string) {
+	if t == nil {
+		return
+	}
+
+	t.endStep(nil)
+	t.job.Steps = append(t.job.Steps, JobStep{Name: step, Status: JobRunning, Started: time.Now()})
+	t.save()
+}
+
+// Completes the running step and the job. A non-nil error fails both.
+func (t *jobTracker) finish(deploymentResult DeploymentResult, appErr *appError) {
+	if t == nil {
+		return
+	}
+
+	now := time.Now()
+	t.job.Finished = &now
+	t.job.Result = redactDeploymentResult(deploymentResult)
+
+	if appErr != nil {
+		t.endStep(appErr)
+		t.job.Status = JobFailed
+		t.job.Error = appErr.Error()
+	} else {
+		t.endStep(nil)
+		t.job.Status = JobSucceeded
+	}
+
+	t.save()
+}
+
+func (t *jobTracker) endStep(err error) {
+	if len(t.job.Steps) == 0 {
+		return
+	}
+
+	step := &t.job.Steps[len(t.job.Steps)-1]
+	if step.Status != JobRunning {
+		return
+	}
+
+	now := time.Now()
+	step.Finished = &now
+	step.Status = JobSucceeded
+	if err != nil {
+		step.Status = JobFailed
+		step.Error = err.Error()
+	}
+}
+
+func (t *jobTracker) save() {
+	if err := t.store.Save(t.job); err != nil {
+		glog.Errorf("unable to record progress of job %s: %s", t.job.Id, err)
+	}
+}
+
+// Returns a copy of the deployment result without secret values, or nil if nothing was created
+func redactDeploymentResult(deploymentResult DeploymentResult) *DeploymentResult {
+	if reflect.DeepEqual(deploymentResult, DeploymentResult{}) {
+		return nil
+	}
+
+	redacted := deploymentResult
+	if deploymentResult.Secret != nil {
+		redacted.Secret = redactSecret(deploymentResult.Secret)
+	}
+	return &redacted
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConfigMapJobStore(t *testing.T) {
+	jobStore := NewConfigMapJobStore(fake.NewSimpleClientset(), "naisd")
+
+	t.Run("Unknown job gives nil", func(t *testing.T) {
+		job, err := jobStore.Get("unknown")
+		assert.NoError(t, err)
+		assert.Nil(t, job)
+	})
+
+	t.Run("Saved job can be read back and updated", func(t *testing.T) {
+		job, err := newDeployJob(NaisDeploymentRequest{Application: appName, Namespace: namespace, Version: version}, []string{"warning"})
+		assert.NoError(t, err)
+		assert.NoError(t, jobStore.Save(job))
+
+		job.Status = JobRunning
+		assert.NoError(t, jobStore.Save(job))
+
+		stored, err := jobStore.Get(job.Id)
+		assert.NoError(t, err)
+		assert.Equal(t, job.Id, stored.Id)
+		assert.Equal(t, JobRunning, stored.Status)
+		assert.Equal(t, []string{"warning"}, stored.Warnings)
+	})
+
+	t.Run("Only jobs finished before the given time are deleted", func(t *testing.T) {
+		old, _ := newDeployJob(NaisDeploymentRequest{Application: appName}, nil)
+		finished := time.Now().Add(-2 * jobRetention)
+		old.Finished = &finished
+		running, _ := newDeployJob(NaisDeploymentRequest{Application: appName}, nil)
+
+		assert.NoError(t, jobStore.Save(old))
+		assert.NoError(t, jobStore.Save(running))
+
+		assert.NoError(t, jobStore.DeleteFinishedBefore(time.Now().Add(-jobRetention)))
+
+		deleted, err := jobStore.Get(old.Id)
+		assert.NoError(t, err)
+		assert.Nil(t, deleted)
+
+		kept, err := jobStore.Get(running.Id)
+		assert.NoError(t, err)
+		assert.NotNil(t, kept)
+	})
+
+	t.Run("Jobs left unfinished before the given time and no longer running are failed", func(t *testing.T) {
+		stale, _ := newDeployJob(NaisDeploymentRequest{Application: appName}, nil)
+		stale.Created = time.Now().Add(-2 * deployLockTimeout)
+		stale.Status = JobRunning
+		stale.Steps = []JobStep{{Name: StepK8sResources, Status: JobRunning, Started: stale.Created}}
+		recent, _ := newDeployJob(NaisDeploymentRequest{Application: appName}, nil)
+		recent.Status = JobRunning
+		locked, _ := newDeployJob(NaisDeploymentRequest{Application: appName}, nil)
+		locked.Created = stale.Created
+		locked.Status = JobRunning
+
+		assert.NoError(t, jobStore.Save(stale))
+		assert.NoError(t, jobStore.Save(recent))
+		assert.NoError(t, jobStore.Save(locked))
+
+		running := func(job DeployJob) bool { return job.Id == locked.Id }
+		assert.NoError(t, jobStore.ExpireUnfinishedBefore(time.Now().Add(-deployLockTimeout), running))
+
+		expired, err := jobStore.Get(stale.Id)
+		assert.NoError(t, err)
+		assert.Equal(t, JobFailed, expired.Status)
+		assert.Equal(t, JobFailed, expired.Steps[0].Status)
+		assert.NotNil(t, expired.Finished)
+		assert.Contains(t, expired.Error, "deploy job expired")
+
+		kept, err := jobStore.Get(recent.Id)
+		assert.NoError(t, err)
+		assert.Equal(t, JobRunning, kept.Status)
+
+		kept, err = jobStore.Get(locked.Id)
+		assert.NoError(t, err)
+		assert.Equal(t, JobRunning, kept.Status, "a job still holding the deploy lock is running")
+	})
+}
+
+func TestJobTracker(t *testing.T) {
+	jobStore := NewConfigMapJobStore(fake.NewSimpleClientset(), "naisd")
+
+	t.Run("Steps are completed when the next one begins", func(t *testing.T) {
+		job, _ := newDeployJob(NaisDeploymentRequest{Application: appName}, nil)
+		tracker := newJobTracker(job, jobStore)
+
+		tracker.start()
+		tracker.begin(StepGenerateManifest)
+		tracker.begin(StepFetchFasitResources)
+
+		stored, _ := jobStore.Get(job.Id)
+		assert.Equal(t, JobRunning, stored.Status)
+		assert.Equal(t, JobSucceeded, stored.Steps[0].Status)
+		assert.NotNil(t, stored.Steps[0].Finished)
+		assert.Equal(t, JobRunning, stored.Steps[1].Status)
+
+		tracker.finish(DeploymentResult{}, nil)
+
+		stored, _ = jobStore.Get(job.Id)
+		assert.Equal(t, JobSucceeded, stored.Status)
+		assert.Equal(t, JobSucceeded, stored.Steps[1].Status)
+		assert.NotNil(t, stored.Finished)
+		assert.Nil(t, stored.Result)
+	})
+
+	t.Run("An error fails the running step and the job", func(t *testing.T) {
+		job, _ := newDeployJob(NaisDeploymentRequest{Application: appName}, nil)
+		tracker := newJobTracker(job, jobStore)
+
+		tracker.begin(StepK8sResources)
+		tracker.finish(DeploymentResult{}, &appError{errors.New("conflict"), "failed while creating or updating k8s-resources", http.StatusInternalServerError})
+
+		stored, _ := jobStore.Get(job.Id)
+		assert.Equal(t, JobFailed, stored.Status)
+		assert.Equal(t, JobFailed, stored.Steps[0].Status)
+		assert.Equal(t, "failed while creating or updating k8s-resources: conflict (500)", stored.Steps[0].Error)
+		assert.Equal(t, stored.Steps[0].Error, stored.Error)
+	})
+
+	t.Run("A nil tracker does nothing", func(t *testing.T) {
+		var tracker *jobTracker
+		tracker.start()
+		tracker.begin(StepGenerateManifest)
+		tracker.finish(DeploymentResult{}, nil)
+	})
+}
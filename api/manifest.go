@@ -6,22 +6,50 @@ import (
 	"github.com/imdario/mergo"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	k8score "k8s.io/api/core/v1"
+	k8sresource "k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"net/http"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// A probe checks the container with an http GET of Path, by opening a tcp connection, or by running Command in it.
+// Http and tcp probes target the named Port.
 type Probe struct {
+	Type             string
 	Path             string
+	Port             string
+	Command          []string
 	InitialDelay     int `yaml:"initialDelay"`
 	PeriodSeconds    int `yaml:"periodSeconds"`
 	FailureThreshold int `yaml:"failureThreshold"`
 	Timeout          int `yaml:"timeout"`
 }
 
+// Kubernetes runs startup probes from version 1.16, which naisd is not built against yet. The startup probe is
+// rejected by validation until then, rather than left out of the pods without notice.
 type Healthcheck struct {
 	Liveness  Probe
 	Readiness Probe
+	Startup   Probe
+}
+
+const (
+	ProbeTypeHTTP = "http"
+	ProbeTypeTCP  = "tcp"
+	ProbeTypeExec = "exec"
+)
+
+// Probes without a type are http probes
+func (p Probe) probeType() string {
+	if p.Type == "" {
+		return ProbeTypeHTTP
+	}
+	return p.Type
 }
 
 type ResourceList struct {
@@ -45,27 +73,190 @@ type IstioConfig struct {
 }
 
 type NaisManifest struct {
-	Image           string
-	Port            int
-	Healthcheck     Healthcheck
-	PreStopHookPath string         `yaml:"preStopHookPath"`
-	Prometheus      PrometheusConfig
-	Istio      		IstioConfig
-	Replicas        Replicas
-	Ingress         Ingress
-	Resources       ResourceRequirements
-	FasitResources  FasitResources `yaml:"fasitResources"`
-	LeaderElection  bool           `yaml:"leaderElection"`
+	Kind                string
+	Schedule            string
+	Image               string
+	Port                int
+	Ports               []Port
+	Healthcheck         Healthcheck
+	PreStopHookPath     string `yaml:"preStopHookPath"`
+	Prometheus          PrometheusConfig
+	Istio               IstioConfig
+	Replicas            Replicas
+	Ingress             Ingress
+	Resources           ResourceRequirements
+	FasitResources      FasitResources `yaml:"fasitResources"`
+	LeaderElection      bool           `yaml:"leaderElection"`
+	Rollback            string
+	Strategy            Strategy
+	Deployment          DeploymentConfig
+	Sidecars            []Container
+	InitContainers      []Container        `yaml:"initContainers"`
+	SharedVolumes       []SharedVolume     `yaml:"sharedVolumes"`
+	PersistentVolumes   []PersistentVolume `yaml:"persistentVolumes"`
+	Migration           Migration
+	PodDisruptionBudget PodDisruptionBudgetConfig `yaml:"podDisruptionBudget"`
+	AccessPolicy        AccessPolicy              `yaml:"accessPolicy"`
+	Env                 map[string]string
+	ConfigMap           ConfigMapConfig `yaml:"configMap"`
+	// Overrides of the manifest keyed by Fasit environment or environment class, see ApplyEnvironmentOverrides
+	Environments map[string]map[string]interface{}
+}
+
+// Files put in a ConfigMap named after the application and mounted in the app container at MountPath.
+// Files maps the name of each file to its content.
+type ConfigMapConfig struct {
+	MountPath string `yaml:"mountPath"`
+	Files     map[string]string
+}
+
+// The applications allowed to call the application, and the applications it is allowed to call. Traffic in a
+// direction without rules is not restricted.
+type AccessPolicy struct {
+	Inbound  []AccessRule
+	Outbound []AccessRule
+}
+
+// An application in a namespace, which defaults to the namespace of the application. A rule without an
+// application covers every application in the namespace.
+type AccessRule struct {
+	Application string
+	Namespace   string
+}
+
+// Overrides the PodDisruptionBudget derived from Replicas.Min. MinAvailable and MaxUnavailable are a number of
+// pods or a percentage of the replicas, only one of them can be set.
+type PodDisruptionBudgetConfig struct {
+	Disabled       bool
+	MinAvailable   string `yaml:"minAvailable"`
+	MaxUnavailable string `yaml:"maxUnavailable"`
+}
+
+// A job running the image of the new version before the deployment is updated. Command and Args override the
+// entrypoint and arguments of the image.
+type Migration struct {
+	Enabled bool
+	Command []string
+	Args    []string
+	Timeout string
+}
+
+// A sidecar or init container running next to the app container. The image includes its tag. With FasitEnv,
+// the container gets the same environment variables and certificates from Fasit as the app container.
+type Container struct {
+	Name         string
+	Image        string
+	Command      []string
+	Args         []string
+	Resources    ResourceRequirements
+	Env          map[string]string
+	FasitEnv     bool          `yaml:"fasitEnv"`
+	VolumeMounts []VolumeMount `yaml:"volumeMounts"`
+}
+
+type VolumeMount struct {
+	Name      string
+	MountPath string `yaml:"mountPath"`
+}
+
+// An empty directory shared by the containers of the pod, mounted at MountPath in the app container if set
+type SharedVolume struct {
+	Name      string
+	MountPath string `yaml:"mountPath"`
+}
+
+// A volume claimed for each pod of a stateful application, kept when the pod is replaced. StorageClass
+// defaults to the default storage class of the cluster.
+type PersistentVolume struct {
+	Name         string
+	Size         string
+	StorageClass string `yaml:"storageClass"`
+	MountPath    string `yaml:"mountPath"`
 }
 
 type Ingress struct {
 	Disabled bool
+	Port     string
+}
+
+// A port of the app container, exposed on the service of the application at ServicePort unless it is zero.
+// Protocol is TCP or UDP, and defaults to TCP. Probes, the prometheus scrape port and the ingress refer to a
+// port by its name.
+type Port struct {
+	Name          string
+	ContainerPort int `yaml:"containerPort"`
+	ServicePort   int `yaml:"servicePort"`
+	Protocol      string
+}
+
+// How the deployment replaces old pods with new ones. MaxSurge and MaxUnavailable are a number of pods or
+// a percentage of the replicas, and are only used by RollingUpdate.
+type DeploymentConfig struct {
+	Strategy                string
+	MaxSurge                string `yaml:"maxSurge"`
+	MaxUnavailable          string `yaml:"maxUnavailable"`
+	ProgressDeadlineSeconds int    `yaml:"progressDeadlineSeconds"`
+	RevisionHistoryLimit    int    `yaml:"revisionHistoryLimit"`
+}
+
+type Strategy struct {
+	Canary    CanaryStrategy
+	BlueGreen BlueGreenStrategy `yaml:"blueGreen"`
+}
+
+// Runs the new version next to the current one before rolling it out. The size of the canary is either a
+// number of replicas, or a weight in percent of the current replicas. The service spreads traffic evenly
+// over the pods, so the weight is also the share of traffic the canary gets.
+type CanaryStrategy struct {
+	Replicas int
+	Weight   int
+	Duration string
+}
+
+func (c CanaryStrategy) Enabled() bool {
+	return c.Replicas > 0 || c.Weight > 0
+}
+
+// Deploys the new version next to the current one, and switches all traffic to it at once when it has rolled out.
+// The previous version is kept for KeepPrevious, so traffic can be switched back to it.
+type BlueGreenStrategy struct {
+	Enabled      bool
+	KeepPrevious string `yaml:"keepPrevious"`
 }
 
 type Replicas struct {
 	Min                    int
 	Max                    int
 	CpuThresholdPercentage int `yaml:"cpuThresholdPercentage"`
+	// replaces CpuThresholdPercentage when set
+	Metrics []Metric
+}
+
+const (
+	MetricTypeResource = "resource"
+	MetricTypePods     = "pods"
+	MetricTypeObject   = "object"
+	// external metrics need the autoscaling/v2beta1 API of kubernetes 1.10, which naisd is not built against yet
+	MetricTypeExternal = "external"
+)
+
+// A metric the autoscaler scales on. Resource metrics are the cpu or memory of the pods, as a percentage of their
+// requests or an average value. Pods metrics are custom metrics averaged over the pods, like requests per second,
+// and object metrics are custom metrics describing another kubernetes object, like the lag of a queue.
+type Metric struct {
+	Type                     string
+	Name                     string
+	TargetAverageUtilization int    `yaml:"targetAverageUtilization"`
+	TargetAverageValue       string `yaml:"targetAverageValue"`
+	TargetValue              string `yaml:"targetValue"`
+	Object                   MetricObject
+}
+
+// The kubernetes object an object metric describes
+type MetricObject struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string
+	Name       string
 }
 
 type FasitResources struct {
@@ -105,7 +296,7 @@ type Field struct {
 	Value string
 }
 
-func GenerateManifest(deploymentRequest NaisDeploymentRequest) (naisManifest NaisManifest, err error) {
+func GenerateManifest(deploymentRequest NaisDeploymentRequest, environmentClass EnvironmentClassLookup) (naisManifest NaisManifest, err error) {
 
 	manifest, err := downloadManifest(deploymentRequest)
 
@@ -114,7 +305,17 @@ func GenerateManifest(deploymentRequest NaisDeploymentRequest) (naisManifest Nai
 		return NaisManifest{}, err
 	}
 
-	if err := AddDefaultManifestValues(&manifest, deploymentRequest.Application); err != nil {
+	return prepareManifest(manifest, deploymentRequest.Application, deploymentRequest.FasitEnvironment, environmentClass)
+}
+
+// Applies the overrides of the Fasit environment, adds the default values to a manifest and validates it
+func prepareManifest(manifest NaisManifest, application, fasitEnvironment string, environmentClass EnvironmentClassLookup) (NaisManifest, error) {
+	if err := ApplyEnvironmentOverrides(&manifest, fasitEnvironment, environmentClass); err != nil {
+		glog.Errorf("Could not apply overrides %s", err)
+		return NaisManifest{}, err
+	}
+
+	if err := AddDefaultManifestValues(&manifest, application); err != nil {
 		glog.Errorf("Could not merge manifest %s", err)
 		return NaisManifest{}, err
 	}
@@ -163,6 +364,112 @@ func createManifestUrl(application, version string) []string {
 func AddDefaultManifestValues(manifest *NaisManifest, application string) error {
 	return mergo.Merge(manifest, GetDefaultManifest(application))
 }
+
+// Returns the environment class of a Fasit environment, e.g. q for q0. Deploys ask Fasit, see
+// FasitClient.GetFasitEnvironmentClass, while EnvironmentClassFromName serves tools that run without Fasit.
+type EnvironmentClassLookup func(fasitEnvironment string) (string, error)
+
+// Most Fasit environments are named after their class, like q0 in class q and p in class p
+var fasitEnvironmentName = regexp.MustCompile(`^([utqp])[0-9]*$`)
+
+// Tells the environment class from the name of the Fasit environment, and errors for names that do not start with one
+func EnvironmentClassFromName(fasitEnvironment string) (string, error) {
+	if match := fasitEnvironmentName.FindStringSubmatch(fasitEnvironment); match != nil {
+		return match[1], nil
+	}
+	return "", fmt.Errorf("the environment class of %s cannot be told from its name", fasitEnvironment)
+}
+
+// Deep-merges the overrides of the environment class of the Fasit environment over the manifest, and then those of
+// the environment itself. Maps are merged key by key, while lists and other values are replaced. The manifest is left
+// without environments, as the result only applies to the one environment. The environment class is only looked up
+// when the manifest has overrides, and an environment whose class cannot be found is an error.
+func ApplyEnvironmentOverrides(manifest *NaisManifest, fasitEnvironment string, environmentClass EnvironmentClassLookup) error {
+	environments := manifest.Environments
+	manifest.Environments = nil
+
+	if len(environments) == 0 || fasitEnvironment == "" {
+		return nil
+	}
+
+	class, err := environmentClass(fasitEnvironment)
+	if err != nil {
+		return fmt.Errorf("unable to get environment class of %s for its overrides: %s", fasitEnvironment, err)
+	}
+
+	var overrides []map[string]interface{}
+	if class != "" && class != fasitEnvironment {
+		if override, ok := environments[class]; ok {
+			overrides = append(overrides, override)
+		}
+	}
+	if override, ok := environments[fasitEnvironment]; ok {
+		overrides = append(overrides, override)
+	}
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	manifestYaml, err := yaml.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("unable to marshal manifest: %s", err)
+	}
+	var merged map[interface{}]interface{}
+	if err := yaml.Unmarshal(manifestYaml, &merged); err != nil {
+		return fmt.Errorf("unable to unmarshal manifest: %s", err)
+	}
+
+	for _, override := range overrides {
+		overrideMap, _ := toYamlMap(override)
+		merged = mergeYamlMaps(merged, overrideMap)
+	}
+
+	mergedYaml, err := yaml.Marshal(merged)
+	if err != nil {
+		return fmt.Errorf("unable to marshal overrides of %s: %s", fasitEnvironment, err)
+	}
+	var effective NaisManifest
+	if err := yaml.Unmarshal(mergedYaml, &effective); err != nil {
+		return fmt.Errorf("unable to apply overrides of %s: %s", fasitEnvironment, err)
+	}
+
+	*manifest = effective
+	return nil
+}
+
+// Merges override into base, copying the maps of override so a later merge does not change them
+func mergeYamlMaps(base, override map[interface{}]interface{}) map[interface{}]interface{} {
+	for key, value := range override {
+		overrideMap, ok := toYamlMap(value)
+		if !ok {
+			base[key] = value
+			continue
+		}
+
+		baseMap, ok := base[key].(map[interface{}]interface{})
+		if !ok {
+			baseMap = map[interface{}]interface{}{}
+		}
+		base[key] = mergeYamlMaps(baseMap, overrideMap)
+	}
+	return base
+}
+
+// The top level of an override is decoded as a map of strings, the maps in it as yaml maps
+func toYamlMap(value interface{}) (map[interface{}]interface{}, bool) {
+	switch m := value.(type) {
+	case map[interface{}]interface{}:
+		return m, true
+	case map[string]interface{}:
+		yamlMap := map[interface{}]interface{}{}
+		for key, value := range m {
+			yamlMap[key] = value
+		}
+		return yamlMap, true
+	default:
+		return nil, false
+	}
+}
 func fetchManifest(url string) (NaisManifest, error) {
 	glog.Infof("Fetching manifest from URL %s\n", url)
 	response, err := http.Get(url)
@@ -198,6 +505,22 @@ func ValidateManifest(manifest NaisManifest) ValidationErrors {
 		validateMinIsSmallerThanMax,
 		validateCpuThreshold,
 		validateResources,
+		validateRollback,
+		validateCanary,
+		validateBlueGreen,
+		validateDeployment,
+		validateContainers,
+		validateMigration,
+		validateKind,
+		validatePersistentVolumes,
+		validateMetrics,
+		validatePodDisruptionBudget,
+		validateAccessPolicy,
+		validatePorts,
+		validateHealthcheck,
+		validateEnv,
+		validateConfigMap,
+		validateRecordedManifest,
 	}
 
 	var validationErrors ValidationErrors
@@ -229,6 +552,466 @@ func validateResources(manifest NaisManifest) *ValidationError {
 	}
 	return nil
 }
+func validateRollback(manifest NaisManifest) *ValidationError {
+	if manifest.Rollback != "" && manifest.Rollback != RollbackAuto {
+		return &ValidationError{
+			"Rollback can only be auto or empty",
+			map[string]string{"Rollback": manifest.Rollback},
+		}
+	}
+	return nil
+}
+
+func validateCanary(manifest NaisManifest) *ValidationError {
+	canary := manifest.Strategy.Canary
+	if canary.Replicas < 0 || canary.Weight < 0 || (canary.Replicas > 0 && canary.Weight > 0) {
+		return &ValidationError{
+			"Strategy.Canary must have either replicas or weight",
+			map[string]string{"Replicas": strconv.Itoa(canary.Replicas), "Weight": strconv.Itoa(canary.Weight)},
+		}
+	}
+	if canary.Weight > 99 {
+		return &ValidationError{
+			"Strategy.Canary.Weight must be between 1 and 99",
+			map[string]string{"Weight": strconv.Itoa(canary.Weight)},
+		}
+	}
+	if canary.Duration != "" {
+		duration, err := time.ParseDuration(canary.Duration)
+		if err != nil || duration <= 0 || duration > maxCanaryDuration {
+			return &ValidationError{
+				fmt.Sprintf("Strategy.Canary.Duration must be a duration of at most %s", maxCanaryDuration),
+				map[string]string{"Duration": canary.Duration},
+			}
+		}
+	}
+	return nil
+}
+
+func validateMigration(manifest NaisManifest) *ValidationError {
+	if manifest.Migration.Timeout == "" {
+		return nil
+	}
+	timeout, err := time.ParseDuration(manifest.Migration.Timeout)
+	if err != nil || timeout <= 0 || timeout > maxMigrationTimeout {
+		return &ValidationError{
+			fmt.Sprintf("Migration.Timeout must be a duration of at most %s", maxMigrationTimeout),
+			map[string]string{"Timeout": manifest.Migration.Timeout},
+		}
+	}
+	return nil
+}
+
+// A scheduled application runs to completion, so it cannot have what keeps a pod running or rolls it out gradually.
+// Stateful applications are rolled out one pod at a time by kubernetes, and keep their volumes across deploys.
+func validateKind(manifest NaisManifest) *ValidationError {
+	var unsupported []string
+	switch manifest.Kind {
+	case "", KindDeployment:
+	case KindCronJob:
+		if fields := strings.Fields(manifest.Schedule); len(fields) != 5 && !(len(fields) == 1 && strings.HasPrefix(fields[0], "@")) {
+			return &ValidationError{
+				"Schedule must be a cron expression like \"0 3 * * *\" when Kind is cronjob",
+				map[string]string{"Schedule": manifest.Schedule},
+			}
+		}
+		unsupported = []string{"Strategy.Canary", "Strategy.BlueGreen", "Rollback", "LeaderElection", "Sidecars"}
+	case KindStatefulSet:
+		unsupported = []string{"Strategy.Canary", "Strategy.BlueGreen", "Rollback"}
+	default:
+		return &ValidationError{
+			"Kind must be deployment, statefulset or cronjob",
+			map[string]string{"Kind": manifest.Kind},
+		}
+	}
+
+	if manifest.Schedule != "" && manifest.Kind != KindCronJob {
+		return &ValidationError{
+			"Schedule can only be set when Kind is cronjob",
+			map[string]string{"Schedule": manifest.Schedule},
+		}
+	}
+	if len(manifest.PersistentVolumes) > 0 && manifest.Kind != KindStatefulSet {
+		return &ValidationError{
+			"PersistentVolumes can only be used when Kind is statefulset",
+			map[string]string{"Kind": manifest.Kind},
+		}
+	}
+
+	used := map[string]bool{
+		"Strategy.Canary":    manifest.Strategy.Canary.Enabled(),
+		"Strategy.BlueGreen": manifest.Strategy.BlueGreen.Enabled,
+		"Rollback":           manifest.Rollback != "",
+		"LeaderElection":     manifest.LeaderElection,
+		"Sidecars":           len(manifest.Sidecars) > 0,
+	}
+	for _, field := range unsupported {
+		if used[field] {
+			return &ValidationError{
+				fmt.Sprintf("%s cannot be used when Kind is %s", field, manifest.Kind),
+				map[string]string{"Kind": manifest.Kind},
+			}
+		}
+	}
+	return nil
+}
+
+func validatePersistentVolumes(manifest NaisManifest) *ValidationError {
+	names := map[string]bool{}
+	for _, volume := range manifest.PersistentVolumes {
+		if !validDNSLabel(volume.Name) || names[volume.Name] {
+			return &ValidationError{
+				"PersistentVolumes must have unique names of lowercase letters, numbers and dashes",
+				map[string]string{"Name": volume.Name},
+			}
+		}
+		names[volume.Name] = true
+
+		if size, err := k8sresource.ParseQuantity(volume.Size); err != nil || size.Sign() <= 0 {
+			return &ValidationError{
+				"PersistentVolumes must have a size like 10Gi",
+				map[string]string{"Name": volume.Name, "Size": volume.Size},
+			}
+		}
+		if !strings.HasPrefix(volume.MountPath, "/") {
+			return &ValidationError{
+				"PersistentVolumes must have an absolute mountPath",
+				map[string]string{"Name": volume.Name, "MountPath": volume.MountPath},
+			}
+		}
+	}
+	return nil
+}
+
+func validateBlueGreen(manifest NaisManifest) *ValidationError {
+	blueGreen := manifest.Strategy.BlueGreen
+	if !blueGreen.Enabled {
+		return nil
+	}
+	if manifest.Strategy.Canary.Enabled() {
+		return &ValidationError{
+			"Strategy.BlueGreen cannot be combined with Strategy.Canary",
+			map[string]string{"BlueGreen.Enabled": "true"},
+		}
+	}
+	if manifest.Rollback != "" {
+		return &ValidationError{
+			"Rollback cannot be combined with Strategy.BlueGreen, traffic is only switched once the new version has rolled out",
+			map[string]string{"Rollback": manifest.Rollback},
+		}
+	}
+	if blueGreen.KeepPrevious != "" {
+		if duration, err := time.ParseDuration(blueGreen.KeepPrevious); err != nil || duration <= 0 {
+			return &ValidationError{
+				"Strategy.BlueGreen.KeepPrevious must be a duration",
+				map[string]string{"KeepPrevious": blueGreen.KeepPrevious},
+			}
+		}
+	}
+	return nil
+}
+
+func validateDeployment(manifest NaisManifest) *ValidationError {
+	deployment := manifest.Deployment
+	switch deployment.Strategy {
+	case DeploymentStrategyRecreate:
+	case "", DeploymentStrategyRollingUpdate:
+		for name, value := range map[string]string{"MaxSurge": deployment.MaxSurge, "MaxUnavailable": deployment.MaxUnavailable} {
+			if value != "" && !validIntOrPercentage(value) {
+				return &ValidationError{
+					"Deployment." + name + " must be a number of pods or a percentage between 0% and 100%",
+					map[string]string{name: value},
+				}
+			}
+		}
+		if isZeroIntOrPercentage(deployment.MaxSurge) && isZeroIntOrPercentage(deployment.MaxUnavailable) {
+			return &ValidationError{
+				"Deployment.MaxSurge and Deployment.MaxUnavailable cannot both be 0",
+				map[string]string{"MaxSurge": deployment.MaxSurge, "MaxUnavailable": deployment.MaxUnavailable},
+			}
+		}
+	default:
+		return &ValidationError{
+			"Deployment.Strategy must be RollingUpdate or Recreate",
+			map[string]string{"Strategy": deployment.Strategy},
+		}
+	}
+	if deployment.ProgressDeadlineSeconds < 0 {
+		return &ValidationError{
+			"Deployment.ProgressDeadlineSeconds cannot be negative",
+			map[string]string{"ProgressDeadlineSeconds": strconv.Itoa(deployment.ProgressDeadlineSeconds)},
+		}
+	}
+	if deployment.RevisionHistoryLimit < 0 {
+		return &ValidationError{
+			"Deployment.RevisionHistoryLimit cannot be negative",
+			map[string]string{"RevisionHistoryLimit": strconv.Itoa(deployment.RevisionHistoryLimit)},
+		}
+	}
+	return nil
+}
+
+func validIntOrPercentage(value string) bool {
+	if strings.HasSuffix(value, "%") {
+		percentage, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		return err == nil && percentage >= 0 && percentage <= 100
+	}
+	number, err := strconv.Atoi(value)
+	return err == nil && number >= 0
+}
+
+func isZeroIntOrPercentage(value string) bool {
+	return value == "0" || value == "0%"
+}
+
+func validatePodDisruptionBudget(manifest NaisManifest) *ValidationError {
+	budget := manifest.PodDisruptionBudget
+	fields := map[string]string{"MinAvailable": budget.MinAvailable, "MaxUnavailable": budget.MaxUnavailable}
+
+	if budget.MinAvailable != "" && budget.MaxUnavailable != "" {
+		return &ValidationError{"PodDisruptionBudget can have either minAvailable or maxUnavailable", fields}
+	}
+	for _, value := range []string{budget.MinAvailable, budget.MaxUnavailable} {
+		if value != "" && !validIntOrPercentage(value) {
+			return &ValidationError{"PodDisruptionBudget values must be a number of pods or a percentage between 0% and 100%", fields}
+		}
+	}
+	return nil
+}
+
+type namedProbe struct {
+	field string
+	probe Probe
+}
+
+// The probes of the healthcheck with their field names
+func probes(healthcheck Healthcheck) []namedProbe {
+	return []namedProbe{{"Liveness", healthcheck.Liveness}, {"Readiness", healthcheck.Readiness}}
+}
+
+func validateHealthcheck(manifest NaisManifest) *ValidationError {
+	if !reflect.DeepEqual(manifest.Healthcheck.Startup, Probe{}) {
+		return &ValidationError{
+			"Healthcheck.Startup is not supported, as the cluster does not run startup probes. Set initialDelay on the liveness probe instead",
+			map[string]string{"Probe": "Startup"},
+		}
+	}
+
+	for _, named := range probes(manifest.Healthcheck) {
+		field, probe := named.field, named.probe
+		fields := map[string]string{"Probe": field, "Type": probe.Type, "Path": probe.Path, "Command": strings.Join(probe.Command, " ")}
+		switch probe.probeType() {
+		case ProbeTypeHTTP:
+			if probe.Path == "" {
+				return &ValidationError{"Http probes must have a path", fields}
+			}
+		case ProbeTypeExec:
+			if len(probe.Command) == 0 {
+				return &ValidationError{"Exec probes must have a command", fields}
+			}
+		case ProbeTypeTCP:
+		default:
+			return &ValidationError{"Probes must have the type http, tcp or exec", fields}
+		}
+		if len(probe.Command) > 0 && probe.probeType() != ProbeTypeExec {
+			return &ValidationError{"Only exec probes can have a command", fields}
+		}
+
+		if probe.InitialDelay < 0 || probe.PeriodSeconds < 0 || probe.FailureThreshold < 0 || probe.Timeout < 0 {
+			return &ValidationError{"Probes cannot have a negative initialDelay, periodSeconds, failureThreshold or timeout", fields}
+		}
+	}
+	return nil
+}
+
+func validatePorts(manifest NaisManifest) *ValidationError {
+	ports := map[string]Port{}
+	for _, port := range manifest.Ports {
+		fields := map[string]string{"Name": port.Name, "ContainerPort": strconv.Itoa(port.ContainerPort), "ServicePort": strconv.Itoa(port.ServicePort), "Protocol": port.Protocol}
+		if _, found := ports[port.Name]; found || len(validation.IsValidPortName(port.Name)) > 0 {
+			return &ValidationError{"Ports must have unique names of at most 15 lowercase letters, numbers and dashes", fields}
+		}
+		ports[port.Name] = port
+
+		if len(validation.IsValidPortNum(port.ContainerPort)) > 0 || (port.ServicePort != 0 && len(validation.IsValidPortNum(port.ServicePort)) > 0) {
+			return &ValidationError{"Ports must have a containerPort, and optionally a servicePort, between 1 and 65535", fields}
+		}
+		if port.Protocol != "" && !strings.EqualFold(port.Protocol, string(k8score.ProtocolTCP)) && !strings.EqualFold(port.Protocol, string(k8score.ProtocolUDP)) {
+			return &ValidationError{"Ports must have the protocol TCP or UDP", fields}
+		}
+	}
+	if len(manifest.Ports) == 0 {
+		for _, port := range manifestPorts(manifest) {
+			ports[port.Name] = port
+		}
+	}
+
+	var references [][2]string
+	for _, named := range probes(manifest.Healthcheck) {
+		if named.probe.probeType() != ProbeTypeExec {
+			references = append(references, [2]string{fmt.Sprintf("Healthcheck.%s.Port", named.field), named.probe.Port})
+		}
+	}
+	if manifest.Prometheus.Enabled {
+		references = append(references, [2]string{"Prometheus.Port", manifest.Prometheus.Port})
+	}
+	if !manifest.Ingress.Disabled && manifest.Kind != KindCronJob {
+		references = append(references, [2]string{"Ingress.Port", manifest.Ingress.Port})
+	}
+	for _, reference := range references {
+		field, name := reference[0], portName(reference[1])
+		port, found := ports[name]
+		if !found {
+			return &ValidationError{fmt.Sprintf("%s must name a port in Ports", field), map[string]string{field: name}}
+		}
+		if field == "Ingress.Port" && port.ServicePort == 0 {
+			return &ValidationError{"Ingress.Port must name a port with a servicePort", map[string]string{field: name}}
+		}
+	}
+	return nil
+}
+
+func validateAccessPolicy(manifest NaisManifest) *ValidationError {
+	rules := append([]AccessRule{}, manifest.AccessPolicy.Inbound...)
+	for _, rule := range append(rules, manifest.AccessPolicy.Outbound...) {
+		valid := rule.Application != "" || rule.Namespace != ""
+		for _, name := range []string{rule.Application, rule.Namespace} {
+			if name != "" && !validDNSLabel(name) {
+				valid = false
+			}
+		}
+		if !valid {
+			return &ValidationError{
+				"AccessPolicy rules must have an application, a namespace or both, of lowercase letters, numbers and dashes",
+				map[string]string{"Application": rule.Application, "Namespace": rule.Namespace},
+			}
+		}
+	}
+	if len(manifest.AccessPolicy.Inbound) > 0 && manifest.Kind == KindCronJob {
+		return &ValidationError{
+			"AccessPolicy cannot have inbound rules when Kind is cronjob",
+			map[string]string{"Kind": manifest.Kind},
+		}
+	}
+	return nil
+}
+
+func validateEnv(manifest NaisManifest) *ValidationError {
+	for name := range manifest.Env {
+		if len(validation.IsCIdentifier(name)) > 0 {
+			return &ValidationError{
+				"Env names must be letters, numbers and underscores, not starting with a number",
+				map[string]string{"Name": name},
+			}
+		}
+	}
+	return nil
+}
+
+func validateConfigMap(manifest NaisManifest) *ValidationError {
+	if len(manifest.ConfigMap.Files) == 0 {
+		return nil
+	}
+
+	if !strings.HasPrefix(manifest.ConfigMap.MountPath, "/") {
+		return &ValidationError{
+			"ConfigMap must have an absolute mountPath",
+			map[string]string{"ConfigMap.MountPath": manifest.ConfigMap.MountPath},
+		}
+	}
+
+	size := 0
+	for name, content := range manifest.ConfigMap.Files {
+		if len(validation.IsConfigMapKey(name)) > 0 {
+			return &ValidationError{
+				"ConfigMap files must have names of letters, numbers, dashes, underscores and dots",
+				map[string]string{"Name": name},
+			}
+		}
+		size += len(name) + len(content)
+	}
+	if size > maxConfigMapSize {
+		return &ValidationError{
+			"ConfigMap files cannot be larger than 128KiB in total",
+			map[string]string{"Size": strconv.Itoa(size)},
+		}
+	}
+	return nil
+}
+
+// The manifest is recorded in an annotation of the deployment, which is limited in size
+func validateRecordedManifest(manifest NaisManifest) *ValidationError {
+	manifestYaml, err := yaml.Marshal(manifest)
+	if err != nil {
+		return &ValidationError{
+			"Manifest could not be marshalled",
+			map[string]string{"Error": err.Error()},
+		}
+	}
+
+	if len(manifestYaml) > maxRecordedManifestSize {
+		return &ValidationError{
+			"Manifest cannot be larger than 192KiB, including the files of the configmap and the env",
+			map[string]string{"Size": strconv.Itoa(len(manifestYaml))},
+		}
+	}
+	return nil
+}
+
+func validateContainers(manifest NaisManifest) *ValidationError {
+	volumes := map[string]bool{}
+	for _, volume := range manifest.SharedVolumes {
+		if !validDNSLabel(volume.Name) || volumes[volume.Name] {
+			return &ValidationError{
+				"SharedVolumes must have unique names of lowercase letters, numbers and dashes",
+				map[string]string{"Name": volume.Name},
+			}
+		}
+		volumes[volume.Name] = true
+	}
+
+	names := map[string]bool{"elector": true}
+	for _, container := range append(append([]Container{}, manifest.Sidecars...), manifest.InitContainers...) {
+		if !validDNSLabel(container.Name) || names[container.Name] {
+			return &ValidationError{
+				"Sidecars and InitContainers must have unique names of lowercase letters, numbers and dashes, other than elector",
+				map[string]string{"Name": container.Name},
+			}
+		}
+		names[container.Name] = true
+
+		if container.Image == "" {
+			return &ValidationError{
+				"Sidecars and InitContainers must have an image",
+				map[string]string{"Name": container.Name},
+			}
+		}
+
+		for _, quantity := range []string{container.Resources.Limits.Cpu, container.Resources.Limits.Memory, container.Resources.Requests.Cpu, container.Resources.Requests.Memory} {
+			if _, err := k8sresource.ParseQuantity(quantity); quantity != "" && err != nil {
+				return &ValidationError{
+					"Resources of Sidecars and InitContainers must be valid quantities",
+					map[string]string{"Name": container.Name, "Quantity": quantity},
+				}
+			}
+		}
+
+		for _, mount := range container.VolumeMounts {
+			if !volumes[mount.Name] || mount.MountPath == "" {
+				return &ValidationError{
+					"VolumeMounts must have a mountPath and refer to one of the SharedVolumes",
+					map[string]string{"Name": container.Name, "Volume": mount.Name},
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validDNSLabel(name string) bool {
+	return len(validation.IsDNS1123Label(name)) == 0
+}
+
 func validateImage(manifest NaisManifest) *ValidationError {
 	if strings.LastIndex(manifest.Image, ":") > strings.LastIndex(manifest.Image, "/") {
 		return &ValidationError{
@@ -251,6 +1034,40 @@ func validateCpuThreshold(manifest NaisManifest) *ValidationError {
 	return nil
 
 }
+func validateMetrics(manifest NaisManifest) *ValidationError {
+	for i, metric := range manifest.Replicas.Metrics {
+		fields := map[string]string{"Replicas.Metrics": strconv.Itoa(i), "Type": metric.Type, "Name": metric.Name}
+
+		switch metric.Type {
+		case MetricTypeResource:
+			if metric.Name != string(k8score.ResourceCPU) && metric.Name != string(k8score.ResourceMemory) {
+				return &ValidationError{"Resource metrics must be named cpu or memory", fields}
+			}
+			if (metric.TargetAverageUtilization > 0) == validQuantity(metric.TargetAverageValue) {
+				return &ValidationError{"Resource metrics must have either a positive targetAverageUtilization or a targetAverageValue", fields}
+			}
+		case MetricTypePods:
+			if metric.Name == "" || !validQuantity(metric.TargetAverageValue) {
+				return &ValidationError{"Pods metrics must have a name and a targetAverageValue", fields}
+			}
+		case MetricTypeObject:
+			if metric.Name == "" || !validQuantity(metric.TargetValue) || metric.Object.Kind == "" || metric.Object.Name == "" {
+				return &ValidationError{"Object metrics must have a name, a targetValue and the kind and name of the object", fields}
+			}
+		case MetricTypeExternal:
+			return &ValidationError{"External metrics are not supported yet. Replicas.Metrics must be of type resource, pods or object", fields}
+		default:
+			return &ValidationError{"Replicas.Metrics must be of type resource, pods or object", fields}
+		}
+	}
+	return nil
+}
+
+func validQuantity(quantity string) bool {
+	_, err := k8sresource.ParseQuantity(quantity)
+	return err == nil
+}
+
 func validateMinIsSmallerThanMax(manifest NaisManifest) *ValidationError {
 	if manifest.Replicas.Min > manifest.Replicas.Max {
 		validationError := new(ValidationError)
@@ -3,6 +3,8 @@ package api
 import (
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/h2non/gock.v1"
+	"gopkg.in/yaml.v2"
+	"strings"
 	"testing"
 )
 
@@ -14,7 +16,7 @@ func TestManifestUnmarshal(t *testing.T) {
 		Reply(200).
 		File("testdata/nais.yaml")
 
-	manifest, err := GenerateManifest(NaisDeploymentRequest{ManifestUrl: repopath})
+	manifest, err := GenerateManifest(NaisDeploymentRequest{ManifestUrl: repopath}, EnvironmentClassFromName)
 
 	assert.NoError(t, err)
 
@@ -48,9 +50,13 @@ func TestManifestUnmarshal(t *testing.T) {
 	assert.Equal(t, 69, manifest.Healthcheck.Liveness.Timeout)
 	assert.Equal(t, "/stop", manifest.PreStopHookPath)
 	assert.Equal(t, true, manifest.Ingress.Disabled)
+	assert.Equal(t, DeploymentStrategyRollingUpdate, manifest.Deployment.Strategy)
+	assert.Equal(t, "50%", manifest.Deployment.MaxSurge)
+	assert.Equal(t, "2", manifest.Deployment.MaxUnavailable)
+	assert.Equal(t, 600, manifest.Deployment.ProgressDeadlineSeconds)
+	assert.Equal(t, 10, manifest.Deployment.RevisionHistoryLimit)
 }
 
-
 func TestManifestUsesDefaultValues(t *testing.T) {
 
 	const repopath = "https://manifest.repo"
@@ -60,7 +66,7 @@ func TestManifestUsesDefaultValues(t *testing.T) {
 		Reply(200).
 		File("testdata/nais_minimal.yaml")
 
-	manifest, err := GenerateManifest(NaisDeploymentRequest{ManifestUrl: repopath})
+	manifest, err := GenerateManifest(NaisDeploymentRequest{ManifestUrl: repopath}, EnvironmentClassFromName)
 
 	assert.NoError(t, err)
 	assert.Equal(t, "docker.adeo.no:5000/", manifest.Image)
@@ -86,6 +92,7 @@ func TestManifestUsesDefaultValues(t *testing.T) {
 	assert.Equal(t, 1, manifest.Healthcheck.Readiness.Timeout)
 	assert.Equal(t, false, manifest.Ingress.Disabled)
 	assert.Empty(t, manifest.PreStopHookPath)
+	assert.Equal(t, DeploymentConfig{Strategy: DeploymentStrategyRollingUpdate, MaxSurge: "1", MaxUnavailable: "0", ProgressDeadlineSeconds: 300, RevisionHistoryLimit: 10}, manifest.Deployment)
 
 }
 
@@ -96,7 +103,7 @@ func TestManifestUsesPartialDefaultValues(t *testing.T) {
 		Reply(200).
 		File("testdata/nais_partial.yaml")
 
-	manifest, err := GenerateManifest(NaisDeploymentRequest{ManifestUrl: repopath})
+	manifest, err := GenerateManifest(NaisDeploymentRequest{ManifestUrl: repopath}, EnvironmentClassFromName)
 
 	assert.NoError(t, err)
 	assert.Equal(t, 2, manifest.Replicas.Min)
@@ -117,7 +124,7 @@ func TestGenerateManifestWithoutPassingRepoUrl(t *testing.T) {
 		gock.New(urls[2]).
 			Reply(404)
 
-		_, err := GenerateManifest(NaisDeploymentRequest{Application: application, Version: version})
+		_, err := GenerateManifest(NaisDeploymentRequest{Application: application, Version: version}, EnvironmentClassFromName)
 		assert.Error(t, err)
 		assert.True(t, gock.IsDone())
 	})
@@ -131,7 +138,7 @@ func TestGenerateManifestWithoutPassingRepoUrl(t *testing.T) {
 			Reply(200).
 			JSON(map[string]string{"image": application})
 
-		manifest, err := GenerateManifest(NaisDeploymentRequest{Application: application, Version: version})
+		manifest, err := GenerateManifest(NaisDeploymentRequest{Application: application, Version: version}, EnvironmentClassFromName)
 		assert.NoError(t, err)
 		assert.Equal(t, application, manifest.Image)
 		assert.True(t, gock.IsDone())
@@ -145,7 +152,7 @@ func TestGenerateManifestWithoutPassingRepoUrl(t *testing.T) {
 			Reply(200).
 			JSON(map[string]string{"image": "incorrect"})
 
-		manifest, err := GenerateManifest(NaisDeploymentRequest{Application: application, Version: version})
+		manifest, err := GenerateManifest(NaisDeploymentRequest{Application: application, Version: version}, EnvironmentClassFromName)
 		assert.NoError(t, err)
 		assert.Equal(t, application, manifest.Image)
 		assert.True(t, gock.IsPending())
@@ -159,7 +166,7 @@ func TestInvalidReplicasConfigGivesValidationErrors(t *testing.T) {
 		Reply(200).
 		File("testdata/nais_error.yaml")
 
-	_, err := GenerateManifest(NaisDeploymentRequest{ManifestUrl: repopath})
+	_, err := GenerateManifest(NaisDeploymentRequest{ManifestUrl: repopath}, EnvironmentClassFromName)
 	assert.Error(t, err)
 }
 
@@ -260,3 +267,401 @@ func TestValidateResource(t *testing.T) {
 	assert.Equal(t, "Alias and ResourceType must be specified", err2.ErrorMessage)
 	assert.Nil(t, noErr)
 }
+
+func TestValidateRollback(t *testing.T) {
+	assert.Nil(t, validateRollback(NaisManifest{}))
+	assert.Nil(t, validateRollback(NaisManifest{Rollback: RollbackAuto}))
+
+	err := validateRollback(NaisManifest{Rollback: "sometimes"})
+	assert.Equal(t, "Rollback can only be auto or empty", err.ErrorMessage)
+	assert.Equal(t, "sometimes", err.Fields["Rollback"])
+
+	// the rollout is watched on the deployment named after the application, which these kinds and strategies do not have
+	blueGreen := NaisManifest{Rollback: RollbackAuto, Strategy: Strategy{BlueGreen: BlueGreenStrategy{Enabled: true}}}
+	assert.Equal(t, "Rollback cannot be combined with Strategy.BlueGreen, traffic is only switched once the new version has rolled out", validateBlueGreen(blueGreen).ErrorMessage)
+	assert.Equal(t, "Rollback cannot be used when Kind is statefulset", validateKind(NaisManifest{Kind: KindStatefulSet, Rollback: RollbackAuto}).ErrorMessage)
+	assert.Equal(t, "Rollback cannot be used when Kind is cronjob", validateKind(NaisManifest{Kind: KindCronJob, Schedule: "@daily", Rollback: RollbackAuto}).ErrorMessage)
+}
+
+func TestValidateCanary(t *testing.T) {
+	assert.Nil(t, validateCanary(NaisManifest{}))
+	assert.Nil(t, validateCanary(NaisManifest{Strategy: Strategy{Canary: CanaryStrategy{Weight: 10, Duration: "10m"}}}))
+
+	err := validateCanary(NaisManifest{Strategy: Strategy{Canary: CanaryStrategy{Replicas: 1, Weight: 10}}})
+	assert.Equal(t, "Strategy.Canary must have either replicas or weight", err.ErrorMessage)
+
+	err = validateCanary(NaisManifest{Strategy: Strategy{Canary: CanaryStrategy{Weight: 100}}})
+	assert.Equal(t, "Strategy.Canary.Weight must be between 1 and 99", err.ErrorMessage)
+
+	err = validateCanary(NaisManifest{Strategy: Strategy{Canary: CanaryStrategy{Replicas: 1, Duration: "1h"}}})
+	assert.Equal(t, "Strategy.Canary.Duration must be a duration of at most 20m0s", err.ErrorMessage)
+}
+
+func TestValidateDeployment(t *testing.T) {
+	assert.Nil(t, validateDeployment(NaisManifest{}))
+	assert.Nil(t, validateDeployment(NaisManifest{Deployment: DeploymentConfig{Strategy: DeploymentStrategyRollingUpdate, MaxSurge: "25%", MaxUnavailable: "0"}}))
+	assert.Nil(t, validateDeployment(NaisManifest{Deployment: DeploymentConfig{Strategy: DeploymentStrategyRecreate, MaxSurge: "0", MaxUnavailable: "0"}}))
+
+	err := validateDeployment(NaisManifest{Deployment: DeploymentConfig{Strategy: "BlueGreen"}})
+	assert.Equal(t, "Deployment.Strategy must be RollingUpdate or Recreate", err.ErrorMessage)
+
+	err = validateDeployment(NaisManifest{Deployment: DeploymentConfig{MaxSurge: "150%"}})
+	assert.Equal(t, "Deployment.MaxSurge must be a number of pods or a percentage between 0% and 100%", err.ErrorMessage)
+
+	err = validateDeployment(NaisManifest{Deployment: DeploymentConfig{MaxUnavailable: "one"}})
+	assert.Equal(t, "one", err.Fields["MaxUnavailable"])
+
+	err = validateDeployment(NaisManifest{Deployment: DeploymentConfig{MaxSurge: "0%", MaxUnavailable: "0"}})
+	assert.Equal(t, "Deployment.MaxSurge and Deployment.MaxUnavailable cannot both be 0", err.ErrorMessage)
+
+	err = validateDeployment(NaisManifest{Deployment: DeploymentConfig{RevisionHistoryLimit: -1}})
+	assert.Equal(t, "Deployment.RevisionHistoryLimit cannot be negative", err.ErrorMessage)
+}
+
+func TestValidateContainers(t *testing.T) {
+	volumes := []SharedVolume{{Name: "logs"}}
+	valid := Container{Name: "shipper", Image: "docker.hub/shipper:1.0", VolumeMounts: []VolumeMount{{Name: "logs", MountPath: "/logs"}}}
+	assert.Nil(t, validateContainers(NaisManifest{}))
+	assert.Nil(t, validateContainers(NaisManifest{Sidecars: []Container{valid}, SharedVolumes: volumes}))
+
+	err := validateContainers(NaisManifest{Sidecars: []Container{valid}, InitContainers: []Container{valid}, SharedVolumes: volumes})
+	assert.Equal(t, "Sidecars and InitContainers must have unique names of lowercase letters, numbers and dashes, other than elector", err.ErrorMessage)
+
+	err = validateContainers(NaisManifest{Sidecars: []Container{{Name: "elector", Image: "docker.hub/elector:1.0"}}})
+	assert.Equal(t, "elector", err.Fields["Name"])
+
+	err = validateContainers(NaisManifest{Sidecars: []Container{{Name: "shipper"}}})
+	assert.Equal(t, "Sidecars and InitContainers must have an image", err.ErrorMessage)
+
+	err = validateContainers(NaisManifest{Sidecars: []Container{{Name: "shipper", Image: "docker.hub/shipper:1.0", Resources: ResourceRequirements{Limits: ResourceList{Cpu: "lots"}}}}})
+	assert.Equal(t, "lots", err.Fields["Quantity"])
+
+	err = validateContainers(NaisManifest{Sidecars: []Container{valid}})
+	assert.Equal(t, "VolumeMounts must have a mountPath and refer to one of the SharedVolumes", err.ErrorMessage)
+
+	err = validateContainers(NaisManifest{SharedVolumes: []SharedVolume{{Name: "Logs"}}})
+	assert.Equal(t, "SharedVolumes must have unique names of lowercase letters, numbers and dashes", err.ErrorMessage)
+}
+
+func TestValidateMigration(t *testing.T) {
+	assert.Nil(t, validateMigration(NaisManifest{Migration: Migration{Enabled: true}}))
+	assert.Nil(t, validateMigration(NaisManifest{Migration: Migration{Enabled: true, Timeout: "15m"}}))
+
+	err := validateMigration(NaisManifest{Migration: Migration{Enabled: true, Timeout: "1h"}})
+	assert.Equal(t, "Migration.Timeout must be a duration of at most 20m0s", err.ErrorMessage)
+
+	err = validateMigration(NaisManifest{Migration: Migration{Enabled: true, Timeout: "soon"}})
+	assert.Equal(t, "soon", err.Fields["Timeout"])
+}
+
+func TestValidateKind(t *testing.T) {
+	assert.Nil(t, validateKind(NaisManifest{}))
+	assert.Nil(t, validateKind(NaisManifest{Kind: KindCronJob, Schedule: "*/15 * * * *"}))
+	assert.Nil(t, validateKind(NaisManifest{Kind: KindCronJob, Schedule: "@hourly"}))
+
+	err := validateKind(NaisManifest{Kind: "daemonset"})
+	assert.Equal(t, "Kind must be deployment, statefulset or cronjob", err.ErrorMessage)
+
+	err = validateKind(NaisManifest{Schedule: "@hourly"})
+	assert.Equal(t, "Schedule can only be set when Kind is cronjob", err.ErrorMessage)
+
+	err = validateKind(NaisManifest{Kind: KindCronJob, Schedule: "every night"})
+	assert.Equal(t, "every night", err.Fields["Schedule"])
+
+	err = validateKind(NaisManifest{Kind: KindCronJob, Schedule: "@daily", LeaderElection: true})
+	assert.Equal(t, "LeaderElection cannot be used when Kind is cronjob", err.ErrorMessage)
+
+	assert.Nil(t, validateKind(NaisManifest{Kind: KindStatefulSet, LeaderElection: true, PersistentVolumes: []PersistentVolume{{Name: "data"}}}))
+
+	err = validateKind(NaisManifest{Kind: KindStatefulSet, Rollback: RollbackAuto})
+	assert.Equal(t, "Rollback cannot be used when Kind is statefulset", err.ErrorMessage)
+
+	err = validateKind(NaisManifest{PersistentVolumes: []PersistentVolume{{Name: "data"}}})
+	assert.Equal(t, "PersistentVolumes can only be used when Kind is statefulset", err.ErrorMessage)
+}
+
+func TestValidatePersistentVolumes(t *testing.T) {
+	valid := PersistentVolume{Name: "data", Size: "10Gi", MountPath: "/var/lib/data"}
+	assert.Nil(t, validatePersistentVolumes(NaisManifest{PersistentVolumes: []PersistentVolume{valid}}))
+
+	err := validatePersistentVolumes(NaisManifest{PersistentVolumes: []PersistentVolume{valid, valid}})
+	assert.Equal(t, "PersistentVolumes must have unique names of lowercase letters, numbers and dashes", err.ErrorMessage)
+
+	err = validatePersistentVolumes(NaisManifest{PersistentVolumes: []PersistentVolume{{Name: "data", Size: "big", MountPath: "/data"}}})
+	assert.Equal(t, "big", err.Fields["Size"])
+
+	err = validatePersistentVolumes(NaisManifest{PersistentVolumes: []PersistentVolume{{Name: "data", Size: "1Gi", MountPath: "data"}}})
+	assert.Equal(t, "PersistentVolumes must have an absolute mountPath", err.ErrorMessage)
+}
+
+func TestValidateMetrics(t *testing.T) {
+	assert.Nil(t, validateMetrics(NaisManifest{}))
+	assert.Nil(t, validateMetrics(NaisManifest{Replicas: Replicas{Metrics: []Metric{
+		{Type: MetricTypeResource, Name: "cpu", TargetAverageUtilization: 70},
+		{Type: MetricTypeResource, Name: "memory", TargetAverageValue: "1Gi"},
+		{Type: MetricTypePods, Name: "http_requests_per_second", TargetAverageValue: "100"},
+		{Type: MetricTypeObject, Name: "queue_lag", TargetValue: "500", Object: MetricObject{Kind: "Service", Name: "queue"}},
+	}}}))
+
+	err := validateMetrics(NaisManifest{Replicas: Replicas{Metrics: []Metric{{Type: MetricTypeResource, Name: "disk", TargetAverageUtilization: 70}}}})
+	assert.Equal(t, "Resource metrics must be named cpu or memory", err.ErrorMessage)
+
+	err = validateMetrics(NaisManifest{Replicas: Replicas{Metrics: []Metric{{Type: MetricTypeResource, Name: "cpu", TargetAverageUtilization: 70, TargetAverageValue: "500m"}}}})
+	assert.Equal(t, "Resource metrics must have either a positive targetAverageUtilization or a targetAverageValue", err.ErrorMessage)
+
+	err = validateMetrics(NaisManifest{Replicas: Replicas{Metrics: []Metric{{Type: MetricTypePods, Name: "rps", TargetAverageValue: "many"}}}})
+	assert.Equal(t, "Pods metrics must have a name and a targetAverageValue", err.ErrorMessage)
+
+	err = validateMetrics(NaisManifest{Replicas: Replicas{Metrics: []Metric{{Type: MetricTypeObject, Name: "queue_lag", TargetValue: "500"}}}})
+	assert.Equal(t, "Object metrics must have a name, a targetValue and the kind and name of the object", err.ErrorMessage)
+
+	err = validateMetrics(NaisManifest{Replicas: Replicas{Metrics: []Metric{{Type: "custom", Name: "queue_lag"}}}})
+	assert.Equal(t, "Replicas.Metrics must be of type resource, pods or object", err.ErrorMessage)
+	assert.Equal(t, "0", err.Fields["Replicas.Metrics"])
+
+	err = validateMetrics(NaisManifest{Replicas: Replicas{Metrics: []Metric{{Type: MetricTypeExternal, Name: "queue_lag"}}}})
+	assert.Equal(t, "External metrics are not supported yet. Replicas.Metrics must be of type resource, pods or object", err.ErrorMessage)
+}
+
+func TestValidatePodDisruptionBudget(t *testing.T) {
+	assert.Nil(t, validatePodDisruptionBudget(NaisManifest{}))
+	assert.Nil(t, validatePodDisruptionBudget(NaisManifest{PodDisruptionBudget: PodDisruptionBudgetConfig{MinAvailable: "50%"}}))
+
+	err := validatePodDisruptionBudget(NaisManifest{PodDisruptionBudget: PodDisruptionBudgetConfig{MinAvailable: "1", MaxUnavailable: "1"}})
+	assert.Equal(t, "PodDisruptionBudget can have either minAvailable or maxUnavailable", err.ErrorMessage)
+
+	err = validatePodDisruptionBudget(NaisManifest{PodDisruptionBudget: PodDisruptionBudgetConfig{MaxUnavailable: "half"}})
+	assert.Equal(t, "half", err.Fields["MaxUnavailable"])
+}
+
+func TestValidateAccessPolicy(t *testing.T) {
+	assert.Nil(t, validateAccessPolicy(NaisManifest{}))
+	assert.Nil(t, validateAccessPolicy(NaisManifest{AccessPolicy: AccessPolicy{
+		Inbound:  []AccessRule{{Application: "frontend"}, {Namespace: "monitoring"}},
+		Outbound: []AccessRule{{Application: "backend", Namespace: "other"}},
+	}}))
+
+	err := validateAccessPolicy(NaisManifest{AccessPolicy: AccessPolicy{Outbound: []AccessRule{{}}}})
+	assert.Equal(t, "AccessPolicy rules must have an application, a namespace or both, of lowercase letters, numbers and dashes", err.ErrorMessage)
+
+	err = validateAccessPolicy(NaisManifest{AccessPolicy: AccessPolicy{Inbound: []AccessRule{{Application: "Frontend"}}}})
+	assert.Equal(t, "Frontend", err.Fields["Application"])
+
+	err = validateAccessPolicy(NaisManifest{Kind: KindCronJob, AccessPolicy: AccessPolicy{Inbound: []AccessRule{{Application: "frontend"}}}})
+	assert.Equal(t, "AccessPolicy cannot have inbound rules when Kind is cronjob", err.ErrorMessage)
+}
+
+func TestValidatePorts(t *testing.T) {
+	manifest := newDefaultManifest()
+	assert.Nil(t, validatePorts(manifest))
+
+	manifest.Ports = []Port{{Name: "grpc", ContainerPort: 9090, ServicePort: 9090}, {Name: "admin", ContainerPort: 8081}}
+	manifest.Healthcheck.Liveness.Port = "admin"
+	manifest.Healthcheck.Readiness.Port = "admin"
+	manifest.Prometheus.Port = "admin"
+	manifest.Ingress.Port = "grpc"
+	assert.Nil(t, validatePorts(manifest))
+
+	t.Run("ports must be valid", func(t *testing.T) {
+		invalid := manifest
+		invalid.Ports = []Port{{Name: "http", ContainerPort: 8080}, {Name: "http", ContainerPort: 8081}}
+		assert.Equal(t, "Ports must have unique names of at most 15 lowercase letters, numbers and dashes", validatePorts(invalid).ErrorMessage)
+
+		invalid.Ports = []Port{{Name: "http", ContainerPort: 70000}}
+		assert.Equal(t, "Ports must have a containerPort, and optionally a servicePort, between 1 and 65535", validatePorts(invalid).ErrorMessage)
+
+		invalid.Ports = []Port{{Name: "http", ContainerPort: 8080, Protocol: "SCTP"}}
+		assert.Equal(t, "Ports must have the protocol TCP or UDP", validatePorts(invalid).ErrorMessage)
+	})
+
+	t.Run("probes, prometheus and the ingress must name a port", func(t *testing.T) {
+		invalid := manifest
+		invalid.Healthcheck.Readiness.Port = ""
+		err := validatePorts(invalid)
+		assert.Equal(t, "Healthcheck.Readiness.Port must name a port in Ports", err.ErrorMessage)
+		assert.Equal(t, DefaultPortName, err.Fields["Healthcheck.Readiness.Port"])
+
+		invalid = manifest
+		invalid.Ingress.Port = "admin"
+		assert.Equal(t, "Ingress.Port must name a port with a servicePort", validatePorts(invalid).ErrorMessage)
+
+		invalid.Ingress.Disabled = true
+		assert.Nil(t, validatePorts(invalid))
+	})
+}
+
+func TestValidateHealthcheck(t *testing.T) {
+	manifest := newDefaultManifest()
+	assert.Nil(t, validateHealthcheck(manifest))
+
+	manifest.Healthcheck.Liveness = Probe{Type: ProbeTypeExec, Command: []string{"pg_isready"}}
+	manifest.Healthcheck.Readiness = Probe{Type: ProbeTypeTCP}
+	assert.Nil(t, validateHealthcheck(manifest))
+
+	invalid := manifest
+	invalid.Healthcheck.Liveness = Probe{Type: ProbeTypeExec}
+	assert.Equal(t, "Exec probes must have a command", validateHealthcheck(invalid).ErrorMessage)
+
+	invalid = manifest
+	invalid.Healthcheck.Readiness = Probe{Type: ProbeTypeHTTP}
+	err := validateHealthcheck(invalid)
+	assert.Equal(t, "Http probes must have a path", err.ErrorMessage)
+	assert.Equal(t, "Readiness", err.Fields["Probe"])
+
+	invalid = manifest
+	invalid.Healthcheck.Startup = Probe{Path: "isStarted", PeriodSeconds: 10, FailureThreshold: 30}
+	err = validateHealthcheck(invalid)
+	assert.Equal(t, "Healthcheck.Startup is not supported, as the cluster does not run startup probes. Set initialDelay on the liveness probe instead", err.ErrorMessage)
+
+	invalid = manifest
+	invalid.Healthcheck.Readiness = Probe{Type: "grpc"}
+	assert.Equal(t, "Probes must have the type http, tcp or exec", validateHealthcheck(invalid).ErrorMessage)
+
+	invalid = manifest
+	invalid.Healthcheck.Readiness = Probe{Path: "isReady", Command: []string{"true"}}
+	assert.Equal(t, "Only exec probes can have a command", validateHealthcheck(invalid).ErrorMessage)
+
+	invalid = manifest
+	invalid.Healthcheck.Readiness = Probe{Type: ProbeTypeTCP, Timeout: -1}
+	assert.Equal(t, "Probes cannot have a negative initialDelay, periodSeconds, failureThreshold or timeout", validateHealthcheck(invalid).ErrorMessage)
+}
+
+func TestValidateEnv(t *testing.T) {
+	manifest := newDefaultManifest()
+	manifest.Env = map[string]string{"LOG_LEVEL": "debug", "_PRIVATE": "x"}
+	assert.Nil(t, validateEnv(manifest))
+
+	manifest.Env = map[string]string{"1LOG": "debug"}
+	assert.Equal(t, "Env names must be letters, numbers and underscores, not starting with a number", validateEnv(manifest).ErrorMessage)
+
+	manifest.Env = map[string]string{"LOG-LEVEL": "debug"}
+	assert.NotNil(t, validateEnv(manifest))
+}
+
+func TestValidateConfigMap(t *testing.T) {
+	manifest := newDefaultManifest()
+	assert.Nil(t, validateConfigMap(manifest))
+
+	manifest.ConfigMap = ConfigMapConfig{MountPath: "/etc/app", Files: map[string]string{"logback.xml": "<configuration/>"}}
+	assert.Nil(t, validateConfigMap(manifest))
+
+	invalid := manifest
+	invalid.ConfigMap = ConfigMapConfig{MountPath: "etc/app", Files: manifest.ConfigMap.Files}
+	assert.Equal(t, "ConfigMap must have an absolute mountPath", validateConfigMap(invalid).ErrorMessage)
+
+	invalid.ConfigMap = ConfigMapConfig{MountPath: "/etc/app", Files: map[string]string{"conf/app.yaml": ""}}
+	assert.Equal(t, "ConfigMap files must have names of letters, numbers, dashes, underscores and dots", validateConfigMap(invalid).ErrorMessage)
+
+	largest := manifest
+	largest.ConfigMap = ConfigMapConfig{MountPath: "/etc/app", Files: map[string]string{"big.txt": strings.Repeat("x", maxConfigMapSize-len("big.txt"))}}
+	assert.Nil(t, validateConfigMap(largest))
+	assert.Nil(t, validateRecordedManifest(largest))
+
+	annotations, err := createDeploymentAnnotations(NaisDeploymentRequest{Zone: ZONE_FSS, Version: version}, largest)
+	assert.NoError(t, err)
+	size := 0
+	for key, value := range annotations {
+		size += len(key) + len(value)
+	}
+	assert.True(t, size < 256*1024, "the largest files fit in the annotations of the deployment")
+
+	invalid.ConfigMap = ConfigMapConfig{MountPath: "/etc/app", Files: map[string]string{"big.txt": strings.Repeat("x", maxConfigMapSize-len("big.txt")+1)}}
+	assert.Equal(t, "ConfigMap files cannot be larger than 128KiB in total", validateConfigMap(invalid).ErrorMessage)
+}
+
+func TestValidateRecordedManifest(t *testing.T) {
+	manifest := newDefaultManifest()
+	assert.Nil(t, validateRecordedManifest(manifest))
+
+	manifest.Env = map[string]string{"BIG": strings.Repeat("x", maxRecordedManifestSize)}
+	assert.Equal(t, "Manifest cannot be larger than 192KiB, including the files of the configmap and the env", validateRecordedManifest(manifest).ErrorMessage)
+}
+
+func TestApplyEnvironmentOverrides(t *testing.T) {
+	const manifestYaml = `
+image: docker.hub/app
+replicas:
+  min: 2
+  max: 4
+ingress:
+  disabled: true
+env:
+  LOG_LEVEL: info
+  TIMEOUT: "10"
+environments:
+  q:
+    replicas:
+      max: 2
+    env:
+      LOG_LEVEL: debug
+  q0:
+    ingress:
+      disabled: false
+  p:
+    replicas:
+      min: 4
+      max: 8
+    resources:
+      limits:
+        memory: 1Gi
+`
+	unmarshal := func() NaisManifest {
+		var manifest NaisManifest
+		assert.NoError(t, yaml.Unmarshal([]byte(manifestYaml), &manifest))
+		return manifest
+	}
+
+	t.Run("the environment is merged over its class and the base", func(t *testing.T) {
+		manifest := unmarshal()
+		assert.NoError(t, ApplyEnvironmentOverrides(&manifest, "q0", EnvironmentClassFromName))
+		assert.Equal(t, []int{2, 2}, []int{manifest.Replicas.Min, manifest.Replicas.Max})
+		assert.False(t, manifest.Ingress.Disabled)
+		assert.Equal(t, map[string]string{"LOG_LEVEL": "debug", "TIMEOUT": "10"}, manifest.Env)
+		assert.Equal(t, "docker.hub/app", manifest.Image)
+		assert.Nil(t, manifest.Environments)
+	})
+
+	t.Run("an environment without overrides of its own gets those of its class", func(t *testing.T) {
+		manifest := unmarshal()
+		assert.NoError(t, ApplyEnvironmentOverrides(&manifest, "q1", EnvironmentClassFromName))
+		assert.Equal(t, []int{2, 2}, []int{manifest.Replicas.Min, manifest.Replicas.Max})
+		assert.True(t, manifest.Ingress.Disabled)
+	})
+
+	t.Run("overrides are merged before the defaults are added", func(t *testing.T) {
+		manifest, err := prepareManifest(unmarshal(), appName, "p", EnvironmentClassFromName)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, manifest.Replicas.Min)
+		assert.Equal(t, 8, manifest.Replicas.Max)
+		assert.Equal(t, "1Gi", manifest.Resources.Limits.Memory)
+		assert.Equal(t, "500m", manifest.Resources.Limits.Cpu)
+	})
+
+	t.Run("other environments get the base", func(t *testing.T) {
+		manifest := unmarshal()
+		assert.NoError(t, ApplyEnvironmentOverrides(&manifest, "t1", EnvironmentClassFromName))
+		assert.Equal(t, []int{2, 4}, []int{manifest.Replicas.Min, manifest.Replicas.Max})
+
+		manifest = unmarshal()
+		assert.NoError(t, ApplyEnvironmentOverrides(&manifest, "", EnvironmentClassFromName))
+		assert.Equal(t, []int{2, 4}, []int{manifest.Replicas.Min, manifest.Replicas.Max})
+	})
+
+	t.Run("the class is looked up for environments not named after it", func(t *testing.T) {
+		manifest := unmarshal()
+		fromFasit := func(fasitEnvironment string) (string, error) { return "q", nil }
+		assert.NoError(t, ApplyEnvironmentOverrides(&manifest, "cd-u1", fromFasit))
+		assert.Equal(t, []int{2, 2}, []int{manifest.Replicas.Min, manifest.Replicas.Max})
+	})
+
+	t.Run("an environment whose class is unknown should error", func(t *testing.T) {
+		manifest := unmarshal()
+		assert.Error(t, ApplyEnvironmentOverrides(&manifest, "cd-u1", EnvironmentClassFromName))
+	})
+
+	t.Run("an override of the wrong type should error", func(t *testing.T) {
+		manifest := unmarshal()
+		manifest.Environments["q0"] = map[string]interface{}{"replicas": "many"}
+		assert.Error(t, ApplyEnvironmentOverrides(&manifest, "q0", EnvironmentClassFromName))
+	})
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	k8sbatch "k8s.io/api/batch/v1"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+	"time"
+)
+
+const (
+	MigrationLabel          = "naisd.io/migration"
+	migrationSuffix         = "-migration"
+	defaultMigrationTimeout = 10 * time.Minute
+	// a migration holds the deploy lock, which is renewed while the deploy runs
+	maxMigrationTimeout = 20 * time.Minute
+	migrationLogLines   = 50
+)
+
+var migrationPollInterval = 5 * time.Second
+
+// Returns the last lines logged by the container of a pod, replaced in tests
+var migrationLogs = func(podName, namespace string, k8sClient kubernetes.Interface) (string, error) {
+	tailLines := int64(migrationLogLines)
+	logs, err := k8sClient.CoreV1().Pods(namespace).GetLogs(podName, &k8score.PodLogOptions{TailLines: &tailLines}).Do().Raw()
+	return string(logs), err
+}
+
+var migrations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "migrations", Help: "migration jobs run by NaisD"}, []string{"nais_app", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(migrations)
+}
+
+func (m Migration) timeout() time.Duration {
+	if timeout, err := time.ParseDuration(m.Timeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultMigrationTimeout
+}
+
+func migrationName(application string) string {
+	return application + migrationSuffix
+}
+
+// Runs the migration of the new version as a job before the deployment is updated, so only one pod migrates and a
+// failed migration stops the deploy before the pods do. The job replaces the one of the previous deploy, and is
+// left behind so its pod can be inspected. If the migration fails, the deploy is aborted with the logs of the job
+// and the secret and configmap are put back the way they were.
+func (api Api) runMigration(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource) error {
+	application, namespace := deploymentRequest.Application, deploymentRequest.Namespace
+
+	previousSecret, err := getExistingSecret(application, namespace, api.Clientset)
+	if err != nil {
+		return fmt.Errorf("unable to get existing secret: %s", err)
+	}
+	if _, err := createOrUpdateSecret(deploymentRequest, naisResources, api.Clientset); err != nil {
+		return fmt.Errorf("failed while creating or updating secret: %s", err)
+	}
+
+	previousConfigMap, err := getExistingConfigMap(application, namespace, api.Clientset)
+	if err != nil {
+		return fmt.Errorf("unable to get existing configmap: %s", err)
+	}
+	if _, err := createOrUpdateConfigMap(deploymentRequest, manifest, api.Clientset); err != nil {
+		return fmt.Errorf("failed while creating or updating configmap: %s", err)
+	}
+
+	if err := api.migrate(deploymentRequest, manifest, naisResources); err != nil {
+		migrations.With(prometheus.Labels{"nais_app": application, "result": "failed"}).Inc()
+		if err := restoreSecret(application, namespace, previousSecret, api.Clientset); err != nil {
+			glog.Errorf("unable to restore secret of %s in %s: %s", application, namespace, err)
+		}
+		if err := restoreConfigMap(application, namespace, previousConfigMap, api.Clientset); err != nil {
+			glog.Errorf("unable to restore configmap of %s in %s: %s", application, namespace, err)
+		}
+		return err
+	}
+
+	migrations.With(prometheus.Labels{"nais_app": application, "result": "succeeded"}).Inc()
+	return nil
+}
+
+func (api Api) migrate(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource) error {
+	namespace := deploymentRequest.Namespace
+
+	jobDef, err := createMigrationJobDef(deploymentRequest, manifest, naisResources)
+	if err != nil {
+		return fmt.Errorf("unable to create migration job: %s", err)
+	}
+	if err := deleteMigrationJob(deploymentRequest.Application, namespace, api.Clientset); err != nil {
+		return fmt.Errorf("unable to delete previous migration job: %s", err)
+	}
+	if _, err := api.Clientset.BatchV1().Jobs(namespace).Create(jobDef); err != nil {
+		return fmt.Errorf("unable to create migration job: %s", err)
+	}
+
+	timeout := manifest.Migration.timeout()
+	glog.Infof("running migration of %s version %s in %s", deploymentRequest.Application, deploymentRequest.Version, namespace)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		job, err := api.Clientset.BatchV1().Jobs(namespace).Get(jobDef.Name, k8smeta.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to get migration job: %s", err)
+		}
+
+		if job.Status.Succeeded > 0 {
+			return nil
+		}
+		if job.Status.Failed > 0 || jobFailed(job) {
+			return fmt.Errorf("migration of version %s failed:\n%s", deploymentRequest.Version, migrationJobLogs(job, api.Clientset))
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("migration of version %s did not complete within %s:\n%s", deploymentRequest.Version, timeout, migrationJobLogs(job, api.Clientset))
+		}
+
+		time.Sleep(migrationPollInterval)
+	}
+}
+
+func jobFailed(job *k8sbatch.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == k8sbatch.JobFailed && condition.Status == k8score.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// The logs of the pods of the job, found by the job-name label kubernetes sets on them
+func migrationJobLogs(job *k8sbatch.Job, k8sClient kubernetes.Interface) string {
+	pods, err := k8sClient.CoreV1().Pods(job.Namespace).List(k8smeta.ListOptions{LabelSelector: "job-name=" + job.Name})
+	if err != nil {
+		return fmt.Sprintf("unable to list pods of migration job: %s", err)
+	}
+	if len(pods.Items) == 0 {
+		return "no pods were started by the migration job"
+	}
+
+	var logs []string
+	for _, pod := range pods.Items {
+		podLogs, err := migrationLogs(pod.Name, job.Namespace, k8sClient)
+		if err != nil {
+			podLogs = fmt.Sprintf("unable to get logs: %s", err)
+		}
+		logs = append(logs, fmt.Sprintf("%s:\n%s", pod.Name, podLogs))
+	}
+	return strings.Join(logs, "\n")
+}
+
+// The job runs the image of the new version once, with the environment variables, certificates and files of the app.
+// The pod is not labelled with the app, so the service does not send it traffic.
+func createMigrationJobDef(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource) (*k8sbatch.Job, error) {
+	fasitEnvVars, err := createEnvironmentVariables(deploymentRequest, naisResources)
+	if err != nil {
+		return nil, err
+	}
+	envVars, err := addManifestEnvironmentVariables(fasitEnvVars, manifest.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	container := k8score.Container{
+		Name:            deploymentRequest.Application,
+		Image:           fmt.Sprintf("%s:%s", manifest.Image, deploymentRequest.Version),
+		Command:         manifest.Migration.Command,
+		Args:            manifest.Migration.Args,
+		Resources:       createResourceLimits(manifest.Resources.Requests.Cpu, manifest.Resources.Requests.Memory, manifest.Resources.Limits.Cpu, manifest.Resources.Limits.Memory),
+		Env:             envVars,
+		ImagePullPolicy: k8score.PullIfNotPresent,
+	}
+
+	podSpec := k8score.PodSpec{
+		Containers:    []k8score.Container{container},
+		RestartPolicy: k8score.RestartPolicyNever,
+		DNSPolicy:     k8score.DNSClusterFirst,
+	}
+	if hasCertificate(naisResources) {
+		podSpec.Volumes = append(podSpec.Volumes, createCertificateVolume(deploymentRequest, naisResources))
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, createCertificateVolumeMount(deploymentRequest, naisResources))
+	}
+	if len(manifest.ConfigMap.Files) > 0 {
+		podSpec.Volumes = append(podSpec.Volumes, createConfigMapVolume(deploymentRequest.Application))
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, createConfigMapVolumeMount(deploymentRequest.Application, manifest))
+	}
+
+	timeoutSeconds := int64(manifest.Migration.timeout().Seconds())
+	objectMeta := createObjectMeta(migrationName(deploymentRequest.Application), deploymentRequest.Namespace)
+	objectMeta.Labels = map[string]string{"app": deploymentRequest.Application}
+
+	return &k8sbatch.Job{
+		TypeMeta: k8smeta.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
+		ObjectMeta: objectMeta,
+		Spec: k8sbatch.JobSpec{
+			BackoffLimit:          int32p(0),
+			ActiveDeadlineSeconds: &timeoutSeconds,
+			Template: k8score.PodTemplateSpec{
+				ObjectMeta: k8smeta.ObjectMeta{
+					Name:   migrationName(deploymentRequest.Application),
+					Labels: map[string]string{MigrationLabel: deploymentRequest.Application},
+				},
+				Spec: podSpec,
+			},
+		},
+	}, nil
+}
+
+func deleteMigrationJob(application, namespace string, k8sClient kubernetes.Interface) error {
+	propagation := k8smeta.DeletePropagationBackground
+	err := k8sClient.BatchV1().Jobs(namespace).Delete(migrationName(application), &k8smeta.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	k8sbatch "k8s.io/api/batch/v1"
+	k8score "k8s.io/api/core/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+	"time"
+)
+
+func TestRunMigration(t *testing.T) {
+	migrationPollInterval = time.Millisecond
+	migrationLogs = func(podName, namespace string, k8sClient kubernetes.Interface) (string, error) {
+		return "ERROR: Validate failed", nil
+	}
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: "2.0", Namespace: namespace, Zone: ZONE_FSS}
+	manifest := newDefaultManifest()
+	manifest.Migration = Migration{Enabled: true, Args: []string{"migrate"}, Timeout: "10ms"}
+	secretResource := NaisResource{name: "db", resourceType: "credential", properties: map[string]string{}, secret: map[string]string{"password": "secret"}}
+
+	// the fake clientset does not run jobs, so their status is set when they are fetched
+	clientsetWithJobStatus := func(status k8sbatch.JobStatus) *fake.Clientset {
+		clientset := fake.NewSimpleClientset(&k8score.Pod{ObjectMeta: k8smeta.ObjectMeta{
+			Name:      "appname-migration-x1y2z",
+			Namespace: namespace,
+			Labels:    map[string]string{"job-name": appName + migrationSuffix},
+		}})
+		clientset.PrependReactor("get", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			name := action.(k8stesting.GetAction).GetName()
+			return true, &k8sbatch.Job{ObjectMeta: k8smeta.ObjectMeta{Name: name, Namespace: namespace}, Status: status}, nil
+		})
+		return clientset
+	}
+
+	t.Run("a completed migration lets the deploy continue", func(t *testing.T) {
+		clientset := clientsetWithJobStatus(k8sbatch.JobStatus{Succeeded: 1})
+
+		assert.NoError(t, Api{Clientset: clientset}.runMigration(deploymentRequest, manifest, []NaisResource{secretResource}))
+
+		jobs, _ := clientset.BatchV1().Jobs(namespace).List(k8smeta.ListOptions{})
+		assert.Len(t, jobs.Items, 1)
+		job := jobs.Items[0]
+		assert.Equal(t, appName+migrationSuffix, job.Name)
+		assert.Equal(t, int32(0), *job.Spec.BackoffLimit)
+		assert.Equal(t, map[string]string{MigrationLabel: appName}, job.Spec.Template.Labels)
+		assert.Equal(t, k8score.RestartPolicyNever, job.Spec.Template.Spec.RestartPolicy)
+		assert.Equal(t, image+":2.0", job.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, []string{"migrate"}, job.Spec.Template.Spec.Containers[0].Args)
+
+		secret, _ := getExistingSecret(appName, namespace, clientset)
+		assert.NotNil(t, secret)
+	})
+
+	t.Run("a failed migration aborts the deploy with the logs of the job", func(t *testing.T) {
+		clientset := clientsetWithJobStatus(k8sbatch.JobStatus{Failed: 1})
+
+		err := Api{Clientset: clientset}.runMigration(deploymentRequest, manifest, []NaisResource{secretResource})
+		assert.EqualError(t, err, "migration of version 2.0 failed:\nappname-migration-x1y2z:\nERROR: Validate failed")
+
+		secret, _ := getExistingSecret(appName, namespace, clientset)
+		assert.Nil(t, secret)
+	})
+
+	t.Run("a migration that does not complete in time aborts the deploy", func(t *testing.T) {
+		clientset := clientsetWithJobStatus(k8sbatch.JobStatus{Active: 1})
+
+		err := Api{Clientset: clientset}.runMigration(deploymentRequest, manifest, []NaisResource{})
+		assert.EqualError(t, err, "migration of version 2.0 did not complete within 10ms:\nappname-migration-x1y2z:\nERROR: Validate failed")
+	})
+}
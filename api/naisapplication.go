@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	k8syaml "github.com/ghodss/yaml"
+	"gopkg.in/yaml.v2"
+	k8score "k8s.io/api/core/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	NaisApplicationGroup   = "naisd.io"
+	NaisApplicationVersion = "v1alpha1"
+	NaisApplicationPlural  = "naisapplications"
+)
+
+// An application declared as a Kubernetes object. The spec has the same fields as nais.yaml, and in
+// addition the version to deploy, the Fasit environment and the zone of the application.
+type NaisApplication struct {
+	k8smeta.TypeMeta   `json:",inline"`
+	k8smeta.ObjectMeta `json:"metadata,omitempty"`
+	Spec               json.RawMessage       `json:"spec"`
+	Status             NaisApplicationStatus `json:"status,omitempty"`
+}
+
+type NaisApplicationList struct {
+	k8smeta.TypeMeta `json:",inline"`
+	k8smeta.ListMeta `json:"metadata,omitempty"`
+	Items            []NaisApplication `json:"items"`
+}
+
+type NaisApplicationStatus struct {
+	// The hash of the last spec that was deployed, or that was found to be invalid
+	ObservedSpecHash string                     `json:"observedSpecHash,omitempty"`
+	DeployedVersion  string                     `json:"deployedVersion,omitempty"`
+	Conditions       []NaisApplicationCondition `json:"conditions,omitempty"`
+}
+
+type NaisApplicationCondition struct {
+	Type               string                  `json:"type"`
+	Status             k8score.ConditionStatus `json:"status"`
+	Reason             string                  `json:"reason,omitempty"`
+	Message            string                  `json:"message,omitempty"`
+	LastTransitionTime k8smeta.Time            `json:"lastTransitionTime,omitempty"`
+}
+
+// The fields of the spec that are not part of the manifest
+type naisApplicationTarget struct {
+	Version          string `yaml:"version"`
+	FasitEnvironment string `yaml:"fasitEnvironment"`
+	Zone             string `yaml:"zone"`
+}
+
+// Reads and writes NaisApplications. The 1.9 API server has no status subresource for custom resources,
+// so the status is written by updating the whole object.
+type NaisApplicationClient interface {
+	List() ([]NaisApplication, error)
+	Get(namespace, name string) (*NaisApplication, error)
+	Update(application NaisApplication) error
+}
+
+type restNaisApplicationClient struct {
+	restClient rest.Interface
+}
+
+func NewNaisApplicationClient(restClient rest.Interface) NaisApplicationClient {
+	return restNaisApplicationClient{restClient: restClient}
+}
+
+func (c restNaisApplicationClient) List() ([]NaisApplication, error) {
+	b, err := c.restClient.Get().AbsPath("/apis", NaisApplicationGroup, NaisApplicationVersion, NaisApplicationPlural).Do().Raw()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list naisapplications: %s", err)
+	}
+
+	var list NaisApplicationList
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal naisapplications: %s", err)
+	}
+
+	return list.Items, nil
+}
+
+func (c restNaisApplicationClient) Get(namespace, name string) (*NaisApplication, error) {
+	b, err := c.restClient.Get().AbsPath(naisApplicationPath(namespace, name)...).Do().Raw()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get naisapplication %s in %s: %s", name, namespace, err)
+	}
+
+	var application NaisApplication
+	if err := json.Unmarshal(b, &application); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal naisapplication %s in %s: %s", name, namespace, err)
+	}
+
+	return &application, nil
+}
+
+func (c restNaisApplicationClient) Update(application NaisApplication) error {
+	b, err := json.Marshal(application)
+	if err != nil {
+		return fmt.Errorf("unable to marshal naisapplication %s: %s", application.Name, err)
+	}
+
+	err = c.restClient.Put().AbsPath(naisApplicationPath(application.Namespace, application.Name)...).Body(b).Do().Error()
+	if err != nil {
+		return fmt.Errorf("unable to update naisapplication %s in %s: %s", application.Name, application.Namespace, err)
+	}
+
+	return nil
+}
+
+func naisApplicationPath(namespace, name string) []string {
+	return []string{"/apis", NaisApplicationGroup, NaisApplicationVersion, "namespaces", namespace, NaisApplicationPlural, name}
+}
+
+// Creates the deployment request and the manifest described by a NaisApplication
+func deploymentFromNaisApplication(application NaisApplication, fasitUsername, fasitPassword string, environmentClass EnvironmentClassLookup) (NaisDeploymentRequest, NaisManifest, error) {
+	specYaml, err := k8syaml.JSONToYAML(application.Spec)
+	if err != nil {
+		return NaisDeploymentRequest{}, NaisManifest{}, fmt.Errorf("unable to read spec: %s", err)
+	}
+
+	var target naisApplicationTarget
+	if err := yaml.Unmarshal(specYaml, &target); err != nil {
+		return NaisDeploymentRequest{}, NaisManifest{}, fmt.Errorf("unable to unmarshal spec: %s", err)
+	}
+
+	if target.Version == "" {
+		return NaisDeploymentRequest{}, NaisManifest{}, fmt.Errorf("spec.version is required and is empty")
+	}
+
+	if target.Zone == "" {
+		target.Zone = ZONE_FSS
+	}
+
+	var manifest NaisManifest
+	if err := yaml.Unmarshal(specYaml, &manifest); err != nil {
+		return NaisDeploymentRequest{}, NaisManifest{}, fmt.Errorf("unable to unmarshal spec: %s", err)
+	}
+
+	manifest, err = prepareManifest(manifest, application.Name, target.FasitEnvironment, environmentClass)
+	if err != nil {
+		return NaisDeploymentRequest{}, NaisManifest{}, err
+	}
+
+	deploymentRequest := NaisDeploymentRequest{
+		Application:      application.Name,
+		Namespace:        application.Namespace,
+		Version:          target.Version,
+		FasitEnvironment: target.FasitEnvironment,
+		Zone:             target.Zone,
+		FasitUsername:    fasitUsername,
+		FasitPassword:    fasitPassword,
+	}
+
+	return deploymentRequest, manifest, nil
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/h2non/gock.v1"
+	k8score "k8s.io/api/core/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+type fakeNaisApplicationClient struct {
+	applications map[string]NaisApplication
+}
+
+func newFakeNaisApplicationClient(applications ...NaisApplication) *fakeNaisApplicationClient {
+	client := &fakeNaisApplicationClient{applications: map[string]NaisApplication{}}
+	for _, application := range applications {
+		client.applications[application.Namespace+"/"+application.Name] = application
+	}
+	return client
+}
+
+func (c *fakeNaisApplicationClient) List() ([]NaisApplication, error) {
+	var applications []NaisApplication
+	for _, application := range c.applications {
+		applications = append(applications, application)
+	}
+	return applications, nil
+}
+
+func (c *fakeNaisApplicationClient) Get(namespace, name string) (*NaisApplication, error) {
+	application, ok := c.applications[namespace+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("naisapplication %s in %s not found", name, namespace)
+	}
+	return &application, nil
+}
+
+func (c *fakeNaisApplicationClient) Update(application NaisApplication) error {
+	c.applications[application.Namespace+"/"+application.Name] = application
+	return nil
+}
+
+func newNaisApplication(spec string) NaisApplication {
+	return NaisApplication{
+		ObjectMeta: k8smeta.ObjectMeta{Name: appName, Namespace: namespace},
+		Spec:       json.RawMessage(spec),
+	}
+}
+
+func TestDeploymentFromNaisApplication(t *testing.T) {
+	t.Run("The spec is read as a manifest with defaults", func(t *testing.T) {
+		application := newNaisApplication(`{"version": "13", "fasitEnvironment": "t0", "image": "docker.hub/app", "port": 8081, "healthcheck": {"liveness": {"path": "alive"}}}`)
+
+		deploymentRequest, manifest, err := deploymentFromNaisApplication(application, "user", "password", EnvironmentClassFromName)
+
+		assert.NoError(t, err)
+		assert.Equal(t, NaisDeploymentRequest{
+			Application:      appName,
+			Namespace:        namespace,
+			Version:          "13",
+			FasitEnvironment: "t0",
+			Zone:             ZONE_FSS,
+			FasitUsername:    "user",
+			FasitPassword:    "password",
+		}, deploymentRequest)
+		assert.Equal(t, "docker.hub/app", manifest.Image)
+		assert.Equal(t, 8081, manifest.Port)
+		assert.Equal(t, "alive", manifest.Healthcheck.Liveness.Path)
+		assert.Equal(t, 2, manifest.Replicas.Min, "defaults are added")
+	})
+
+	t.Run("Version is required", func(t *testing.T) {
+		_, _, err := deploymentFromNaisApplication(newNaisApplication(`{"image": "docker.hub/app"}`), "user", "password", EnvironmentClassFromName)
+
+		assert.EqualError(t, err, "spec.version is required and is empty")
+	})
+
+	t.Run("The manifest is validated", func(t *testing.T) {
+		_, _, err := deploymentFromNaisApplication(newNaisApplication(`{"version": "13", "replicas": {"min": 5, "max": 2}}`), "user", "password", EnvironmentClassFromName)
+
+		assert.Error(t, err)
+	})
+}
+
+func TestSpecHashIgnoresFormatting(t *testing.T) {
+	assert.Equal(t, specHash(newNaisApplication(`{"version":"13","port":8080}`)), specHash(newNaisApplication(`{"port": 8080, "version": "13"}`)))
+	assert.NotEqual(t, specHash(newNaisApplication(`{"version":"13"}`)), specHash(newNaisApplication(`{"version":"14"}`)))
+}
+
+func TestNaisApplicationController(t *testing.T) {
+	newController := func(client NaisApplicationClient) NaisApplicationController {
+		clientset := fake.NewSimpleClientset()
+		api := Api{
+			Clientset:              clientset,
+			FasitUrl:               "https://fasit.local",
+			ClusterSubdomain:       "nais.example.tk",
+			ClusterName:            "test-cluster",
+			DeploymentStatusViewer: FakeDeployStatusViewer{deployStatusToReturn: InProgress, viewToReturn: DeploymentStatusView{Status: "InProgress"}},
+			DeployLocker:           NewConfigMapDeployLocker(clientset, "naisd"),
+			DeployHistory:          NewConfigMapDeployHistory(clientset, "naisd"),
+		}
+		return NewNaisApplicationController(api, client, "user", "password", time.Second)
+	}
+	reconcileAll := func(controller NaisApplicationController) {
+		controller.reconcileAll()
+		controller.reconciles.inFlight.Wait()
+	}
+
+	t.Run("A changed spec is deployed and the status is updated", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("https://fasit.local").
+			Get("/api/v2/scopedresource").
+			MatchParam("alias", NavTruststoreFasitAlias).
+			Reply(200).File("testdata/fasitTruststoreResponse.json")
+		gock.New("https://fasit.local").
+			Get("/api/v2/resources/3024713/file/keystore").
+			Reply(200).
+			BodyString("")
+
+		client := newFakeNaisApplicationClient(newNaisApplication(`{"version": "13", "image": "docker.hub/app"}`))
+		controller := newController(client)
+
+		reconcileAll(controller)
+
+		assert.True(t, gock.IsDone())
+
+		deployment, err := controller.Api.Clientset.ExtensionsV1beta1().Deployments(namespace).Get(appName, k8smeta.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "docker.hub/app:13", deployment.Spec.Template.Spec.Containers[0].Image)
+
+		application, _ := client.Get(namespace, appName)
+		assert.Equal(t, specHash(*application), application.Status.ObservedSpecHash)
+		assert.Equal(t, "13", application.Status.DeployedVersion)
+		assert.Equal(t, ConditionReconciled, application.Status.Conditions[0].Type)
+		assert.Equal(t, k8score.ConditionTrue, application.Status.Conditions[0].Status)
+		assert.Equal(t, ConditionRolledOut, application.Status.Conditions[1].Type)
+		assert.Equal(t, k8score.ConditionUnknown, application.Status.Conditions[1].Status)
+
+		records, _ := controller.Api.DeployHistory.List(namespace, appName)
+		assert.Len(t, records, 1)
+		assert.Equal(t, DeployKindNaisApplication, records[0].Kind)
+	})
+
+	t.Run("An unchanged spec is not deployed again", func(t *testing.T) {
+		application := newNaisApplication(`{"version": "13", "image": "docker.hub/app"}`)
+		application.Status.ObservedSpecHash = specHash(application)
+		client := newFakeNaisApplicationClient(application)
+		controller := newController(client)
+
+		reconcileAll(controller)
+
+		_, err := controller.Api.Clientset.ExtensionsV1beta1().Deployments(namespace).Get(appName, k8smeta.GetOptions{})
+		assert.Error(t, err, "nothing is deployed")
+
+		updated, _ := client.Get(namespace, appName)
+		assert.Len(t, updated.Status.Conditions, 1)
+		assert.Equal(t, ConditionRolledOut, updated.Status.Conditions[0].Type)
+	})
+
+	t.Run("An invalid spec is reported in the status", func(t *testing.T) {
+		client := newFakeNaisApplicationClient(newNaisApplication(`{"image": "docker.hub/app"}`))
+		controller := newController(client)
+
+		reconcileAll(controller)
+
+		application, _ := client.Get(namespace, appName)
+		assert.Equal(t, specHash(*application), application.Status.ObservedSpecHash, "an invalid spec is not retried")
+		assert.Equal(t, k8score.ConditionFalse, application.Status.Conditions[0].Status)
+		assert.Equal(t, "InvalidSpec", application.Status.Conditions[0].Reason)
+	})
+
+	t.Run("A locked application is left for later", func(t *testing.T) {
+		client := newFakeNaisApplicationClient(newNaisApplication(`{"version": "13", "image": "docker.hub/app"}`))
+		controller := newController(client)
+		controller.Api.DeployLocker.Lock(namespace, appName, "someone else")
+
+		reconcileAll(controller)
+
+		application, _ := client.Get(namespace, appName)
+		assert.Empty(t, application.Status.ObservedSpecHash)
+	})
+
+	t.Run("An application already being reconciled is not reconciled again", func(t *testing.T) {
+		client := newFakeNaisApplicationClient(newNaisApplication(`{"version": "13", "image": "docker.hub/app"}`))
+		controller := newController(client)
+		controller.reconciles.running[namespace+"/"+appName] = true
+
+		reconcileAll(controller)
+
+		application, _ := client.Get(namespace, appName)
+		assert.Empty(t, application.Status.Conditions)
+	})
+
+	t.Run("A failed deploy is not retried until the backoff has passed", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("https://fasit.local").
+			Get("/api/v2/scopedresource").
+			Persist().
+			Reply(500)
+
+		client := newFakeNaisApplicationClient(newNaisApplication(`{"version": "13", "image": "docker.hub/app"}`))
+		controller := newController(client)
+
+		reconcileAll(controller)
+		reconcileAll(controller)
+
+		application, _ := client.Get(namespace, appName)
+		assert.Empty(t, application.Status.ObservedSpecHash)
+		assert.Equal(t, "DeployFailed", application.Status.Conditions[0].Reason)
+
+		records, _ := controller.Api.DeployHistory.List(namespace, appName)
+		assert.Len(t, records, 1, "the second reconcile backs off")
+		assert.Equal(t, 1, controller.reconciles.failed[namespace+"/"+appName].failures)
+	})
+}
+
+func TestNaisApplicationBackoff(t *testing.T) {
+	reconciles := &naisApplicationReconciles{running: map[string]bool{}, failed: map[string]failedDeploy{}}
+	key := namespace + "/" + appName
+
+	t.Run("The backoff doubles for every failure", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			reconciles.deployed(key, "hash", false, time.Minute)
+		}
+
+		assert.True(t, reconciles.backingOff(key, "hash"))
+		assert.WithinDuration(t, time.Now().Add(4*time.Minute), reconciles.failed[key].retryAt, time.Second)
+	})
+
+	t.Run("The backoff is capped", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			reconciles.deployed(key, "hash", false, time.Minute)
+		}
+
+		assert.WithinDuration(t, time.Now().Add(maxDeployBackoff), reconciles.failed[key].retryAt, time.Second)
+	})
+
+	t.Run("A changed spec is deployed right away", func(t *testing.T) {
+		assert.False(t, reconciles.backingOff(key, "changed"))
+	})
+
+	t.Run("A successful deploy ends the backoff", func(t *testing.T) {
+		reconciles.deployed(key, "hash", true, time.Minute)
+
+		assert.False(t, reconciles.backingOff(key, "hash"))
+	})
+}
+
+func TestSetCondition(t *testing.T) {
+	transition := k8smeta.NewTime(time.Now().Add(-time.Hour))
+	conditions := []NaisApplicationCondition{
+		{Type: ConditionReconciled, Status: k8score.ConditionTrue, LastTransitionTime: transition},
+		{Type: ConditionRolledOut, Status: k8score.ConditionTrue, LastTransitionTime: transition},
+	}
+
+	updated := setCondition(conditions, NaisApplicationCondition{Type: ConditionReconciled, Status: k8score.ConditionTrue, Message: "new message"})
+	assert.Equal(t, transition, updated[0].LastTransitionTime, "same status keeps the transition time")
+	assert.Equal(t, "new message", updated[0].Message)
+
+	updated = setCondition(conditions, NaisApplicationCondition{Type: ConditionRolledOut, Status: k8score.ConditionFalse})
+	assert.NotEqual(t, transition, updated[1].LastTransitionTime, "changed status updates the transition time")
+	assert.Equal(t, ConditionReconciled, updated[0].Type, "the order of the conditions is kept")
+}
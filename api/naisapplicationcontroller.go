@@ -0,0 +1,309 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	k8score "k8s.io/api/core/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	ConditionReconciled       = "Reconciled"
+	ConditionRolledOut        = "RolledOut"
+	DeployKindNaisApplication = "naisapplication"
+	maxDeployBackoff          = 15 * time.Minute
+)
+
+// Deploys NaisApplications through the same path as POST /deploy whenever their spec changes, and keeps
+// their status conditions up to date with the rollout of the deployment. Every application is reconciled in a
+// goroutine of its own, so a slow deploy does not hold back the others.
+type NaisApplicationController struct {
+	Api           Api
+	Client        NaisApplicationClient
+	FasitUsername string
+	FasitPassword string
+	Interval      time.Duration
+	reconciles    *naisApplicationReconciles
+}
+
+// The reconciles in flight and the failed deploys, by namespace/name of the application
+type naisApplicationReconciles struct {
+	sync.Mutex
+	inFlight sync.WaitGroup
+	running  map[string]bool
+	failed   map[string]failedDeploy
+}
+
+// A spec that failed to deploy is retried after Interval, doubling for every failure up to maxDeployBackoff
+type failedDeploy struct {
+	hash     string
+	failures int
+	retryAt  time.Time
+}
+
+func NewNaisApplicationController(api Api, client NaisApplicationClient, fasitUsername, fasitPassword string, interval time.Duration) NaisApplicationController {
+	return NaisApplicationController{
+		Api:           api,
+		Client:        client,
+		FasitUsername: fasitUsername,
+		FasitPassword: fasitPassword,
+		Interval:      interval,
+		reconciles: &naisApplicationReconciles{
+			running: map[string]bool{},
+			failed:  map[string]failedDeploy{},
+		},
+	}
+}
+
+func (c NaisApplicationController) Run(stop <-chan struct{}) {
+	glog.Infof("starting naisapplication controller, reconciling every %s", c.Interval)
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.reconcileAll()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c NaisApplicationController) reconcileAll() {
+	applications, err := c.Client.List()
+	if err != nil {
+		glog.Errorf("%s", err)
+		return
+	}
+
+	listed := make(map[string]bool)
+	for _, application := range applications {
+		key := application.Namespace + "/" + application.Name
+		listed[key] = true
+
+		if !c.reconciles.start(key) {
+			continue
+		}
+
+		go func(application NaisApplication) {
+			defer c.reconciles.finish(key)
+
+			if err := c.reconcile(application); err != nil {
+				glog.Errorf("unable to reconcile naisapplication %s in %s: %s", application.Name, application.Namespace, err)
+			}
+		}(application)
+	}
+
+	c.reconciles.forgetFailures(listed)
+}
+
+func (c NaisApplicationController) reconcile(application NaisApplication) error {
+	status := application.Status
+	hash := specHash(application)
+	key := application.Namespace + "/" + application.Name
+
+	if status.ObservedSpecHash != hash && c.reconciles.backingOff(key, hash) {
+		glog.Infof("not deploying naisapplication %s in %s, backing off after a failed deploy", application.Name, application.Namespace)
+	} else if status.ObservedSpecHash != hash {
+		release, err := c.Api.DeployLocker.Lock(application.Namespace, application.Name, "naisapplication controller")
+		if err != nil {
+			if _, ok := err.(deployLockedError); ok {
+				glog.Infof("not reconciling naisapplication %s in %s: %s", application.Name, application.Namespace, err)
+				return nil
+			}
+			return err
+		}
+		defer release()
+
+		// Another naisd replica may have deployed the spec while we waited for the lock
+		current, err := c.Client.Get(application.Namespace, application.Name)
+		if err != nil {
+			return err
+		}
+		application = *current
+		status = application.Status
+
+		if status.ObservedSpecHash != hash && specHash(application) == hash {
+			status = c.deploy(application, hash)
+			c.reconciles.deployed(key, hash, status.ObservedSpecHash == hash, c.Interval)
+		}
+	}
+
+	status.Conditions = setCondition(status.Conditions, c.rolloutCondition(application))
+
+	if reflect.DeepEqual(status, application.Status) {
+		return nil
+	}
+
+	application.Status = status
+	return c.Client.Update(application)
+}
+
+// Deploys the spec of the application, returning its new status
+func (c NaisApplicationController) deploy(application NaisApplication, hash string) NaisApplicationStatus {
+	status := application.Status
+
+	fasit := FasitClient{c.Api.FasitUrl, c.FasitUsername, c.FasitPassword}
+	deploymentRequest, manifest, err := deploymentFromNaisApplication(application, c.FasitUsername, c.FasitPassword, fasit.GetFasitEnvironmentClass)
+	if err != nil {
+		status.ObservedSpecHash = hash
+		status.Conditions = setCondition(status.Conditions, NaisApplicationCondition{
+			Type:    ConditionReconciled,
+			Status:  k8score.ConditionFalse,
+			Reason:  "InvalidSpec",
+			Message: err.Error(),
+		})
+		return status
+	}
+
+	glog.Infof("Reconciling naisapplication. Deploying %s:%s to %s\n", deploymentRequest.Application, deploymentRequest.Version, deploymentRequest.Namespace)
+
+	started := time.Now()
+	_, appErr := c.Api.deployManifest(deploymentRequest, manifest, nil)
+	c.Api.recordDeploy(newDeployRecord(DeployKindNaisApplication, deploymentRequest, manifest, started, appErr))
+
+	// A failed deploy leaves the observed hash as it was, so it is retried once the backoff has passed
+	if appErr != nil {
+		status.Conditions = setCondition(status.Conditions, NaisApplicationCondition{
+			Type:    ConditionReconciled,
+			Status:  k8score.ConditionFalse,
+			Reason:  "DeployFailed",
+			Message: appErr.Error(),
+		})
+		return status
+	}
+
+	status.ObservedSpecHash = hash
+	status.DeployedVersion = deploymentRequest.Version
+	status.Conditions = setCondition(status.Conditions, NaisApplicationCondition{
+		Type:    ConditionReconciled,
+		Status:  k8score.ConditionTrue,
+		Reason:  "Deployed",
+		Message: fmt.Sprintf("version %s deployed", deploymentRequest.Version),
+	})
+	return status
+}
+
+// Returns false if the application is already being reconciled
+func (r *naisApplicationReconciles) start(key string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.running[key] {
+		return false
+	}
+	r.running[key] = true
+	r.inFlight.Add(1)
+	return true
+}
+
+func (r *naisApplicationReconciles) finish(key string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.running, key)
+	r.inFlight.Done()
+}
+
+func (r *naisApplicationReconciles) backingOff(key, hash string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	failed, ok := r.failed[key]
+	return ok && failed.hash == hash && time.Now().Before(failed.retryAt)
+}
+
+// A changed spec is deployed right away, even if the previous one failed
+func (r *naisApplicationReconciles) deployed(key, hash string, succeeded bool, interval time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	if succeeded {
+		delete(r.failed, key)
+		return
+	}
+
+	failed := r.failed[key]
+	if failed.hash != hash {
+		failed = failedDeploy{hash: hash}
+	}
+	failed.failures++
+
+	backoff := interval
+	for i := 1; i < failed.failures && backoff < maxDeployBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxDeployBackoff {
+		backoff = maxDeployBackoff
+	}
+	failed.retryAt = time.Now().Add(backoff)
+
+	r.failed[key] = failed
+}
+
+// Forgets the failed deploys of applications that are removed
+func (r *naisApplicationReconciles) forgetFailures(listed map[string]bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	for key := range r.failed {
+		if !listed[key] {
+			delete(r.failed, key)
+		}
+	}
+}
+
+func (c NaisApplicationController) rolloutCondition(application NaisApplication) NaisApplicationCondition {
+	status, view, err := c.Api.DeploymentStatusViewer.DeploymentStatusView(application.Namespace, application.Name)
+	if err != nil {
+		return NaisApplicationCondition{Type: ConditionRolledOut, Status: k8score.ConditionUnknown, Reason: "DeploymentNotFound", Message: err.Error()}
+	}
+
+	message := fmt.Sprintf("%s (%d desired, %d up to date, %d available)", view.Reason, view.Desired, view.UpToDate, view.Available)
+
+	switch status {
+	case Success:
+		return NaisApplicationCondition{Type: ConditionRolledOut, Status: k8score.ConditionTrue, Reason: view.Status, Message: message}
+	case Failed:
+		return NaisApplicationCondition{Type: ConditionRolledOut, Status: k8score.ConditionFalse, Reason: view.Status, Message: message}
+	default:
+		return NaisApplicationCondition{Type: ConditionRolledOut, Status: k8score.ConditionUnknown, Reason: view.Status, Message: message}
+	}
+}
+
+// Replaces the condition of the same type, keeping its transition time if the status is unchanged
+func setCondition(conditions []NaisApplicationCondition, condition NaisApplicationCondition) []NaisApplicationCondition {
+	updated := append([]NaisApplicationCondition{}, conditions...)
+	condition.LastTransitionTime = k8smeta.Now()
+
+	for i, existing := range updated {
+		if existing.Type == condition.Type {
+			if existing.Status == condition.Status {
+				condition.LastTransitionTime = existing.LastTransitionTime
+			}
+			updated[i] = condition
+			return updated
+		}
+	}
+
+	return append(updated, condition)
+}
+
+// Hashes the spec in a canonical form, so that it does not depend on how the API server formats it
+func specHash(application NaisApplication) string {
+	var spec interface{}
+	if err := json.Unmarshal(application.Spec, &spec); err != nil {
+		return fmt.Sprintf("%x", sha256.Sum256(application.Spec))
+	}
+
+	b, _ := json.Marshal(spec)
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
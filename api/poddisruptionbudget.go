@@ -0,0 +1,97 @@
+package api
+
+import (
+	"fmt"
+	k8spolicy "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"reflect"
+)
+
+// Creates a Kubernetes PodDisruptionBudget object keeping all but one of the minimum replicas available while nodes
+// are drained, unless the manifest sets minAvailable or maxUnavailable. Returns nil when the application gets no
+// budget: when it is disabled, when it runs as a cronjob, or when a single replica would block drains for good.
+func createPodDisruptionBudgetDef(manifest NaisManifest, application, namespace string) *k8spolicy.PodDisruptionBudget {
+	config := manifest.PodDisruptionBudget
+	if config.Disabled || manifest.Kind == KindCronJob {
+		return nil
+	}
+
+	spec := k8spolicy.PodDisruptionBudgetSpec{
+		Selector: &k8smeta.LabelSelector{MatchLabels: map[string]string{"app": application}},
+	}
+	switch {
+	case config.MinAvailable != "":
+		minAvailable := intstr.Parse(config.MinAvailable)
+		spec.MinAvailable = &minAvailable
+	case config.MaxUnavailable != "":
+		maxUnavailable := intstr.Parse(config.MaxUnavailable)
+		spec.MaxUnavailable = &maxUnavailable
+	case manifest.Replicas.Min > 1:
+		minAvailable := intstr.FromInt(manifest.Replicas.Min - 1)
+		spec.MinAvailable = &minAvailable
+	default:
+		return nil
+	}
+
+	return &k8spolicy.PodDisruptionBudget{
+		TypeMeta: k8smeta.TypeMeta{
+			Kind:       "PodDisruptionBudget",
+			APIVersion: "policy/v1beta1",
+		},
+		ObjectMeta: createObjectMeta(application, namespace),
+		Spec:       spec,
+	}
+}
+
+// The spec of a PodDisruptionBudget cannot be updated, so a budget that has changed is deleted and created again.
+// Returns nil if the application gets no budget.
+func createOrUpdatePodDisruptionBudget(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, k8sClient kubernetes.Interface) (*k8spolicy.PodDisruptionBudget, error) {
+	budgetDef := createPodDisruptionBudgetDef(manifest, deploymentRequest.Application, deploymentRequest.Namespace)
+	if budgetDef == nil {
+		return nil, nil
+	}
+
+	existingBudget, err := getExistingPodDisruptionBudget(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing poddisruptionbudget: %s", err)
+	}
+
+	budgets := k8sClient.PolicyV1beta1().PodDisruptionBudgets(deploymentRequest.Namespace)
+	if existingBudget != nil {
+		if reflect.DeepEqual(existingBudget.Spec, budgetDef.Spec) {
+			return existingBudget, nil
+		}
+		if err := budgets.Delete(deploymentRequest.Application, &k8smeta.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("unable to delete changed poddisruptionbudget: %s", err)
+		}
+	}
+
+	return budgets.Create(budgetDef)
+}
+
+func getExistingPodDisruptionBudget(application string, namespace string, k8sClient kubernetes.Interface) (*k8spolicy.PodDisruptionBudget, error) {
+	budget, err := k8sClient.PolicyV1beta1().PodDisruptionBudgets(namespace).Get(application, k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return budget, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Deletes the poddisruptionbudget of the application if naisd created it, returning whether it was deleted
+func deletePodDisruptionBudget(application, namespace string, k8sClient kubernetes.Interface) (bool, error) {
+	budget, err := getExistingPodDisruptionBudget(application, namespace, k8sClient)
+	if err != nil || budget == nil || !createdByNaisd(budget.ObjectMeta, application) {
+		return false, err
+	}
+
+	err = k8sClient.PolicyV1beta1().PodDisruptionBudgets(namespace).Delete(application, &k8smeta.DeleteOptions{})
+	return deleted(err)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestCreatePodDisruptionBudgetDef(t *testing.T) {
+	manifest := newDefaultManifest()
+
+	t.Run("all but one of the minimum replicas are kept available", func(t *testing.T) {
+		manifest.Replicas = Replicas{Min: 3, Max: 6}
+		budget := createPodDisruptionBudgetDef(manifest, appName, namespace)
+		assert.Equal(t, intstr.FromInt(2), *budget.Spec.MinAvailable)
+		assert.Nil(t, budget.Spec.MaxUnavailable)
+		assert.Equal(t, map[string]string{"app": appName}, budget.Spec.Selector.MatchLabels)
+	})
+
+	t.Run("a single replica gets no budget, as it would block drains", func(t *testing.T) {
+		manifest.Replicas = Replicas{Min: 1, Max: 2}
+		assert.Nil(t, createPodDisruptionBudgetDef(manifest, appName, namespace))
+	})
+
+	t.Run("the manifest overrides the budget", func(t *testing.T) {
+		manifest.Replicas = Replicas{Min: 1, Max: 2}
+		manifest.PodDisruptionBudget = PodDisruptionBudgetConfig{MaxUnavailable: "25%"}
+		budget := createPodDisruptionBudgetDef(manifest, appName, namespace)
+		assert.Equal(t, intstr.FromString("25%"), *budget.Spec.MaxUnavailable)
+		assert.Nil(t, budget.Spec.MinAvailable)
+
+		manifest.PodDisruptionBudget = PodDisruptionBudgetConfig{Disabled: true}
+		assert.Nil(t, createPodDisruptionBudgetDef(manifest, appName, namespace))
+	})
+}
+
+func TestCreateOrUpdatePodDisruptionBudget(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+	manifest := newDefaultManifest()
+	manifest.Replicas = Replicas{Min: 2, Max: 4, CpuThresholdPercentage: 50}
+
+	t.Run("the budget is part of the deploy result", func(t *testing.T) {
+		result, err := createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, fake.NewSimpleClientset())
+		assert.NoError(t, err)
+		assert.Equal(t, intstr.FromInt(1), *result.PodDisruptionBudget.Spec.MinAvailable)
+		assert.Contains(t, string(createResponse(result, nil)), "- created poddisruptionbudget\n")
+	})
+
+	t.Run("a changed budget is created again, as its spec cannot be updated", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		_, err := createOrUpdatePodDisruptionBudget(deploymentRequest, manifest, clientset)
+		assert.NoError(t, err)
+
+		scaled := manifest
+		scaled.Replicas.Min = 4
+		_, err = createOrUpdatePodDisruptionBudget(deploymentRequest, scaled, clientset)
+		assert.NoError(t, err)
+
+		budget, _ := getExistingPodDisruptionBudget(appName, namespace, clientset)
+		assert.Equal(t, intstr.FromInt(3), *budget.Spec.MinAvailable)
+
+		clientset.ClearActions()
+		unchanged, err := createOrUpdatePodDisruptionBudget(deploymentRequest, scaled, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, budget, unchanged)
+		assert.Len(t, clientset.Actions(), 1, "only the existing budget is fetched")
+	})
+
+	t.Run("a budget no longer produced by the manifest is deleted", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		createOrUpdateK8sResources(deploymentRequest, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+
+		single := manifest
+		single.Replicas.Min = 1
+		result, err := createOrUpdateK8sResources(deploymentRequest, single, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, result.PodDisruptionBudget)
+		assert.Contains(t, result.Deleted, DeletedResource{Kind: "PodDisruptionBudget", Name: appName})
+	})
+}
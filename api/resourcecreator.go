@@ -2,30 +2,53 @@ package api
 
 import (
 	"fmt"
-	k8sautoscaling "k8s.io/api/autoscaling/v1"
+	"github.com/imdario/mergo"
+	"gopkg.in/yaml.v2"
+	k8sapps "k8s.io/api/apps/v1"
+	k8sautoscaling "k8s.io/api/autoscaling/v2beta1"
+	k8sbatchv1beta1 "k8s.io/api/batch/v1beta1"
 	k8score "k8s.io/api/core/v1"
 	k8sextensions "k8s.io/api/extensions/v1beta1"
+	k8snetworking "k8s.io/api/networking/v1"
+	k8spolicy "k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	k8sresource "k8s.io/apimachinery/pkg/api/resource"
 	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 )
 
-const RootMountPoint = "/var/run/secrets/naisd.io/"
+const (
+	RootMountPoint             = "/var/run/secrets/naisd.io/"
+	ManifestAnnotation         = "naisd.io/manifest"
+	ZoneAnnotation             = "naisd.io/zone"
+	VersionAnnotation          = "naisd.io/version"
+	FasitEnvironmentAnnotation = "naisd.io/fasit-environment"
+	// leaves room for the other annotations within the 256KiB kubernetes allows, and keeps the deploy job, which
+	// holds the deployment along with its configmap, well within the 1MiB of a config map
+	maxRecordedManifestSize = 192 * 1024
+)
 
 type DeploymentResult struct {
-	Autoscaler *k8sautoscaling.HorizontalPodAutoscaler
-	Ingress    *k8sextensions.Ingress
-	Deployment *k8sextensions.Deployment
-	Secret     *k8score.Secret
-	Service    *k8score.Service
+	Autoscaler          *k8sautoscaling.HorizontalPodAutoscaler
+	Ingress             *k8sextensions.Ingress
+	Deployment          *k8sextensions.Deployment
+	Secret              *k8score.Secret
+	ConfigMap           *k8score.ConfigMap
+	Service             *k8score.Service
+	CronJob             *k8sbatchv1beta1.CronJob
+	StatefulSet         *k8sapps.StatefulSet
+	PodDisruptionBudget *k8spolicy.PodDisruptionBudget
+	NetworkPolicy       *k8snetworking.NetworkPolicy
+	Deleted             []DeletedResource
 }
 
-// Creates a Kubernetes Service object
-func createServiceDef(application, namespace string) *k8score.Service {
+// Creates a Kubernetes Service object exposing the ports of the manifest that have a service port
+func createServiceDef(application, namespace string, manifest NaisManifest) *k8score.Service {
 	return &k8score.Service{
 		TypeMeta: k8smeta.TypeMeta{
 			Kind:       "Service",
@@ -35,21 +58,69 @@ func createServiceDef(application, namespace string) *k8score.Service {
 		Spec: k8score.ServiceSpec{
 			Type:     k8score.ServiceTypeClusterIP,
 			Selector: map[string]string{"app": application},
-			Ports: []k8score.ServicePort{
-				{
-					Name:     "http",
-					Protocol: k8score.ProtocolTCP,
-					Port:     80,
-					TargetPort: intstr.IntOrString{
-						Type:   intstr.String,
-						StrVal: DefaultPortName,
-					},
-				},
-			},
+			Ports:    createServicePorts(manifest),
 		},
 	}
 }
 
+func createServicePorts(manifest NaisManifest) []k8score.ServicePort {
+	var servicePorts []k8score.ServicePort
+	for _, port := range manifestPorts(manifest) {
+		if port.ServicePort == 0 {
+			continue
+		}
+		servicePorts = append(servicePorts, k8score.ServicePort{
+			Name:       port.Name,
+			Protocol:   portProtocol(port),
+			Port:       int32(port.ServicePort),
+			TargetPort: intstr.FromString(port.Name),
+		})
+	}
+	return servicePorts
+}
+
+// The ports of the app container. A manifest without ports gets a port named http, exposed as port 80 on the service.
+func manifestPorts(manifest NaisManifest) []Port {
+	if len(manifest.Ports) > 0 {
+		return manifest.Ports
+	}
+	return []Port{{Name: DefaultPortName, ContainerPort: manifest.Port, ServicePort: 80}}
+}
+
+// Probes, the prometheus scrape port and the ingress target the port named http unless they name another
+func portName(name string) string {
+	if name == "" {
+		return DefaultPortName
+	}
+	return name
+}
+
+func portProtocol(port Port) k8score.Protocol {
+	if strings.EqualFold(port.Protocol, string(k8score.ProtocolUDP)) {
+		return k8score.ProtocolUDP
+	}
+	return k8score.ProtocolTCP
+}
+
+func createContainerPorts(manifest NaisManifest) []k8score.ContainerPort {
+	var containerPorts []k8score.ContainerPort
+	for _, port := range manifestPorts(manifest) {
+		containerPorts = append(containerPorts, k8score.ContainerPort{ContainerPort: int32(port.ContainerPort), Protocol: portProtocol(port), Name: port.Name})
+	}
+	return containerPorts
+}
+
+// The service port the ingress sends traffic to
+func ingressServicePort(manifest NaisManifest) int32 {
+	name := portName(manifest.Ingress.Port)
+	for _, port := range manifestPorts(manifest) {
+		if port.Name == name {
+			return int32(port.ServicePort)
+		}
+	}
+	return 80
+}
+
 func validLabelName(str string) string {
 	tmpStr := strings.Replace(str, "_", "-", -1)
 	return strings.ToLower(tmpStr)
@@ -64,8 +135,20 @@ func createDeploymentDef(naisResources []NaisResource, manifest NaisManifest, de
 		return nil, err
 	}
 
+	annotations, err := createDeploymentAnnotations(deploymentRequest, manifest)
+
+	if err != nil {
+		return nil, err
+	}
+
 	if existingDeployment != nil {
 		existingDeployment.Spec = spec
+		if existingDeployment.Annotations == nil {
+			existingDeployment.Annotations = map[string]string{}
+		}
+		for k, v := range annotations {
+			existingDeployment.Annotations[k] = v
+		}
 		return existingDeployment, nil
 	} else {
 		deployment := &k8sextensions.Deployment{
@@ -76,10 +159,27 @@ func createDeploymentDef(naisResources []NaisResource, manifest NaisManifest, de
 			ObjectMeta: createObjectMeta(deploymentRequest.Application, deploymentRequest.Namespace),
 			Spec:       spec,
 		}
+		deployment.Annotations = annotations
 		return deployment, nil
 	}
 }
 
+// The deployment controller copies these annotations to the replica set of each revision,
+// which lets naisd redeploy an old revision without fetching its manifest again
+func createDeploymentAnnotations(deploymentRequest NaisDeploymentRequest, manifest NaisManifest) (map[string]string, error) {
+	manifestYaml, err := yaml.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal manifest: %s", err)
+	}
+
+	return map[string]string{
+		ManifestAnnotation:         string(manifestYaml),
+		ZoneAnnotation:             deploymentRequest.Zone,
+		VersionAnnotation:          deploymentRequest.Version,
+		FasitEnvironmentAnnotation: deploymentRequest.FasitEnvironment,
+	}, nil
+}
+
 func createDeploymentSpec(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource, istioEnabled bool) (k8sextensions.DeploymentSpec, error) {
 	spec, err := createPodSpec(deploymentRequest, manifest, naisResources)
 
@@ -87,23 +187,21 @@ func createDeploymentSpec(deploymentRequest NaisDeploymentRequest, manifest Nais
 		return k8sextensions.DeploymentSpec{}, err
 	}
 
+	if istioRulesEnabled(manifest, istioEnabled) {
+		spec.ServiceAccountName = deploymentRequest.Application
+	}
+
+	// manifests recorded before the deployment block was added have it empty
+	config := manifest.Deployment
+	if err := mergo.Merge(&config, GetDefaultManifest(deploymentRequest.Application).Deployment); err != nil {
+		return k8sextensions.DeploymentSpec{}, fmt.Errorf("unable to add default deployment values: %s", err)
+	}
+
 	return k8sextensions.DeploymentSpec{
-		Replicas: int32p(1),
-		Strategy: k8sextensions.DeploymentStrategy{
-			Type: k8sextensions.RollingUpdateDeploymentStrategyType,
-			RollingUpdate: &k8sextensions.RollingUpdateDeployment{
-				MaxUnavailable: &intstr.IntOrString{
-					Type:   intstr.Int,
-					IntVal: int32(0),
-				},
-				MaxSurge: &intstr.IntOrString{
-					Type:   intstr.Int,
-					IntVal: int32(1),
-				},
-			},
-		},
-		ProgressDeadlineSeconds: int32p(300),
-		RevisionHistoryLimit:    int32p(10),
+		Replicas:                int32p(1),
+		Strategy:                createDeploymentStrategy(config),
+		ProgressDeadlineSeconds: int32p(int32(config.ProgressDeadlineSeconds)),
+		RevisionHistoryLimit:    int32p(int32(config.RevisionHistoryLimit)),
 		Template: k8score.PodTemplateSpec{
 			ObjectMeta: createPodObjectMetaWithAnnotations(deploymentRequest, manifest, istioEnabled),
 			Spec:       spec,
@@ -111,11 +209,27 @@ func createDeploymentSpec(deploymentRequest NaisDeploymentRequest, manifest Nais
 	}, nil
 }
 
+func createDeploymentStrategy(config DeploymentConfig) k8sextensions.DeploymentStrategy {
+	if config.Strategy == DeploymentStrategyRecreate {
+		return k8sextensions.DeploymentStrategy{Type: k8sextensions.RecreateDeploymentStrategyType}
+	}
+
+	maxUnavailable := intstr.Parse(config.MaxUnavailable)
+	maxSurge := intstr.Parse(config.MaxSurge)
+	return k8sextensions.DeploymentStrategy{
+		Type: k8sextensions.RollingUpdateDeploymentStrategyType,
+		RollingUpdate: &k8sextensions.RollingUpdateDeployment{
+			MaxUnavailable: &maxUnavailable,
+			MaxSurge:       &maxSurge,
+		},
+	}
+}
+
 func createPodObjectMetaWithAnnotations(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, istioEnabled bool) k8smeta.ObjectMeta {
 	objectMeta := createObjectMeta(deploymentRequest.Application, deploymentRequest.Namespace)
 	objectMeta.Annotations = map[string]string{
 		"prometheus.io/scrape": strconv.FormatBool(manifest.Prometheus.Enabled),
-		"prometheus.io/port":   DefaultPortName,
+		"prometheus.io/port":   portName(manifest.Prometheus.Port),
 		"prometheus.io/path":   manifest.Prometheus.Path,
 	}
 
@@ -123,12 +237,21 @@ func createPodObjectMetaWithAnnotations(deploymentRequest NaisDeploymentRequest,
 		objectMeta.Annotations["sidecar.istio.io/inject"] = "true"
 	}
 
+	if len(manifest.ConfigMap.Files) > 0 {
+		objectMeta.Annotations[ConfigMapChecksumAnnotation] = configMapChecksum(manifest.ConfigMap.Files)
+	}
+
 	return objectMeta
 }
 
 func createPodSpec(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource) (k8score.PodSpec, error) {
-	envVars, err := createEnvironmentVariables(deploymentRequest, naisResources)
+	fasitEnvVars, err := createEnvironmentVariables(deploymentRequest, naisResources)
+
+	if err != nil {
+		return k8score.PodSpec{}, err
+	}
 
+	envVars, err := addManifestEnvironmentVariables(fasitEnvVars, manifest.Env)
 	if err != nil {
 		return k8score.PodSpec{}, err
 	}
@@ -136,39 +259,15 @@ func createPodSpec(deploymentRequest NaisDeploymentRequest, manifest NaisManifes
 	podSpec := k8score.PodSpec{
 		Containers: []k8score.Container{
 			{
-				Name:  deploymentRequest.Application,
-				Image: fmt.Sprintf("%s:%s", manifest.Image, deploymentRequest.Version),
-				Ports: []k8score.ContainerPort{
-					{ContainerPort: int32(manifest.Port), Protocol: k8score.ProtocolTCP, Name: DefaultPortName},
-				},
-				Resources: createResourceLimits(manifest.Resources.Requests.Cpu, manifest.Resources.Requests.Memory, manifest.Resources.Limits.Cpu, manifest.Resources.Limits.Memory),
-				LivenessProbe: &k8score.Probe{
-					Handler: k8score.Handler{
-						HTTPGet: &k8score.HTTPGetAction{
-							Path: manifest.Healthcheck.Liveness.Path,
-							Port: intstr.FromString(DefaultPortName),
-						},
-					},
-					InitialDelaySeconds: int32(manifest.Healthcheck.Liveness.InitialDelay),
-					PeriodSeconds:       int32(manifest.Healthcheck.Liveness.PeriodSeconds),
-					FailureThreshold:    int32(manifest.Healthcheck.Liveness.FailureThreshold),
-					TimeoutSeconds:      int32(manifest.Healthcheck.Liveness.Timeout),
-				},
-				ReadinessProbe: &k8score.Probe{
-					Handler: k8score.Handler{
-						HTTPGet: &k8score.HTTPGetAction{
-							Path: manifest.Healthcheck.Readiness.Path,
-							Port: intstr.FromString(DefaultPortName),
-						},
-					},
-					InitialDelaySeconds: int32(manifest.Healthcheck.Readiness.InitialDelay),
-					PeriodSeconds:       int32(manifest.Healthcheck.Readiness.PeriodSeconds),
-					FailureThreshold:    int32(manifest.Healthcheck.Readiness.FailureThreshold),
-					TimeoutSeconds:      int32(manifest.Healthcheck.Readiness.Timeout),
-				},
+				Name:            deploymentRequest.Application,
+				Image:           fmt.Sprintf("%s:%s", manifest.Image, deploymentRequest.Version),
+				Ports:           createContainerPorts(manifest),
+				Resources:       createResourceLimits(manifest.Resources.Requests.Cpu, manifest.Resources.Requests.Memory, manifest.Resources.Limits.Cpu, manifest.Resources.Limits.Memory),
+				LivenessProbe:   createProbe(manifest.Healthcheck.Liveness),
+				ReadinessProbe:  createProbe(manifest.Healthcheck.Readiness),
 				Env:             envVars,
 				ImagePullPolicy: k8score.PullIfNotPresent,
-				Lifecycle:       createLifeCycle(manifest.PreStopHookPath),
+				Lifecycle:       createLifeCycle(manifest.PreStopHookPath, portName(manifest.Healthcheck.Readiness.Port)),
 			},
 		},
 
@@ -193,6 +292,32 @@ func createPodSpec(deploymentRequest NaisDeploymentRequest, manifest NaisManifes
 		container.VolumeMounts = append(container.VolumeMounts, createCertificateVolumeMount(deploymentRequest, naisResources))
 	}
 
+	if len(manifest.ConfigMap.Files) > 0 {
+		podSpec.Volumes = append(podSpec.Volumes, createConfigMapVolume(deploymentRequest.Application))
+		container := &podSpec.Containers[0]
+		container.VolumeMounts = append(container.VolumeMounts, createConfigMapVolumeMount(deploymentRequest.Application, manifest))
+	}
+
+	podSpec.Volumes = append(podSpec.Volumes, createSharedVolumes(manifest.SharedVolumes)...)
+	for _, volume := range manifest.SharedVolumes {
+		if len(volume.MountPath) > 0 {
+			container := &podSpec.Containers[0]
+			container.VolumeMounts = append(container.VolumeMounts, k8score.VolumeMount{Name: volume.Name, MountPath: volume.MountPath})
+		}
+	}
+
+	sidecars, err := createContainers(manifest.Sidecars, deploymentRequest, naisResources, fasitEnvVars)
+	if err != nil {
+		return k8score.PodSpec{}, err
+	}
+	podSpec.Containers = append(podSpec.Containers, sidecars...)
+
+	initContainers, err := createContainers(manifest.InitContainers, deploymentRequest, naisResources, fasitEnvVars)
+	if err != nil {
+		return k8score.PodSpec{}, err
+	}
+	podSpec.InitContainers = initContainers
+
 	return podSpec, nil
 }
 func createLeaderElectionContainer(appName string) k8score.Container {
@@ -212,13 +337,34 @@ func createLeaderElectionContainer(appName string) k8score.Container {
 	}
 }
 
-func createLifeCycle(path string) *k8score.Lifecycle {
+func createProbe(probe Probe) *k8score.Probe {
+	var handler k8score.Handler
+	switch probe.probeType() {
+	case ProbeTypeExec:
+		handler.Exec = &k8score.ExecAction{Command: probe.Command}
+	case ProbeTypeTCP:
+		handler.TCPSocket = &k8score.TCPSocketAction{Port: intstr.FromString(portName(probe.Port))}
+	default:
+		handler.HTTPGet = &k8score.HTTPGetAction{Path: probe.Path, Port: intstr.FromString(portName(probe.Port))}
+	}
+
+	return &k8score.Probe{
+		Handler:             handler,
+		InitialDelaySeconds: int32(probe.InitialDelay),
+		PeriodSeconds:       int32(probe.PeriodSeconds),
+		FailureThreshold:    int32(probe.FailureThreshold),
+		TimeoutSeconds:      int32(probe.Timeout),
+	}
+}
+
+// The pre stop hook is called on the port the readiness probe is served on
+func createLifeCycle(path, port string) *k8score.Lifecycle {
 	if len(path) > 0 {
 		return &k8score.Lifecycle{
 			PreStop: &k8score.Handler{
 				HTTPGet: &k8score.HTTPGetAction{
 					Path: path,
-					Port: intstr.FromString(DefaultPortName),
+					Port: intstr.FromString(port),
 				},
 			},
 		}
@@ -355,6 +501,26 @@ func createEnvironmentVariables(deploymentRequest NaisDeploymentRequest, naisRes
 	return envVars, nil
 }
 
+// Adds the env of the manifest to the variables from Fasit, sorted so the pod spec is the same from one deploy
+// to the next
+func addManifestEnvironmentVariables(fasitEnvVars []k8score.EnvVar, env map[string]string) ([]k8score.EnvVar, error) {
+	var names []string
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	envVars := append([]k8score.EnvVar{}, fasitEnvVars...)
+	for _, name := range names {
+		envVar := k8score.EnvVar{Name: name, Value: env[name]}
+		if err := checkForDuplicates(envVars, envVar, name, NaisResource{name: "env", resourceType: "manifest"}); err != nil {
+			return nil, err
+		}
+		envVars = append(envVars, envVar)
+	}
+	return envVars, nil
+}
+
 func createDefaultEnvironmentVariables(request *NaisDeploymentRequest) []k8score.EnvVar {
 	return []k8score.EnvVar{{
 		Name:  "APP_NAME",
@@ -453,7 +619,7 @@ func createSBSPublicHostname(request NaisDeploymentRequest) string {
 	}
 }
 
-func createIngressRule(serviceName, host, path string) k8sextensions.IngressRule {
+func createIngressRule(serviceName string, servicePort int32, host, path string) k8sextensions.IngressRule {
 	return k8sextensions.IngressRule{
 		Host: host,
 		IngressRuleValue: k8sextensions.IngressRuleValue{
@@ -462,7 +628,7 @@ func createIngressRule(serviceName, host, path string) k8sextensions.IngressRule
 					{
 						Backend: k8sextensions.IngressBackend{
 							ServiceName: serviceName,
-							ServicePort: intstr.IntOrString{IntVal: 80},
+							ServicePort: intstr.FromInt(int(servicePort)),
 						},
 						Path: strings.Replace("/"+path, "//", "/", 1), // make sure we always begin with exactly one slash
 					},
@@ -474,9 +640,9 @@ func createIngressRule(serviceName, host, path string) k8sextensions.IngressRule
 
 // Creates a Kubernetes HorizontalPodAutoscaler object
 // If existingAutoscaler is provided, this is updated with provided parameters
-func createOrUpdateAutoscalerDef(min, max, cpuTargetPercentage int, existingAutoscaler *k8sautoscaling.HorizontalPodAutoscaler, application, namespace string) *k8sautoscaling.HorizontalPodAutoscaler {
+func createOrUpdateAutoscalerDef(replicas Replicas, existingAutoscaler *k8sautoscaling.HorizontalPodAutoscaler, application, namespace string) *k8sautoscaling.HorizontalPodAutoscaler {
 	if existingAutoscaler != nil {
-		existingAutoscaler.Spec = createAutoscalerSpec(min, max, cpuTargetPercentage, application)
+		existingAutoscaler.Spec = createAutoscalerSpec(replicas, application)
 
 		return existingAutoscaler
 	} else {
@@ -484,19 +650,19 @@ func createOrUpdateAutoscalerDef(min, max, cpuTargetPercentage int, existingAuto
 		return &k8sautoscaling.HorizontalPodAutoscaler{
 			TypeMeta: k8smeta.TypeMeta{
 				Kind:       "HorizontalPodAutoscaler",
-				APIVersion: "autoscaling/v1",
+				APIVersion: "autoscaling/v2beta1",
 			},
 			ObjectMeta: createObjectMeta(application, namespace),
-			Spec:       createAutoscalerSpec(min, max, cpuTargetPercentage, application),
+			Spec:       createAutoscalerSpec(replicas, application),
 		}
 	}
 }
 
-func createAutoscalerSpec(min, max, cpuTargetPercentage int, application string) k8sautoscaling.HorizontalPodAutoscalerSpec {
+func createAutoscalerSpec(replicas Replicas, application string) k8sautoscaling.HorizontalPodAutoscalerSpec {
 	return k8sautoscaling.HorizontalPodAutoscalerSpec{
-		MinReplicas:                    int32p(int32(min)),
-		MaxReplicas:                    int32(max),
-		TargetCPUUtilizationPercentage: int32p(int32(cpuTargetPercentage)),
+		MinReplicas: int32p(int32(replicas.Min)),
+		MaxReplicas: int32(replicas.Max),
+		Metrics:     createAutoscalerMetrics(replicas),
 		ScaleTargetRef: k8sautoscaling.CrossVersionObjectReference{
 			APIVersion: "extensions/v1beta1",
 			Kind:       "Deployment",
@@ -505,15 +671,85 @@ func createAutoscalerSpec(min, max, cpuTargetPercentage int, application string)
 	}
 }
 
+// The metrics of the manifest, or the cpu of the pods at CpuThresholdPercentage when there are none.
+// Quantities are validated by ValidateManifest.
+func createAutoscalerMetrics(replicas Replicas) []k8sautoscaling.MetricSpec {
+	if len(replicas.Metrics) == 0 {
+		return []k8sautoscaling.MetricSpec{{
+			Type: k8sautoscaling.ResourceMetricSourceType,
+			Resource: &k8sautoscaling.ResourceMetricSource{
+				Name:                     k8score.ResourceCPU,
+				TargetAverageUtilization: int32p(int32(replicas.CpuThresholdPercentage)),
+			},
+		}}
+	}
+
+	var metrics []k8sautoscaling.MetricSpec
+	for _, metric := range replicas.Metrics {
+		switch metric.Type {
+		case MetricTypeResource:
+			source := &k8sautoscaling.ResourceMetricSource{Name: k8score.ResourceName(metric.Name)}
+			if metric.TargetAverageUtilization > 0 {
+				source.TargetAverageUtilization = int32p(int32(metric.TargetAverageUtilization))
+			} else {
+				value := k8sresource.MustParse(metric.TargetAverageValue)
+				source.TargetAverageValue = &value
+			}
+			metrics = append(metrics, k8sautoscaling.MetricSpec{Type: k8sautoscaling.ResourceMetricSourceType, Resource: source})
+		case MetricTypePods:
+			metrics = append(metrics, k8sautoscaling.MetricSpec{
+				Type: k8sautoscaling.PodsMetricSourceType,
+				Pods: &k8sautoscaling.PodsMetricSource{
+					MetricName:         metric.Name,
+					TargetAverageValue: k8sresource.MustParse(metric.TargetAverageValue),
+				},
+			})
+		case MetricTypeObject:
+			metrics = append(metrics, k8sautoscaling.MetricSpec{
+				Type: k8sautoscaling.ObjectMetricSourceType,
+				Object: &k8sautoscaling.ObjectMetricSource{
+					Target: k8sautoscaling.CrossVersionObjectReference{
+						APIVersion: metric.Object.APIVersion,
+						Kind:       metric.Object.Kind,
+						Name:       metric.Object.Name,
+					},
+					MetricName:  metric.Name,
+					TargetValue: k8sresource.MustParse(metric.TargetValue),
+				},
+			})
+		}
+	}
+	return metrics
+}
+
 func createOrUpdateK8sResources(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, resources []NaisResource, clusterSubdomain string, istioEnabled bool, k8sClient kubernetes.Interface) (DeploymentResult, error) {
+	switch manifest.Kind {
+	case KindCronJob:
+		return createOrUpdateCronJobResources(deploymentRequest, manifest, resources, k8sClient)
+	case KindStatefulSet:
+		return createOrUpdateStatefulSetResources(deploymentRequest, manifest, resources, clusterSubdomain, istioEnabled, k8sClient)
+	}
+
 	var deploymentResult DeploymentResult
 
-	service, err := createService(deploymentRequest, k8sClient)
+	service, err := createService(deploymentRequest, manifest, k8sClient)
 	if err != nil {
 		return deploymentResult, fmt.Errorf("failed while creating service: %s", err)
 	}
 	deploymentResult.Service = service
 
+	networkPolicy, err := createOrUpdateAccessPolicy(deploymentRequest, manifest, istioEnabled, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating access policy: %s", err)
+	}
+	deploymentResult.NetworkPolicy = networkPolicy
+
+	configMap, err := createOrUpdateConfigMap(deploymentRequest, manifest, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating configmap: %s", err)
+	}
+	deploymentResult.ConfigMap = configMap
+
 	deployment, err := createOrUpdateDeployment(deploymentRequest, manifest, resources, istioEnabled, k8sClient)
 	if err != nil {
 		return deploymentResult, fmt.Errorf("failed while creating or updating deployment: %s", err)
@@ -527,7 +763,7 @@ func createOrUpdateK8sResources(deploymentRequest NaisDeploymentRequest, manifes
 	deploymentResult.Secret = secret
 
 	if !manifest.Ingress.Disabled {
-		ingress, err := createOrUpdateIngress(deploymentRequest, clusterSubdomain, resources, k8sClient)
+		ingress, err := createOrUpdateIngress(deploymentRequest, manifest, clusterSubdomain, resources, k8sClient)
 		if err != nil {
 			return deploymentResult, fmt.Errorf("failed while creating ingress: %s", err)
 		}
@@ -541,7 +777,69 @@ func createOrUpdateK8sResources(deploymentRequest NaisDeploymentRequest, manifes
 
 	deploymentResult.Autoscaler = autoscaler
 
-	return deploymentResult, err
+	podDisruptionBudget, err := createOrUpdatePodDisruptionBudget(deploymentRequest, manifest, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating poddisruptionbudget: %s", err)
+	}
+	deploymentResult.PodDisruptionBudget = podDisruptionBudget
+
+	deleted, err := deleteRemovedResources(deploymentRequest, manifest, resources, k8sClient)
+	deploymentResult.Deleted = deleted
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while deleting removed resources: %s", err)
+	}
+
+	return deploymentResult, nil
+}
+
+// Creates the Kubernetes objects for a deploy without reading from or writing to the cluster
+func createK8sResourceDefs(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, resources []NaisResource, clusterSubdomain string, istioEnabled bool) (DeploymentResult, error) {
+	var deploymentResult DeploymentResult
+
+	if manifest.Kind == KindCronJob {
+		cronJob, err := createCronJobDef(resources, manifest, deploymentRequest, nil)
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating cronjob: %s", err)
+		}
+		deploymentResult.CronJob = cronJob
+		deploymentResult.Secret = createSecretDef(resources, nil, deploymentRequest.Application, deploymentRequest.Namespace)
+		deploymentResult.ConfigMap = createConfigMapDef(manifest, deploymentRequest.Application, deploymentRequest.Namespace)
+		deploymentResult.NetworkPolicy = createNetworkPolicyDef(manifest, deploymentRequest.Application, deploymentRequest.Namespace, false)
+		return deploymentResult, nil
+	}
+
+	deploymentResult.Service = createServiceDef(deploymentRequest.Application, deploymentRequest.Namespace, manifest)
+	deploymentResult.NetworkPolicy = createNetworkPolicyDef(manifest, deploymentRequest.Application, deploymentRequest.Namespace, istioEnabled)
+
+	if manifest.Kind == KindStatefulSet {
+		statefulSet, err := createStatefulSetDef(resources, manifest, deploymentRequest, nil, istioEnabled)
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating statefulset: %s", err)
+		}
+		deploymentResult.StatefulSet = statefulSet
+	} else {
+		deployment, err := createDeploymentDef(resources, manifest, deploymentRequest, nil, istioEnabled)
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating deployment: %s", err)
+		}
+		deploymentResult.Deployment = deployment
+	}
+
+	deploymentResult.Secret = createSecretDef(resources, nil, deploymentRequest.Application, deploymentRequest.Namespace)
+	deploymentResult.ConfigMap = createConfigMapDef(manifest, deploymentRequest.Application, deploymentRequest.Namespace)
+
+	if !manifest.Ingress.Disabled {
+		ingress := createIngressDef(deploymentRequest.Application, deploymentRequest.Namespace)
+		addIngressRules(ingress, deploymentRequest, manifest, clusterSubdomain, resources)
+		deploymentResult.Ingress = ingress
+	}
+
+	if manifest.Kind != KindStatefulSet {
+		deploymentResult.Autoscaler = createOrUpdateAutoscalerDef(manifest.Replicas, nil, deploymentRequest.Application, deploymentRequest.Namespace)
+	}
+	deploymentResult.PodDisruptionBudget = createPodDisruptionBudgetDef(manifest, deploymentRequest.Application, deploymentRequest.Namespace)
+
+	return deploymentResult, nil
 }
 
 func createOrUpdateAutoscaler(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, k8sClient kubernetes.Interface) (*k8sautoscaling.HorizontalPodAutoscaler, error) {
@@ -551,12 +849,12 @@ func createOrUpdateAutoscaler(deploymentRequest NaisDeploymentRequest, manifest
 		return nil, fmt.Errorf("unable to get existing autoscaler: %s", err)
 	}
 
-	autoscalerDef := createOrUpdateAutoscalerDef(manifest.Replicas.Min, manifest.Replicas.Max, manifest.Replicas.CpuThresholdPercentage, autoscaler, deploymentRequest.Application, deploymentRequest.Namespace)
+	autoscalerDef := createOrUpdateAutoscalerDef(manifest.Replicas, autoscaler, deploymentRequest.Application, deploymentRequest.Namespace)
 	return createOrUpdateAutoscalerResource(autoscalerDef, deploymentRequest.Namespace, k8sClient)
 }
 
 // Returns nil,nil if ingress already exists. No reason to do update, as nothing can change
-func createOrUpdateIngress(deploymentRequest NaisDeploymentRequest, clusterSubdomain string, naisResources []NaisResource, k8sClient kubernetes.Interface) (*k8sextensions.Ingress, error) {
+func createOrUpdateIngress(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, clusterSubdomain string, naisResources []NaisResource, k8sClient kubernetes.Interface) (*k8sextensions.Ingress, error) {
 	ingress, err := getExistingIngress(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient)
 
 	if err != nil {
@@ -567,46 +865,60 @@ func createOrUpdateIngress(deploymentRequest NaisDeploymentRequest, clusterSubdo
 		ingress = createIngressDef(deploymentRequest.Application, deploymentRequest.Namespace)
 	}
 
-	ingress.Spec.TLS = []k8sextensions.IngressTLS{{SecretName: "istio-ingress-certs"}}
-	ingress.Spec.Rules = createIngressRules(deploymentRequest, clusterSubdomain, naisResources)
+	addIngressRules(ingress, deploymentRequest, manifest, clusterSubdomain, naisResources)
 	return createOrUpdateIngressResource(ingress, deploymentRequest.Namespace, k8sClient)
 }
 
-func createIngressRules(deploymentRequest NaisDeploymentRequest, clusterSubdomain string, naisResources []NaisResource) []k8sextensions.IngressRule {
+func addIngressRules(ingress *k8sextensions.Ingress, deploymentRequest NaisDeploymentRequest, manifest NaisManifest, clusterSubdomain string, naisResources []NaisResource) {
+	ingress.Spec.TLS = []k8sextensions.IngressTLS{{SecretName: "istio-ingress-certs"}}
+	ingress.Spec.Rules = createIngressRules(deploymentRequest, ingressServicePort(manifest), clusterSubdomain, naisResources)
+}
+
+func createIngressRules(deploymentRequest NaisDeploymentRequest, servicePort int32, clusterSubdomain string, naisResources []NaisResource) []k8sextensions.IngressRule {
 	var ingressRules []k8sextensions.IngressRule
 
-	defaultIngressRule := createIngressRule(deploymentRequest.Application, createIngressHostname(deploymentRequest.Application, deploymentRequest.Namespace, clusterSubdomain), "")
+	defaultIngressRule := createIngressRule(deploymentRequest.Application, servicePort, createIngressHostname(deploymentRequest.Application, deploymentRequest.Namespace, clusterSubdomain), "")
 	ingressRules = append(ingressRules, defaultIngressRule)
 
 	if deploymentRequest.Zone == ZONE_SBS {
-		ingressRules = append(ingressRules, createIngressRule(deploymentRequest.Application, createSBSPublicHostname(deploymentRequest), deploymentRequest.Application))
+		ingressRules = append(ingressRules, createIngressRule(deploymentRequest.Application, servicePort, createSBSPublicHostname(deploymentRequest), deploymentRequest.Application))
 	}
 
 	for _, naisResource := range naisResources {
 		if naisResource.resourceType == "LoadBalancerConfig" && len(naisResource.ingresses) > 0 {
 			for host, path := range naisResource.ingresses {
-				ingressRules = append(ingressRules, createIngressRule(deploymentRequest.Application, host, path))
+				ingressRules = append(ingressRules, createIngressRule(deploymentRequest.Application, servicePort, host, path))
 			}
 		}
 	}
 
 	return ingressRules
 }
-func createService(deploymentRequest NaisDeploymentRequest, k8sClient kubernetes.Interface) (*k8score.Service, error) {
+func createService(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, k8sClient kubernetes.Interface) (*k8score.Service, error) {
 	existingService, err := getExistingService(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient)
 
 	if err != nil {
 		return nil, fmt.Errorf("unable to get existing service: %s", err)
 	}
 
+	serviceDef := createServiceDef(deploymentRequest.Application, deploymentRequest.Namespace, manifest)
 	if existingService != nil {
-		return nil, nil // we have done nothing
+		return updateServicePorts(existingService, serviceDef, k8sClient)
 	}
 
-	serviceDef := createServiceDef(deploymentRequest.Application, deploymentRequest.Namespace)
 	return createServiceResource(serviceDef, deploymentRequest.Namespace, k8sClient)
 }
 
+// Updates the ports of an existing service if the manifest has changed them. Returns nil if nothing changed.
+func updateServicePorts(existingService, serviceDef *k8score.Service, k8sClient kubernetes.Interface) (*k8score.Service, error) {
+	if reflect.DeepEqual(existingService.Spec.Ports, serviceDef.Spec.Ports) {
+		return nil, nil // we have done nothing
+	}
+
+	existingService.Spec.Ports = serviceDef.Spec.Ports
+	return k8sClient.CoreV1().Services(existingService.Namespace).Update(existingService)
+}
+
 func createOrUpdateDeployment(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource, istioEnabled bool, k8sClient kubernetes.Interface) (*k8sextensions.Deployment, error) {
 	existingDeployment, err := getExistingDeployment(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient)
 
@@ -693,7 +1005,7 @@ func getExistingIngress(application string, namespace string, k8sClient kubernet
 }
 
 func getExistingAutoscaler(application string, namespace string, k8sClient kubernetes.Interface) (*k8sautoscaling.HorizontalPodAutoscaler, error) {
-	autoscalerClient := k8sClient.AutoscalingV1().HorizontalPodAutoscalers(namespace)
+	autoscalerClient := k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace)
 	autoscaler, err := autoscalerClient.Get(application, k8smeta.GetOptions{})
 
 	switch {
@@ -708,9 +1020,9 @@ func getExistingAutoscaler(application string, namespace string, k8sClient kuber
 
 func createOrUpdateAutoscalerResource(autoscalerSpec *k8sautoscaling.HorizontalPodAutoscaler, namespace string, k8sClient kubernetes.Interface) (*k8sautoscaling.HorizontalPodAutoscaler, error) {
 	if autoscalerSpec.ObjectMeta.ResourceVersion != "" {
-		return k8sClient.AutoscalingV1().HorizontalPodAutoscalers(namespace).Update(autoscalerSpec)
+		return k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace).Update(autoscalerSpec)
 	} else {
-		return k8sClient.AutoscalingV1().HorizontalPodAutoscalers(namespace).Create(autoscalerSpec)
+		return k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace).Create(autoscalerSpec)
 	}
 }
 
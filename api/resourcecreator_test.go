@@ -2,7 +2,9 @@ package api
 
 import (
 	"github.com/stretchr/testify/assert"
+	k8sautoscaling "k8s.io/api/autoscaling/v2beta1"
 	k8score "k8s.io/api/core/v1"
+	k8sextensions "k8s.io/api/extensions/v1beta1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/fake"
@@ -70,7 +72,7 @@ func newDefaultManifest() NaisManifest {
 }
 
 func TestService(t *testing.T) {
-	service := createServiceDef(appName, namespace)
+	service := createServiceDef(appName, namespace, newDefaultManifest())
 	service.Spec.ClusterIP = clusterIP
 	clientset := fake.NewSimpleClientset(service)
 
@@ -87,7 +89,7 @@ func TestService(t *testing.T) {
 	})
 
 	t.Run("when no service exists, a new one is created", func(t *testing.T) {
-		service, err := createService(NaisDeploymentRequest{Namespace: namespace, Application: otherAppName, Version: version}, clientset)
+		service, err := createService(NaisDeploymentRequest{Namespace: namespace, Application: otherAppName, Version: version}, newDefaultManifest(), clientset)
 
 		assert.NoError(t, err)
 		assert.Equal(t, otherAppName, service.ObjectMeta.Name)
@@ -96,12 +98,83 @@ func TestService(t *testing.T) {
 		assert.Equal(t, map[string]string{"app": otherAppName}, service.Spec.Selector)
 	})
 	t.Run("when service exists, nothing happens", func(t *testing.T) {
-		nilValue, err := createService(NaisDeploymentRequest{Namespace: namespace, Application: appName, Version: version}, clientset)
+		nilValue, err := createService(NaisDeploymentRequest{Namespace: namespace, Application: appName, Version: version}, newDefaultManifest(), clientset)
 		assert.NoError(t, err)
 		assert.Nil(t, nilValue)
 	})
 }
 
+func TestPorts(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Namespace: namespace, Application: appName, Version: version}
+	manifest := newDefaultManifest()
+	manifest.Ports = []Port{
+		{Name: "grpc", ContainerPort: 9090, ServicePort: 9090},
+		{Name: "admin", ContainerPort: 8081},
+		{Name: "statsd", ContainerPort: 8125, ServicePort: 8125, Protocol: "udp"},
+	}
+	manifest.Healthcheck.Liveness.Port = "admin"
+	manifest.Healthcheck.Readiness.Port = "admin"
+	manifest.Prometheus.Port = "admin"
+	manifest.Ingress.Port = "grpc"
+
+	t.Run("the service exposes the ports with a service port", func(t *testing.T) {
+		service := createServiceDef(appName, namespace, manifest)
+		assert.Equal(t, []k8score.ServicePort{
+			{Name: "grpc", Protocol: k8score.ProtocolTCP, Port: 9090, TargetPort: intstr.FromString("grpc")},
+			{Name: "statsd", Protocol: k8score.ProtocolUDP, Port: 8125, TargetPort: intstr.FromString("statsd")},
+		}, service.Spec.Ports)
+	})
+
+	t.Run("the container exposes every port, and probes and prometheus target the named port", func(t *testing.T) {
+		deployment, err := createDeploymentDef([]NaisResource{}, manifest, deploymentRequest, nil, false)
+		assert.NoError(t, err)
+
+		container := deployment.Spec.Template.Spec.Containers[0]
+		assert.Equal(t, []k8score.ContainerPort{
+			{Name: "grpc", ContainerPort: 9090, Protocol: k8score.ProtocolTCP},
+			{Name: "admin", ContainerPort: 8081, Protocol: k8score.ProtocolTCP},
+			{Name: "statsd", ContainerPort: 8125, Protocol: k8score.ProtocolUDP},
+		}, container.Ports)
+		assert.Equal(t, intstr.FromString("admin"), container.LivenessProbe.HTTPGet.Port)
+		assert.Equal(t, intstr.FromString("admin"), container.ReadinessProbe.HTTPGet.Port)
+		assert.Equal(t, "admin", deployment.Spec.Template.Annotations["prometheus.io/port"])
+	})
+
+	t.Run("the ingress targets the service port of the named port", func(t *testing.T) {
+		ingress, err := createOrUpdateIngress(deploymentRequest, manifest, "nais.example.yo", []NaisResource{}, fake.NewSimpleClientset())
+		assert.NoError(t, err)
+		assert.Equal(t, intstr.FromInt(9090), ingress.Spec.Rules[0].HTTP.Paths[0].Backend.ServicePort)
+	})
+
+	t.Run("the ports of an existing service are updated", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(createServiceDef(appName, namespace, newDefaultManifest()))
+
+		service, err := createService(deploymentRequest, manifest, clientset)
+		assert.NoError(t, err)
+		assert.Len(t, service.Spec.Ports, 2)
+
+		unchanged, err := createService(deploymentRequest, manifest, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, unchanged)
+	})
+}
+
+func TestCreateProbes(t *testing.T) {
+	t.Run("probes check the container by http, tcp or exec", func(t *testing.T) {
+		http := createProbe(Probe{Path: "isAlive", InitialDelay: 20, PeriodSeconds: 10, FailureThreshold: 3, Timeout: 1})
+		assert.Equal(t, &k8score.HTTPGetAction{Path: "isAlive", Port: intstr.FromString(DefaultPortName)}, http.HTTPGet)
+		assert.Equal(t, int32(20), http.InitialDelaySeconds)
+
+		tcp := createProbe(Probe{Type: ProbeTypeTCP, Port: "amqp"})
+		assert.Nil(t, tcp.HTTPGet)
+		assert.Equal(t, &k8score.TCPSocketAction{Port: intstr.FromString("amqp")}, tcp.TCPSocket)
+
+		exec := createProbe(Probe{Type: ProbeTypeExec, Command: []string{"pg_isready", "-q"}})
+		assert.Nil(t, exec.HTTPGet)
+		assert.Equal(t, &k8score.ExecAction{Command: []string{"pg_isready", "-q"}}, exec.Exec)
+	})
+}
+
 func TestDeployment(t *testing.T) {
 	newVersion := "14"
 	resource1Name := "r1"
@@ -497,6 +570,80 @@ func TestDeployment(t *testing.T) {
 		assert.Equal(t, "unable to create deployment: found duplicate environment variable SRVAPP_PASSWORD when adding password for srvapp (certificate)"+
 			" Change the Fasit alias or use propertyMap to create unique variable names", err.Error())
 	})
+	t.Run("rollout strategy is taken from the manifest, with defaults for what is not set", func(t *testing.T) {
+		deploymentRequest := NaisDeploymentRequest{Namespace: namespace, Application: appName, Version: version}
+
+		spec, err := createDeploymentSpec(deploymentRequest, newDefaultManifest(), naisResources, false)
+		assert.NoError(t, err)
+		assert.Equal(t, k8sextensions.RollingUpdateDeploymentStrategyType, spec.Strategy.Type)
+		assert.Equal(t, intstr.FromInt(1), *spec.Strategy.RollingUpdate.MaxSurge)
+		assert.Equal(t, intstr.FromInt(0), *spec.Strategy.RollingUpdate.MaxUnavailable)
+		assert.Equal(t, int32(300), *spec.ProgressDeadlineSeconds)
+		assert.Equal(t, int32(10), *spec.RevisionHistoryLimit)
+
+		manifest := newDefaultManifest()
+		manifest.Deployment = DeploymentConfig{MaxSurge: "25%", MaxUnavailable: "2", ProgressDeadlineSeconds: 900}
+		spec, err = createDeploymentSpec(deploymentRequest, manifest, naisResources, false)
+		assert.NoError(t, err)
+		assert.Equal(t, intstr.FromString("25%"), *spec.Strategy.RollingUpdate.MaxSurge)
+		assert.Equal(t, intstr.FromInt(2), *spec.Strategy.RollingUpdate.MaxUnavailable)
+		assert.Equal(t, int32(900), *spec.ProgressDeadlineSeconds)
+		assert.Equal(t, int32(10), *spec.RevisionHistoryLimit)
+
+		manifest.Deployment = DeploymentConfig{Strategy: DeploymentStrategyRecreate, RevisionHistoryLimit: 3}
+		spec, err = createDeploymentSpec(deploymentRequest, manifest, naisResources, false)
+		assert.NoError(t, err)
+		assert.Equal(t, k8sextensions.DeploymentStrategy{Type: k8sextensions.RecreateDeploymentStrategyType}, spec.Strategy)
+		assert.Equal(t, int32(3), *spec.RevisionHistoryLimit)
+	})
+
+	t.Run("sidecars and init containers are added next to the app container", func(t *testing.T) {
+		deploymentRequest := NaisDeploymentRequest{Namespace: namespace, Application: appName, Version: version}
+		manifest := newDefaultManifest()
+		manifest.SharedVolumes = []SharedVolume{{Name: "logs", MountPath: "/var/log/app"}}
+		manifest.Sidecars = []Container{{
+			Name:         "shipper",
+			Image:        "docker.hub/shipper:1.0",
+			Resources:    ResourceRequirements{Requests: ResourceList{Memory: "64Mi"}},
+			Env:          map[string]string{"LOG_DIR": "/logs", "FORMAT": "json"},
+			FasitEnv:     true,
+			VolumeMounts: []VolumeMount{{Name: "logs", MountPath: "/logs"}},
+		}}
+		manifest.InitContainers = []Container{{Name: "migrate", Image: "docker.hub/migrate:1.0", Args: []string{"up"}}}
+
+		podSpec, err := createPodSpec(deploymentRequest, manifest, naisResources)
+		assert.NoError(t, err)
+
+		assert.Len(t, podSpec.Containers, 2)
+		assert.Equal(t, []k8score.VolumeMount{{Name: "logs", MountPath: "/var/log/app"}}, podSpec.Containers[0].VolumeMounts)
+		assert.Equal(t, k8score.Volume{Name: "logs", VolumeSource: k8score.VolumeSource{EmptyDir: &k8score.EmptyDirVolumeSource{}}}, podSpec.Volumes[0])
+
+		sidecar := podSpec.Containers[1]
+		assert.Equal(t, "docker.hub/shipper:1.0", sidecar.Image)
+		assert.Equal(t, resource.MustParse("64Mi"), sidecar.Resources.Requests[k8score.ResourceMemory])
+		assert.Empty(t, sidecar.Resources.Limits)
+		assert.Equal(t, podSpec.Containers[0].Env, sidecar.Env[:len(sidecar.Env)-2])
+		assert.Equal(t, []k8score.EnvVar{{Name: "FORMAT", Value: "json"}, {Name: "LOG_DIR", Value: "/logs"}}, sidecar.Env[len(sidecar.Env)-2:])
+		assert.Equal(t, []k8score.VolumeMount{{Name: "logs", MountPath: "/logs"}}, sidecar.VolumeMounts)
+
+		assert.Len(t, podSpec.InitContainers, 1)
+		assert.Equal(t, []string{"up"}, podSpec.InitContainers[0].Args)
+		assert.Empty(t, podSpec.InitContainers[0].Env)
+	})
+
+	t.Run("duplicate environment variables in a sidecar should error", func(t *testing.T) {
+		manifest := newDefaultManifest()
+		manifest.Sidecars = []Container{{Name: "shipper", Image: "docker.hub/shipper:1.0", Env: map[string]string{"R1_KEY1": "value"}, FasitEnv: true}}
+
+		_, err := createPodSpec(NaisDeploymentRequest{Namespace: namespace, Application: appName, Version: version}, manifest, naisResources)
+		assert.EqualError(t, err, "found duplicate environment variable R1_KEY1 when adding R1_KEY1 for shipper (container)"+
+			" Change the Fasit alias or use propertyMap to create unique variable names")
+
+		manifest.Sidecars[0].FasitEnv = false
+		_, err = createPodSpec(NaisDeploymentRequest{Namespace: namespace, Application: appName, Version: version}, manifest, naisResources)
+		assert.NoError(t, err)
+	})
+
 	t.Run("Injects envoy sidecar based on settings", func(t *testing.T) {
 		deploymentRequest := NaisDeploymentRequest{
 			Namespace:   "default",
@@ -536,7 +683,7 @@ func TestIngress(t *testing.T) {
 	})
 
 	t.Run("when no ingress exists, a default ingress is created", func(t *testing.T) {
-		ingress, err := createOrUpdateIngress(NaisDeploymentRequest{Namespace: namespace, Application: otherAppName}, subDomain, []NaisResource{}, clientset)
+		ingress, err := createOrUpdateIngress(NaisDeploymentRequest{Namespace: namespace, Application: otherAppName}, newDefaultManifest(), subDomain, []NaisResource{}, clientset)
 
 		assert.NoError(t, err)
 		assert.Equal(t, otherAppName, ingress.ObjectMeta.Name)
@@ -549,7 +696,7 @@ func TestIngress(t *testing.T) {
 
 	t.Run("when ingress is created in non-default namespace, hostname is postfixed with namespace", func(t *testing.T) {
 		namespace := "nondefault"
-		ingress, err := createOrUpdateIngress(NaisDeploymentRequest{Namespace: namespace, Application: otherAppName}, subDomain, []NaisResource{}, clientset)
+		ingress, err := createOrUpdateIngress(NaisDeploymentRequest{Namespace: namespace, Application: otherAppName}, newDefaultManifest(), subDomain, []NaisResource{}, clientset)
 		assert.NoError(t, err)
 		assert.Equal(t, otherAppName+"-"+namespace+"."+subDomain, ingress.Spec.Rules[0].Host)
 	})
@@ -570,7 +717,7 @@ func TestIngress(t *testing.T) {
 				},
 			},
 		}
-		ingress, err := createOrUpdateIngress(NaisDeploymentRequest{Namespace: namespace, Application: otherAppName}, subDomain, naisResources, clientset)
+		ingress, err := createOrUpdateIngress(NaisDeploymentRequest{Namespace: namespace, Application: otherAppName}, newDefaultManifest(), subDomain, naisResources, clientset)
 
 		assert.NoError(t, err)
 		assert.Equal(t, 3, len(ingress.Spec.Rules))
@@ -589,7 +736,7 @@ func TestIngress(t *testing.T) {
 		clientset := fake.NewSimpleClientset(ingress) //Avoid interfering with other tests in suite.
 		var naisResources []NaisResource
 
-		ingress, err := createOrUpdateIngress(NaisDeploymentRequest{Namespace: namespace, Application: "testapp", Zone: ZONE_SBS, FasitEnvironment: "testenv"}, subDomain, naisResources, clientset)
+		ingress, err := createOrUpdateIngress(NaisDeploymentRequest{Namespace: namespace, Application: "testapp", Zone: ZONE_SBS, FasitEnvironment: "testenv"}, newDefaultManifest(), subDomain, naisResources, clientset)
 		rules := ingress.Spec.Rules
 
 		assert.NoError(t, err)
@@ -708,7 +855,7 @@ func TestCreateOrUpdateSecret(t *testing.T) {
 }
 
 func TestCreateOrUpdateAutoscaler(t *testing.T) {
-	autoscaler := createOrUpdateAutoscalerDef(1, 2, 3, nil, appName, namespace)
+	autoscaler := createOrUpdateAutoscalerDef(Replicas{Min: 1, Max: 2, CpuThresholdPercentage: 3}, nil, appName, namespace)
 	autoscaler.ObjectMeta.ResourceVersion = resourceVersion
 	clientset := fake.NewSimpleClientset(autoscaler)
 
@@ -730,7 +877,7 @@ func TestCreateOrUpdateAutoscaler(t *testing.T) {
 		assert.Equal(t, "", autoscaler.ObjectMeta.ResourceVersion)
 		assert.Equal(t, int32(1), autoscaler.Spec.MaxReplicas)
 		assert.Equal(t, int32p(2), autoscaler.Spec.MinReplicas)
-		assert.Equal(t, int32p(69), autoscaler.Spec.TargetCPUUtilizationPercentage)
+		assert.Equal(t, int32p(69), autoscaler.Spec.Metrics[0].Resource.TargetAverageUtilization)
 		assert.Equal(t, namespace, autoscaler.ObjectMeta.Namespace)
 		assert.Equal(t, otherAppName, autoscaler.ObjectMeta.Name)
 		assert.Equal(t, otherAppName, autoscaler.Spec.ScaleTargetRef.Name)
@@ -746,12 +893,41 @@ func TestCreateOrUpdateAutoscaler(t *testing.T) {
 		assert.Equal(t, resourceVersion, autoscaler.ObjectMeta.ResourceVersion)
 		assert.Equal(t, namespace, autoscaler.ObjectMeta.Namespace)
 		assert.Equal(t, appName, autoscaler.ObjectMeta.Name)
-		assert.Equal(t, int32p(int32(cpuThreshold)), autoscaler.Spec.TargetCPUUtilizationPercentage)
+		assert.Equal(t, int32p(int32(cpuThreshold)), autoscaler.Spec.Metrics[0].Resource.TargetAverageUtilization)
 		assert.Equal(t, int32p(int32(minReplicas)), autoscaler.Spec.MinReplicas)
 		assert.Equal(t, int32(maxReplicas), autoscaler.Spec.MaxReplicas)
 		assert.Equal(t, appName, autoscaler.Spec.ScaleTargetRef.Name)
 		assert.Equal(t, "Deployment", autoscaler.Spec.ScaleTargetRef.Kind)
 	})
+
+	t.Run("metrics replace the cpu threshold", func(t *testing.T) {
+		replicas := Replicas{Min: 2, Max: 10, CpuThresholdPercentage: 50, Metrics: []Metric{
+			{Type: MetricTypeResource, Name: "memory", TargetAverageValue: "512Mi"},
+			{Type: MetricTypePods, Name: "http_requests_per_second", TargetAverageValue: "100"},
+			{Type: MetricTypeObject, Name: "kafka_consumergroup_lag", TargetValue: "1k", Object: MetricObject{APIVersion: "v1", Kind: "Service", Name: "kafka"}},
+		}}
+
+		metrics := createOrUpdateAutoscalerDef(replicas, nil, appName, namespace).Spec.Metrics
+		assert.Len(t, metrics, 3)
+
+		memory := resource.MustParse("512Mi")
+		assert.Equal(t, k8sautoscaling.MetricSpec{
+			Type:     k8sautoscaling.ResourceMetricSourceType,
+			Resource: &k8sautoscaling.ResourceMetricSource{Name: k8score.ResourceMemory, TargetAverageValue: &memory},
+		}, metrics[0])
+		assert.Equal(t, k8sautoscaling.MetricSpec{
+			Type: k8sautoscaling.PodsMetricSourceType,
+			Pods: &k8sautoscaling.PodsMetricSource{MetricName: "http_requests_per_second", TargetAverageValue: resource.MustParse("100")},
+		}, metrics[1])
+		assert.Equal(t, k8sautoscaling.MetricSpec{
+			Type: k8sautoscaling.ObjectMetricSourceType,
+			Object: &k8sautoscaling.ObjectMetricSource{
+				Target:      k8sautoscaling.CrossVersionObjectReference{APIVersion: "v1", Kind: "Service", Name: "kafka"},
+				MetricName:  "kafka_consumergroup_lag",
+				TargetValue: resource.MustParse("1k"),
+			},
+		}, metrics[2])
+	})
 }
 
 func TestDNS1123ValidResourceNames(t *testing.T) {
@@ -824,9 +1000,9 @@ func TestCreateK8sResources(t *testing.T) {
 		},
 	}
 
-	service := createServiceDef(appName, namespace)
+	service := createServiceDef(appName, namespace, newDefaultManifest())
 
-	autoscaler := createOrUpdateAutoscalerDef(6, 9, 6, nil, appName, namespace)
+	autoscaler := createOrUpdateAutoscalerDef(Replicas{Min: 6, Max: 9, CpuThresholdPercentage: 6}, nil, appName, namespace)
 	autoscaler.ObjectMeta.ResourceVersion = resourceVersion
 	clientset := fake.NewSimpleClientset(autoscaler, service)
 
@@ -875,6 +1051,37 @@ func TestCreateK8sResources(t *testing.T) {
 		assert.Empty(t, deploymentResult.Ingress)
 	})
 
+	t.Run("deletes ingress and secret no longer produced by the manifest", func(t *testing.T) {
+		manifest.Ingress.Disabled = false
+		clientset := fake.NewSimpleClientset()
+		_, err := createOrUpdateK8sResources(deploymentRequest, manifest, naisResources, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		manifest.Ingress.Disabled = true
+		deploymentResult, err := createOrUpdateK8sResources(deploymentRequest, manifest, naisResourcesNoSecret, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []DeletedResource{{"Ingress", appName}, {"Secret", appName}}, deploymentResult.Deleted)
+
+		ingress, _ := getExistingIngress(appName, namespace, clientset)
+		assert.Nil(t, ingress)
+		secret, _ := getExistingSecret(appName, namespace, clientset)
+		assert.Nil(t, secret)
+	})
+
+	t.Run("leaves objects not created by naisd alone", func(t *testing.T) {
+		manifest.Ingress.Disabled = true
+		ingress := createIngressDef(appName, namespace)
+		ingress.Labels = map[string]string{"app": "other"}
+		clientset := fake.NewSimpleClientset(ingress)
+
+		deploymentResult, err := createOrUpdateK8sResources(deploymentRequest, manifest, naisResourcesNoSecret, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		assert.Empty(t, deploymentResult.Deleted)
+		existing, _ := getExistingIngress(appName, namespace, clientset)
+		assert.NotNil(t, existing)
+	})
 }
 
 func TestCheckForDuplicates(t *testing.T) {
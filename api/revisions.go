@@ -0,0 +1,195 @@
+package api
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+	k8score "k8s.io/api/core/v1"
+	k8sextensions "k8s.io/api/extensions/v1beta1"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+type Revision struct {
+	Revision         int64     `json:"revision"`
+	Version          string    `json:"version"`
+	Image            string    `json:"image"`
+	FasitEnvironment string    `json:"fasitEnvironment,omitempty"`
+	Created          time.Time `json:"created"`
+	Current          bool      `json:"current"`
+}
+
+type RollbackRequest struct {
+	Application   string `json:"application"`
+	Namespace     string `json:"namespace"`
+	Revision      int64  `json:"revision"`
+	Zone          string `json:"zone,omitempty"` // Only used if the revision was deployed before naisd recorded the zone
+	FasitUsername string `json:"fasitUsername"`
+	FasitPassword string `json:"fasitPassword"`
+	OnBehalfOf    string `json:"onbehalfof,omitempty"`
+}
+
+type revisionNotFoundError struct {
+	application string
+	revision    int64
+}
+
+func (e revisionNotFoundError) Error() string {
+	if e.revision == 0 {
+		return fmt.Sprintf("no deployment of %s found", e.application)
+	}
+	return fmt.Sprintf("revision %d of %s not found", e.revision, e.application)
+}
+
+// Lists the revisions of an application kept by its deployment, newest first
+func listRevisions(application, namespace string, limit int, k8sClient kubernetes.Interface) ([]Revision, error) {
+	deployment, replicaSets, err := getDeploymentAndReplicaSets(application, namespace, k8sClient)
+	if err != nil {
+		return nil, err
+	}
+
+	currentRevision := revisionOf(deployment.ObjectMeta)
+	revisions := []Revision{}
+
+	for i := len(replicaSets) - 1; i >= 0 && (limit <= 0 || len(revisions) < limit); i-- {
+		replicaSet := replicaSets[i]
+		container := findAppContainer(application, replicaSet.Spec.Template.Spec.Containers)
+
+		revisions = append(revisions, Revision{
+			Revision:         revisionOf(replicaSet.ObjectMeta),
+			Version:          envValue(container, "APP_VERSION"),
+			Image:            container.Image,
+			FasitEnvironment: envValue(container, "FASIT_ENVIRONMENT_NAME"),
+			Created:          replicaSet.CreationTimestamp.Time,
+			Current:          revisionOf(replicaSet.ObjectMeta) == currentRevision,
+		})
+	}
+
+	return revisions, nil
+}
+
+// Recreates the deployment request and manifest that produced a revision. The manifest is read from the
+// replica set when it is recorded there, otherwise it is fetched again for the version of the revision.
+func deploymentFromRevision(rollbackRequest RollbackRequest, environmentClass EnvironmentClassLookup, k8sClient kubernetes.Interface) (NaisDeploymentRequest, NaisManifest, error) {
+	_, replicaSets, err := getDeploymentAndReplicaSets(rollbackRequest.Application, rollbackRequest.Namespace, k8sClient)
+	if err != nil {
+		return NaisDeploymentRequest{}, NaisManifest{}, err
+	}
+
+	var replicaSet *k8sextensions.ReplicaSet
+	for i := range replicaSets {
+		if revisionOf(replicaSets[i].ObjectMeta) == rollbackRequest.Revision {
+			replicaSet = &replicaSets[i]
+		}
+	}
+
+	if replicaSet == nil {
+		return NaisDeploymentRequest{}, NaisManifest{}, revisionNotFoundError{rollbackRequest.Application, rollbackRequest.Revision}
+	}
+
+	deploymentRequest := recordedDeploymentRequest(rollbackRequest.Application, rollbackRequest.Namespace, replicaSet.Annotations, replicaSet.Spec.Template.Spec.Containers)
+	deploymentRequest.FasitUsername = rollbackRequest.FasitUsername
+	deploymentRequest.FasitPassword = rollbackRequest.FasitPassword
+	deploymentRequest.OnBehalfOf = rollbackRequest.OnBehalfOf
+	if deploymentRequest.Zone == "" {
+		deploymentRequest.Zone = rollbackRequest.Zone
+	}
+
+	manifest, err := recordedManifest(replicaSet.Annotations)
+	if err != nil {
+		return NaisDeploymentRequest{}, NaisManifest{}, fmt.Errorf("revision %d: %s", rollbackRequest.Revision, err)
+	}
+	if manifest != nil {
+		return deploymentRequest, *manifest, nil
+	}
+
+	glog.Infof("revision %d of %s has no recorded manifest, fetching manifest for version %s", rollbackRequest.Revision, rollbackRequest.Application, deploymentRequest.Version)
+
+	generatedManifest, err := GenerateManifest(deploymentRequest, environmentClass)
+	if err != nil {
+		return NaisDeploymentRequest{}, NaisManifest{}, err
+	}
+
+	return deploymentRequest, generatedManifest, nil
+}
+
+// Recreates the deployment request recorded on a deployment or replica set. The version and the Fasit
+// environment are read from the application container when they are not recorded as annotations.
+func recordedDeploymentRequest(application, namespace string, annotations map[string]string, containers []k8score.Container) NaisDeploymentRequest {
+	container := findAppContainer(application, containers)
+
+	deploymentRequest := NaisDeploymentRequest{
+		Application:      application,
+		Namespace:        namespace,
+		Version:          annotations[VersionAnnotation],
+		FasitEnvironment: annotations[FasitEnvironmentAnnotation],
+		Zone:             annotations[ZoneAnnotation],
+	}
+
+	if deploymentRequest.Version == "" {
+		deploymentRequest.Version = envValue(container, "APP_VERSION")
+	}
+	if deploymentRequest.FasitEnvironment == "" {
+		deploymentRequest.FasitEnvironment = envValue(container, "FASIT_ENVIRONMENT_NAME")
+	}
+
+	return deploymentRequest
+}
+
+// Returns the manifest recorded on a deployment or replica set, or nil if none is recorded
+func recordedManifest(annotations map[string]string) (*NaisManifest, error) {
+	manifestYaml, ok := annotations[ManifestAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	var manifest NaisManifest
+	if err := yaml.Unmarshal([]byte(manifestYaml), &manifest); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal recorded manifest: %s", err)
+	}
+	return &manifest, nil
+}
+
+func getDeploymentAndReplicaSets(application, namespace string, k8sClient kubernetes.Interface) (*k8sextensions.Deployment, []k8sextensions.ReplicaSet, error) {
+	deployName, err := activeDeploymentName(application, namespace, k8sClient)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get existing service: %s", err)
+	}
+
+	deployment, err := getExistingDeployment(deployName, namespace, k8sClient)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get existing deployment: %s", err)
+	}
+	if deployment == nil {
+		return nil, nil, revisionNotFoundError{application: application}
+	}
+
+	replicaSets, err := getReplicaSetsByRevision(deployment, k8sClient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return deployment, replicaSets, nil
+}
+
+func findAppContainer(application string, containers []k8score.Container) k8score.Container {
+	for _, container := range containers {
+		if container.Name == application {
+			return container
+		}
+	}
+
+	if len(containers) > 0 {
+		return containers[0]
+	}
+	return k8score.Container{}
+}
+
+func envValue(container k8score.Container, name string) string {
+	for _, envVar := range container.Env {
+		if envVar.Name == name {
+			return envVar.Value
+		}
+	}
+	return ""
+}
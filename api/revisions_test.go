@@ -0,0 +1,114 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	k8score "k8s.io/api/core/v1"
+	k8sextensions "k8s.io/api/extensions/v1beta1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func newReplicaSetForVersion(revision, appVersion string, manifest *NaisManifest) *k8sextensions.ReplicaSet {
+	replicaSet := newReplicaSet(revision, image+":"+appVersion)
+	replicaSet.Spec.Template.Spec.Containers[0].Env = []k8score.EnvVar{
+		{Name: "APP_VERSION", Value: appVersion},
+		{Name: "FASIT_ENVIRONMENT_NAME", Value: environment},
+	}
+
+	if manifest != nil {
+		manifestYaml, _ := yaml.Marshal(manifest)
+		replicaSet.Annotations[ManifestAnnotation] = string(manifestYaml)
+		replicaSet.Annotations[ZoneAnnotation] = ZONE_SBS
+	}
+
+	return replicaSet
+}
+
+func TestListRevisions(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		newFailedDeployment(image+":2"),
+		newReplicaSetForVersion("1", "1", nil),
+		newReplicaSetForVersion("2", "2", nil),
+	)
+
+	t.Run("revisions are listed newest first", func(t *testing.T) {
+		revisions, err := listRevisions(appName, namespace, 10, clientset)
+		assert.NoError(t, err)
+
+		assert.Len(t, revisions, 2)
+		assert.Equal(t, int64(2), revisions[0].Revision)
+		assert.Equal(t, "2", revisions[0].Version)
+		assert.Equal(t, image+":2", revisions[0].Image)
+		assert.Equal(t, environment, revisions[0].FasitEnvironment)
+		assert.True(t, revisions[0].Current)
+		assert.Equal(t, int64(1), revisions[1].Revision)
+		assert.False(t, revisions[1].Current)
+	})
+
+	t.Run("number of revisions is limited", func(t *testing.T) {
+		revisions, err := listRevisions(appName, namespace, 1, clientset)
+		assert.NoError(t, err)
+		assert.Len(t, revisions, 1)
+	})
+
+	t.Run("unknown application yields not found", func(t *testing.T) {
+		_, err := listRevisions("unknown", namespace, 10, clientset)
+		assert.IsType(t, revisionNotFoundError{}, err)
+	})
+}
+
+func TestListRevisionsOfBlueGreen(t *testing.T) {
+	colourLabels := map[string]string{"app": appName, ColourLabel: ColourBlue}
+
+	deployment := newFailedDeployment(image + ":2")
+	deployment.Name = colourName(appName, ColourBlue)
+	deployment.Spec.Selector = &k8smeta.LabelSelector{MatchLabels: colourLabels}
+
+	service := createServiceDef(appName, namespace, newDefaultManifest())
+	service.Spec.Selector = colourLabels
+
+	objects := []runtime.Object{deployment, service}
+	for _, revision := range []string{"1", "2"} {
+		replicaSet := newReplicaSetForVersion(revision, revision, nil)
+		replicaSet.Labels = colourLabels
+		objects = append(objects, replicaSet)
+	}
+
+	revisions, err := listRevisions(appName, namespace, 10, fake.NewSimpleClientset(objects...))
+	assert.NoError(t, err)
+	assert.Len(t, revisions, 2, "the replica sets of the active colour are labelled with the app, not the name of the deployment")
+	assert.True(t, revisions[0].Current)
+}
+
+func TestDeploymentFromRevision(t *testing.T) {
+	manifest := newDefaultManifest()
+	manifest.Port = 1337
+
+	clientset := fake.NewSimpleClientset(
+		newFailedDeployment(image+":2"),
+		newReplicaSetForVersion("1", "1", &manifest),
+		newReplicaSetForVersion("2", "2", nil),
+	)
+
+	t.Run("recorded manifest and zone are used", func(t *testing.T) {
+		rollbackRequest := RollbackRequest{Application: appName, Namespace: namespace, Revision: 1, Zone: ZONE_FSS, FasitUsername: "user"}
+
+		deploymentRequest, revisionManifest, err := deploymentFromRevision(rollbackRequest, EnvironmentClassFromName, clientset)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "1", deploymentRequest.Version)
+		assert.Equal(t, environment, deploymentRequest.FasitEnvironment)
+		assert.Equal(t, ZONE_SBS, deploymentRequest.Zone)
+		assert.Equal(t, "user", deploymentRequest.FasitUsername)
+		assert.Equal(t, 1337, revisionManifest.Port)
+		assert.Equal(t, manifest.Healthcheck, revisionManifest.Healthcheck)
+	})
+
+	t.Run("unknown revision yields not found", func(t *testing.T) {
+		_, _, err := deploymentFromRevision(RollbackRequest{Application: appName, Namespace: namespace, Revision: 3}, EnvironmentClassFromName, clientset)
+		assert.Equal(t, revisionNotFoundError{appName, 3}, err)
+	})
+}
@@ -0,0 +1,438 @@
+package api
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	k8sautoscaling "k8s.io/api/autoscaling/v2beta1"
+	k8score "k8s.io/api/core/v1"
+	k8sextensions "k8s.io/api/extensions/v1beta1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	RollbackAuto           = "auto"
+	RevisionAnnotation     = "deployment.kubernetes.io/revision"
+	podTemplateHashLabel   = "pod-template-hash"
+	rollbackDeadlineMargin = 60 * time.Second
+	rollbackLockHolder     = "automatic rollback"
+	DeployKindAutoRollback = "autorollback"
+)
+
+var rollbackPollInterval = 5 * time.Second
+
+var rollbacks = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "rollbacks", Help: "automatic rollbacks done by NaisD"}, []string{"nais_app", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(rollbacks)
+}
+
+// The objects a deploy may change, as they were before the deploy started
+type rollbackSnapshot struct {
+	Secret     *k8score.Secret
+	ConfigMap  *k8score.ConfigMap
+	Autoscaler *k8sautoscaling.HorizontalPodAutoscaler
+	Ingress    *k8sextensions.Ingress
+}
+
+func takeRollbackSnapshot(application, namespace string, k8sClient kubernetes.Interface) (rollbackSnapshot, error) {
+	secret, err := getExistingSecret(application, namespace, k8sClient)
+	if err != nil {
+		return rollbackSnapshot{}, fmt.Errorf("unable to get existing secret: %s", err)
+	}
+
+	configMap, err := getExistingConfigMap(application, namespace, k8sClient)
+	if err != nil {
+		return rollbackSnapshot{}, fmt.Errorf("unable to get existing configmap: %s", err)
+	}
+
+	autoscaler, err := getExistingAutoscaler(application, namespace, k8sClient)
+	if err != nil {
+		return rollbackSnapshot{}, fmt.Errorf("unable to get existing autoscaler: %s", err)
+	}
+
+	ingress, err := getExistingIngress(application, namespace, k8sClient)
+	if err != nil {
+		return rollbackSnapshot{}, fmt.Errorf("unable to get existing ingress: %s", err)
+	}
+
+	return rollbackSnapshot{Secret: secret, ConfigMap: configMap, Autoscaler: autoscaler, Ingress: ingress}, nil
+}
+
+// Waits for the rollout of the deployment to finish. If it fails, the deployment is rolled back to its
+// previous revision, and the secret, configmap, autoscaler and ingress are restored from the snapshot.
+// Only the deployment named after the application is watched, so validation rejects automatic rollback
+// for blue/green deploys, statefulsets and cronjobs.
+//
+// The watch outlives the deploy, so the rollback takes the deploy lock, and a rollout that a newer deploy has
+// changed the deployment of is left alone: its snapshot would undo the newer deploy. The rollback is recorded
+// in the deploy history, on behalf of whoever made the deploy that failed.
+func (api Api) watchDeploymentAndRollback(deploymentRequest NaisDeploymentRequest, snapshot rollbackSnapshot) {
+	application, namespace, k8sClient := deploymentRequest.Application, deploymentRequest.Namespace, api.Clientset
+
+	status, deployment, err := waitForRollout(application, namespace, k8sClient)
+	if _, ok := err.(rolloutSupersededError); ok {
+		glog.Infof("not rolling back %s in %s: %s", application, namespace, err)
+		return
+	}
+	if err != nil {
+		glog.Errorf("unable to watch rollout of %s in %s: %s", application, namespace, err)
+		return
+	}
+
+	if status != Failed {
+		return
+	}
+
+	release, err := lockForRollback(application, namespace, api.DeployLocker)
+	if err != nil {
+		glog.Errorf("unable to take deploy lock to roll back %s in %s: %s", application, namespace, err)
+		rollbacks.With(prometheus.Labels{"nais_app": application, "result": "failed"}).Inc()
+		return
+	}
+	defer release()
+
+	current, err := getExistingDeployment(application, namespace, k8sClient)
+	if err != nil {
+		glog.Errorf("unable to get deployment %s in %s to roll back: %s", application, namespace, err)
+		return
+	}
+	if current == nil || current.Generation != deployment.Generation {
+		glog.Infof("not rolling back %s in %s: %s", application, namespace, rolloutSupersededError{application})
+		return
+	}
+
+	glog.Infof("rollout of %s in %s failed, rolling back", application, namespace)
+
+	started := time.Now()
+	if err := rollbackK8sResources(current, snapshot, k8sClient); err != nil {
+		glog.Errorf("automatic rollback of %s in %s failed: %s", application, namespace, err)
+		rollbacks.With(prometheus.Labels{"nais_app": application, "result": "failed"}).Inc()
+		recordDeployEvent(deployment, k8score.EventTypeWarning, "RollbackFailed", fmt.Sprintf("automatic rollback failed: %s", err), k8sClient)
+		api.recordAutoRollback(deploymentRequest, current, started, &appError{err, "automatic rollback failed", http.StatusInternalServerError})
+		return
+	}
+
+	rollbacks.With(prometheus.Labels{"nais_app": application, "result": "success"}).Inc()
+	recordDeployEvent(deployment, k8score.EventTypeNormal, "RolledBack", "rollout exceeded its progress deadline, rolled back to previous revision", k8sClient)
+	api.recordAutoRollback(deploymentRequest, current, started, nil)
+}
+
+// Records the version the deployment was rolled back to, which a failed rollback leaves at the failed version
+func (api Api) recordAutoRollback(deploymentRequest NaisDeploymentRequest, deployment *k8sextensions.Deployment, started time.Time, appErr *appError) {
+	rolledBack := recordedDeploymentRequest(deploymentRequest.Application, deploymentRequest.Namespace, deployment.Annotations, deployment.Spec.Template.Spec.Containers)
+	rolledBack.FasitUsername = deploymentRequest.FasitUsername
+	rolledBack.OnBehalfOf = deploymentRequest.OnBehalfOf
+
+	var manifest NaisManifest
+	if recorded, err := recordedManifest(deployment.Annotations); err != nil {
+		glog.Errorf("unable to read manifest of %s in %s for the deploy history: %s", deployment.Name, deployment.Namespace, err)
+	} else if recorded != nil {
+		manifest = *recorded
+	}
+
+	api.recordDeploy(newDeployRecord(DeployKindAutoRollback, rolledBack, manifest, started, appErr))
+}
+
+type rolloutSupersededError struct {
+	application string
+}
+
+func (e rolloutSupersededError) Error() string {
+	return fmt.Sprintf("deployment %s has been changed by a newer deploy", e.application)
+}
+
+// The deploy that started the watch may still hold the deploy lock when the rollout fails, so a held lock is
+// waited for. Whoever held it may have deployed again, which the caller checks once it has the lock.
+func lockForRollback(application, namespace string, deployLocker DeployLocker) (func(), error) {
+	deadline := time.Now().Add(rollbackDeadlineMargin)
+
+	for {
+		release, err := deployLocker.Lock(namespace, application, rollbackLockHolder)
+		if _, locked := err.(deployLockedError); !locked || time.Now().After(deadline) {
+			return release, err
+		}
+		time.Sleep(rollbackPollInterval)
+	}
+}
+
+// Polls the deployment until its rollout has finished. The generation of the deployment when the watch starts
+// is the one deployed, a later generation means a newer deploy has taken over and gives a rolloutSupersededError.
+func waitForRollout(application, namespace string, k8sClient kubernetes.Interface) (DeployStatus, *k8sextensions.Deployment, error) {
+	var deadline time.Time
+	var generation int64
+
+	for {
+		deployment, err := getExistingDeployment(application, namespace, k8sClient)
+		if err != nil {
+			return Failed, nil, err
+		}
+		if deployment == nil {
+			return Failed, nil, fmt.Errorf("deployment %s does not exist", application)
+		}
+
+		if deadline.IsZero() {
+			progressDeadline := time.Duration(300) * time.Second
+			if deployment.Spec.ProgressDeadlineSeconds != nil {
+				progressDeadline = time.Duration(*deployment.Spec.ProgressDeadlineSeconds) * time.Second
+			}
+			deadline = time.Now().Add(progressDeadline + rollbackDeadlineMargin)
+			generation = deployment.Generation
+		}
+
+		if deployment.Generation != generation {
+			return InProgress, deployment, rolloutSupersededError{application}
+		}
+
+		if status, _ := deploymentStatusAndView(*deployment); status != InProgress {
+			return status, deployment, nil
+		}
+
+		if time.Now().After(deadline) {
+			return InProgress, deployment, fmt.Errorf("gave up waiting for rollout of %s to finish", application)
+		}
+
+		time.Sleep(rollbackPollInterval)
+	}
+}
+
+func rollbackK8sResources(deployment *k8sextensions.Deployment, snapshot rollbackSnapshot, k8sClient kubernetes.Interface) error {
+	if err := rollbackDeployment(deployment, k8sClient); err != nil {
+		return fmt.Errorf("unable to roll back deployment: %s", err)
+	}
+
+	if err := restoreSecret(deployment.Name, deployment.Namespace, snapshot.Secret, k8sClient); err != nil {
+		return fmt.Errorf("unable to restore secret: %s", err)
+	}
+
+	if err := restoreConfigMap(deployment.Name, deployment.Namespace, snapshot.ConfigMap, k8sClient); err != nil {
+		return fmt.Errorf("unable to restore configmap: %s", err)
+	}
+
+	if err := restoreAutoscaler(deployment.Name, deployment.Namespace, snapshot.Autoscaler, k8sClient); err != nil {
+		return fmt.Errorf("unable to restore autoscaler: %s", err)
+	}
+
+	if err := restoreIngress(deployment.Name, deployment.Namespace, snapshot.Ingress, k8sClient); err != nil {
+		return fmt.Errorf("unable to restore ingress: %s", err)
+	}
+
+	return nil
+}
+
+// Replaces the pod template of the deployment with the template of the replica set of the previous revision
+func rollbackDeployment(deployment *k8sextensions.Deployment, k8sClient kubernetes.Interface) error {
+	replicaSets, err := getReplicaSetsByRevision(deployment, k8sClient)
+	if err != nil {
+		return err
+	}
+
+	currentRevision := revisionOf(deployment.ObjectMeta)
+
+	var previous *k8sextensions.ReplicaSet
+	for i := range replicaSets {
+		if revisionOf(replicaSets[i].ObjectMeta) < currentRevision {
+			previous = &replicaSets[i]
+		}
+	}
+
+	if previous == nil {
+		return fmt.Errorf("no previous revision found for deployment %s", deployment.Name)
+	}
+
+	deployment.Spec.Template = templateFromReplicaSet(*previous)
+	for _, annotation := range []string{ManifestAnnotation, ZoneAnnotation, VersionAnnotation, FasitEnvironmentAnnotation} {
+		if value, ok := previous.Annotations[annotation]; ok {
+			deployment.Annotations[annotation] = value
+		}
+	}
+
+	_, err = k8sClient.ExtensionsV1beta1().Deployments(deployment.Namespace).Update(deployment)
+	return err
+}
+
+// Returns the replica sets owned by the deployment, sorted by ascending revision. They are listed by the selector of
+// the deployment, as the deployment of a blue/green colour is not named after the app label of its pods.
+func getReplicaSetsByRevision(deployment *k8sextensions.Deployment, k8sClient kubernetes.Interface) ([]k8sextensions.ReplicaSet, error) {
+	selector, err := k8smeta.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse selector of deployment %s: %s", deployment.Name, err)
+	}
+
+	replicaSetList, err := k8sClient.ExtensionsV1beta1().ReplicaSets(deployment.Namespace).List(k8smeta.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list replica sets: %s", err)
+	}
+
+	var replicaSets []k8sextensions.ReplicaSet
+	for _, replicaSet := range replicaSetList.Items {
+		if isOwnedBy(replicaSet.ObjectMeta, deployment.UID) {
+			replicaSets = append(replicaSets, replicaSet)
+		}
+	}
+
+	sort.Slice(replicaSets, func(i, j int) bool {
+		return revisionOf(replicaSets[i].ObjectMeta) < revisionOf(replicaSets[j].ObjectMeta)
+	})
+
+	return replicaSets, nil
+}
+
+func templateFromReplicaSet(replicaSet k8sextensions.ReplicaSet) k8score.PodTemplateSpec {
+	template := *replicaSet.Spec.Template.DeepCopy()
+	delete(template.Labels, podTemplateHashLabel)
+	return template
+}
+
+func isOwnedBy(objectMeta k8smeta.ObjectMeta, uid k8stypes.UID) bool {
+	for _, owner := range objectMeta.OwnerReferences {
+		if owner.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func revisionOf(objectMeta k8smeta.ObjectMeta) int64 {
+	revision, err := strconv.ParseInt(objectMeta.Annotations[RevisionAnnotation], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return revision
+}
+
+// Puts the secret back the way it was before the deploy, deleting it if it did not exist
+func restoreSecret(application, namespace string, previous *k8score.Secret, k8sClient kubernetes.Interface) error {
+	current, err := getExistingSecret(application, namespace, k8sClient)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case previous == nil && current == nil:
+		return nil
+	case previous == nil:
+		return k8sClient.CoreV1().Secrets(namespace).Delete(application, &k8smeta.DeleteOptions{})
+	case current == nil:
+		restored := previous.DeepCopy()
+		restored.ResourceVersion = ""
+		_, err = k8sClient.CoreV1().Secrets(namespace).Create(restored)
+		return err
+	default:
+		current.Data = previous.Data
+		_, err = k8sClient.CoreV1().Secrets(namespace).Update(current)
+		return err
+	}
+}
+
+// Puts the configmap back the way it was before the deploy, deleting it if it did not exist
+func restoreConfigMap(application, namespace string, previous *k8score.ConfigMap, k8sClient kubernetes.Interface) error {
+	current, err := getExistingConfigMap(application, namespace, k8sClient)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case previous == nil && current == nil:
+		return nil
+	case previous == nil:
+		return k8sClient.CoreV1().ConfigMaps(namespace).Delete(application, &k8smeta.DeleteOptions{})
+	case current == nil:
+		restored := previous.DeepCopy()
+		restored.ResourceVersion = ""
+		_, err = k8sClient.CoreV1().ConfigMaps(namespace).Create(restored)
+		return err
+	default:
+		current.Data = previous.Data
+		_, err = k8sClient.CoreV1().ConfigMaps(namespace).Update(current)
+		return err
+	}
+}
+
+// Puts the autoscaler back the way it was before the deploy, deleting it if it did not exist
+func restoreAutoscaler(application, namespace string, previous *k8sautoscaling.HorizontalPodAutoscaler, k8sClient kubernetes.Interface) error {
+	current, err := getExistingAutoscaler(application, namespace, k8sClient)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case previous == nil && current == nil:
+		return nil
+	case previous == nil:
+		return k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace).Delete(application, &k8smeta.DeleteOptions{})
+	case current == nil:
+		restored := previous.DeepCopy()
+		restored.ResourceVersion = ""
+		_, err = k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace).Create(restored)
+		return err
+	default:
+		current.Spec = previous.Spec
+		_, err = k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace).Update(current)
+		return err
+	}
+}
+
+// Puts the ingress back the way it was before the deploy, deleting it if it did not exist
+func restoreIngress(application, namespace string, previous *k8sextensions.Ingress, k8sClient kubernetes.Interface) error {
+	current, err := getExistingIngress(application, namespace, k8sClient)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case previous == nil && current == nil:
+		return nil
+	case previous == nil:
+		return k8sClient.ExtensionsV1beta1().Ingresses(namespace).Delete(application, &k8smeta.DeleteOptions{})
+	case current == nil:
+		restored := previous.DeepCopy()
+		restored.ResourceVersion = ""
+		_, err = k8sClient.ExtensionsV1beta1().Ingresses(namespace).Create(restored)
+		return err
+	default:
+		current.Spec = previous.Spec
+		_, err = k8sClient.ExtensionsV1beta1().Ingresses(namespace).Update(current)
+		return err
+	}
+}
+
+func recordDeployEvent(deployment *k8sextensions.Deployment, eventType, reason, message string, k8sClient kubernetes.Interface) {
+	now := k8smeta.Now()
+	event := &k8score.Event{
+		ObjectMeta: k8smeta.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", deployment.Name, now.UnixNano()),
+			Namespace: deployment.Namespace,
+			Labels:    map[string]string{"app": deployment.Name},
+		},
+		InvolvedObject: k8score.ObjectReference{
+			Kind:            "Deployment",
+			APIVersion:      "extensions/v1beta1",
+			Name:            deployment.Name,
+			Namespace:       deployment.Namespace,
+			UID:             deployment.UID,
+			ResourceVersion: deployment.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         k8score.EventSource{Component: "naisd"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := k8sClient.CoreV1().Events(deployment.Namespace).Create(event); err != nil {
+		glog.Errorf("unable to record event %s for %s: %s", reason, deployment.Name, err)
+	}
+}
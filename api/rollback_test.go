@@ -0,0 +1,192 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	k8score "k8s.io/api/core/v1"
+	k8sextensions "k8s.io/api/extensions/v1beta1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+const deploymentUID = k8stypes.UID("2a7f1c4e")
+
+func newReplicaSet(revision, image string) *k8sextensions.ReplicaSet {
+	return &k8sextensions.ReplicaSet{
+		ObjectMeta: k8smeta.ObjectMeta{
+			Name:            appName + "-" + revision,
+			Namespace:       namespace,
+			Labels:          map[string]string{"app": appName},
+			Annotations:     map[string]string{RevisionAnnotation: revision},
+			OwnerReferences: []k8smeta.OwnerReference{{Kind: "Deployment", Name: appName, UID: deploymentUID}},
+		},
+		Spec: k8sextensions.ReplicaSetSpec{
+			Template: &k8score.PodTemplateSpec{
+				ObjectMeta: k8smeta.ObjectMeta{
+					Labels: map[string]string{"app": appName, podTemplateHashLabel: "hash" + revision},
+				},
+				Spec: k8score.PodSpec{
+					Containers: []k8score.Container{{Name: appName, Image: image}},
+				},
+			},
+		},
+	}
+}
+
+func newFailedDeployment(image string) *k8sextensions.Deployment {
+	return &k8sextensions.Deployment{
+		ObjectMeta: k8smeta.ObjectMeta{
+			Name:        appName,
+			Namespace:   namespace,
+			UID:         deploymentUID,
+			Generation:  2,
+			Annotations: map[string]string{RevisionAnnotation: "2"},
+		},
+		Spec: k8sextensions.DeploymentSpec{
+			Replicas: int32p(1),
+			Template: k8score.PodTemplateSpec{
+				Spec: k8score.PodSpec{
+					Containers: []k8score.Container{{Name: appName, Image: image}},
+				},
+			},
+		},
+		Status: k8sextensions.DeploymentStatus{
+			ObservedGeneration: 2,
+			Conditions: []k8sextensions.DeploymentCondition{
+				{Type: k8sextensions.DeploymentProgressing, Reason: "ProgressDeadlineExceeded"},
+			},
+		},
+	}
+}
+
+func TestAutomaticRollback(t *testing.T) {
+	rollbackPollInterval = time.Millisecond
+
+	previousSecret := &k8score.Secret{
+		ObjectMeta: createObjectMeta(appName, namespace),
+		Data:       map[string][]byte{"key": []byte("old")},
+	}
+	currentSecret := previousSecret.DeepCopy()
+	currentSecret.Data = map[string][]byte{"key": []byte("new")}
+	currentAutoscaler := createOrUpdateAutoscalerDef(Replicas{Min: 2, Max: 4, CpuThresholdPercentage: 50}, nil, appName, namespace)
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Namespace: namespace, Version: "2", OnBehalfOf: "deployer"}
+	newRollbackApi := func(clientset *fake.Clientset) Api {
+		return Api{Clientset: clientset, DeployLocker: NewConfigMapDeployLocker(clientset, "naisd"), DeployHistory: NewConfigMapDeployHistory(clientset, "naisd")}
+	}
+
+	t.Run("failed rollout is rolled back to the previous revision", func(t *testing.T) {
+		previous := newReplicaSet("1", image+":1")
+		previous.Annotations[VersionAnnotation] = "1"
+		clientset := fake.NewSimpleClientset(
+			newFailedDeployment(image+":2"),
+			previous,
+			newReplicaSet("2", image+":2"),
+			currentSecret.DeepCopy(),
+			currentAutoscaler.DeepCopy(),
+		)
+		api := newRollbackApi(clientset)
+
+		api.watchDeploymentAndRollback(deploymentRequest, rollbackSnapshot{Secret: previousSecret})
+
+		deployment, _ := getExistingDeployment(appName, namespace, clientset)
+		assert.Equal(t, image+":1", deployment.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, map[string]string{"app": appName}, deployment.Spec.Template.Labels)
+
+		secret, _ := getExistingSecret(appName, namespace, clientset)
+		assert.Equal(t, []byte("old"), secret.Data["key"])
+
+		autoscaler, _ := getExistingAutoscaler(appName, namespace, clientset)
+		assert.Nil(t, autoscaler, "autoscaler did not exist before the deploy")
+
+		events, _ := clientset.CoreV1().Events(namespace).List(k8smeta.ListOptions{})
+		assert.Len(t, events.Items, 1)
+		assert.Equal(t, "RolledBack", events.Items[0].Reason)
+
+		records, _ := api.DeployHistory.List(namespace, appName)
+		assert.Len(t, records, 1)
+		assert.Equal(t, DeployKindAutoRollback, records[0].Kind)
+		assert.Equal(t, JobSucceeded, records[0].Outcome)
+		assert.Equal(t, "1", records[0].Version)
+		assert.Equal(t, "deployer", records[0].OnBehalfOf)
+	})
+
+	t.Run("successful rollout is left alone", func(t *testing.T) {
+		deployment := newFailedDeployment(image + ":2")
+		deployment.Status.Conditions = nil
+		deployment.Status.Replicas = 1
+		deployment.Status.UpdatedReplicas = 1
+		deployment.Status.AvailableReplicas = 1
+		clientset := fake.NewSimpleClientset(deployment, newReplicaSet("1", image+":1"), currentSecret.DeepCopy())
+		api := newRollbackApi(clientset)
+
+		api.watchDeploymentAndRollback(deploymentRequest, rollbackSnapshot{Secret: previousSecret})
+
+		existing, _ := getExistingDeployment(appName, namespace, clientset)
+		assert.Equal(t, image+":2", existing.Spec.Template.Spec.Containers[0].Image)
+
+		secret, _ := getExistingSecret(appName, namespace, clientset)
+		assert.Equal(t, []byte("new"), secret.Data["key"])
+
+		records, _ := api.DeployHistory.List(namespace, appName)
+		assert.Empty(t, records)
+	})
+
+	t.Run("rollback without a previous revision is recorded as failed", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(newFailedDeployment(image+":2"), newReplicaSet("2", image+":2"))
+		api := newRollbackApi(clientset)
+
+		api.watchDeploymentAndRollback(deploymentRequest, rollbackSnapshot{})
+
+		events, _ := clientset.CoreV1().Events(namespace).List(k8smeta.ListOptions{})
+		assert.Len(t, events.Items, 1)
+		assert.Equal(t, "RollbackFailed", events.Items[0].Reason)
+
+		records, _ := api.DeployHistory.List(namespace, appName)
+		assert.Len(t, records, 1)
+		assert.Equal(t, DeployKindAutoRollback, records[0].Kind)
+		assert.Equal(t, JobFailed, records[0].Outcome)
+	})
+
+	t.Run("failed rollout changed by a newer deploy is left alone", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(
+			newFailedDeployment(image+":2"),
+			newReplicaSet("1", image+":1"),
+			newReplicaSet("2", image+":2"),
+			currentSecret.DeepCopy(),
+		)
+		api := newRollbackApi(clientset)
+		release, err := api.DeployLocker.Lock(namespace, appName, "newer deploy")
+		assert.NoError(t, err)
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			deployment, _ := getExistingDeployment(appName, namespace, clientset)
+			deployment.Generation = 3
+			clientset.ExtensionsV1beta1().Deployments(namespace).Update(deployment)
+			release()
+		}()
+
+		api.watchDeploymentAndRollback(deploymentRequest, rollbackSnapshot{Secret: previousSecret})
+
+		deployment, _ := getExistingDeployment(appName, namespace, clientset)
+		assert.Equal(t, image+":2", deployment.Spec.Template.Spec.Containers[0].Image)
+
+		secret, _ := getExistingSecret(appName, namespace, clientset)
+		assert.Equal(t, []byte("new"), secret.Data["key"])
+	})
+}
+
+func TestRestoreAutoscaler(t *testing.T) {
+	previous := createOrUpdateAutoscalerDef(Replicas{Min: 2, Max: 4, CpuThresholdPercentage: 50}, nil, appName, namespace)
+	current := createOrUpdateAutoscalerDef(Replicas{Min: 6, Max: 8, CpuThresholdPercentage: 70}, nil, appName, namespace)
+	clientset := fake.NewSimpleClientset(current)
+
+	err := restoreAutoscaler(appName, namespace, previous, clientset)
+	assert.NoError(t, err)
+
+	autoscaler, _ := getExistingAutoscaler(appName, namespace, clientset)
+	assert.Equal(t, int32(4), autoscaler.Spec.MaxReplicas)
+	assert.Equal(t, int32(50), *autoscaler.Spec.Metrics[0].Resource.TargetAverageUtilization)
+}
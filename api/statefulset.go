@@ -0,0 +1,249 @@
+package api
+
+import (
+	"fmt"
+	k8sapps "k8s.io/api/apps/v1"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8sresource "k8s.io/apimachinery/pkg/api/resource"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	KindStatefulSet = "statefulset"
+	headlessSuffix  = "-headless"
+)
+
+func headlessServiceName(application string) string {
+	return application + headlessSuffix
+}
+
+// Creates the headless Kubernetes Service governing a StatefulSet, giving each pod a DNS name of its own:
+// <app>-<ordinal>.<app>-headless.<namespace>
+func createHeadlessServiceDef(application, namespace string, manifest NaisManifest) *k8score.Service {
+	service := createServiceDef(application, namespace, manifest)
+	service.Name = headlessServiceName(application)
+	service.Spec.ClusterIP = k8score.ClusterIPNone
+	return service
+}
+
+// Creates a Kubernetes StatefulSet object running Replicas.Min pods of the application, with the persistent
+// volumes of the manifest claimed for each pod and mounted in the app container. The annotations recording
+// the deploy are the same as on a deployment.
+func createStatefulSetDef(naisResources []NaisResource, manifest NaisManifest, deploymentRequest NaisDeploymentRequest, existingStatefulSet *k8sapps.StatefulSet, istioEnabled bool) (*k8sapps.StatefulSet, error) {
+	podSpec, err := createPodSpec(deploymentRequest, manifest, naisResources)
+	if err != nil {
+		return nil, err
+	}
+	if istioRulesEnabled(manifest, istioEnabled) {
+		podSpec.ServiceAccountName = deploymentRequest.Application
+	}
+
+	var claims []k8score.PersistentVolumeClaim
+	for _, volume := range manifest.PersistentVolumes {
+		claims = append(claims, createPersistentVolumeClaim(deploymentRequest.Application, volume))
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, k8score.VolumeMount{Name: volume.Name, MountPath: volume.MountPath})
+	}
+
+	annotations, err := createDeploymentAnnotations(deploymentRequest, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := k8sapps.StatefulSetSpec{
+		Replicas:    int32p(int32(manifest.Replicas.Min)),
+		ServiceName: headlessServiceName(deploymentRequest.Application),
+		Selector: &k8smeta.LabelSelector{
+			MatchLabels: map[string]string{"app": deploymentRequest.Application},
+		},
+		Template: k8score.PodTemplateSpec{
+			ObjectMeta: createPodObjectMetaWithAnnotations(deploymentRequest, manifest, istioEnabled),
+			Spec:       podSpec,
+		},
+		VolumeClaimTemplates: claims,
+		UpdateStrategy:       k8sapps.StatefulSetUpdateStrategy{Type: k8sapps.RollingUpdateStatefulSetStrategyType},
+	}
+
+	statefulSet := existingStatefulSet
+	if statefulSet == nil {
+		statefulSet = &k8sapps.StatefulSet{
+			TypeMeta: k8smeta.TypeMeta{
+				Kind:       "StatefulSet",
+				APIVersion: "apps/v1",
+			},
+			ObjectMeta: createObjectMeta(deploymentRequest.Application, deploymentRequest.Namespace),
+		}
+	} else {
+		// kubernetes does not allow the volume claims of a statefulset to change
+		spec.VolumeClaimTemplates = statefulSet.Spec.VolumeClaimTemplates
+	}
+	if statefulSet.Annotations == nil {
+		statefulSet.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		statefulSet.Annotations[k] = v
+	}
+	statefulSet.Spec = spec
+
+	return statefulSet, nil
+}
+
+func createPersistentVolumeClaim(application string, volume PersistentVolume) k8score.PersistentVolumeClaim {
+	claim := k8score.PersistentVolumeClaim{
+		ObjectMeta: k8smeta.ObjectMeta{
+			Name:   volume.Name,
+			Labels: map[string]string{"app": application},
+		},
+		Spec: k8score.PersistentVolumeClaimSpec{
+			AccessModes: []k8score.PersistentVolumeAccessMode{k8score.ReadWriteOnce},
+			Resources: k8score.ResourceRequirements{
+				Requests: k8score.ResourceList{k8score.ResourceStorage: k8sresource.MustParse(volume.Size)},
+			},
+		},
+	}
+	if volume.StorageClass != "" {
+		storageClass := volume.StorageClass
+		claim.Spec.StorageClassName = &storageClass
+	}
+	return claim
+}
+
+func createOrUpdateStatefulSet(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, naisResources []NaisResource, istioEnabled bool, k8sClient kubernetes.Interface) (*k8sapps.StatefulSet, error) {
+	existingStatefulSet, err := getExistingStatefulSet(deploymentRequest.Application, deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing statefulset: %s", err)
+	}
+
+	statefulSetDef, err := createStatefulSetDef(naisResources, manifest, deploymentRequest, existingStatefulSet, istioEnabled)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create statefulset: %s", err)
+	}
+
+	if existingStatefulSet != nil {
+		return k8sClient.AppsV1().StatefulSets(deploymentRequest.Namespace).Update(statefulSetDef)
+	}
+	return k8sClient.AppsV1().StatefulSets(deploymentRequest.Namespace).Create(statefulSetDef)
+}
+
+func createHeadlessService(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, k8sClient kubernetes.Interface) (*k8score.Service, error) {
+	existingService, err := getExistingService(headlessServiceName(deploymentRequest.Application), deploymentRequest.Namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing headless service: %s", err)
+	}
+
+	serviceDef := createHeadlessServiceDef(deploymentRequest.Application, deploymentRequest.Namespace, manifest)
+	if existingService != nil {
+		return updateServicePorts(existingService, serviceDef, k8sClient)
+	}
+
+	return createServiceResource(serviceDef, deploymentRequest.Namespace, k8sClient)
+}
+
+// Creates or updates the StatefulSet, Services, Secret and Ingress of a stateful application. The number of pods
+// is fixed, so an application that used to be a deployment has its Deployment and HorizontalPodAutoscaler deleted.
+func createOrUpdateStatefulSetResources(deploymentRequest NaisDeploymentRequest, manifest NaisManifest, resources []NaisResource, clusterSubdomain string, istioEnabled bool, k8sClient kubernetes.Interface) (DeploymentResult, error) {
+	var deploymentResult DeploymentResult
+
+	service, err := createService(deploymentRequest, manifest, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating service: %s", err)
+	}
+	deploymentResult.Service = service
+
+	networkPolicy, err := createOrUpdateAccessPolicy(deploymentRequest, manifest, istioEnabled, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating access policy: %s", err)
+	}
+	deploymentResult.NetworkPolicy = networkPolicy
+
+	if _, err := createHeadlessService(deploymentRequest, manifest, k8sClient); err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating headless service: %s", err)
+	}
+
+	secret, err := createOrUpdateSecret(deploymentRequest, resources, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating secret: %s", err)
+	}
+	deploymentResult.Secret = secret
+
+	configMap, err := createOrUpdateConfigMap(deploymentRequest, manifest, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating configmap: %s", err)
+	}
+	deploymentResult.ConfigMap = configMap
+
+	statefulSet, err := createOrUpdateStatefulSet(deploymentRequest, manifest, resources, istioEnabled, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating statefulset: %s", err)
+	}
+	deploymentResult.StatefulSet = statefulSet
+
+	if !manifest.Ingress.Disabled {
+		ingress, err := createOrUpdateIngress(deploymentRequest, manifest, clusterSubdomain, resources, k8sClient)
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating ingress: %s", err)
+		}
+		deploymentResult.Ingress = ingress
+	}
+
+	podDisruptionBudget, err := createOrUpdatePodDisruptionBudget(deploymentRequest, manifest, k8sClient)
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while creating or updating poddisruptionbudget: %s", err)
+	}
+	deploymentResult.PodDisruptionBudget = podDisruptionBudget
+
+	deleted, err := deleteRemovedResources(deploymentRequest, manifest, resources, k8sClient)
+	deploymentResult.Deleted = deleted
+	if err != nil {
+		return deploymentResult, fmt.Errorf("failed while deleting removed resources: %s", err)
+	}
+
+	return deploymentResult, nil
+}
+
+func getExistingStatefulSet(application string, namespace string, k8sClient kubernetes.Interface) (*k8sapps.StatefulSet, error) {
+	statefulSet, err := k8sClient.AppsV1().StatefulSets(namespace).Get(application, k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return statefulSet, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+}
+
+// The rollout status of a StatefulSet, following kubectl rollout status: the pods are replaced one at a time,
+// and the rollout is done when every pod is ready and runs the update revision. A StatefulSet has no progress
+// deadline, so it never fails.
+func statefulSetStatusAndView(statefulSet k8sapps.StatefulSet) (DeployStatus, DeploymentStatusView) {
+	replicas := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		replicas = *statefulSet.Spec.Replicas
+	}
+
+	status, reason := Success, ""
+	switch {
+	case statefulSet.Generation > statefulSet.Status.ObservedGeneration:
+		status, reason = InProgress, "Waiting for statefulset spec update to be observed."
+	case statefulSet.Status.ReadyReplicas < replicas:
+		status, reason = InProgress, fmt.Sprintf("Waiting for %d pods to be ready.", replicas-statefulSet.Status.ReadyReplicas)
+	case statefulSet.Status.UpdateRevision != statefulSet.Status.CurrentRevision:
+		status, reason = InProgress, fmt.Sprintf("Waiting for rollout to finish: %d out of %d new pods have been updated.", statefulSet.Status.UpdatedReplicas, replicas)
+	}
+
+	containers, images := findContainerImages(statefulSet.Spec.Template.Spec.Containers)
+	return status, DeploymentStatusView{
+		Name:       statefulSet.Name,
+		Desired:    replicas,
+		Current:    statefulSet.Status.Replicas,
+		UpToDate:   statefulSet.Status.UpdatedReplicas,
+		Available:  statefulSet.Status.ReadyReplicas,
+		Containers: containers,
+		Images:     images,
+		Status:     status.String(),
+		Reason:     reason,
+	}
+}
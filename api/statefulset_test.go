@@ -0,0 +1,119 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	k8sapps "k8s.io/api/apps/v1"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func newStatefulSetManifest() NaisManifest {
+	manifest := newDefaultManifest()
+	manifest.Kind = KindStatefulSet
+	manifest.Replicas = Replicas{Min: 3, Max: 3}
+	manifest.PersistentVolumes = []PersistentVolume{{Name: "data", Size: "10Gi", StorageClass: "ssd", MountPath: "/var/lib/data"}}
+	return manifest
+}
+
+func TestCreateOrUpdateStatefulSetResources(t *testing.T) {
+	deploymentRequest := NaisDeploymentRequest{Application: appName, Version: version, Namespace: namespace, Zone: ZONE_FSS}
+
+	t.Run("a stateful application gets a statefulset with a volume claimed for each pod", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+
+		result, err := createOrUpdateK8sResources(deploymentRequest, newStatefulSetManifest(), []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, result.Deployment)
+		assert.Nil(t, result.Autoscaler)
+		assert.NotNil(t, result.Service)
+		assert.NotNil(t, result.Ingress)
+
+		statefulSet, _ := getExistingStatefulSet(appName, namespace, clientset)
+		assert.Equal(t, int32(3), *statefulSet.Spec.Replicas)
+		assert.Equal(t, appName+headlessSuffix, statefulSet.Spec.ServiceName)
+		assert.Equal(t, version, statefulSet.Annotations[VersionAnnotation])
+		assert.Contains(t, statefulSet.Spec.Template.Spec.Containers[0].VolumeMounts, k8score.VolumeMount{Name: "data", MountPath: "/var/lib/data"})
+
+		claim := statefulSet.Spec.VolumeClaimTemplates[0]
+		assert.Equal(t, "data", claim.Name)
+		assert.Equal(t, "ssd", *claim.Spec.StorageClassName)
+		assert.Equal(t, resource.MustParse("10Gi"), claim.Spec.Resources.Requests[k8score.ResourceStorage])
+
+		headless, _ := getExistingService(appName+headlessSuffix, namespace, clientset)
+		assert.Equal(t, k8score.ClusterIPNone, headless.Spec.ClusterIP)
+	})
+
+	t.Run("the volume claims of an existing statefulset are kept", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		createOrUpdateK8sResources(deploymentRequest, newStatefulSetManifest(), []NaisResource{}, "nais.example.yo", false, clientset)
+
+		manifest := newStatefulSetManifest()
+		manifest.PersistentVolumes[0].Size = "20Gi"
+		newVersion := deploymentRequest
+		newVersion.Version = "2.0"
+		_, err := createOrUpdateK8sResources(newVersion, manifest, []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+
+		statefulSet, _ := getExistingStatefulSet(appName, namespace, clientset)
+		assert.Equal(t, image+":2.0", statefulSet.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, resource.MustParse("10Gi"), statefulSet.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests[k8score.ResourceStorage])
+	})
+
+	t.Run("a deployment that becomes stateful has its deployment and autoscaler deleted", func(t *testing.T) {
+		result, err := createOrUpdateK8sResources(deploymentRequest, newStatefulSetManifest(), []NaisResource{}, "nais.example.yo", false, newDeployedClientset(t, []NaisResource{}))
+		assert.NoError(t, err)
+		assert.Equal(t, []DeletedResource{
+			{Kind: "HorizontalPodAutoscaler", Name: appName},
+			{Kind: "Deployment", Name: appName},
+		}, result.Deleted)
+	})
+
+	t.Run("a stateful application that becomes a deployment has its statefulset and headless service deleted", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		createOrUpdateK8sResources(deploymentRequest, newStatefulSetManifest(), []NaisResource{}, "nais.example.yo", false, clientset)
+
+		result, err := createOrUpdateK8sResources(deploymentRequest, newDefaultManifest(), []NaisResource{}, "nais.example.yo", false, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, []DeletedResource{
+			{Kind: "StatefulSet", Name: appName},
+			{Kind: "Service", Name: appName + headlessSuffix},
+		}, result.Deleted)
+	})
+}
+
+func TestStatefulSetStatusAndView(t *testing.T) {
+	statefulSet := func(status k8sapps.StatefulSetStatus) *k8sapps.StatefulSet {
+		return &k8sapps.StatefulSet{
+			ObjectMeta: k8smeta.ObjectMeta{Name: appName, Namespace: namespace, Generation: 2},
+			Spec:       k8sapps.StatefulSetSpec{Replicas: int32p(3)},
+			Status:     status,
+		}
+	}
+
+	t.Run("a statefulset is rolled out when every pod is ready and updated", func(t *testing.T) {
+		status, view, err := NewDeploymentStatusViewer(fake.NewSimpleClientset(statefulSet(k8sapps.StatefulSetStatus{
+			ObservedGeneration: 2, Replicas: 3, ReadyReplicas: 3, UpdatedReplicas: 3, CurrentRevision: "b", UpdateRevision: "b",
+		}))).DeploymentStatusView(namespace, appName)
+		assert.NoError(t, err)
+		assert.Equal(t, Success, status)
+		assert.Equal(t, int32(3), view.Available)
+	})
+
+	t.Run("a statefulset is in progress while pods are replaced", func(t *testing.T) {
+		status, view := statefulSetStatusAndView(*statefulSet(k8sapps.StatefulSetStatus{
+			ObservedGeneration: 2, Replicas: 3, ReadyReplicas: 3, UpdatedReplicas: 1, CurrentRevision: "a", UpdateRevision: "b",
+		}))
+		assert.Equal(t, InProgress, status)
+		assert.Equal(t, "Waiting for rollout to finish: 1 out of 3 new pods have been updated.", view.Reason)
+
+		status, view = statefulSetStatusAndView(*statefulSet(k8sapps.StatefulSetStatus{ObservedGeneration: 2, ReadyReplicas: 1}))
+		assert.Equal(t, InProgress, status)
+		assert.Equal(t, "Waiting for 2 pods to be ready.", view.Reason)
+
+		status, _ = statefulSetStatusAndView(*statefulSet(k8sapps.StatefulSetStatus{ObservedGeneration: 1}))
+		assert.Equal(t, InProgress, status)
+	})
+}
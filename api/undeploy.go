@@ -0,0 +1,218 @@
+package api
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const DeployKindUndeploy = "undeploy"
+
+type UndeployRequest struct {
+	// Defaults to the Fasit environment recorded on the deployment
+	FasitEnvironment string `json:"fasitEnvironment,omitempty"`
+	FasitUsername    string `json:"fasitUsername"`
+	FasitPassword    string `json:"fasitPassword"`
+	OnBehalfOf       string `json:"onbehalfof,omitempty"`
+	UnregisterFasit  bool   `json:"unregisterFasit,omitempty"`
+}
+
+type UndeployResult struct {
+	Deleted []DeletedResource `json:"deleted"`
+	// The ids of the application instance and the exposed resources deleted from Fasit
+	FasitApplicationInstance int   `json:"fasitApplicationInstance,omitempty"`
+	FasitExposedResources    []int `json:"fasitExposedResources,omitempty"`
+}
+
+// Deletes every k8s-resource naisd creates for the application, finding them by the app label set by createObjectMeta.
+// The ingress goes first, so that traffic stops before the pods do.
+func deleteK8sResources(application, namespace string, k8sClient kubernetes.Interface) ([]DeletedResource, error) {
+	deleted := []DeletedResource{}
+	listOptions := k8smeta.ListOptions{LabelSelector: "app=" + application}
+	propagation := k8smeta.DeletePropagationBackground
+	deleteOptions := &k8smeta.DeleteOptions{PropagationPolicy: &propagation}
+
+	deleteAll := func(kind string, names []string, deleteFunc func(name string, options *k8smeta.DeleteOptions) error) error {
+		for _, name := range names {
+			if err := deleteFunc(name, deleteOptions); err != nil {
+				if errors.IsNotFound(err) {
+					continue
+				}
+				return fmt.Errorf("unable to delete %s %s: %s", kind, name, err)
+			}
+			deleted = append(deleted, DeletedResource{Kind: kind, Name: name})
+		}
+		return nil
+	}
+
+	ingresses, err := k8sClient.ExtensionsV1beta1().Ingresses(namespace).List(listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to list ingresses: %s", err)
+	}
+	var names []string
+	for _, ingress := range ingresses.Items {
+		names = append(names, ingress.Name)
+	}
+	if err := deleteAll("Ingress", names, k8sClient.ExtensionsV1beta1().Ingresses(namespace).Delete); err != nil {
+		return deleted, err
+	}
+
+	autoscalers, err := k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace).List(listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to list autoscalers: %s", err)
+	}
+	names = nil
+	for _, autoscaler := range autoscalers.Items {
+		names = append(names, autoscaler.Name)
+	}
+	if err := deleteAll("HorizontalPodAutoscaler", names, k8sClient.AutoscalingV2beta1().HorizontalPodAutoscalers(namespace).Delete); err != nil {
+		return deleted, err
+	}
+
+	budgets, err := k8sClient.PolicyV1beta1().PodDisruptionBudgets(namespace).List(listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to list poddisruptionbudgets: %s", err)
+	}
+	names = nil
+	for _, budget := range budgets.Items {
+		names = append(names, budget.Name)
+	}
+	if err := deleteAll("PodDisruptionBudget", names, k8sClient.PolicyV1beta1().PodDisruptionBudgets(namespace).Delete); err != nil {
+		return deleted, err
+	}
+
+	policies, err := k8sClient.NetworkingV1().NetworkPolicies(namespace).List(listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to list networkpolicies: %s", err)
+	}
+	names = nil
+	for _, policy := range policies.Items {
+		names = append(names, policy.Name)
+	}
+	if err := deleteAll("NetworkPolicy", names, k8sClient.NetworkingV1().NetworkPolicies(namespace).Delete); err != nil {
+		return deleted, err
+	}
+
+	cronJobs, err := k8sClient.BatchV1beta1().CronJobs(namespace).List(listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to list cronjobs: %s", err)
+	}
+	names = nil
+	for _, cronJob := range cronJobs.Items {
+		names = append(names, cronJob.Name)
+	}
+	if err := deleteAll("CronJob", names, k8sClient.BatchV1beta1().CronJobs(namespace).Delete); err != nil {
+		return deleted, err
+	}
+
+	jobs, err := k8sClient.BatchV1().Jobs(namespace).List(listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to list jobs: %s", err)
+	}
+	names = nil
+	for _, job := range jobs.Items {
+		names = append(names, job.Name)
+	}
+	if err := deleteAll("Job", names, k8sClient.BatchV1().Jobs(namespace).Delete); err != nil {
+		return deleted, err
+	}
+
+	deployments, err := k8sClient.ExtensionsV1beta1().Deployments(namespace).List(listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to list deployments: %s", err)
+	}
+	names = nil
+	for _, deployment := range deployments.Items {
+		names = append(names, deployment.Name)
+	}
+	if err := deleteAll("Deployment", names, k8sClient.ExtensionsV1beta1().Deployments(namespace).Delete); err != nil {
+		return deleted, err
+	}
+
+	statefulSets, err := k8sClient.AppsV1().StatefulSets(namespace).List(listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to list statefulsets: %s", err)
+	}
+	names = nil
+	for _, statefulSet := range statefulSets.Items {
+		names = append(names, statefulSet.Name)
+	}
+	if err := deleteAll("StatefulSet", names, k8sClient.AppsV1().StatefulSets(namespace).Delete); err != nil {
+		return deleted, err
+	}
+
+	services, err := k8sClient.CoreV1().Services(namespace).List(listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to list services: %s", err)
+	}
+	names = nil
+	for _, service := range services.Items {
+		names = append(names, service.Name)
+	}
+	if err := deleteAll("Service", names, k8sClient.CoreV1().Services(namespace).Delete); err != nil {
+		return deleted, err
+	}
+
+	secrets, err := k8sClient.CoreV1().Secrets(namespace).List(listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to list secrets: %s", err)
+	}
+	names = nil
+	for _, secret := range secrets.Items {
+		names = append(names, secret.Name)
+	}
+	if err := deleteAll("Secret", names, k8sClient.CoreV1().Secrets(namespace).Delete); err != nil {
+		return deleted, err
+	}
+
+	// naisd keeps its own state in config maps, possibly in this namespace, so only the one it created for the
+	// files of the application is deleted
+	ok, err := deleteConfigMap(application, namespace, k8sClient)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to delete ConfigMap %s: %s", application, err)
+	}
+	if ok {
+		deleted = append(deleted, DeletedResource{Kind: "ConfigMap", Name: application})
+	}
+
+	serviceAccounts, err := k8sClient.CoreV1().ServiceAccounts(namespace).List(listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("unable to list service accounts: %s", err)
+	}
+	names = nil
+	for _, serviceAccount := range serviceAccounts.Items {
+		names = append(names, serviceAccount.Name)
+	}
+	if err := deleteAll("ServiceAccount", names, k8sClient.CoreV1().ServiceAccounts(namespace).Delete); err != nil {
+		return deleted, err
+	}
+
+	return deleted, nil
+}
+
+// Deletes the application instance and the resources it exposes from Fasit. Returns a zero id if the
+// application has no instance in the environment.
+func unregisterFromFasit(fasit FasitClient, application, fasitEnvironment, onBehalfOf string) (int, []int, error) {
+	applicationInstance, err := fasit.getApplicationInstance(application, fasitEnvironment)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to get application instance: %s", err)
+	}
+	if applicationInstance == nil {
+		return 0, nil, nil
+	}
+
+	var exposedResourceIds []int
+	for _, resource := range applicationInstance.ExposedResources {
+		if err := fasit.deleteResource(resource.Id, onBehalfOf); err != nil {
+			return 0, exposedResourceIds, fmt.Errorf("unable to delete exposed resource %d: %s", resource.Id, err)
+		}
+		exposedResourceIds = append(exposedResourceIds, resource.Id)
+	}
+
+	if err := fasit.deleteApplicationInstance(applicationInstance.Id, onBehalfOf); err != nil {
+		return 0, exposedResourceIds, fmt.Errorf("unable to delete application instance %d: %s", applicationInstance.Id, err)
+	}
+
+	return applicationInstance.Id, exposedResourceIds, nil
+}
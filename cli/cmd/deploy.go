@@ -18,6 +18,7 @@ import (
 
 const DeployEndpoint = "/deploy"
 const StatusEndpoint = "/deploystatus"
+const JobsEndpoint = "/deploy/jobs"
 const DefaultCluster = "preprod-fss"
 
 var clustersDict = map[string]string{
@@ -64,79 +65,113 @@ func getClusterUrl(cluster string) (string, error) {
 	return "https://daemon." + url, nil
 }
 
-var deployCmd = &cobra.Command{
-	Use:   "deploy",
-	Short: "Deploys your application",
-	Long:  `Deploys your application`,
-	Run: func(cmd *cobra.Command, args []string) {
-		deployRequest := api.NaisDeploymentRequest{
-			FasitUsername: os.Getenv("FASIT_USERNAME"),
-			FasitPassword: os.Getenv("FASIT_PASSWORD"),
-		}
+// Builds a deployment request from the flags added by addDeploymentRequestFlags, prompting for
+// the Fasit password if it is not provided. Returns the request and the cluster to use.
+func deploymentRequestFromFlags(cmd *cobra.Command) (api.NaisDeploymentRequest, string) {
+	deployRequest := api.NaisDeploymentRequest{
+		FasitUsername: os.Getenv("FASIT_USERNAME"),
+		FasitPassword: os.Getenv("FASIT_PASSWORD"),
+	}
 
-		if deployRequest.FasitUsername == "" {
-			deployRequest.FasitUsername = os.Getenv("NAIS_USERNAME")
+	if deployRequest.FasitUsername == "" {
+		deployRequest.FasitUsername = os.Getenv("NAIS_USERNAME")
 
-			if deployRequest.FasitUsername != "" {
-				fmt.Fprintf(os.Stderr, "Deprecation warning: NAIS_USERNAME is replaced by FASIT_USERNAME.\n" +
-					"It will be removed in future versions.\n")
-			}
+		if deployRequest.FasitUsername != "" {
+			fmt.Fprintf(os.Stderr, "Deprecation warning: NAIS_USERNAME is replaced by FASIT_USERNAME.\n"+
+				"It will be removed in future versions.\n")
 		}
+	}
 
-		if deployRequest.FasitPassword == "" {
-			deployRequest.FasitPassword = os.Getenv("NAIS_PASSWORD")
+	if deployRequest.FasitPassword == "" {
+		deployRequest.FasitPassword = os.Getenv("NAIS_PASSWORD")
 
-			if deployRequest.FasitPassword != "" {
-				fmt.Fprintf(os.Stderr, "Deprecation warning: NAIS_PASSWORD is replaced by FASIT_PASSWORD.\n" +
-					"It will be removed in future versions.\n")
-			}
+		if deployRequest.FasitPassword != "" {
+			fmt.Fprintf(os.Stderr, "Deprecation warning: NAIS_PASSWORD is replaced by FASIT_PASSWORD.\n"+
+				"It will be removed in future versions.\n")
 		}
+	}
 
-		var cluster string
-		strings := map[string]*string{
-			"app":               &deployRequest.Application,
-			"version":           &deployRequest.Version,
-			"zone":              &deployRequest.Zone,
-			"namespace":         &deployRequest.Namespace,
-			"fasit-environment": &deployRequest.FasitEnvironment,
-			"fasit-username":    &deployRequest.FasitUsername,
-			"fasit-password":    &deployRequest.FasitPassword,
-			"manifest-url":      &deployRequest.ManifestUrl,
-			"cluster":           &cluster,
-		}
+	var cluster string
+	strings := map[string]*string{
+		"app":               &deployRequest.Application,
+		"version":           &deployRequest.Version,
+		"zone":              &deployRequest.Zone,
+		"namespace":         &deployRequest.Namespace,
+		"fasit-environment": &deployRequest.FasitEnvironment,
+		"fasit-username":    &deployRequest.FasitUsername,
+		"fasit-password":    &deployRequest.FasitPassword,
+		"manifest-url":      &deployRequest.ManifestUrl,
+		"cluster":           &cluster,
+	}
 
-		for key, pointer := range strings {
-			if value, err := cmd.Flags().GetString(key); err != nil {
-				fmt.Printf("Error when getting flag: %s. %v\n", key, err)
-				os.Exit(1)
-			} else if len(value) > 0 {
-				*pointer = value
-			}
+	for key, pointer := range strings {
+		if value, err := cmd.Flags().GetString(key); err != nil {
+			fmt.Printf("Error when getting flag: %s. %v\n", key, err)
+			os.Exit(1)
+		} else if len(value) > 0 {
+			*pointer = value
 		}
+	}
 
-		if deployRequest.FasitUsername == "" {
-			currentUser, err := user.Current()
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Unable resolve a username, please specify FASIT_USERNAME")
-				os.Exit(1)
-			}
-			deployRequest.FasitUsername = currentUser.Username
+	deployRequest.FasitUsername, deployRequest.FasitPassword = resolveFasitCredentials(deployRequest.FasitUsername, deployRequest.FasitPassword)
+
+	if err := deployRequest.Validate(); err != nil {
+		fmt.Printf("DeploymentRequest is not valid: %v\n", err)
+		os.Exit(1)
+	}
+
+	return deployRequest, cluster
+}
+
+// Falls back to the current user if no username is given, and prompts for the password if it is missing
+func resolveFasitCredentials(username, password string) (string, string) {
+	if username == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable resolve a username, please specify FASIT_USERNAME")
+			os.Exit(1)
 		}
+		username = currentUser.Username
+	}
 
-		if deployRequest.FasitPassword == "" {
-			fmt.Fprintf(os.Stderr, "Enter password for %s: ", deployRequest.FasitUsername)
-			passwordBytes, err := terminal.ReadPassword(int(syscall.Stdin))
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error occurred while trying to read password from stdin\n")
-				os.Exit(1)
-			}
-			deployRequest.FasitPassword = string(passwordBytes)
-			fmt.Fprintln(os.Stderr)
+	if password == "" {
+		fmt.Fprintf(os.Stderr, "Enter password for %s: ", username)
+		passwordBytes, err := terminal.ReadPassword(int(syscall.Stdin))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred while trying to read password from stdin\n")
+			os.Exit(1)
 		}
+		password = string(passwordBytes)
+		fmt.Fprintln(os.Stderr)
+	}
 
-		if err := deployRequest.Validate(); err != nil {
-			fmt.Printf("DeploymentRequest is not valid: %v\n", err)
+	return username, password
+}
+
+func addDeploymentRequestFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("app", "a", "", "name of your app")
+	cmd.Flags().StringP("version", "v", "", "version you want to deploy")
+	cmd.Flags().StringP("cluster", "c", "", "the cluster you want to deploy to")
+	cmd.Flags().StringP("fasit-environment", "e", "q0", "environment you want to use")
+	cmd.Flags().StringP("zone", "z", api.ZONE_FSS, "the zone the app will be in")
+	cmd.Flags().StringP("namespace", "n", "default", "the kubernetes namespace")
+	cmd.Flags().StringP("fasit-username", "u", "", "the username")
+	cmd.Flags().StringP("fasit-password", "p", "", "the password")
+	cmd.Flags().StringP("manifest-url", "m", "", "alternative URL to the nais manifest")
+}
+
+var deployCmd = &cobra.Command{
+	Use:   "deploy",
+	Short: "Deploys your application",
+	Long:  `Deploys your application`,
+	Run: func(cmd *cobra.Command, args []string) {
+		deployRequest, cluster := deploymentRequestFromFlags(cmd)
+
+		if dryRun, err := cmd.Flags().GetBool("dry-run"); err != nil {
+			fmt.Printf("Error when getting flag: dry-run. %v\n", err)
 			os.Exit(1)
+		} else {
+			deployRequest.DryRun = dryRun
 		}
 
 		clusterUrl, err := getClusterUrl(cluster)
@@ -170,10 +205,24 @@ var deployCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		if deployRequest.DryRun {
+			return
+		}
+
+		var job api.DeployJob
+		if err := json.Unmarshal(body, &job); err != nil {
+			fmt.Printf("Error while unmarshalling deploy job: %v\n", err)
+			os.Exit(1)
+		}
+
 		if wait, err := cmd.Flags().GetBool("wait"); err != nil {
 			fmt.Printf("Error: %v\n", err)
 		} else if wait {
 			start := time.Now()
+			if err := followJob(clusterUrl + JobsEndpoint + "/" + job.Id); err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
 			if err := waitForDeploy(clusterUrl + StatusEndpoint + "/" + deployRequest.Namespace + "/" + deployRequest.Application); err != nil {
 				fmt.Printf("%v\n", err)
 				os.Exit(1)
@@ -187,14 +236,7 @@ var deployCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(deployCmd)
 
-	deployCmd.Flags().StringP("app", "a", "", "name of your app")
-	deployCmd.Flags().StringP("version", "v", "", "version you want to deploy")
-	deployCmd.Flags().StringP("cluster", "c", "", "the cluster you want to deploy to")
-	deployCmd.Flags().StringP("fasit-environment", "e", "q0", "environment you want to use")
-	deployCmd.Flags().StringP("zone", "z", api.ZONE_FSS, "the zone the app will be in")
-	deployCmd.Flags().StringP("namespace", "n", "default", "the kubernetes namespace")
-	deployCmd.Flags().StringP("fasit-username", "u", "", "the username")
-	deployCmd.Flags().StringP("fasit-password", "p", "", "the password")
-	deployCmd.Flags().StringP("manifest-url", "m", "", "alternative URL to the nais manifest")
-	deployCmd.Flags().Bool("wait", false, "whether to wait until the deploy has succeeded (or failed)")
+	addDeploymentRequestFlags(deployCmd)
+	deployCmd.Flags().Bool("wait", false, "whether to follow the deploy job and wait until the rollout has succeeded (or failed)")
+	deployCmd.Flags().Bool("dry-run", false, "prints the kubernetes resources that would be created, without deploying anything")
 }
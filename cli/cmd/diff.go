@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/nais/naisd/api"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const DiffEndpoint = "/deploy/diff"
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Shows what a deploy would change in the cluster",
+	Long:  `Compares the resources running in the cluster with the resources the next deploy of your application would create`,
+	Run: func(cmd *cobra.Command, args []string) {
+		deployRequest, cluster := deploymentRequestFromFlags(cmd)
+
+		clusterUrl, err := getClusterUrl(cluster)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		jsonStr, err := json.Marshal(deployRequest)
+		if err != nil {
+			fmt.Printf("Error while marshalling JSON: %v\n", err)
+			os.Exit(1)
+		}
+
+		resp, err := http.Post(clusterUrl+DiffEndpoint, "application/json", bytes.NewBuffer(jsonStr))
+		if err != nil {
+			fmt.Printf("Error while POSTing to API: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		if resp.StatusCode > 299 {
+			fmt.Println("response Status:", resp.Status)
+			fmt.Println("response Body:", string(body))
+			os.Exit(1)
+		}
+
+		var diffs []api.ResourceDiff
+		if err := json.Unmarshal(body, &diffs); err != nil {
+			fmt.Printf("Error while unmarshalling response: %v\n", err)
+			os.Exit(1)
+		}
+
+		printDiffs(diffs)
+	},
+}
+
+func printDiffs(diffs []api.ResourceDiff) {
+	for _, diff := range diffs {
+		fmt.Printf("%s %s: %s\n", diff.Kind, diff.Name, diff.Action)
+		for _, change := range diff.Changes {
+			fmt.Printf("  %s: %s -> %s\n", change.Path, formatDiffValue(change.Old), formatDiffValue(change.New))
+		}
+	}
+}
+
+func formatDiffValue(value interface{}) string {
+	if value == nil {
+		return "<none>"
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(b)
+}
+
+func init() {
+	RootCmd.AddCommand(diffCmd)
+	addDeploymentRequestFlags(diffCmd)
+}
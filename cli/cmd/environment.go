@@ -125,6 +125,12 @@ Or just save it to a file
 			FasitUrl: fasitUrl,
 		}
 
+		// the overrides may use other resources
+		if err := api.ApplyEnvironmentOverrides(&manifest, environment, fasit.GetFasitEnvironmentClass); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while applying overrides. %v\n", err)
+			os.Exit(1)
+		}
+
 		vars, err := api.FetchFasitResources(fasit, application, environment, zone, manifest.FasitResources.Used)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to contact Fasit. %v\n", err)
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nais/naisd/api"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const HistoryEndpoint = "/deployments"
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Lists the deploys of your application",
+	Long: `Lists the latest deploys and rollbacks of your application, newest first.
+With --at, lists the deploys started before that time, and shows which version was running then.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var cluster, app, namespace, at string
+		strings := map[string]*string{
+			"app":       &app,
+			"namespace": &namespace,
+			"cluster":   &cluster,
+			"at":        &at,
+		}
+
+		for key, pointer := range strings {
+			if value, err := cmd.Flags().GetString(key); err != nil {
+				fmt.Printf("Error when getting flag: %s. %v\n", key, err)
+				os.Exit(1)
+			} else if len(value) > 0 {
+				*pointer = value
+			}
+		}
+
+		if len(app) == 0 {
+			fmt.Println("Application cannot be empty")
+			os.Exit(1)
+		}
+
+		limit, err := cmd.Flags().GetInt("limit")
+		if err != nil {
+			fmt.Printf("Error when getting flag: limit. %v\n", err)
+			os.Exit(1)
+		}
+
+		clusterUrl, err := getClusterUrl(cluster)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		query := url.Values{}
+		query.Set("limit", fmt.Sprintf("%d", limit))
+
+		var atTime time.Time
+		if len(at) > 0 {
+			if atTime, err = parseHistoryTime(at); err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+			query.Set("at", atTime.Format(time.RFC3339))
+		}
+
+		records, err := getHistory(fmt.Sprintf("%s%s/%s/%s?%s", clusterUrl, HistoryEndpoint, namespace, app, query.Encode()))
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		if !atTime.IsZero() {
+			printRunningAt(records, atTime)
+		}
+
+		printHistory(records)
+	},
+}
+
+// Accepts RFC 3339 timestamps, or a date and time in the local time zone
+func parseHistoryTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unable to parse time %s, use e.g. \"2006-01-02 15:04\"", value)
+}
+
+func getHistory(historyUrl string) ([]api.DeployRecord, error) {
+	resp, err := http.Get(historyUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unable to get deploy history: %s %s", resp.Status, string(body))
+	}
+
+	var records []api.DeployRecord
+	if err := json.Unmarshal(body, &records); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal deploy history: %s", err)
+	}
+
+	return records, nil
+}
+
+// The newest successful deploy started before a time is the one that was running then
+func printRunningAt(records []api.DeployRecord, at time.Time) {
+	for _, record := range records {
+		if record.Outcome == api.JobSucceeded {
+			fmt.Printf("Running at %s: version %s, deployed %s by %s\n\n", at.Format("2006-01-02 15:04:05"), record.Version, record.Started.Local().Format("2006-01-02 15:04:05"), deployedBy(record))
+			return
+		}
+	}
+
+	fmt.Printf("No successful deploy found before %s\n\n", at.Format("2006-01-02 15:04:05"))
+}
+
+func printHistory(records []api.DeployRecord) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tKIND\tVERSION\tBY\tFASIT ENVIRONMENT\tOUTCOME\tDURATION\t")
+	for _, record := range records {
+		duration := time.Duration(record.DurationSeconds * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", record.Started.Local().Format("2006-01-02 15:04:05"), record.Kind, record.Version, deployedBy(record), record.FasitEnvironment, record.Outcome, duration)
+	}
+	w.Flush()
+
+	for _, record := range records {
+		if record.Error != "" {
+			fmt.Printf("\n%s %s failed: %s\n", record.Started.Local().Format("2006-01-02 15:04:05"), record.Kind, record.Error)
+		}
+	}
+}
+
+func deployedBy(record api.DeployRecord) string {
+	if record.OnBehalfOf != "" {
+		return record.OnBehalfOf
+	}
+	return record.FasitUsername
+}
+
+func init() {
+	RootCmd.AddCommand(historyCmd)
+
+	historyCmd.Flags().StringP("app", "a", "", "name of your app")
+	historyCmd.Flags().StringP("cluster", "c", "", "the cluster your app is deployed to")
+	historyCmd.Flags().StringP("namespace", "n", "default", "the kubernetes namespace")
+	historyCmd.Flags().String("at", "", "only list deploys started before this time, e.g. \"2006-01-02 15:04\"")
+	historyCmd.Flags().IntP("limit", "l", 20, "number of deploys to list")
+}
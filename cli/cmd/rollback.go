@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/nais/naisd/api"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"text/tabwriter"
+)
+
+const RevisionsEndpoint = "/revisions"
+const RollbackEndpoint = "/rollback"
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Lists revisions of your application, or rolls back to one of them",
+	Long: `Without --revision, lists the latest revisions of your application.
+With --revision, redeploys that revision, re-resolving the Fasit resources it used.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var cluster, app, namespace, zone string
+		strings := map[string]*string{
+			"app":       &app,
+			"namespace": &namespace,
+			"cluster":   &cluster,
+			"zone":      &zone,
+		}
+
+		for key, pointer := range strings {
+			if value, err := cmd.Flags().GetString(key); err != nil {
+				fmt.Printf("Error when getting flag: %s. %v\n", key, err)
+				os.Exit(1)
+			} else if len(value) > 0 {
+				*pointer = value
+			}
+		}
+
+		if len(app) == 0 {
+			fmt.Println("Application cannot be empty")
+			os.Exit(1)
+		}
+
+		revision, err := cmd.Flags().GetInt64("revision")
+		if err != nil {
+			fmt.Printf("Error when getting flag: revision. %v\n", err)
+			os.Exit(1)
+		}
+
+		limit, err := cmd.Flags().GetInt("limit")
+		if err != nil {
+			fmt.Printf("Error when getting flag: limit. %v\n", err)
+			os.Exit(1)
+		}
+
+		clusterUrl, err := getClusterUrl(cluster)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if revision == 0 {
+			if err := printRevisions(fmt.Sprintf("%s%s/%s/%s?limit=%d", clusterUrl, RevisionsEndpoint, namespace, app, limit)); err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		username, password := resolveFasitCredentials(os.Getenv("FASIT_USERNAME"), os.Getenv("FASIT_PASSWORD"))
+
+		jsonStr, err := json.Marshal(api.RollbackRequest{
+			Application:   app,
+			Namespace:     namespace,
+			Revision:      revision,
+			Zone:          zone,
+			FasitUsername: username,
+			FasitPassword: password,
+		})
+		if err != nil {
+			fmt.Printf("Error while marshalling JSON: %v\n", err)
+			os.Exit(1)
+		}
+
+		resp, err := http.Post(clusterUrl+RollbackEndpoint, "application/json", bytes.NewBuffer(jsonStr))
+		if err != nil {
+			fmt.Printf("Error while POSTing to API: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		fmt.Println("response Status:", resp.Status)
+		fmt.Println("response Body:", string(body))
+
+		if resp.StatusCode > 299 {
+			os.Exit(1)
+		}
+	},
+}
+
+func printRevisions(url string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("unable to list revisions: %s %s", resp.Status, string(body))
+	}
+
+	var revisions []api.Revision
+	if err := json.Unmarshal(body, &revisions); err != nil {
+		return fmt.Errorf("unable to unmarshal revisions: %s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "REVISION\tVERSION\tIMAGE\tCREATED\t")
+	for _, revision := range revisions {
+		current := ""
+		if revision.Current {
+			current = "(current)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", revision.Revision, revision.Version, revision.Image, revision.Created.Format("2006-01-02 15:04:05"), current)
+	}
+	return w.Flush()
+}
+
+func init() {
+	RootCmd.AddCommand(rollbackCmd)
+
+	rollbackCmd.Flags().StringP("app", "a", "", "name of your app")
+	rollbackCmd.Flags().StringP("cluster", "c", "", "the cluster your app is deployed to")
+	rollbackCmd.Flags().StringP("namespace", "n", "default", "the kubernetes namespace")
+	rollbackCmd.Flags().StringP("zone", "z", api.ZONE_FSS, "the zone of the app, if not recorded on the revision")
+	rollbackCmd.Flags().Int64P("revision", "r", 0, "the revision to roll back to")
+	rollbackCmd.Flags().IntP("limit", "l", 10, "number of revisions to list")
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const SwitchBackEndpoint = "/switchback"
+
+var switchBackCmd = &cobra.Command{
+	Use:   "switchback",
+	Short: "Switches traffic back to the previous version of a blue/green deployed application",
+	Long: `Switches the Service, Ingress and HorizontalPodAutoscaler of your application back to the colour that
+served it before the last deploy, as long as the previous version is kept.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var cluster, app, namespace string
+		strings := map[string]*string{
+			"app":       &app,
+			"namespace": &namespace,
+			"cluster":   &cluster,
+		}
+
+		for key, pointer := range strings {
+			if value, err := cmd.Flags().GetString(key); err != nil {
+				fmt.Printf("Error when getting flag: %s. %v\n", key, err)
+				os.Exit(1)
+			} else if len(value) > 0 {
+				*pointer = value
+			}
+		}
+
+		if len(app) == 0 {
+			fmt.Println("Application cannot be empty")
+			os.Exit(1)
+		}
+
+		clusterUrl, err := getClusterUrl(cluster)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		resp, err := http.Post(fmt.Sprintf("%s%s/%s/%s", clusterUrl, SwitchBackEndpoint, namespace, app), "application/json", nil)
+		if err != nil {
+			fmt.Printf("Error while POSTing to API: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode > 299 {
+			fmt.Println("response Status:", resp.Status)
+			fmt.Println("response Body:", string(body))
+			os.Exit(1)
+		}
+
+		fmt.Print(string(body))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(switchBackCmd)
+
+	switchBackCmd.Flags().StringP("app", "a", "", "name of your app")
+	switchBackCmd.Flags().StringP("cluster", "c", "", "the cluster your app is deployed to")
+	switchBackCmd.Flags().StringP("namespace", "n", "default", "the kubernetes namespace")
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/nais/naisd/api"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const UndeployEndpoint = "/app"
+
+var undeployCmd = &cobra.Command{
+	Use:   "undeploy",
+	Short: "Removes your application from the cluster",
+	Long: `Deletes the Deployment, Service, Ingress, HorizontalPodAutoscaler and Secret of your application.
+With --unregister-fasit, also deletes its application instance and the resources it exposes from Fasit.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var cluster, app, namespace, fasitEnvironment, username, password string
+		strings := map[string]*string{
+			"app":               &app,
+			"namespace":         &namespace,
+			"cluster":           &cluster,
+			"fasit-environment": &fasitEnvironment,
+			"fasit-username":    &username,
+			"fasit-password":    &password,
+		}
+
+		for key, pointer := range strings {
+			if value, err := cmd.Flags().GetString(key); err != nil {
+				fmt.Printf("Error when getting flag: %s. %v\n", key, err)
+				os.Exit(1)
+			} else if len(value) > 0 {
+				*pointer = value
+			}
+		}
+
+		if len(app) == 0 {
+			fmt.Println("Application cannot be empty")
+			os.Exit(1)
+		}
+
+		unregisterFasit, err := cmd.Flags().GetBool("unregister-fasit")
+		if err != nil {
+			fmt.Printf("Error when getting flag: unregister-fasit. %v\n", err)
+			os.Exit(1)
+		}
+
+		clusterUrl, err := getClusterUrl(cluster)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		undeployRequest := api.UndeployRequest{FasitEnvironment: fasitEnvironment, UnregisterFasit: unregisterFasit}
+		if unregisterFasit {
+			if username == "" {
+				username = os.Getenv("FASIT_USERNAME")
+			}
+			if password == "" {
+				password = os.Getenv("FASIT_PASSWORD")
+			}
+			undeployRequest.FasitUsername, undeployRequest.FasitPassword = resolveFasitCredentials(username, password)
+		}
+
+		jsonStr, err := json.Marshal(undeployRequest)
+		if err != nil {
+			fmt.Printf("Error while marshalling JSON: %v\n", err)
+			os.Exit(1)
+		}
+
+		req, err := http.NewRequest("DELETE", fmt.Sprintf("%s%s/%s/%s", clusterUrl, UndeployEndpoint, namespace, app), bytes.NewBuffer(jsonStr))
+		if err != nil {
+			fmt.Printf("Error while creating request: %v\n", err)
+			os.Exit(1)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Printf("Error while sending DELETE to API: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode > 299 {
+			fmt.Println("response Status:", resp.Status)
+			fmt.Println("response Body:", string(body))
+			os.Exit(1)
+		}
+
+		var undeployResult api.UndeployResult
+		if err := json.Unmarshal(body, &undeployResult); err != nil {
+			fmt.Printf("Error while unmarshalling undeploy result: %v\n", err)
+			os.Exit(1)
+		}
+
+		for _, deleted := range undeployResult.Deleted {
+			fmt.Printf("- deleted %s %s\n", deleted.Kind, deleted.Name)
+		}
+		for _, id := range undeployResult.FasitExposedResources {
+			fmt.Printf("- deleted exposed resource %d from Fasit\n", id)
+		}
+		if undeployResult.FasitApplicationInstance != 0 {
+			fmt.Printf("- deleted application instance %d from Fasit\n", undeployResult.FasitApplicationInstance)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(undeployCmd)
+
+	undeployCmd.Flags().StringP("app", "a", "", "name of your app")
+	undeployCmd.Flags().StringP("cluster", "c", "", "the cluster your app is deployed to")
+	undeployCmd.Flags().StringP("namespace", "n", "default", "the kubernetes namespace")
+	undeployCmd.Flags().StringP("fasit-environment", "e", "", "the Fasit environment to unregister from, if not recorded on the deployment")
+	undeployCmd.Flags().StringP("fasit-username", "u", "", "the username")
+	undeployCmd.Flags().StringP("fasit-password", "p", "", "the password")
+	undeployCmd.Flags().Bool("unregister-fasit", false, "also delete the application instance and its exposed resources from Fasit")
+}
@@ -25,6 +25,11 @@ var validateCmd = &cobra.Command{
 			fmt.Printf("Error when getting flag: output. %v", err)
 			os.Exit(1)
 		}
+		environment, err := cmd.Flags().GetString("fasit-environment")
+		if err != nil {
+			fmt.Printf("Error when getting flag: fasit-environment. %v", err)
+			os.Exit(1)
+		}
 
 		naisYaml, err := ioutil.ReadFile(file)
 		if err != nil {
@@ -41,12 +46,18 @@ var validateCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		if err := api.ApplyEnvironmentOverrides(&manifest, environment, api.EnvironmentClassFromName); err != nil {
+			fmt.Printf("Error while applying overrides. %v", err)
+			os.Exit(1)
+		}
+
 		if err := api.AddDefaultManifestValues(&manifest, "appName"); err != nil {
 			fmt.Printf("Error while adding default values yaml. %v", err)
 			os.Exit(1)
 		}
 
-		if output {
+		// the effective manifest of an environment is always shown
+		if output || environment != "" {
 			conf, _ := yaml.Marshal(manifest)
 			fmt.Println(string(conf))
 		}
@@ -64,4 +75,5 @@ func init() {
 	RootCmd.AddCommand(validateCmd)
 	validateCmd.Flags().StringP("file", "f", "nais.yaml", "path to manifest")
 	validateCmd.Flags().BoolP("output", "o", false, "prints full manifest including defaults")
+	validateCmd.Flags().StringP("fasit-environment", "e", "", "applies the overrides of this Fasit environment and its environment class")
 }
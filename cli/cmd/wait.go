@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/nais/naisd/api"
 	"github.com/spf13/cobra"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"time"
@@ -30,6 +33,52 @@ func waitForDeploy(url string) error {
 	return nil
 }
 
+// Polls a deploy job until it is done, printing each step as it completes
+func followJob(url string) error {
+	printed := 0
+	for {
+		resp, err := http.Get(url)
+		if err != nil {
+			return err
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("Unable to get deploy job: %d %s\n", resp.StatusCode, string(body))
+		}
+
+		var job api.DeployJob
+		if err := json.Unmarshal(body, &job); err != nil {
+			return fmt.Errorf("Unable to unmarshal deploy job: %s\n", err)
+		}
+
+		for ; printed < len(job.Steps) && job.Steps[printed].Status != api.JobRunning; printed++ {
+			step := job.Steps[printed]
+			if step.Error != "" {
+				fmt.Printf("- %s: %s (%s)\n", step.Name, step.Status, step.Error)
+			} else {
+				fmt.Printf("- %s: %s\n", step.Name, step.Status)
+			}
+		}
+
+		if job.Done() {
+			if job.Result != nil {
+				for _, deleted := range job.Result.Deleted {
+					fmt.Printf("- deleted %s %s, no longer part of the manifest\n", deleted.Kind, deleted.Name)
+				}
+			}
+			if job.Status == api.JobFailed {
+				return fmt.Errorf("Deploy job failed: %s\n", job.Error)
+			}
+			return nil
+		}
+
+		time.Sleep(1000 * time.Millisecond)
+	}
+}
+
 var waitCmd = &cobra.Command{
 	Use:   "wait",
 	Short: "Waits for deploy",
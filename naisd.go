@@ -6,6 +6,8 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/nais/naisd/api"
@@ -19,16 +21,52 @@ func main() {
 	clusterSubdomain := flag.String("cluster-subdomain", "nais-example.nais.example.no", "Cluster sub-domain")
 	clusterName := flag.String("clustername", "kubernetes", "Name of the kubernetes cluster")
 	istioEnabled := flag.Bool("istio-enabled", false, "If istio is enabled or not")
+	stateNamespace := flag.String("state-namespace", "default", "Namespace where naisd keeps its deploy jobs, locks and history")
+	controllerEnabled := flag.Bool("naisapplication-controller", false, "If naisd should deploy NaisApplication resources or not")
+	controllerInterval := flag.Duration("naisapplication-interval", 30*time.Second, "How often NaisApplication resources are reconciled")
+	driftMode := flag.String("drift-reconciler", api.DriftModeOff, "If drift from the last deploy is reported (report), reported and corrected (enforce), or ignored (off)")
+	driftInterval := flag.Duration("drift-interval", 10*time.Minute, "How often k8s-resources are checked for drift")
+	fasitServiceUsername := flag.String("fasit-service-username", "", "Fasit username used when naisd deploys on its own, i.e. NaisApplication resources and drift corrections")
+	fasitServicePassword := flag.String("fasit-service-password", "", "Fasit password used when naisd deploys on its own, defaults to $FASIT_SERVICE_PASSWORD")
 
 	flag.Parse()
 
+	// the password is preferably given in the environment, where it does not show up in the process list
+	if *fasitServicePassword == "" {
+		*fasitServicePassword = os.Getenv("FASIT_SERVICE_PASSWORD")
+	}
+
 	glog.Infof("using fasit instance %s", *fasitUrl)
 	glog.Infof("running on port %s", Port)
 	glog.Infof("istio enabled = %b", *istioEnabled)
 
+	if !api.ValidDriftMode(*driftMode) {
+		glog.Fatalf("invalid drift reconciler mode %s, must be one of off, report or enforce", *driftMode)
+	}
 
 	clientSet := newClientSet(*kubeconfig)
-	err := http.ListenAndServe(Port, api.NewApi(clientSet, *fasitUrl, *clusterSubdomain, *clusterName, *istioEnabled, api.NewDeploymentStatusViewer(clientSet)).Handler())
+	naisdApi := api.NewApi(clientSet, *fasitUrl, *clusterSubdomain, *clusterName, *istioEnabled, api.NewDeploymentStatusViewer(clientSet), api.NewConfigMapJobStore(clientSet, *stateNamespace), api.NewConfigMapDeployLocker(clientSet, *stateNamespace), api.NewConfigMapDeployHistory(clientSet, *stateNamespace))
+
+	if *controllerEnabled {
+		naisApplicationClient := api.NewNaisApplicationClient(clientSet.CoreV1().RESTClient())
+		controller := api.NewNaisApplicationController(naisdApi, naisApplicationClient, *fasitServiceUsername, *fasitServicePassword, *controllerInterval)
+		go controller.Run(make(chan struct{}))
+	}
+
+	go api.PreviousColourSweeper{Clientset: clientSet, Interval: time.Minute}.Run(make(chan struct{}))
+
+	if *driftMode != api.DriftModeOff {
+		reconciler := api.DriftReconciler{
+			Api:           naisdApi,
+			Mode:          *driftMode,
+			FasitUsername: *fasitServiceUsername,
+			FasitPassword: *fasitServicePassword,
+			Interval:      *driftInterval,
+		}
+		go reconciler.Run(make(chan struct{}))
+	}
+
+	err := http.ListenAndServe(Port, naisdApi.Handler())
 	if err != nil {
 		panic(err)
 	}